@@ -0,0 +1,184 @@
+package berenc
+
+import (
+	"bytes"
+	"math/rand"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// BER encoding variations for outgoing LDAP messages.
+//
+// go-asn1-ber always emits the shortest encoding X.690 allows, which is
+// also what every stock LDAP client library emits. BER (unlike DER) leaves
+// several choices open to the encoder, and a server decoding with a
+// permissive BER decoder accepts all of them as the same message:
+//
+//   - Lengths below 128 can use the long form (X.690 §8.1.3.5) - 0x05
+//     becomes 0x81 0x05.
+//   - Long-form lengths can carry leading zero octets - 0x81 0x05 becomes
+//     0x83 0x00 0x00 0x05. X.690 §8.1.3.5(c) only recommends against them.
+//   - Constructed elements can use the indefinite form (X.690 §8.1.3.6),
+//     terminated by end-of-contents octets. RFC 4511 §5.1 restricts LDAP to
+//     definite lengths, so this one is the most likely to be rejected.
+//   - INTEGER and ENUMERATED contents can carry redundant leading zero
+//     octets. X.690 §8.3.2 forbids them, but decoders that just accumulate
+//     the octets read the same value.
+//
+// Which of these a given server accepts is an empirical question - each
+// variation has its own switch and probability so they can be tried one at
+// a time.
+
+// Options selects which variations are applied, and how often. Each
+// probability is rolled independently for every element the variation can
+// apply to.
+type Options struct {
+	LongLength     bool
+	LongLengthProb float64
+
+	PaddedLength         bool
+	PaddedLengthProb     float64
+	PaddedLengthMaxBytes int
+
+	IndefiniteLength     bool
+	IndefiniteLengthProb float64
+
+	IntPadding         bool
+	IntPaddingProb     float64
+	IntPaddingMaxBytes int
+}
+
+// Enabled reports whether any variation is switched on.
+func (o Options) Enabled() bool {
+	return o.LongLength || o.PaddedLength || o.IndefiniteLength || o.IntPadding
+}
+
+// Names lists the variations that are switched on.
+func (o Options) Names() []string {
+	names := []string{}
+	if o.LongLength {
+		names = append(names, "LongLength")
+	}
+	if o.PaddedLength {
+		names = append(names, "PaddedLength")
+	}
+	if o.IndefiniteLength {
+		names = append(names, "IndefiniteLength")
+	}
+	if o.IntPadding {
+		names = append(names, "IntPadding")
+	}
+	return names
+}
+
+// EncodeMessage serializes a top-level LDAPMessage with the enabled
+// variations applied. Integer padding applies to the messageID and to every
+// ENUMERATED element; the other variations apply to every element. With no
+// variation enabled the output matches packet.Bytes().
+func EncodeMessage(packet *ber.Packet, o Options) []byte {
+	if !o.Enabled() {
+		return packet.Bytes()
+	}
+
+	var out bytes.Buffer
+	o.encode(&out, packet, 0, -1)
+	return out.Bytes()
+}
+
+// encode writes packet at the given depth; index is its position among its
+// parent's children (-1 for the top-level message).
+func (o Options) encode(out *bytes.Buffer, packet *ber.Packet, depth, index int) {
+	out.Write(identifier(packet))
+
+	if packet.TagType == ber.TypeConstructed && len(packet.Children) > 0 {
+		var content bytes.Buffer
+		for i, child := range packet.Children {
+			o.encode(&content, child, depth+1, i)
+		}
+
+		if o.IndefiniteLength && rand.Float64() < o.IndefiniteLengthProb {
+			out.WriteByte(0x80)
+			out.Write(content.Bytes())
+			out.Write([]byte{0x00, 0x00})
+			return
+		}
+
+		out.Write(o.length(content.Len()))
+		out.Write(content.Bytes())
+		return
+	}
+
+	content := packet.Data.Bytes()
+	if o.isIntPaddable(packet, depth, index) && rand.Float64() < o.IntPaddingProb {
+		content = padInteger(content, o.IntPaddingMaxBytes)
+	}
+
+	out.Write(o.length(len(content)))
+	out.Write(content)
+}
+
+// isIntPaddable reports whether packet is the messageID or an ENUMERATED.
+func (o Options) isIntPaddable(packet *ber.Packet, depth, index int) bool {
+	if !o.IntPadding || packet.ClassType != ber.ClassUniversal || packet.TagType != ber.TypePrimitive {
+		return false
+	}
+	if packet.Tag == ber.TagEnumerated {
+		return true
+	}
+	return packet.Tag == ber.TagInteger && depth == 1 && index == 0
+}
+
+// padInteger prepends 1 to maxBytes zero octets to the contents of a
+// non-negative INTEGER/ENUMERATED. Negative values would need 0xFF octets
+// instead and are left alone, as are empty contents.
+func padInteger(content []byte, maxBytes int) []byte {
+	if maxBytes <= 0 || len(content) == 0 || content[0]&0x80 != 0 {
+		return content
+	}
+	padded := make([]byte, 1+rand.Intn(maxBytes), 1+maxBytes+len(content))
+	return append(padded, content...)
+}
+
+// length encodes n as a definite length, possibly in a non-minimal form.
+func (o Options) length(n int) []byte {
+	minimal := minimalUnsigned(n)
+
+	padding := 0
+	if o.PaddedLength && o.PaddedLengthMaxBytes > 0 && rand.Float64() < o.PaddedLengthProb {
+		padding = 1 + rand.Intn(o.PaddedLengthMaxBytes)
+	}
+
+	longForm := n > 127 || padding > 0 || (o.LongLength && rand.Float64() < o.LongLengthProb)
+	if !longForm {
+		return []byte{byte(n)}
+	}
+
+	// The initial octet holds the count of subsequent octets in 7 bits, and
+	// 0xFF is reserved (X.690 §8.1.3.5(c)).
+	if len(minimal)+padding > 126 {
+		padding = 126 - len(minimal)
+	}
+
+	encoded := make([]byte, 1+padding, 1+padding+len(minimal))
+	encoded[0] = 0x80 | byte(padding+len(minimal))
+	return append(encoded, minimal...)
+}
+
+// minimalUnsigned returns n big-endian in as few octets as possible (at
+// least one).
+func minimalUnsigned(n int) []byte {
+	var b []byte
+	for v := uint64(n); ; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+		if v <= 0xff {
+			return b
+		}
+	}
+}
+
+// identifier returns the canonical identifier octets of packet, taken from
+// go-asn1-ber's own encoding of an empty element with the same identifier.
+func identifier(packet *ber.Packet) []byte {
+	empty := ber.Encode(packet.ClassType, packet.TagType, packet.Tag, nil, "").Bytes()
+	return empty[:len(empty)-1]
+}
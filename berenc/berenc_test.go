@@ -0,0 +1,77 @@
+package berenc
+
+import (
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSearchRequest() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(7), "MessageID"))
+
+	search := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 3, nil, "Search Request")
+	search.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "DC=draco,DC=local", "Base DN"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(2), "Scope"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "Deref Aliases"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "Size Limit"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "Time Limit"))
+	search.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	search.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, "objectClass", "Present"))
+	search.AppendChild(ber.NewSequence("Attributes"))
+	packet.AppendChild(search)
+
+	return packet
+}
+
+func TestEncodeMessage_Disabled(t *testing.T) {
+	packet := testSearchRequest()
+	assert.Equal(t, packet.Bytes(), EncodeMessage(packet, Options{}))
+}
+
+func TestEncodeMessage_DecodesToSameMessage(t *testing.T) {
+	packet := testSearchRequest()
+
+	for _, o := range []Options{
+		{LongLength: true, LongLengthProb: 1},
+		{PaddedLength: true, PaddedLengthProb: 1, PaddedLengthMaxBytes: 3},
+		{IndefiniteLength: true, IndefiniteLengthProb: 1},
+		{IntPadding: true, IntPaddingProb: 1, IntPaddingMaxBytes: 2},
+	} {
+		encoded := EncodeMessage(packet, o)
+		assert.NotEqual(t, packet.Bytes(), encoded, o.Names())
+
+		decoded, err := ber.DecodePacketErr(encoded)
+		assert.NoError(t, err, o.Names())
+		assert.Equal(t, packet.Bytes(), canonical(decoded), o.Names())
+	}
+}
+
+func TestLength_MinimalWithoutVariations(t *testing.T) {
+	var o Options
+	assert.Equal(t, []byte{0x05}, o.length(5))
+	assert.Equal(t, []byte{0x81, 0x80}, o.length(128))
+	assert.Equal(t, []byte{0x82, 0x01, 0x00}, o.length(256))
+}
+
+// canonical re-serializes a decoded packet with minimal encodings.
+func canonical(packet *ber.Packet) []byte {
+	if packet.TagType != ber.TypeConstructed || len(packet.Children) == 0 {
+		content := packet.Data.Bytes()
+		if packet.Tag == ber.TagInteger || packet.Tag == ber.TagEnumerated {
+			for len(content) > 1 && content[0] == 0 && content[1]&0x80 == 0 {
+				content = content[1:]
+			}
+		}
+		p := ber.Encode(packet.ClassType, packet.TagType, packet.Tag, nil, "")
+		p.Data.Write(content)
+		return p.Bytes()
+	}
+
+	p := ber.Encode(packet.ClassType, packet.TagType, packet.Tag, nil, "")
+	for _, child := range packet.Children {
+		p.Data.Write(canonical(child))
+	}
+	return p.Bytes()
+}
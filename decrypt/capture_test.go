@@ -0,0 +1,183 @@
+package decrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Macmod/ldapx/log"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/etypeID"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/nametype"
+	"github.com/oiweiwei/gokrb5.fork/v9/messages"
+	"github.com/oiweiwei/gokrb5.fork/v9/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatKrb5TGSHash(t *testing.T) {
+	checksum16 := bytes.Repeat([]byte{0x11}, 16)
+	checksum12 := bytes.Repeat([]byte{0x22}, 12)
+	encrypted := []byte{0xca, 0xfe, 0xba, 0xbe}
+
+	testCases := []struct {
+		name           string
+		spn            string
+		etype          int32
+		cipher         []byte
+		expectedLine   string
+		expectedFormat string
+	}{
+		{
+			name:           "RC4 checksum before the ciphertext",
+			spn:            "ldap/dc01.draco.local",
+			etype:          etypeID.RC4_HMAC,
+			cipher:         concatBytes(checksum16, encrypted),
+			expectedLine:   "$krb5tgs$23$*ldap/dc01.draco.local$DRACO.LOCAL$ldap/dc01.draco.local*$11111111111111111111111111111111$cafebabe",
+			expectedFormat: "Kerberos TGS-REP etype 23 (hashcat -m 13100)",
+		},
+		{
+			name:           "AES128 checksum after the ciphertext",
+			spn:            "ldap/dc01.draco.local",
+			etype:          etypeID.AES128_CTS_HMAC_SHA1_96,
+			cipher:         concatBytes(encrypted, checksum12),
+			expectedLine:   "$krb5tgs$17$ldap/dc01.draco.local$DRACO.LOCAL$*ldap/dc01.draco.local*$222222222222222222222222$cafebabe",
+			expectedFormat: "Kerberos TGS-REP etype 17 (hashcat -m 19600)",
+		},
+		{
+			name:           "AES256 checksum after the ciphertext",
+			spn:            "ldap/dc01.draco.local",
+			etype:          etypeID.AES256_CTS_HMAC_SHA1_96,
+			cipher:         concatBytes(encrypted, checksum12),
+			expectedLine:   "$krb5tgs$18$ldap/dc01.draco.local$DRACO.LOCAL$*ldap/dc01.draco.local*$222222222222222222222222$cafebabe",
+			expectedFormat: "Kerberos TGS-REP etype 18 (hashcat -m 19700)",
+		},
+		{
+			name:           "Colons in the SPN field",
+			spn:            "MSSQLSvc/sql01.draco.local:1433",
+			etype:          etypeID.RC4_HMAC,
+			cipher:         concatBytes(checksum16, encrypted),
+			expectedLine:   "$krb5tgs$23$*MSSQLSvc/sql01.draco.local:1433$DRACO.LOCAL$MSSQLSvc/sql01.draco.local~1433*$11111111111111111111111111111111$cafebabe",
+			expectedFormat: "Kerberos TGS-REP etype 23 (hashcat -m 13100)",
+		},
+		{name: "RC4 too short", spn: "ldap/dc01", etype: etypeID.RC4_HMAC, cipher: make([]byte, 15)},
+		{name: "AES too short", spn: "ldap/dc01", etype: etypeID.AES256_CTS_HMAC_SHA1_96, cipher: make([]byte, 11)},
+		{name: "Unsupported etype", spn: "ldap/dc01", etype: etypeID.DES_CBC_MD5, cipher: make([]byte, 40)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			apReq := &messages.APReq{Ticket: messages.Ticket{
+				Realm:   "DRACO.LOCAL",
+				SName:   types.NewPrincipalName(nametype.KRB_NT_SRV_INST, tc.spn),
+				EncPart: types.EncryptedData{EType: tc.etype, Cipher: tc.cipher},
+			}}
+			line, format := formatKrb5TGSHash(apReq)
+			assert.Equal(t, tc.expectedLine, line)
+			assert.Equal(t, tc.expectedFormat, format)
+		})
+	}
+}
+
+// testNTLMAuthenticate builds an AUTHENTICATE_MESSAGE from DRACO\alice
+// carrying the given responses (MS-NLMP §2.2.1.3).
+func testNTLMAuthenticate(lmResponse, ntResponse []byte) []byte {
+	domain, user := utf16le("DRACO"), utf16le("alice")
+
+	const header = 64
+	msg := make([]byte, header)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:12], 3)
+	binary.LittleEndian.PutUint32(msg[60:64], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateExtendedSessionSec)
+
+	offset := header
+	for _, field := range []struct {
+		at    int
+		value []byte
+	}{{12, lmResponse}, {20, ntResponse}, {28, domain}, {36, user}, {44, nil}, {52, nil}} {
+		putNTLMField(msg, field.at, offset, len(field.value))
+		offset += len(field.value)
+	}
+	return concatBytes(msg, lmResponse, ntResponse, domain, user)
+}
+
+func TestCaptureNetNTLM(t *testing.T) {
+	log.InitLog("")
+
+	ntProofStr := bytes.Repeat([]byte{0xab}, 16)
+	// NTLMv2_CLIENT_CHALLENGE: version, reserved, timestamp, client
+	// challenge and an empty AV_PAIR list
+	blob := concatBytes([]byte{0x01, 0x01}, make([]byte, 6), bytes.Repeat([]byte{0x55}, 8), bytes.Repeat([]byte{0x66}, 8), make([]byte, 8))
+	lmResponse := bytes.Repeat([]byte{0x33}, 24)
+	ntResponse := bytes.Repeat([]byte{0x44}, 24)
+
+	testCases := []struct {
+		name           string
+		authenticate   []byte
+		expectedFormat string
+		expectedLine   string
+	}{
+		{
+			name:           "NetNTLMv2",
+			authenticate:   testNTLMAuthenticate(make([]byte, 24), concatBytes(ntProofStr, blob)),
+			expectedFormat: "NetNTLMv2 (hashcat -m 5600)",
+			expectedLine:   `alice::DRACO:0102030405060708:abababababababababababababababab:0101000000000000555555555555555566666666666666660000000000000000`,
+		},
+		{
+			name:           "NetNTLMv1",
+			authenticate:   testNTLMAuthenticate(lmResponse, ntResponse),
+			expectedFormat: "NetNTLMv1 (hashcat -m 5500)",
+			expectedLine: "alice::DRACO:" + strings.Repeat("33", 24) + ":" + strings.Repeat("44", 24) +
+				":0102030405060708",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "captured.txt")
+			capture, err := OpenCredentialCapture(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer capture.file.Close()
+
+			bs := NewBindSession()
+			bs.SetConnID("7")
+			bs.mu.Lock()
+			bs.pending = [][]byte{testNTLMChallenge(), tc.authenticate}
+			bs.captureCreds(Config{Capture: capture}, tc.authenticate)
+			bs.mu.Unlock()
+
+			content, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+			if !assert.Len(t, lines, 2) {
+				return
+			}
+			assert.True(t, strings.HasPrefix(lines[0], "# ["), lines[0])
+			assert.True(t, strings.HasSuffix(lines[0], "] conn 7 - "+tc.expectedFormat), lines[0])
+			assert.Equal(t, tc.expectedLine, lines[1])
+		})
+	}
+
+	t.Run("No earlier CHALLENGE", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "captured.txt")
+		capture, err := OpenCredentialCapture(path)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer capture.file.Close()
+
+		authenticate := testNTLMAuthenticate(lmResponse, ntResponse)
+		bs := NewBindSession()
+		bs.mu.Lock()
+		bs.pending = [][]byte{authenticate}
+		bs.captureCreds(Config{Capture: capture}, authenticate)
+		bs.mu.Unlock()
+
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Empty(t, content)
+	})
+}
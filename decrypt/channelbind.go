@@ -111,11 +111,17 @@ func RewriteBindChannelBindings(bs *BindSession, packet *ber.Packet, cfg Config,
 // logChannelBindingsOnce prints msg the first time it's called for the
 // given outcome (success or failure), tracked separately.
 func (bs *BindSession) logChannelBindingsOnce(failed bool, msg string) {
-	bs.mu.Lock()
-	flag := &bs.cbLogged
 	if failed {
-		flag = &bs.cbFailLogged
+		bs.logOnce(&bs.cbFailLogged, msg)
+	} else {
+		bs.logOnce(&bs.cbLogged, msg)
 	}
+}
+
+// logOnce prints msg unless flag, one of bs's one-time log guards, is
+// already set.
+func (bs *BindSession) logOnce(flag *bool, msg string) {
+	bs.mu.Lock()
 	first := !*flag
 	*flag = true
 	bs.mu.Unlock()
@@ -152,10 +158,7 @@ func (c bindCarrier) write(packet *ber.Packet, auth *ber.Packet, newCreds []byte
 	if !c.sicily {
 		leaf = auth.Children[1]
 	}
-	leaf.Data.Reset()
-	leaf.Data.Write(newCreds)
-	leaf.ByteValue = newCreds
-	leaf.Value = string(newCreds)
+	setPrimitiveBytes(leaf, newCreds)
 
 	if !c.sicily {
 		rebuildBerData(auth)
@@ -164,6 +167,15 @@ func (c bindCarrier) write(packet *ber.Packet, auth *ber.Packet, newCreds []byte
 	rebuildBerData(packet)
 }
 
+// setPrimitiveBytes replaces a primitive packet's content. The enclosing
+// packets must be rebuilt afterwards.
+func setPrimitiveBytes(p *ber.Packet, b []byte) {
+	p.Data.Reset()
+	p.Data.Write(b)
+	p.ByteValue = b
+	p.Value = string(b)
+}
+
 // bindCreds returns a BindRequest's authentication choice, its carrier,
 // and raw token bytes. ok is false for binds with no channel-binding-capable
 // token (simple bind, SASL without credentials).
@@ -187,7 +199,7 @@ func bindCreds(packet *ber.Packet) (auth *ber.Packet, carrier bindCarrier, credB
 		}
 		mechName, _ := auth.Children[0].Value.(string)
 		return auth, bindCarrier{mech: mechName}, primitiveBytes(auth.Children[1]), true
-	case authChoiceSicilyResponse:
+	case authChoiceSicilyNegotiate, authChoiceSicilyResponse:
 		return auth, bindCarrier{mech: sicilyMech, sicily: true}, primitiveBytes(auth), true
 	}
 	return nil, carrier, nil, false
@@ -0,0 +1,179 @@
+package decrypt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// Client-side binds: the initiator half of --translate-auth, exposed to Go
+// LDAP clients. BindClient runs the same NTLM (Sicily) or Kerberos
+// (SASL/GSS-SPNEGO) bind ldapx makes upstream, and hands back the connection
+// with the negotiated security layer applied underneath, so a client library
+// that only knows plain LDAP (e.g. go-ldap's ldap.NewConn) can talk to a DC
+// that requires signing and sealing.
+
+// applicationBindResponse is the BindResponse protocolOp tag (RFC 4511
+// §4.2.2).
+const applicationBindResponse ber.Tag = 1
+
+// maxClientWrappedLen caps the length prefix of a wrapped buffer read from
+// the server, as the proxy does.
+const maxClientWrappedLen = 64 << 20
+
+// ClientConn is an LDAP connection bound by BindClient. Whatever is written
+// to it is wrapped as one SASL buffer, and what is read from it is the
+// unwrapped LDAP stream. Without a security layer (over TLS) it passes the
+// traffic through untouched.
+type ClientConn struct {
+	net.Conn
+
+	bs      *BindSession
+	wrapped bool
+	reader  *bufio.Reader
+
+	readMu  sync.Mutex
+	pending []byte
+
+	writeMu sync.Mutex
+}
+
+// BindClient binds conn as tc, answering the server's challenges itself, and
+// returns conn wrapped with the negotiated security layer. targetHost names
+// the server for the default SPN and KDC. Over TLS (conn is a *tls.Conn) the
+// bind carries a channel binding for the server's certificate and negotiates
+// no layer, as a DC refuses one over TLS; over plain LDAP it signs and
+// seals.
+func BindClient(conn net.Conn, tc *TranslateConfig, targetHost string) (*ClientConn, error) {
+	if tc == nil {
+		return nil, errors.New("no account to bind as")
+	}
+
+	var targetCert *x509.Certificate
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		if state := tlsConn.ConnectionState(); len(state.PeerCertificates) > 0 {
+			targetCert = state.PeerCertificates[0]
+		}
+	}
+
+	c := &ClientConn{
+		Conn:   conn,
+		bs:     NewBindSession(),
+		reader: bufio.NewReader(conn),
+	}
+	if err := c.bs.BindUpstream(tc, targetHost, targetCert, c.bindExchange()); err != nil {
+		return nil, err
+	}
+	_, layer, _ := c.bs.State()
+	c.wrapped = layer != LayerNone
+	return c, nil
+}
+
+// bindExchange sends each bind operation in its own plain LDAPMessage and
+// returns the matching BindResponse operation.
+func (c *ClientConn) bindExchange() BindExchange {
+	var messageID int64
+	return func(op *ber.Packet) (*ber.Packet, error) {
+		messageID++
+		request := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+		request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+		request.AppendChild(op)
+		if _, err := c.Conn.Write(request.Bytes()); err != nil {
+			return nil, err
+		}
+
+		response, err := ber.ReadPacket(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(response.Children) < 2 {
+			return nil, errors.New("malformed response to the bind")
+		}
+		if id, _ := response.Children[0].Value.(int64); id != messageID {
+			return nil, fmt.Errorf("expected a response to message %d, got %d", messageID, id)
+		}
+		if response.Children[1].Tag != applicationBindResponse {
+			return nil, fmt.Errorf("expected a BindResponse, got application %d", response.Children[1].Tag)
+		}
+		return response.Children[1], nil
+	}
+}
+
+// Identity returns the mechanism-prefixed account the connection is bound
+// as, as in BindSession.Identity.
+func (c *ClientConn) Identity() string {
+	return c.bs.Identity()
+}
+
+// Layer returns the security layer negotiated by the bind.
+func (c *ClientConn) Layer() SecurityLayer {
+	_, layer, _ := c.bs.State()
+	return layer
+}
+
+// Read reads the unwrapped LDAP stream.
+func (c *ClientConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if !c.wrapped {
+		return c.reader.Read(b)
+	}
+
+	for len(c.pending) == 0 {
+		lenBuf := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, lenBuf); err != nil {
+			return 0, err
+		}
+		wrappedLen := binary.BigEndian.Uint32(lenBuf)
+		if wrappedLen > maxClientWrappedLen {
+			return 0, fmt.Errorf("wrapped buffer length %d looks implausible (>64MB)", wrappedLen)
+		}
+		wrapped := make([]byte, wrappedLen)
+		if _, err := io.ReadFull(c.reader, wrapped); err != nil {
+			return 0, err
+		}
+		plain, err := c.bs.UnwrapFromTarget(wrapped)
+		if err != nil {
+			return 0, fmt.Errorf("unwrap: %w", err)
+		}
+		c.pending = plain
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write wraps b as one buffer and sends it. LDAP clients write one message
+// per call, which is also how a DC expects them to be wrapped.
+func (c *ClientConn) Write(b []byte) (int, error) {
+	if !c.wrapped {
+		return c.Conn.Write(b)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	wrapped, err := c.bs.WrapToTarget(b)
+	if err != nil {
+		return 0, fmt.Errorf("wrap: %w", err)
+	}
+	frame := make([]byte, 4, 4+len(wrapped))
+	binary.BigEndian.PutUint32(frame, uint32(len(wrapped)))
+	if _, err := c.Conn.Write(append(frame, wrapped...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,199 @@
+package decrypt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Macmod/ldapx/log"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/assert"
+)
+
+// testNTLMChallenge builds the CHALLENGE_MESSAGE of a DC offering signing
+// and sealing (MS-NLMP §2.2.1.2).
+func testNTLMChallenge() []byte {
+	flags := uint32(ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateSign | ntlmNegotiateSeal |
+		ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSec |
+		ntlmNegotiateTargetInfo | ntlmNegotiateVersion | ntlmNegotiate128 | ntlmNegotiateKeyExch | ntlmNegotiate56)
+
+	avPair := func(id uint16, value []byte) []byte {
+		pair := make([]byte, 4, 4+len(value))
+		binary.LittleEndian.PutUint16(pair[0:2], id)
+		binary.LittleEndian.PutUint16(pair[2:4], uint16(len(value)))
+		return append(pair, value...)
+	}
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	targetInfo := concatBytes(
+		avPair(0x0002, utf16le("DRACO")), // MsvAvNbDomainName
+		avPair(0x0001, utf16le("DC01")),  // MsvAvNbComputerName
+		avPair(msvAvTimestamp, timestamp),
+		avPair(0x0000, nil), // MsvAvEOL
+	)
+	targetName := utf16le("DRACO")
+
+	const header = 56
+	msg := make([]byte, header)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:12], 2)
+	binary.LittleEndian.PutUint32(msg[20:24], flags)
+	copy(msg[24:32], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	copy(msg[48:56], ntlmClientVersion)
+	putNTLMField(msg, 12, header, len(targetName))
+	putNTLMField(msg, 40, header+len(targetName), len(targetInfo))
+	return concatBytes(msg, targetName, targetInfo)
+}
+
+// sicilyBindResponse builds a successful SicilyBindResponse carrying
+// serverCreds.
+func sicilyBindResponse(messageID int64, serverCreds []byte) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationBindResponse, nil, "Bind Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(serverCreds), "Server Creds"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Error Message"))
+
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+// testLDAPMessage is an LDAPMessage of about size bytes.
+func testLDAPMessage(messageID int64, size int) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(ber.NewString(ber.ClassApplication, ber.TypePrimitive, 16, string(make([]byte, size)), "Filler"))
+	return packet.Bytes()
+}
+
+// ntlmAcceptor answers a Sicily NTLM bind on conn the way a DC would, then
+// decrypts the bind's security layer with the account's NT hash, as the
+// proxy does, to read wrapped requests and wrap replies.
+type ntlmAcceptor struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	bs     *BindSession
+	cfg    Config
+}
+
+func (a *ntlmAcceptor) bind(t *testing.T) {
+	for _, serverCreds := range [][]byte{testNTLMChallenge(), nil} {
+		request, err := ber.ReadPacket(a.reader)
+		if !assert.NoError(t, err) {
+			return
+		}
+		InspectBindRequest(a.bs, request, a.cfg)
+
+		messageID, _ := request.Children[0].Value.(int64)
+		// Inspected as parsed off the wire, as the proxy does
+		response := ber.DecodePacket(sicilyBindResponse(messageID, serverCreds).Bytes())
+		InspectBindResponse(a.bs, response, a.cfg)
+		_, err = a.conn.Write(response.Bytes())
+		assert.NoError(t, err)
+		a.bs.FinishPendingHandshake()
+	}
+}
+
+func (a *ntlmAcceptor) read() ([]byte, error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(a.reader, lenBuf); err != nil {
+		return nil, err
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint32(lenBuf))
+	if _, err := io.ReadFull(a.reader, wrapped); err != nil {
+		return nil, err
+	}
+	return a.bs.UnwrapFromClient(wrapped)
+}
+
+func (a *ntlmAcceptor) write(plain []byte) error {
+	wrapped, err := a.bs.WrapToClient(plain)
+	if err != nil {
+		return err
+	}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(wrapped)))
+	_, err = a.conn.Write(append(frame, wrapped...))
+	return err
+}
+
+func TestBindClientNTLM(t *testing.T) {
+	log.InitLog("")
+
+	ntHash := NTHashFromPassword("Passw0rd!")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	request := testLDAPMessage(2, 40)
+	replies := [][]byte{testLDAPMessage(2, 100), testLDAPMessage(3, 10)}
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		a := &ntlmAcceptor{conn: conn, reader: bufio.NewReader(conn), bs: NewBindSession(), cfg: Config{NTHash: ntHash}}
+		a.bind(t)
+		plain, err := a.read()
+		assert.NoError(t, err)
+		received <- plain
+		for _, reply := range replies {
+			assert.NoError(t, a.write(reply))
+		}
+		// Hold the connection until the client is done
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	tc := &TranslateConfig{Mech: "ntlm", User: "alice", Domain: "DRACO", NTHash: ntHash}
+	c, err := BindClient(conn, tc, "dc01.draco.local")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, LayerSignSeal, c.Layer())
+	assert.Equal(t, `ntlm:draco\alice`, c.Identity())
+
+	// Writes arrive as one wrapped buffer, unwrapped by the server
+	n, err := c.Write(request)
+	assert.NoError(t, err)
+	assert.Equal(t, len(request), n)
+	select {
+	case plain := <-received:
+		assert.Equal(t, request, plain)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server received nothing")
+	}
+
+	// Reads into a small buffer return the rest of an unwrapped buffer
+	// before reading the next one
+	want := concatBytes(replies...)
+	var got []byte
+	buf := make([]byte, 7)
+	reads := 0
+	for len(got) < len(want) {
+		n, err := c.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.LessOrEqual(t, n, len(buf))
+		got = append(got, buf[:n]...)
+		reads++
+	}
+	assert.Equal(t, want, got)
+	assert.Greater(t, reads, len(replies))
+}
@@ -52,6 +52,36 @@ type Config struct {
 	Keytab    *keytab.Keytab
 	CCache    *credentials.CCache
 	RawSvcKey []byte
+
+	// DigestHA1 holds H(username:realm:password) values standing in for
+	// the password of DIGEST-MD5 binds (--decrypt-digest-ha1).
+	DigestHA1 []DigestHA1
+
+	// Store, if set, holds per-account credentials (--decrypt-store),
+	// which take priority over the single ones above for the accounts and
+	// services it names.
+	Store *CredentialStore
+
+	// KDCProxy, if set, holds the session keys learned by relaying the
+	// clients' own AS/TGS exchanges (--kdc-proxy).
+	KDCProxy *KDCProxy
+
+	// Capture, if set, receives the credentials seen in binds
+	// (--capture-creds).
+	Capture *CredentialCapture
+
+	// Downgrade is the security layer binds are rewritten down to
+	// (--downgrade-layer), LayerUnknown leaving them as negotiated. See
+	// DowngradeBindRequest.
+	Downgrade SecurityLayer
+
+	// SName, if set, is the SPN the tickets in Kerberos binds are presented
+	// for (--rewrite-sname). See RewriteBindSName.
+	SName []string
+
+	// KeytabExport, if set, receives the Kerberos keys resolveSessionKey
+	// learns (--export-keytab).
+	KeytabExport *KeytabExport
 }
 
 // ResolveConfig validates the --decrypt-* flags (mutual exclusion within
@@ -59,9 +89,25 @@ type Config struct {
 // given. All arguments empty is valid - decryption simply never engages,
 // since these flags are the opt-in signal themselves; there's no separate
 // gate flag.
-func ResolveConfig(ntHashHex, ntPassword, svcPassword, svcKeytabPath, ccachePath, svcKeySpec, salt string) (Config, error) {
+func ResolveConfig(ntHashHex, ntPassword, svcPassword, svcKeytabPath, ccachePath, svcKeySpec, salt, storePath string, importPaths []string) (Config, error) {
 	var cfg Config
 
+	if storePath != "" {
+		store, err := LoadCredentialStore(storePath)
+		if err != nil {
+			return cfg, fmt.Errorf("load --decrypt-store: %w", err)
+		}
+		cfg.Store = store
+	}
+	for _, path := range importPaths {
+		if cfg.Store == nil {
+			cfg.Store = &CredentialStore{}
+		}
+		if _, err := cfg.Store.Import(path); err != nil {
+			return cfg, fmt.Errorf("load --decrypt-import '%s': %w", path, err)
+		}
+	}
+
 	if ntHashHex != "" && ntPassword != "" {
 		return cfg, errors.New("invalid decryption flags: --decrypt-hash and --decrypt-password are mutually exclusive")
 	}
@@ -98,7 +144,7 @@ func ResolveConfig(ntHashHex, ntPassword, svcPassword, svcKeytabPath, ccachePath
 		}
 		cfg.Keytab = kt
 	case ccachePath != "":
-		cc, err := credentials.LoadCCache(ccachePath)
+		cc, err := loadTicketCache(ccachePath)
 		if err != nil {
 			return cfg, fmt.Errorf("load --decrypt-ccache: %w", err)
 		}
@@ -156,18 +202,52 @@ func (c Config) resolveNTHash() (hash []byte, ok bool) {
 //     for it, never derived from any password. See
 //     deriveServiceKeyFromPassword for the derivation itself and its salt
 //     caveat.
+//
+// A session key the KDC proxy learned for the ticket, or --decrypt-store
+// entries for the ticket's service, are tried before any of these.
 func resolveSessionKey(cfg Config, apReq *messages.APReq) (types.EncryptionKey, error) {
+	sessionKey, serviceKey, err := resolveTicketKeys(cfg, apReq)
+	if err != nil {
+		return types.EncryptionKey{}, err
+	}
+	if cfg.KeytabExport != nil {
+		cfg.KeytabExport.record(&apReq.Ticket, sessionKey, serviceKey)
+	}
+	return sessionKey, nil
+}
+
+// resolveTicketKeys does the work of resolveSessionKey, also returning the
+// service key the ticket was decrypted with (a zero key when the session
+// key came from somewhere that doesn't need it).
+func resolveTicketKeys(cfg Config, apReq *messages.APReq) (types.EncryptionKey, types.EncryptionKey, error) {
+	var none types.EncryptionKey
+
 	tkt := &apReq.Ticket
+	if cfg.KDCProxy != nil {
+		if key, ok := cfg.KDCProxy.lookup(tkt); ok {
+			return key, none, nil
+		}
+	}
+
+	var storeErr error
+	if cfg.Store != nil {
+		key, serviceKey, err := cfg.Store.storeSessionKey(apReq)
+		if err == nil {
+			return key, serviceKey, nil
+		}
+		storeErr = err
+	}
+
 	switch {
 	case cfg.Keytab != nil:
 		serviceKey, _, err := cfg.Keytab.GetEncryptionKey(tkt.SName, tkt.Realm, tkt.EncPart.KVNO, tkt.EncPart.EType)
 		if err != nil {
-			return types.EncryptionKey{}, fmt.Errorf("keytab: no matching key for %v: %w", tkt.SName.PrincipalNameString(), err)
+			return none, none, fmt.Errorf("keytab: no matching key for %v: %w", tkt.SName.PrincipalNameString(), err)
 		}
 		if err := tkt.Decrypt(serviceKey); err != nil {
-			return types.EncryptionKey{}, fmt.Errorf("decrypt ticket (wrong keytab entry?): %w", err)
+			return none, none, fmt.Errorf("decrypt ticket (wrong keytab entry?): %w", err)
 		}
-		return tkt.DecryptedEncPart.Key, nil
+		return tkt.DecryptedEncPart.Key, serviceKey, nil
 
 	case cfg.CCache != nil:
 		// Match by which cached session key actually decrypts the AP-REQ's
@@ -181,10 +261,10 @@ func resolveSessionKey(cfg Config, apReq *messages.APReq) (types.EncryptionKey,
 		// Authenticator, so trying every entry is unambiguous.
 		for _, cred := range cfg.CCache.GetEntries() {
 			if err := apReq.DecryptAuthenticator(cred.Key); err == nil {
-				return cred.Key, nil
+				return cred.Key, none, nil
 			}
 		}
-		return types.EncryptionKey{}, fmt.Errorf("ccache: no cached ticket's session key could decrypt the AP-REQ Authenticator for %v (is this the connecting user's own ccache, containing that service ticket?)", tkt.SName.PrincipalNameString())
+		return none, none, fmt.Errorf("ccache: no cached ticket's session key could decrypt the AP-REQ Authenticator for %v (is this the connecting user's own ccache, containing that service ticket?)", tkt.SName.PrincipalNameString())
 
 	case cfg.RawSvcKey != nil:
 		// The ticket's own declared encryption type (sent in the clear) is
@@ -195,27 +275,33 @@ func resolveSessionKey(cfg Config, apReq *messages.APReq) (types.EncryptionKey,
 		eType := tkt.EncPart.EType
 		if et, err := crypto.GetEtype(eType); err == nil {
 			if want := et.GetKeyByteSize(); len(cfg.RawSvcKey) != want {
-				return types.EncryptionKey{}, fmt.Errorf("--decrypt-svc-key is %d bytes, but the observed ticket uses encryption type %d, which needs a %d-byte key", len(cfg.RawSvcKey), eType, want)
+				return none, none, fmt.Errorf("--decrypt-svc-key is %d bytes, but the observed ticket uses encryption type %d, which needs a %d-byte key", len(cfg.RawSvcKey), eType, want)
 			}
 		}
 		serviceKey := types.EncryptionKey{KeyType: eType, KeyValue: cfg.RawSvcKey}
 		if err := tkt.Decrypt(serviceKey); err != nil {
-			return types.EncryptionKey{}, fmt.Errorf("decrypt ticket (wrong --decrypt-svc-key?): %w", err)
+			return none, none, fmt.Errorf("decrypt ticket (wrong --decrypt-svc-key?): %w", err)
 		}
-		return tkt.DecryptedEncPart.Key, nil
+		return tkt.DecryptedEncPart.Key, serviceKey, nil
 
 	case cfg.SvcPassword != "":
 		serviceKey, err := deriveServiceKeyFromPassword(cfg, tkt)
 		if err != nil {
-			return types.EncryptionKey{}, err
+			return none, none, err
 		}
 		if err := tkt.Decrypt(serviceKey); err != nil {
-			return types.EncryptionKey{}, fmt.Errorf("decrypt ticket (wrong --decrypt-svc-password, or wrong salt - try --decrypt-salt): %w", err)
+			return none, none, fmt.Errorf("decrypt ticket (wrong --decrypt-svc-password, or wrong salt - try --decrypt-salt): %w", err)
 		}
-		return tkt.DecryptedEncPart.Key, nil
+		return tkt.DecryptedEncPart.Key, serviceKey, nil
+
+	case storeErr != nil:
+		return none, none, storeErr
+
+	case cfg.KDCProxy != nil:
+		return none, none, fmt.Errorf("the ticket for %v wasn't obtained through the KDC proxy", tkt.SName.PrincipalNameString())
 
 	default:
-		return types.EncryptionKey{}, errors.New("no --decrypt-svc-keytab/--decrypt-ccache/--decrypt-svc-key/--decrypt-svc-password supplied")
+		return none, none, errors.New("no --decrypt-svc-keytab/--decrypt-ccache/--decrypt-svc-key/--decrypt-svc-password supplied")
 	}
 }
 
@@ -0,0 +1,382 @@
+package decrypt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/etypeID"
+	"github.com/oiweiwei/gokrb5.fork/v9/keytab"
+	"github.com/oiweiwei/gokrb5.fork/v9/messages"
+	"github.com/oiweiwei/gokrb5.fork/v9/types"
+)
+
+// CredentialStore holds per-account decryption credentials loaded from a
+// --decrypt-store file, so one ldapx instance can decrypt the binds of
+// several users, or of clients binding to several DCs. Each line is a
+// principal, a kind and a value:
+//
+//	# client accounts (NTLM, DIGEST-MD5)
+//	DRACO\alice              password  Passw0rd!
+//	bob@draco.local          hash      31d6cfe0d16ae931b73c59d7e0c089c0
+//	carol@example.org        ha1       5f1bd2c0...9c
+//	# service principals (Kerberos)
+//	ldap/dc01.draco.local    key       0011...ff
+//	ldap/dc02.draco.local    password  MachineP@ss
+//	ldap/dc02.draco.local    salt      DRACO.LOCALhostdc02.draco.local
+//	*                        keytab    /path/to/services.keytab
+//
+// A principal with a '/' is a service principal; anything else is a client
+// account, as DOMAIN\user, user@domain or a bare user name. "*" matches any
+// service. The value is the rest of the line, so passwords may hold spaces,
+// trailing ones included.
+// An ha1 value is the hex H(user:realm:password) that DIGEST-MD5 binds can
+// be decrypted with in place of the password.
+type CredentialStore struct {
+	users    []*storeUser
+	services []*storeService
+}
+
+type storeUser struct {
+	user, domain string
+	ntHash       []byte
+	password     string
+	digestHA1    []byte // DIGEST-MD5 only
+}
+
+type storeService struct {
+	spn, realm string // spn "*" matches any service
+	cfg        Config
+
+	// Imported (--decrypt-import) entries name the account owning the keys
+	// instead of a service, with one key per encryption type.
+	account, domain string
+	keys            map[int32][]byte
+}
+
+func (svc *storeService) String() string {
+	if svc.account != "" {
+		return svc.account
+	}
+	return svc.spn
+}
+
+// LoadCredentialStore parses a --decrypt-store file.
+func LoadCredentialStore(path string) (*CredentialStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening credential store: %w", err)
+	}
+	defer f.Close()
+
+	store := &CredentialStore{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		// The scanner has already dropped the line terminator
+		line := strings.TrimLeftFunc(scanner.Text(), unicode.IsSpace)
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("credential store line %d: expected <principal> <kind> <value>", lineNo)
+		}
+		principal, kind := fields[0], strings.ToLower(fields[1])
+		// The value is everything after the kind, verbatim for passwords
+		rest := strings.TrimLeftFunc(line[len(principal):], unicode.IsSpace)
+		value := strings.TrimLeftFunc(rest[len(fields[1]):], unicode.IsSpace)
+		if kind != "password" {
+			value = strings.TrimSpace(value)
+		}
+
+		if err := store.add(principal, kind, value); err != nil {
+			return nil, fmt.Errorf("credential store line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading credential store: %w", err)
+	}
+	if len(store.users) == 0 && len(store.services) == 0 {
+		return nil, errors.New("credential store has no entries")
+	}
+	return store, nil
+}
+
+func (s *CredentialStore) add(principal, kind, value string) error {
+	if principal == "*" || strings.Contains(principal, "/") {
+		svc := s.service(principal)
+		switch kind {
+		case "password":
+			svc.cfg.SvcPassword = value
+		case "salt":
+			svc.cfg.Salt = value
+		case "key":
+			key, err := parseRawKrb5Key(value)
+			if err != nil {
+				return err
+			}
+			svc.cfg.RawSvcKey = key
+		case "keytab":
+			kt, err := keytab.Load(value)
+			if err != nil {
+				return fmt.Errorf("load keytab: %w", err)
+			}
+			svc.cfg.Keytab = kt
+		default:
+			return fmt.Errorf("unknown kind '%s' for a service principal (expected password, salt, key or keytab)", kind)
+		}
+		return nil
+	}
+
+	u := s.user(principal)
+	switch kind {
+	case "password":
+		u.password = value
+		u.ntHash = NTHashFromPassword(value)
+	case "hash":
+		h, err := hex.DecodeString(value)
+		if err != nil || len(h) != 16 {
+			return fmt.Errorf("invalid NT hash '%s'", value)
+		}
+		// A password given on another line stays authoritative
+		if u.password == "" {
+			u.ntHash = h
+		}
+	case "ha1":
+		h, err := hex.DecodeString(value)
+		if err != nil || len(h) != 16 {
+			return fmt.Errorf("invalid H(A1) '%s'", value)
+		}
+		u.digestHA1 = h
+	default:
+		return fmt.Errorf("unknown kind '%s' for an account (expected password, hash or ha1)", kind)
+	}
+	return nil
+}
+
+// user returns the entry for principal, creating it on first use.
+func (s *CredentialStore) user(principal string) *storeUser {
+	user, domain := principal, ""
+	if d, u, ok := strings.Cut(principal, `\`); ok {
+		user, domain = u, d
+	} else if u, d, ok := strings.Cut(principal, "@"); ok {
+		user, domain = u, d
+	}
+	for _, u := range s.users {
+		if strings.EqualFold(u.user, user) && strings.EqualFold(u.domain, domain) {
+			return u
+		}
+	}
+	u := &storeUser{user: user, domain: domain}
+	s.users = append(s.users, u)
+	return u
+}
+
+// service returns the entry for principal, creating it on first use.
+func (s *CredentialStore) service(principal string) *storeService {
+	spn, realm, _ := strings.Cut(principal, "@")
+	for _, svc := range s.services {
+		if strings.EqualFold(svc.spn, spn) && strings.EqualFold(svc.realm, realm) {
+			return svc
+		}
+	}
+	svc := &storeService{spn: spn, realm: realm}
+	s.services = append(s.services, svc)
+	return svc
+}
+
+// Len returns the number of accounts and of service credential entries in
+// the store.
+func (s *CredentialStore) Len() (users, services int) {
+	return len(s.users), len(s.services)
+}
+
+// lookupUser finds the entry for an account as named in a bind. Domains
+// compare loosely, since NTLM carries the NetBIOS domain name while store
+// entries often use the DNS one (see domainsCompatible).
+func (s *CredentialStore) lookupUser(domain, user string) *storeUser {
+	if domain == "" {
+		if u, d, ok := strings.Cut(user, "@"); ok {
+			user, domain = u, d
+		}
+	}
+
+	var loose *storeUser
+	for _, u := range s.users {
+		if !strings.EqualFold(u.user, user) {
+			continue
+		}
+		if strings.EqualFold(u.domain, domain) {
+			return u
+		}
+		if loose == nil && domainsCompatible(u.domain, domain) {
+			loose = u
+		}
+	}
+	return loose
+}
+
+// domainsCompatible tells whether two domain names may name the same
+// domain. DNS names must be equal; a NetBIOS name (a single label) matches
+// the first label of a DNS name, so "DRACO" matches "draco.local" but
+// "corp.a.local" doesn't match "corp.b.local". An empty domain matches any.
+func domainsCompatible(a, b string) bool {
+	if a == "" || b == "" {
+		return true
+	}
+	aLabel, _, aDotted := strings.Cut(a, ".")
+	bLabel, _, bDotted := strings.Cut(b, ".")
+	if aDotted && bDotted {
+		return strings.EqualFold(a, b)
+	}
+	return strings.EqualFold(aLabel, bLabel)
+}
+
+// servicesFor returns the entries that may hold the key of a ticket's
+// service: those naming its SPN first, then imported machine accounts
+// whose name matches the SPN's host, then the "*" ones, then every other
+// imported account, since any of them may be the one the SPN is
+// registered on.
+func (s *CredentialStore) servicesFor(sname types.PrincipalName, realm string) []*storeService {
+	spn := sname.PrincipalNameString()
+	host := ""
+	if len(sname.NameString) > 1 {
+		host, _, _ = strings.Cut(sname.NameString[1], ".")
+	}
+
+	var exact, machine, wildcard, accounts []*storeService
+	for _, svc := range s.services {
+		switch {
+		case svc.account != "":
+			if !domainsCompatible(svc.domain, realm) {
+				continue
+			}
+			if host != "" && strings.EqualFold(svc.account, host+"$") {
+				machine = append(machine, svc)
+			} else {
+				accounts = append(accounts, svc)
+			}
+		case svc.realm != "" && !strings.EqualFold(svc.realm, realm):
+			continue
+		case svc.spn == "*":
+			wildcard = append(wildcard, svc)
+		case strings.EqualFold(svc.spn, spn):
+			exact = append(exact, svc)
+		}
+	}
+	return slices.Concat(exact, machine, wildcard, accounts)
+}
+
+// ntHashFor returns the NT hash for the account an AUTHENTICATE_MESSAGE
+// names: its --decrypt-store entry if it has one, else the global
+// --decrypt-hash/--decrypt-password.
+func (c Config) ntHashFor(authenticate []byte) (hash []byte, ok bool) {
+	if c.Store != nil {
+		if idx := bytes.Index(authenticate, ntlmSignature); idx >= 0 {
+			if auth, err := parseNTLMAuthenticate(authenticate[idx:]); err == nil {
+				if u := c.Store.lookupUser(auth.Domain, auth.User); u != nil && len(u.ntHash) > 0 {
+					return u.ntHash, true
+				}
+			}
+		}
+	}
+	return c.resolveNTHash()
+}
+
+// digestUserHashFor is ntHashFor's DIGEST-MD5 counterpart, returning
+// H(username:realm:password) for the account a DIGEST-MD5 response names:
+// from its --decrypt-store password or ha1 entry, else a matching
+// --decrypt-digest-ha1, else the global --decrypt-password.
+func (c Config) digestUserHashFor(username, realm string) ([]byte, bool) {
+	if c.Store != nil {
+		if u := c.Store.lookupUser(realm, username); u != nil {
+			switch {
+			case u.password != "":
+				return digestMD5UserHash(username, realm, u.password), true
+			case len(u.digestHA1) > 0:
+				return u.digestHA1, true
+			}
+		}
+	}
+	for _, e := range c.DigestHA1 {
+		if strings.EqualFold(e.User, username) && (e.Realm == "" || strings.EqualFold(e.Realm, realm)) {
+			return e.Hash, true
+		}
+	}
+	if password, ok := c.resolvePassword(); ok {
+		return digestMD5UserHash(username, realm, password), true
+	}
+	return nil, false
+}
+
+// storeSessionKey tries every store entry that may hold the key of the
+// ticket's service, returning the session key and the service key it was
+// found with.
+func (s *CredentialStore) storeSessionKey(apReq *messages.APReq) (types.EncryptionKey, types.EncryptionKey, error) {
+	tkt := &apReq.Ticket
+	candidates := s.servicesFor(tkt.SName, tkt.Realm)
+	if len(candidates) == 0 {
+		return types.EncryptionKey{}, types.EncryptionKey{}, fmt.Errorf("no --decrypt-store entry for %v", tkt.SName.PrincipalNameString())
+	}
+	etype := tkt.EncPart.EType
+	var (
+		errs []error
+		// imported entries without a key of the ticket's encryption
+		// type, and the types they have keys of instead
+		skipped      int
+		skippedTypes = map[int32]bool{}
+	)
+	for _, svc := range candidates {
+		cfg := svc.cfg
+		if svc.keys != nil {
+			key, ok := svc.keys[etype]
+			if !ok {
+				skipped++
+				for et := range svc.keys {
+					skippedTypes[et] = true
+				}
+				continue
+			}
+			cfg.RawSvcKey = key
+		}
+		key, serviceKey, err := resolveTicketKeys(cfg, apReq)
+		if err == nil {
+			return key, serviceKey, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", svc, err))
+	}
+
+	if len(errs) > 3 {
+		errs = []error{fmt.Errorf("none of the %d --decrypt-store entries tried has the key of %v (%s)", len(errs), tkt.SName.PrincipalNameString(), etypeName(etype))}
+	}
+	if skipped > 0 {
+		var names []string
+		for _, et := range slices.Sorted(maps.Keys(skippedTypes)) {
+			names = append(names, etypeName(et))
+		}
+		errs = append(errs, fmt.Errorf("%s key missing from %d imported --decrypt-store entries, only %s imported", etypeName(etype), skipped, strings.Join(names, "/")))
+	}
+	return types.EncryptionKey{}, types.EncryptionKey{}, errors.Join(errs...)
+}
+
+// etypeNames names the encryption types of imported keys in messages.
+var etypeNames = map[int32]string{
+	etypeID.AES256_CTS_HMAC_SHA1_96: "AES256",
+	etypeID.AES128_CTS_HMAC_SHA1_96: "AES128",
+	etypeID.RC4_HMAC:                "RC4",
+	etypeID.DES_CBC_MD5:             "DES",
+}
+
+func etypeName(etype int32) string {
+	if name, ok := etypeNames[etype]; ok {
+		return name
+	}
+	return fmt.Sprintf("encryption type %d", etype)
+}
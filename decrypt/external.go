@@ -0,0 +1,130 @@
+package decrypt
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+
+	"github.com/Macmod/ldapx/log"
+)
+
+// SASL EXTERNAL (RFC 4422 Appendix A) authenticates a connection as the
+// identity established outside LDAP - over LDAPS, the TLS client
+// certificate, which AD maps to an account through its certificate mapping
+// rules (Pass-the-Cert). The bind itself only carries an optional authzId,
+// so it says nothing about the account it ends up as. ldapx correlates it
+// with the certificate the target connection was set up with, and once it
+// succeeds asks the target itself with a WhoAmI (RFC 4532).
+
+// ExternalBind describes a SASL EXTERNAL bind.
+type ExternalBind struct {
+	// AuthzID is the authorization identity requested in the bind ("" for
+	// the one the certificate maps to).
+	AuthzID string
+
+	// Certificate is the TLS client certificate the target sees, if any.
+	Certificate *x509.Certificate
+
+	// Done reports that the BindResponse was observed, with ResultCode and
+	// Diagnostic as the target answered.
+	Done       bool
+	ResultCode int64
+	Diagnostic string
+
+	// Mapped is the authorization identity the target reports for the
+	// connection after a successful bind, e.g. "u:DRACO\alice".
+	Mapped string
+}
+
+// SetClientCertificate records the TLS client certificate ldapx
+// authenticates the target connection with - the client's own (relayed with
+// --key) or --upstream-cert.
+func (bs *BindSession) SetClientCertificate(cert *x509.Certificate) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.clientCert = cert
+}
+
+// External returns the connection's last SASL EXTERNAL bind, if any.
+func (bs *BindSession) External() (ExternalBind, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.external == nil {
+		return ExternalBind{}, false
+	}
+	return *bs.external, true
+}
+
+// TakeExternalWhoAmI reports whether a SASL EXTERNAL bind just succeeded
+// and the account it maps to should be asked for, clearing the request.
+func (bs *BindSession) TakeExternalWhoAmI() bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	take := bs.externalWhoAmI
+	bs.externalWhoAmI = false
+	return take
+}
+
+// SetExternalMapped records the WhoAmI answer for the connection's last
+// SASL EXTERNAL bind, which then names the connection's identity. Ignored
+// if another bind has started since.
+func (bs *BindSession) SetExternalMapped(authzID string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.external == nil || bs.hsMech != MechSaslExternal || !bs.bindComplete || bs.identity == "" {
+		return
+	}
+	bs.external.Mapped = authzID
+	if authzID != "" {
+		bs.identity = "external:" + strings.ToLower(authzID)
+	}
+}
+
+// observeExternal records a SASL EXTERNAL BindRequest. Caller holds bs.mu.
+func (bs *BindSession) observeExternal(credBytes []byte) {
+	ext := &ExternalBind{AuthzID: string(credBytes), Certificate: bs.clientCert}
+	bs.external = ext
+	bs.externalWhoAmI = false
+
+	switch {
+	case ext.AuthzID != "":
+		bs.hsIdentity = "external:" + strings.ToLower(ext.AuthzID)
+		log.Log.Print(decryptColor.Sprintf("[+] SASL/EXTERNAL authzId: '%s'", ext.AuthzID))
+	case ext.Certificate != nil:
+		bs.hsIdentity = "external:cert:" + certFingerprint(ext.Certificate)
+	}
+
+	if ext.Certificate == nil {
+		log.Log.Print(failColor.Sprintf("[-] SASL/EXTERNAL bind, but the target connection has no TLS client certificate to authenticate with"))
+		return
+	}
+	log.Log.Print(decryptColor.Sprintf("[+] SASL/EXTERNAL client certificate: '%s' (issuer '%s', SHA-256 %s)",
+		ext.Certificate.Subject, ext.Certificate.Issuer, certFingerprint(ext.Certificate)))
+}
+
+// concludeExternal records the target's answer to a SASL EXTERNAL bind.
+// Caller holds bs.mu.
+func (bs *BindSession) concludeExternal(resultCode int64, diagnostic string) {
+	ext := bs.external
+	if ext == nil {
+		return
+	}
+	ext.Done, ext.ResultCode, ext.Diagnostic = true, resultCode, diagnostic
+
+	if resultCode != 0 {
+		log.Log.Print(failColor.Sprintf("[-] SASL/EXTERNAL bind failed with result code %d: %s", resultCode, diagnostic))
+		return
+	}
+	bs.externalWhoAmI = true
+	if ext.Certificate != nil {
+		log.Log.Print(decryptColor.Sprintf("[+] SASL/EXTERNAL bind succeeded with certificate '%s'", ext.Certificate.Subject))
+	} else {
+		log.Log.Print(decryptColor.Sprintf("[+] SASL/EXTERNAL bind succeeded"))
+	}
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
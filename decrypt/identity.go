@@ -0,0 +1,73 @@
+package decrypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// credsIdentity names the account behind one round of bind credentials, or
+// returns "" if the round doesn't reveal it. NTLM and DIGEST-MD5 carry the
+// account name in the clear. A Kerberos AP-REQ doesn't (the client name is
+// inside the encrypted parts), so the ticket's ciphertext stands in for it -
+// it stays the same for as long as the client keeps reusing the ticket.
+func credsIdentity(credBytes []byte) string {
+	if idx := bytes.Index(credBytes, ntlmSignature); idx >= 0 {
+		if auth, err := parseNTLMAuthenticate(credBytes[idx:]); err == nil {
+			if auth.User == "" {
+				return anonymousIdentity
+			}
+			return "ntlm:" + strings.ToLower(auth.Domain+`\`+auth.User)
+		}
+		return ""
+	}
+
+	if apReq, err := apReqFromBindCreds(credBytes); err == nil {
+		sum := sha256.Sum256(apReq.Ticket.EncPart.Cipher)
+		return "krb5:" + hex.EncodeToString(sum[:])
+	}
+
+	if resp, err := parseDigestMD5Response(credBytes); err == nil {
+		return "digest-md5:" + strings.ToLower(resp.Realm+`\`+resp.Username)
+	}
+
+	return ""
+}
+
+// anonymousIdentity marks an observed anonymous authentication, as opposed
+// to a round that revealed nothing.
+const anonymousIdentity = "anonymous"
+
+// Identity returns a string identifying the account the connection is
+// currently bound as: "" while it is anonymous (never bound, bind failed or
+// in progress), otherwise a mechanism-prefixed account name. When the bind
+// mechanism doesn't reveal the account, the identity is unique to this
+// session, so it never matches another connection's.
+func (bs *BindSession) Identity() string {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.identity
+}
+
+// observeIdentity refines the identity of the authentication in progress
+// with one more round of credentials. Caller holds bs.mu.
+func (bs *BindSession) observeIdentity(credBytes []byte) {
+	if id := credsIdentity(credBytes); id != "" {
+		bs.hsIdentity = id
+	}
+}
+
+// concludeIdentity records the identity the connection ends up bound as
+// once an authentication ends. Caller holds bs.mu.
+func (bs *BindSession) concludeIdentity(success bool) {
+	switch {
+	case !success, bs.hsIdentity == anonymousIdentity:
+		bs.identity = ""
+	case bs.hsIdentity == "":
+		bs.identity = fmt.Sprintf("%s:unidentified:%p", bs.hsMech, bs)
+	default:
+		bs.identity = bs.hsIdentity
+	}
+}
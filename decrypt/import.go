@@ -0,0 +1,228 @@
+package decrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/oiweiwei/gokrb5.fork/v9/credentials"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/etypeID"
+	"github.com/oiweiwei/gokrb5.fork/v9/messages"
+)
+
+// secretsdumpKeyTypes maps the key type names secretsdump prints in its
+// "Kerberos keys" section to encryption types.
+var secretsdumpKeyTypes = map[string]int32{
+	"aes256-cts-hmac-sha1-96": etypeID.AES256_CTS_HMAC_SHA1_96,
+	"aes128-cts-hmac-sha1-96": etypeID.AES128_CTS_HMAC_SHA1_96,
+	"des-cbc-md5":             etypeID.DES_CBC_MD5,
+	"rc4_hmac":                etypeID.RC4_HMAC,
+}
+
+// Import loads the credentials in one --decrypt-import file into the store.
+// Recognized formats:
+//
+//   - secretsdump/NTDS output: "[DOMAIN\]user:rid:lmhash:nthash:::" lines,
+//     "[DOMAIN\]user:aes256-cts-hmac-sha1-96:<hex>" Kerberos key lines and
+//     "[DOMAIN\]user:CLEARTEXT:<password>" lines. Each account's NT hash
+//     decrypts its own NTLM binds, and all of its keys (the NT hash being
+//     its RC4-HMAC key) decrypt tickets for the SPNs registered on it.
+//     Other lines are skipped.
+//   - A .kirbi file (KRB-CRED, as exported by mimikatz or Rubeus), raw or
+//     base64-encoded, or a ccache, whose session keys decrypt binds made
+//     with those very tickets.
+//
+// It returns how many credentials were imported.
+func (s *CredentialStore) Import(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if cc, err := parseTicketCache(data); err == nil {
+		for _, cred := range cc.GetEntries() {
+			svc := s.service(cred.Server.PrincipalName.PrincipalNameString() + "@" + cred.Server.Realm)
+			if svc.cfg.CCache == nil {
+				svc.cfg.CCache = &credentials.CCache{Version: 4, DefaultPrincipal: cc.DefaultPrincipal}
+			}
+			svc.cfg.CCache.Credentials = append(svc.cfg.CCache.Credentials, cred)
+		}
+		return len(cc.GetEntries()), nil
+	}
+
+	imported := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		// Only the line terminator goes: passwords may start or end with
+		// spaces
+		ok, err := s.importSecretsdumpLine(strings.TrimSuffix(line, "\r"))
+		if err != nil {
+			return imported, err
+		}
+		if ok {
+			imported++
+		}
+	}
+	if imported == 0 {
+		return 0, errors.New("no credentials found (expected secretsdump output, a .kirbi, base64 KRB-CRED or a ccache)")
+	}
+	return imported, nil
+}
+
+// importSecretsdumpLine imports one line of secretsdump output, reporting
+// whether it held a credential.
+func (s *CredentialStore) importSecretsdumpLine(line string) (bool, error) {
+	// Status lines ("[*] Dumping...") start with '['; account names may
+	// hold spaces
+	if line == "" || strings.HasPrefix(line, "[") {
+		return false, nil
+	}
+	fields := strings.Split(line, ":")
+	if len(fields) < 3 || fields[0] == "" {
+		return false, nil
+	}
+	principal := fields[0]
+
+	switch {
+	// user:rid:lmhash:nthash:::
+	case len(fields) >= 7 && isDecimal(fields[1]) && len(fields[3]) == 32:
+		ntHash, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return false, nil
+		}
+		if u := s.user(principal); u.password == "" {
+			u.ntHash = ntHash
+		}
+		s.account(principal).keys[etypeID.RC4_HMAC] = ntHash
+		return true, nil
+
+	// user:CLEARTEXT:password
+	case fields[1] == "CLEARTEXT":
+		// Everything after the second ':', as it is
+		password := strings.SplitN(line, ":", 3)[2]
+		if password == "" {
+			return false, nil
+		}
+		u := s.user(principal)
+		u.password = password
+		u.ntHash = NTHashFromPassword(password)
+		s.account(principal).keys[etypeID.RC4_HMAC] = u.ntHash
+		return true, nil
+
+	// user:aes256-cts-hmac-sha1-96:key
+	case len(fields) == 3:
+		etype, known := secretsdumpKeyTypes[strings.ToLower(fields[1])]
+		if !known {
+			return false, nil
+		}
+		key, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return false, fmt.Errorf("invalid %s key for %s: %w", fields[1], principal, err)
+		}
+		s.account(principal).keys[etype] = key
+		return true, nil
+	}
+	return false, nil
+}
+
+// account returns the imported keys entry of an account, creating it on
+// first use.
+func (s *CredentialStore) account(principal string) *storeService {
+	account, domain := principal, ""
+	if d, a, ok := strings.Cut(principal, `\`); ok {
+		account, domain = a, d
+	}
+	for _, svc := range s.services {
+		if strings.EqualFold(svc.account, account) && strings.EqualFold(svc.domain, domain) {
+			return svc
+		}
+	}
+	svc := &storeService{account: account, domain: domain, keys: map[int32][]byte{}}
+	s.services = append(s.services, svc)
+	return svc
+}
+
+func isDecimal(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
+
+// loadTicketCache loads a ccache, or a .kirbi converted into one, as
+// --decrypt-ccache and --translate-ccache accept.
+func loadTicketCache(path string) (*credentials.CCache, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTicketCache(data)
+}
+
+// parseTicketCache parses a ccache, a KRB-CRED (.kirbi) or a base64-encoded
+// KRB-CRED. A KRB-CRED becomes a ccache holding its tickets.
+func parseTicketCache(data []byte) (*credentials.CCache, error) {
+	if len(data) > 0 && data[0] == 0x05 {
+		cc := new(credentials.CCache)
+		if err := cc.Unmarshal(data); err != nil {
+			return nil, err
+		}
+		return cc, nil
+	}
+
+	// KRB-CRED is [APPLICATION 22]
+	if len(data) == 0 || data[0] != 0x76 {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+		if err != nil || len(decoded) == 0 || decoded[0] != 0x76 {
+			return nil, errors.New("not a ccache, .kirbi or base64 KRB-CRED")
+		}
+		data = decoded
+	}
+	return krbCredToCCache(data)
+}
+
+// krbCredToCCache converts a KRB-CRED into a ccache. Exported tickets
+// (mimikatz, Rubeus) leave the KRB-CRED's encrypted part unencrypted
+// (etype 0), which is the only form that can be read without a key.
+func krbCredToCCache(data []byte) (*credentials.CCache, error) {
+	var krbCred messages.KRBCred
+	if err := krbCred.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("parse KRB-CRED: %w", err)
+	}
+	if krbCred.EncPart.EType != 0 {
+		return nil, fmt.Errorf("KRB-CRED is encrypted (etype %d)", krbCred.EncPart.EType)
+	}
+	var encPart messages.EncKrbCredPart
+	if err := encPart.Unmarshal(krbCred.EncPart.Cipher); err != nil {
+		return nil, err
+	}
+	if len(encPart.TicketInfo) != len(krbCred.Tickets) {
+		return nil, fmt.Errorf("KRB-CRED has %d tickets but %d ticket infos", len(krbCred.Tickets), len(encPart.TicketInfo))
+	}
+
+	cc := &credentials.CCache{Version: 4}
+	for i, info := range encPart.TicketInfo {
+		ticket, err := krbCred.Tickets[i].Marshal()
+		if err != nil {
+			return nil, err
+		}
+		client := credentials.Principal{Realm: info.PRealm, PrincipalName: info.PName}
+		if i == 0 {
+			cc.DefaultPrincipal = client
+		}
+		cc.Credentials = append(cc.Credentials, &credentials.Credential{
+			Client:      client,
+			Server:      credentials.Principal{Realm: info.SRealm, PrincipalName: info.SName},
+			Key:         info.Key,
+			AuthTime:    info.AuthTime,
+			StartTime:   info.StartTime,
+			EndTime:     info.EndTime,
+			RenewTill:   info.RenewTill,
+			TicketFlags: info.Flags,
+			Ticket:      ticket,
+		})
+	}
+	return cc, nil
+}
@@ -0,0 +1,244 @@
+package decrypt
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/oiweiwei/gokrb5.fork/v9/asn1tools"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/asnAppTag"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/etypeID"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/msgtype"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/nametype"
+	"github.com/oiweiwei/gokrb5.fork/v9/messages"
+	"github.com/oiweiwei/gokrb5.fork/v9/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testNTHash  = "31d6cfe0d16ae931b73c59d7e0c089c0"
+	testAES256  = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	testSession = "0123456789abcdef0123456789abcdef"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	assert.NoError(t, err)
+	return b
+}
+
+// testKirbi builds an exported (etype 0) KRB-CRED holding one ticket for
+// ldap/dc01.draco.local, as mimikatz or Rubeus write them.
+func testKirbi(t *testing.T) []byte {
+	t.Helper()
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "ldap/dc01.draco.local")
+	ticket := messages.Ticket{
+		TktVNO:  5,
+		Realm:   "DRACO.LOCAL",
+		SName:   sname,
+		EncPart: types.EncryptedData{EType: etypeID.AES256_CTS_HMAC_SHA1_96, KVNO: 2, Cipher: []byte{1, 2, 3, 4}},
+	}
+	ticketBytes, err := ticket.Marshal()
+	assert.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	encPart, err := asn1.Marshal(messages.EncKrbCredPart{
+		TicketInfo: []messages.KrbCredInfo{{
+			Key:       types.EncryptionKey{KeyType: etypeID.AES256_CTS_HMAC_SHA1_96, KeyValue: mustHex(t, testSession)},
+			PRealm:    "DRACO.LOCAL",
+			PName:     types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "alice"),
+			Flags:     asn1.BitString{Bytes: []byte{0x40, 0x81, 0, 0}, BitLength: 32},
+			AuthTime:  now,
+			StartTime: now,
+			EndTime:   now.Add(10 * time.Hour),
+			RenewTill: now.Add(7 * 24 * time.Hour),
+			SRealm:    "DRACO.LOCAL",
+			SName:     sname,
+		}},
+	})
+	assert.NoError(t, err)
+
+	krbCred, err := asn1.Marshal(struct {
+		PVNO    int                 `asn1:"explicit,tag:0"`
+		MsgType int                 `asn1:"explicit,tag:1"`
+		Tickets []asn1.RawValue     `asn1:"explicit,tag:2"`
+		EncPart types.EncryptedData `asn1:"explicit,tag:3"`
+	}{
+		PVNO:    5,
+		MsgType: msgtype.KRB_CRED,
+		Tickets: []asn1.RawValue{{FullBytes: ticketBytes}},
+		EncPart: types.EncryptedData{Cipher: asn1tools.AddASNAppTag(encPart, asnAppTag.EncKrbCredPart)},
+	})
+	assert.NoError(t, err)
+	return asn1tools.AddASNAppTag(krbCred, asnAppTag.KRBCred)
+}
+
+func TestImport(t *testing.T) {
+	type account struct {
+		account, domain string
+		keys            map[int32][]byte
+	}
+	type user struct {
+		user, domain, password string
+	}
+
+	ntHash := mustHex(t, testNTHash)
+	testCases := []struct {
+		name     string
+		content  string
+		imported int
+		accounts []account
+		users    []user
+		wantErr  bool
+	}{
+		{
+			name:     "NT hash",
+			content:  "DRACO\\alice:1104:aad3b435b51404eeaad3b435b51404ee:" + testNTHash + ":::\n",
+			imported: 1,
+			accounts: []account{{"alice", "DRACO", map[int32][]byte{etypeID.RC4_HMAC: ntHash}}},
+			users:    []user{{"alice", "DRACO", ""}},
+		},
+		{
+			name:     "NT hash with the user status",
+			content:  "DRACO\\alice:1104:aad3b435b51404eeaad3b435b51404ee:" + testNTHash + "::: (status=Enabled)\n",
+			imported: 1,
+			accounts: []account{{"alice", "DRACO", map[int32][]byte{etypeID.RC4_HMAC: ntHash}}},
+			users:    []user{{"alice", "DRACO", ""}},
+		},
+		{
+			name:     "Kerberos keys",
+			content:  "DRACO\\DC01$:aes256-cts-hmac-sha1-96:" + testAES256 + "\nDRACO\\DC01$:des-cbc-md5:0011223344556677\nDRACO\\DC01$:unknown-type:00\n",
+			imported: 2,
+			accounts: []account{{"DC01$", "DRACO", map[int32][]byte{
+				etypeID.AES256_CTS_HMAC_SHA1_96: mustHex(t, testAES256),
+				etypeID.DES_CBC_MD5:             mustHex(t, "0011223344556677"),
+			}}},
+		},
+		{
+			name:     "Cleartext password keeps its spaces and colons",
+			content:  "DRACO\\alice:CLEARTEXT: pass:word \n",
+			imported: 1,
+			accounts: []account{{"alice", "DRACO", map[int32][]byte{etypeID.RC4_HMAC: NTHashFromPassword(" pass:word ")}}},
+			users:    []user{{"alice", "DRACO", " pass:word "}},
+		},
+		{
+			name:     "CRLF line endings",
+			content:  "DRACO\\alice:CLEARTEXT:Passw0rd!\r\nDRACO\\alice:aes256-cts-hmac-sha1-96:" + testAES256 + "\r\n",
+			imported: 2,
+			accounts: []account{{"alice", "DRACO", map[int32][]byte{
+				etypeID.RC4_HMAC:                NTHashFromPassword("Passw0rd!"),
+				etypeID.AES256_CTS_HMAC_SHA1_96: mustHex(t, testAES256),
+			}}},
+			users: []user{{"alice", "DRACO", "Passw0rd!"}},
+		},
+		{
+			name:     "Account name with a space",
+			content:  "DRACO\\John Smith:1105:aad3b435b51404eeaad3b435b51404ee:" + testNTHash + ":::\n",
+			imported: 1,
+			accounts: []account{{"John Smith", "DRACO", map[int32][]byte{etypeID.RC4_HMAC: ntHash}}},
+			users:    []user{{"John Smith", "DRACO", ""}},
+		},
+		{
+			name:     "Status lines are skipped",
+			content:  "[*] Dumping Domain Credentials (domain\\uid:rid:lmhash:nthash)\n[*] Kerberos keys grabbed\n\nDRACO\\alice:CLEARTEXT:x\n",
+			imported: 1,
+			accounts: []account{{"alice", "DRACO", map[int32][]byte{etypeID.RC4_HMAC: NTHashFromPassword("x")}}},
+			users:    []user{{"alice", "DRACO", "x"}},
+		},
+		{name: "Nothing to import", content: "[*] Cleaning up...\n\n", wantErr: true},
+		{name: "Invalid key", content: "DRACO\\alice:aes256-cts-hmac-sha1-96:zz\n", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "secrets.txt")
+			assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0600))
+
+			store := &CredentialStore{}
+			imported, err := store.Import(path)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.imported, imported)
+
+			var accounts []account
+			for _, svc := range store.services {
+				accounts = append(accounts, account{svc.account, svc.domain, svc.keys})
+			}
+			assert.Equal(t, tc.accounts, accounts)
+
+			var users []user
+			for _, u := range store.users {
+				users = append(users, user{u.user, u.domain, u.password})
+			}
+			assert.Equal(t, tc.users, users)
+		})
+	}
+}
+
+func TestImportTicketCache(t *testing.T) {
+	kirbi := testKirbi(t)
+	testCases := []struct {
+		name    string
+		content []byte
+	}{
+		{"Raw KRB-CRED", kirbi},
+		{"Base64 KRB-CRED", []byte(base64.StdEncoding.EncodeToString(kirbi) + "\n")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ticket.kirbi")
+			assert.NoError(t, os.WriteFile(path, tc.content, 0600))
+
+			store := &CredentialStore{}
+			imported, err := store.Import(path)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, imported)
+			if !assert.Len(t, store.services, 1) {
+				return
+			}
+
+			svc := store.services[0]
+			assert.Equal(t, "ldap/dc01.draco.local", svc.spn)
+			assert.Equal(t, "DRACO.LOCAL", svc.realm)
+			if !assert.NotNil(t, svc.cfg.CCache) || !assert.Len(t, svc.cfg.CCache.Credentials, 1) {
+				return
+			}
+			cred := svc.cfg.CCache.Credentials[0]
+			assert.Equal(t, "alice", cred.Client.PrincipalName.PrincipalNameString())
+			assert.Equal(t, "ldap/dc01.draco.local", cred.Server.PrincipalName.PrincipalNameString())
+			assert.Equal(t, mustHex(t, testSession), cred.Key.KeyValue)
+
+			var ticket messages.Ticket
+			assert.NoError(t, ticket.Unmarshal(cred.Ticket))
+			assert.Equal(t, int32(etypeID.AES256_CTS_HMAC_SHA1_96), ticket.EncPart.EType)
+		})
+	}
+}
+
+func TestStoreSessionKeyMissingEtype(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.txt")
+	content := "DRACO\\alice:1104:aad3b435b51404eeaad3b435b51404ee:" + testNTHash + ":::\n" +
+		"DRACO\\svc_sql:1105:aad3b435b51404eeaad3b435b51404ee:" + testNTHash + ":::\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+	store := &CredentialStore{}
+	_, err := store.Import(path)
+	assert.NoError(t, err)
+
+	apReq := &messages.APReq{Ticket: messages.Ticket{
+		Realm:   "DRACO.LOCAL",
+		SName:   types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "ldap/dc01.draco.local"),
+		EncPart: types.EncryptedData{EType: etypeID.AES256_CTS_HMAC_SHA1_96},
+	}}
+	_, _, err = store.storeSessionKey(apReq)
+	assert.EqualError(t, err, "AES256 key missing from 2 imported --decrypt-store entries, only RC4 imported")
+}
@@ -0,0 +1,327 @@
+package decrypt
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Macmod/ldapx/log"
+	"github.com/oiweiwei/gokrb5.fork/v9/crypto"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/etypeID"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/keyusage"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/patype"
+	"github.com/oiweiwei/gokrb5.fork/v9/messages"
+	"github.com/oiweiwei/gokrb5.fork/v9/types"
+)
+
+// KDCProxy relays Kerberos traffic between clients and a real KDC
+// (--kdc-proxy), learning session keys along the way. With the client's
+// own credential it decrypts the AS-REP, which yields the TGT's session
+// key, and with that the TGS-REPs for every service ticket requested with
+// the TGT. resolveSessionKey then finds the key of a ticket seen in an LDAP
+// bind without any service credential or exported ccache.
+type KDCProxy struct {
+	cfg      Config
+	upstream string
+	dial     func(network, addr string) (net.Conn, error)
+
+	mu sync.Mutex
+	// keys maps the SHA-256 of a ticket's ciphertext to its session key
+	keys map[[32]byte]types.EncryptionKey
+}
+
+// kdcMaxMessage bounds the size of a Kerberos message over TCP.
+const kdcMaxMessage = 1 << 20
+
+// NewKDCProxy creates a KDC proxy relaying to upstream ("host:port") with
+// dial, using the client credentials in cfg.
+func NewKDCProxy(cfg Config, upstream string, dial func(network, addr string) (net.Conn, error)) *KDCProxy {
+	return &KDCProxy{
+		cfg:      cfg,
+		upstream: upstream,
+		dial:     dial,
+		keys:     make(map[[32]byte]types.EncryptionKey),
+	}
+}
+
+// Upstream returns the address of the KDC requests are relayed to.
+func (p *KDCProxy) Upstream() string {
+	return p.upstream
+}
+
+// Listen starts serving Kerberos over both TCP and UDP on addr. Requests
+// are always relayed to the upstream KDC over TCP.
+func (p *KDCProxy) Listen(addr string) error {
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		tcpListener.Close()
+		return err
+	}
+
+	go p.serveTCP(tcpListener)
+	go p.serveUDP(udpConn)
+	return nil
+}
+
+func (p *KDCProxy) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Log.Print(failColor.Sprintf("[-] KDC proxy: accept failed: %v", err))
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				req, err := readKerberosTCP(conn)
+				if err != nil {
+					return
+				}
+				rep, err := p.exchange(req)
+				if err != nil {
+					log.Log.Print(failColor.Sprintf("[-] KDC proxy: relaying to '%s' failed: %v", p.upstream, err))
+					return
+				}
+				if err := writeKerberosTCP(conn, rep); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (p *KDCProxy) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Log.Print(failColor.Sprintf("[-] KDC proxy: UDP read failed: %v", err))
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		go func() {
+			rep, err := p.exchange(req)
+			if err != nil {
+				log.Log.Print(failColor.Sprintf("[-] KDC proxy: relaying to '%s' failed: %v", p.upstream, err))
+				return
+			}
+			pc.WriteTo(rep, addr)
+		}()
+	}
+}
+
+// exchange relays one request to the upstream KDC and inspects the reply.
+func (p *KDCProxy) exchange(req []byte) ([]byte, error) {
+	conn, err := p.dial("tcp", p.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if err := writeKerberosTCP(conn, req); err != nil {
+		return nil, err
+	}
+	rep, err := readKerberosTCP(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	p.inspect(req, rep)
+	return rep, nil
+}
+
+func readKerberosTCP(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > kdcMaxMessage {
+		return nil, fmt.Errorf("Kerberos message too large (%d bytes)", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeKerberosTCP(w io.Writer, msg []byte) error {
+	framed := binary.BigEndian.AppendUint32(nil, uint32(len(msg)))
+	_, err := w.Write(append(framed, msg...))
+	return err
+}
+
+// Application tags of the KDC messages inspect looks at (RFC 4120 5.4).
+const (
+	krbTagTGSReq = 0x6c // [APPLICATION 12]
+	krbTagASRep  = 0x6b // [APPLICATION 11]
+	krbTagTGSRep = 0x6d // [APPLICATION 13]
+)
+
+// inspect learns the session key of the ticket a KDC reply carries, if
+// the credentials at hand can decrypt it.
+func (p *KDCProxy) inspect(req, rep []byte) {
+	if len(req) == 0 || len(rep) == 0 {
+		return
+	}
+
+	switch rep[0] {
+	case krbTagASRep:
+		var asRep messages.ASRep
+		if err := asRep.Unmarshal(rep); err != nil {
+			return
+		}
+		client := principalString(asRep.CName, asRep.CRealm)
+		for _, key := range p.cfg.clientKeys(asRep.CName, asRep.CRealm, asRep.EncPart.EType, asRep.PAData) {
+			if encPart, err := decryptKDCRepPart(asRep.EncPart, key, keyusage.AS_REP_ENCPART); err == nil {
+				p.learn(&asRep.Ticket, encPart.Key)
+				log.Log.Print(decryptColor.Sprintf("[+] KDC proxy: AS-REP for %s decrypted - session key of %s captured", client, principalString(asRep.Ticket.SName, asRep.Ticket.Realm)))
+				return
+			}
+		}
+		log.Log.Print(failColor.Sprintf("[-] KDC proxy: no credential decrypts the AS-REP for %s (encryption type %d)", client, asRep.EncPart.EType))
+
+	case krbTagTGSRep:
+		if req[0] != krbTagTGSReq {
+			return
+		}
+		var tgsReq messages.TGSReq
+		if err := tgsReq.Unmarshal(req); err != nil {
+			return
+		}
+		var tgsRep messages.TGSRep
+		if err := tgsRep.Unmarshal(rep); err != nil {
+			return
+		}
+		service := principalString(tgsRep.Ticket.SName, tgsRep.Ticket.Realm)
+		client := principalString(tgsRep.CName, tgsRep.CRealm)
+
+		apReq, tgtKey, err := p.tgsReqAPReq(tgsReq)
+		if err != nil {
+			log.Log.Print(failColor.Sprintf("[-] KDC proxy: can't decrypt the TGS-REP for %s (%s): %v", service, client, err))
+			return
+		}
+		// The reply is encrypted with the Authenticator's subkey if it
+		// has one, else with the TGT's session key
+		if err := apReq.DecryptAuthenticator(tgtKey); err == nil && len(apReq.Authenticator.SubKey.KeyValue) > 0 {
+			if encPart, err := decryptKDCRepPart(tgsRep.EncPart, apReq.Authenticator.SubKey, keyusage.TGS_REP_ENCPART_AUTHENTICATOR_SUB_KEY); err == nil {
+				p.learn(&tgsRep.Ticket, encPart.Key)
+				log.Log.Print(decryptColor.Sprintf("[+] KDC proxy: TGS-REP for %s (%s) decrypted - session key captured", service, client))
+				return
+			}
+		}
+		if encPart, err := decryptKDCRepPart(tgsRep.EncPart, tgtKey, keyusage.TGS_REP_ENCPART_SESSION_KEY); err == nil {
+			p.learn(&tgsRep.Ticket, encPart.Key)
+			log.Log.Print(decryptColor.Sprintf("[+] KDC proxy: TGS-REP for %s (%s) decrypted - session key captured", service, client))
+			return
+		}
+		log.Log.Print(failColor.Sprintf("[-] KDC proxy: the TGS-REP for %s (%s) didn't decrypt with the TGT's keys", service, client))
+	}
+}
+
+// tgsReqAPReq returns the AP-REQ of a TGS-REQ's PA-TGS-REQ, and the session
+// key of the TGT it carries, as learned from an earlier reply.
+func (p *KDCProxy) tgsReqAPReq(tgsReq messages.TGSReq) (*messages.APReq, types.EncryptionKey, error) {
+	for _, pa := range tgsReq.PAData {
+		if pa.PADataType != patype.PA_TGS_REQ {
+			continue
+		}
+		var apReq messages.APReq
+		if err := apReq.Unmarshal(pa.PADataValue); err != nil {
+			return nil, types.EncryptionKey{}, err
+		}
+		key, ok := p.lookup(&apReq.Ticket)
+		if !ok {
+			return nil, types.EncryptionKey{}, errors.New("its TGT wasn't obtained through the KDC proxy")
+		}
+		return &apReq, key, nil
+	}
+	return nil, types.EncryptionKey{}, errors.New("no PA-TGS-REQ")
+}
+
+func (p *KDCProxy) learn(tkt *messages.Ticket, key types.EncryptionKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[sha256.Sum256(tkt.EncPart.Cipher)] = key
+}
+
+func (p *KDCProxy) lookup(tkt *messages.Ticket) (types.EncryptionKey, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[sha256.Sum256(tkt.EncPart.Cipher)]
+	return key, ok
+}
+
+func decryptKDCRepPart(encPart types.EncryptedData, key types.EncryptionKey, usage uint32) (*messages.EncKDCRepPart, error) {
+	if key.KeyType != encPart.EType {
+		return nil, fmt.Errorf("key is of encryption type %d, not %d", key.KeyType, encPart.EType)
+	}
+	b, err := crypto.DecryptEncPart(encPart, key, usage)
+	if err != nil {
+		return nil, err
+	}
+	var dec messages.EncKDCRepPart
+	if err := dec.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	return &dec, nil
+}
+
+func principalString(name types.PrincipalName, realm string) string {
+	return name.PrincipalNameString() + "@" + realm
+}
+
+// clientKeys returns every candidate long-term key of a client for an
+// AS-REP's encryption type: from its --decrypt-store entries, then from
+// the global --decrypt-password/--decrypt-hash. Passwords are salted per
+// the AS-REP's PA-ETYPE-INFO2 (or the default salt).
+func (c Config) clientKeys(cname types.PrincipalName, realm string, etype int32, pas types.PADataSequence) []types.EncryptionKey {
+	var passwords []string
+	var raw [][]byte
+
+	if c.Store != nil && len(cname.NameString) > 0 {
+		user := cname.NameString[0]
+		if u := c.Store.lookupUser(realm, user); u != nil {
+			if u.password != "" {
+				passwords = append(passwords, u.password)
+			} else if etype == etypeID.RC4_HMAC && len(u.ntHash) > 0 {
+				raw = append(raw, u.ntHash)
+			}
+		}
+		for _, svc := range c.Store.services {
+			if svc.account != "" && strings.EqualFold(svc.account, user) && domainsCompatible(svc.domain, realm) {
+				if key, ok := svc.keys[etype]; ok {
+					raw = append(raw, key)
+				}
+			}
+		}
+	}
+	if c.Password != "" {
+		passwords = append(passwords, c.Password)
+	} else if etype == etypeID.RC4_HMAC && len(c.NTHash) > 0 {
+		raw = append(raw, c.NTHash)
+	}
+
+	var keys []types.EncryptionKey
+	for _, password := range passwords {
+		if key, _, err := crypto.GetKeyFromPassword(password, cname, realm, etype, pas); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	for _, value := range raw {
+		keys = append(keys, types.EncryptionKey{KeyType: etype, KeyValue: value})
+	}
+	return keys
+}
@@ -0,0 +1,112 @@
+package decrypt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Macmod/ldapx/log"
+	"github.com/oiweiwei/gokrb5.fork/v9/keytab"
+	"github.com/oiweiwei/gokrb5.fork/v9/messages"
+	"github.com/oiweiwei/gokrb5.fork/v9/types"
+)
+
+// KeytabExport writes the Kerberos keys resolveSessionKey learns to a
+// keytab file, so that a capture of the same traffic can be decrypted with
+// it elsewhere (Wireshark's "Try to decrypt Kerberos blobs" with the keytab
+// set in the KRB5 protocol preferences):
+//
+//   - the service key a ticket was decrypted with, under the ticket's
+//     service principal and key version, which lets Wireshark decrypt the
+//     ticket and learn its session key by itself;
+//   - the ticket's session key, which is all there is when it came from a
+//     ccache or the KDC proxy. Wireshark tries every key of a keytab
+//     regardless of its principal, so it is stored under the ticket's
+//     client principal when the ticket was decrypted, and under its service
+//     principal with key version 0 otherwise.
+//
+// The file is rewritten whenever a new key is learned, so it is always a
+// complete keytab.
+type KeytabExport struct {
+	mu   sync.Mutex
+	path string
+	kt   *keytab.Keytab
+}
+
+// OpenKeytabExport creates (or truncates) the keytab file.
+func OpenKeytabExport(path string) (*KeytabExport, error) {
+	e := &KeytabExport{path: path, kt: keytab.New()}
+	if err := e.flush(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Path returns the path of the keytab file.
+func (e *KeytabExport) Path() string {
+	return e.path
+}
+
+func (e *KeytabExport) flush() error {
+	b, err := e.kt.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshaling keytab: %w", err)
+	}
+	if err := os.WriteFile(e.path, b, 0600); err != nil {
+		return fmt.Errorf("writing keytab: %w", err)
+	}
+	return nil
+}
+
+// record adds the keys of a ticket resolveSessionKey just resolved. A zero
+// serviceKey means the session key came without one.
+func (e *KeytabExport) record(tkt *messages.Ticket, sessionKey, serviceKey types.EncryptionKey) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	added := false
+	if len(serviceKey.KeyValue) > 0 {
+		added = e.add(tkt.SName, tkt.Realm, uint32(tkt.EncPart.KVNO), serviceKey) || added
+	}
+
+	sessionPrincipal, sessionRealm := tkt.SName, tkt.Realm
+	if cname := tkt.DecryptedEncPart.CName; len(cname.NameString) > 0 {
+		sessionPrincipal, sessionRealm = cname, tkt.DecryptedEncPart.CRealm
+	}
+	if e.add(sessionPrincipal, sessionRealm, 0, sessionKey) {
+		added = true
+		log.Log.Print(decryptColor.Sprintf("[+] Exported session key of the ticket for %s@%s (encryption type %d) to '%s'",
+			tkt.SName.PrincipalNameString(), tkt.Realm, sessionKey.KeyType, e.path))
+	}
+
+	if !added {
+		return
+	}
+	if err := e.flush(); err != nil {
+		log.Log.Print(failColor.Sprintf("[-] Failed to export Kerberos keys: %v", err))
+	}
+}
+
+// add appends a keytab entry unless the key is already in the keytab,
+// reporting whether it did.
+func (e *KeytabExport) add(principal types.PrincipalName, realm string, kvno uint32, key types.EncryptionKey) bool {
+	for _, entry := range e.kt.Entries {
+		if entry.Key.KeyType == key.KeyType && bytes.Equal(entry.Key.KeyValue, key.KeyValue) {
+			return false
+		}
+	}
+
+	entry := keytab.NewEntry()
+	entry.Principal.NumComponents = int16(len(principal.NameString))
+	entry.Principal.Components = principal.NameString
+	entry.Principal.NameType = principal.NameType
+	entry.Principal.Realm = realm
+	entry.Timestamp = time.Now()
+	entry.KVNO8 = uint8(kvno)
+	entry.KVNO = kvno
+	entry.Key = key
+	e.kt.Entries = append(e.kt.Entries, entry)
+	return true
+}
@@ -43,15 +43,31 @@ func authenticatorKeyUsage(sname types.PrincipalName) uint32 {
 
 // rewriteKerberosChannelBindings substitutes token into the Bnd field of
 // the AP-REQ Authenticator's GSS-API checksum. Returns nil credentials and
-// no error when the round has nothing to rewrite. The substitution is made
-// at the byte level so every enclosing length stays as the client encoded
-// it.
+// no error when the round has nothing to rewrite.
 func rewriteKerberosChannelBindings(credBytes []byte, cfg Config, token []byte) ([]byte, error) {
 	apReq, err := apReqFromBindCreds(credBytes)
 	if err != nil {
 		return nil, nil
 	}
 
+	return rewriteGSSChecksum(credBytes, apReq, cfg, func(cksum []byte) []byte {
+		if binary.LittleEndian.Uint32(cksum[:4]) != gssChecksumBndLen || len(cksum) < 4+gssChecksumBndLen {
+			return nil
+		}
+		if bytes.Equal(cksum[4:4+gssChecksumBndLen], token) {
+			return nil
+		}
+		return replaceBnd(cksum, token)
+	})
+}
+
+// rewriteGSSChecksum replaces the GSS-API checksum of apReq's Authenticator
+// with what patch returns for it, re-encrypting the Authenticator under the
+// ticket's session key. patch returning nil means there is nothing to
+// change, and so do nil credentials with no error. The substitution is made
+// at the byte level so every enclosing length stays as the client encoded
+// it.
+func rewriteGSSChecksum(credBytes []byte, apReq *messages.APReq, cfg Config, patch func(cksum []byte) []byte) ([]byte, error) {
 	sessionKey, err := resolveSessionKey(cfg, apReq)
 	if err != nil {
 		return nil, err
@@ -72,14 +88,12 @@ func rewriteKerberosChannelBindings(credBytes []byte, cfg Config, token []byte)
 	if authenticator.Cksum.CksumType != chksumtype.GSSAPI || len(cksum) < 4 {
 		return nil, nil
 	}
-	if binary.LittleEndian.Uint32(cksum[:4]) != gssChecksumBndLen || len(cksum) < 4+gssChecksumBndLen {
-		return nil, nil
-	}
-	if bytes.Equal(cksum[4:4+gssChecksumBndLen], token) {
+	newCksum := patch(cksum)
+	if newCksum == nil {
 		return nil, nil
 	}
 
-	patched, err := substituteOnce(plaintext, cksum, replaceBnd(cksum, token))
+	patched, err := substituteOnce(plaintext, cksum, newCksum)
 	if err != nil {
 		return nil, fmt.Errorf("locate GSS-API checksum in authenticator: %w", err)
 	}
@@ -294,7 +294,7 @@ func rewriteNTLMChannelBindings(credBytes []byte, cfg Config, token []byte, pend
 		return nil, nil
 	}
 
-	ntHash, haveHash := cfg.resolveNTHash()
+	ntHash, haveHash := cfg.ntHashFor(authMsg)
 	if !haveHash {
 		return nil, errors.New("no --decrypt-hash/--decrypt-password supplied")
 	}
@@ -369,23 +369,33 @@ func rewriteNTLMChannelBindings(credBytes []byte, cfg Config, token []byte, pend
 		return nil, err
 	}
 
-	if micOffset, present := ntlmMICOffset(newAuthMsg); present {
-		negotiateMsg, ok := findNTLMMessage(pending, 1)
-		if !ok {
-			return nil, errors.New("AUTHENTICATE_MESSAGE carries a MIC but no NEGOTIATE_MESSAGE was observed")
-		}
-		// MS-NLMP §3.1.5.1.2: the MIC covers the three messages concatenated,
-		// with its own bytes zeroed while it is computed.
-		for i := micOffset; i < micOffset+16; i++ {
-			newAuthMsg[i] = 0
-		}
-		mic := hmacMD5(exportedSessionKey, concatBytes(negotiateMsg, challengeMsg, newAuthMsg))
-		copy(newAuthMsg[micOffset:micOffset+16], mic)
+	if err := signNTLMMIC(newAuthMsg, exportedSessionKey, challengeMsg, pending); err != nil {
+		return nil, err
 	}
 
 	return replaceNTLMMessage(credBytes, newAuthMsg)
 }
 
+// signNTLMMIC recomputes authMsg's MIC in place, if it carries one.
+func signNTLMMIC(authMsg, exportedSessionKey, challengeMsg []byte, pending [][]byte) error {
+	micOffset, present := ntlmMICOffset(authMsg)
+	if !present {
+		return nil
+	}
+	negotiateMsg, ok := findNTLMMessage(pending, 1)
+	if !ok {
+		return errors.New("AUTHENTICATE_MESSAGE carries a MIC but no NEGOTIATE_MESSAGE was observed")
+	}
+	// MS-NLMP §3.1.5.1.2: the MIC covers the three messages concatenated,
+	// with its own bytes zeroed while it is computed.
+	for i := micOffset; i < micOffset+16; i++ {
+		authMsg[i] = 0
+	}
+	mic := hmacMD5(exportedSessionKey, concatBytes(negotiateMsg, challengeMsg, authMsg))
+	copy(authMsg[micOffset:micOffset+16], mic)
+	return nil
+}
+
 func rc4Crypt(key, data []byte) ([]byte, error) {
 	c, err := rc4.NewCipher(key)
 	if err != nil {
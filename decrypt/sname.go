@@ -0,0 +1,172 @@
+package decrypt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Macmod/ldapx/log"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/oiweiwei/gokrb5.fork/v9/types"
+)
+
+// Service name substitution (--rewrite-sname). A ticket's sname sits
+// outside its encrypted part and nothing signs it, so a ticket issued for
+// one SPN can be presented for another: AD accepts it as long as both SPNs
+// belong to the account whose key encrypted the ticket, e.g. a cifs/dc01
+// ticket used as ldap/dc01. The new name may differ in length, so every
+// enclosing DER length is re-encoded around it.
+
+// ParseSName parses an --rewrite-sname value as a service principal name,
+// ignoring any @REALM suffix.
+func ParseSName(spn string) ([]string, error) {
+	spn, _, _ = strings.Cut(spn, "@")
+	parts := strings.Split(spn, "/")
+	if len(parts) < 2 || slices.Contains(parts, "") {
+		return nil, fmt.Errorf("invalid SPN '%s' (expected service/host)", spn)
+	}
+	return parts, nil
+}
+
+// RewriteBindSName substitutes cfg.SName for the sname of the ticket in a
+// Kerberos BindRequest. Returns the original packet unchanged when no
+// substitution is configured, the ticket already names it, or on failure.
+func RewriteBindSName(packet *ber.Packet, cfg Config) *ber.Packet {
+	if len(cfg.SName) == 0 {
+		return packet
+	}
+
+	auth, carrier, credBytes, ok := bindCreds(packet)
+	if !ok || len(credBytes) == 0 || (carrier.mech != "GSSAPI" && carrier.mech != "GSS-SPNEGO") {
+		return packet
+	}
+	apReq, err := apReqFromBindCreds(credBytes)
+	if err != nil {
+		return packet
+	}
+
+	sname := apReq.Ticket.SName
+	if strings.EqualFold(sname.PrincipalNameString(), strings.Join(cfg.SName, "/")) {
+		return packet
+	}
+	newSName := types.PrincipalName{NameType: sname.NameType, NameString: cfg.SName}
+
+	newCreds, err := replaceSName(credBytes, sname, newSName)
+	if err != nil {
+		log.Log.Print(failColor.Sprintf("[-] Service name of the %s ticket could not be rewritten: %v", carrier.label(), err))
+		return packet
+	}
+
+	carrier.write(packet, auth, newCreds)
+	log.Log.Print(decryptColor.Sprintf("[+] Ticket for %s presented as %s in the %s bind", sname.PrincipalNameString(), newSName.PrincipalNameString(), carrier.label()))
+	return packet
+}
+
+// replaceSName swaps the DER encoding of old for that of new in a bind's
+// credentials, requiring old's to occur exactly once.
+func replaceSName(credBytes []byte, old, new types.PrincipalName) ([]byte, error) {
+	oldDER, err := asn1.Marshal(old)
+	if err != nil {
+		return nil, err
+	}
+	newDER, err := asn1.Marshal(new)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := bytes.Index(credBytes, oldDER)
+	if idx < 0 {
+		return nil, errors.New("sname not found in the credentials")
+	}
+	if bytes.Contains(credBytes[idx+1:], oldDER) {
+		return nil, errors.New("sname found more than once in the credentials")
+	}
+	return spliceDER(credBytes, idx, idx+len(oldDER), newDER)
+}
+
+// spliceDER replaces b[start:end], which must be a whole TLV nested
+// somewhere in the sequence of TLVs b holds, with repl, re-encoding the
+// length of every TLV enclosing it. Primitive values are descended into as
+// well, since an OCTET STRING may carry DER of its own (as SPNEGO's
+// mechToken does).
+func spliceDER(b []byte, start, end int, repl []byte) ([]byte, error) {
+	out := make([]byte, 0, len(b)+len(repl)-(end-start))
+	for off := 0; off < len(b); {
+		idLen, hdrLen, contentLen, err := derHeader(b[off:])
+		if err != nil {
+			return nil, err
+		}
+		contentStart := off + hdrLen
+		tlvEnd := contentStart + contentLen
+
+		switch {
+		case start == off && end == tlvEnd:
+			out = append(out, repl...)
+		case start >= contentStart && end <= tlvEnd:
+			inner, err := spliceDER(b[contentStart:tlvEnd], start-contentStart, end-contentStart, repl)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, b[off:off+idLen]...)
+			out = append(out, derLength(len(inner))...)
+			out = append(out, inner...)
+		case start < tlvEnd && end > off:
+			return nil, errors.New("replaced range straddles a TLV boundary")
+		default:
+			out = append(out, b[off:tlvEnd]...)
+		}
+		off = tlvEnd
+	}
+	return out, nil
+}
+
+// derHeader parses the identifier and length octets of the TLV at the
+// start of b.
+func derHeader(b []byte) (idLen, hdrLen, contentLen int, err error) {
+	if len(b) < 2 {
+		return 0, 0, 0, errors.New("truncated TLV")
+	}
+	idLen = 1
+	if b[0]&0x1f == 0x1f {
+		for idLen < len(b) && b[idLen]&0x80 != 0 {
+			idLen++
+		}
+		idLen++
+	}
+	if idLen >= len(b) {
+		return 0, 0, 0, errors.New("truncated TLV identifier")
+	}
+
+	hdrLen = idLen + 1
+	if l := b[idLen]; l < 0x80 {
+		contentLen = int(l)
+	} else {
+		n := int(l & 0x7f)
+		if n == 0 || n > 4 || idLen+1+n > len(b) {
+			return 0, 0, 0, errors.New("unsupported TLV length")
+		}
+		for _, c := range b[idLen+1 : idLen+1+n] {
+			contentLen = contentLen<<8 | int(c)
+		}
+		hdrLen += n
+	}
+	if hdrLen+contentLen > len(b) {
+		return 0, 0, 0, errors.New("TLV extends past the end of its parent")
+	}
+	return idLen, hdrLen, contentLen, nil
+}
+
+// derLength encodes a DER length.
+func derLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var digits []byte
+	for ; n > 0; n >>= 8 {
+		digits = append([]byte{byte(n)}, digits...)
+	}
+	return append([]byte{0x80 | byte(len(digits))}, digits...)
+}
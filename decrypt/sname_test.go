@@ -0,0 +1,239 @@
+package decrypt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/oiweiwei/gokrb5.fork/v9/asn1tools"
+	"github.com/oiweiwei/gokrb5.fork/v9/gssapi"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/etypeID"
+	"github.com/oiweiwei/gokrb5.fork/v9/iana/nametype"
+	"github.com/oiweiwei/gokrb5.fork/v9/messages"
+	"github.com/oiweiwei/gokrb5.fork/v9/spnego"
+	"github.com/oiweiwei/gokrb5.fork/v9/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// tlv encodes a DER TLV of the given identifier octet around content.
+func tlv(id byte, content ...[]byte) []byte {
+	c := concatBytes(content...)
+	return concatBytes([]byte{id}, derLength(len(c)), c)
+}
+
+func TestDERLength(t *testing.T) {
+	testCases := []struct {
+		n        int
+		expected []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x81, 0x80}},
+		{255, []byte{0x81, 0xff}},
+		{256, []byte{0x82, 0x01, 0x00}},
+		{65535, []byte{0x82, 0xff, 0xff}},
+		{65536, []byte{0x83, 0x01, 0x00, 0x00}},
+	}
+
+	for _, tc := range testCases {
+		encoded := derLength(tc.n)
+		assert.Equal(t, tc.expected, encoded, "length %d", tc.n)
+
+		// and derHeader reads it back
+		b := concatBytes([]byte{0x04}, encoded, make([]byte, tc.n))
+		idLen, hdrLen, contentLen, err := derHeader(b)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, idLen)
+		assert.Equal(t, 1+len(encoded), hdrLen)
+		assert.Equal(t, tc.n, contentLen)
+	}
+}
+
+func TestDERHeaderErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x30},
+		{0x30, 0x05, 0x00},
+		{0x30, 0x80},
+		{0x30, 0x85, 0x01, 0x00, 0x00, 0x00, 0x00},
+		{0x30, 0x82, 0x01},
+		{0x7f, 0x81},
+	} {
+		_, _, _, err := derHeader(b)
+		assert.Error(t, err, "% x", b)
+	}
+}
+
+func TestSpliceDER(t *testing.T) {
+	// value is a replaceable TLV of n content bytes
+	value := func(n int) []byte {
+		return tlv(0x1b, bytes.Repeat([]byte{'a'}, n))
+	}
+	// nest puts v three levels deep, with siblings around it and an OCTET
+	// STRING carrying DER on the way, as SPNEGO's mechToken does
+	nest := func(v []byte, padding int) []byte {
+		inner := tlv(0x30, tlv(0x02, []byte{0x05}), v, tlv(0x04, bytes.Repeat([]byte{'p'}, padding)))
+		return concatBytes(
+			tlv(0x02, []byte{0x01}),
+			tlv(0xa0, tlv(0x04, tlv(0x60, inner))),
+			tlv(0x05),
+		)
+	}
+
+	testCases := []struct {
+		name       string
+		oldLen     int
+		newLen     int
+		padding    int
+		wantHeader []byte // header of the outermost parent after the splice
+	}{
+		{name: "Same length", oldLen: 10, newLen: 10, padding: 10},
+		{name: "Short lengths", oldLen: 10, newLen: 3, padding: 10},
+		{name: "Crossing 127 to 128", oldLen: 10, newLen: 30, padding: 90},
+		{name: "Crossing 128 to 127", oldLen: 30, newLen: 10, padding: 90},
+		{name: "Crossing 255 to 256", oldLen: 10, newLen: 40, padding: 200},
+		{name: "Crossing 256 to 255", oldLen: 40, newLen: 10, padding: 200},
+		{name: "Crossing both ways at once", oldLen: 5, newLen: 300, padding: 100},
+		{name: "Shrinking from long form", oldLen: 300, newLen: 5, padding: 100},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			old, repl := value(tc.oldLen), value(tc.newLen)
+			b := nest(old, tc.padding)
+			start := bytes.Index(b, old)
+			assert.GreaterOrEqual(t, start, 0)
+
+			out, err := spliceDER(b, start, start+len(old), repl)
+			assert.NoError(t, err)
+			// Every parent's length is re-encoded, as if built afresh
+			assert.Equal(t, nest(repl, tc.padding), out)
+		})
+	}
+
+	t.Run("Lengths around the boundaries", func(t *testing.T) {
+		for newLen := 100; newLen < 280; newLen++ {
+			b := nest(value(50), 0)
+			start := bytes.Index(b, value(50))
+			out, err := spliceDER(b, start, start+len(value(50)), value(newLen))
+			if !assert.NoError(t, err, "length %d", newLen) {
+				return
+			}
+			assert.Equal(t, nest(value(newLen), 0), out, "length %d", newLen)
+		}
+	})
+
+	t.Run("Range straddling a TLV", func(t *testing.T) {
+		b := nest(value(10), 10)
+		start := bytes.Index(b, value(10))
+		_, err := spliceDER(b, start+1, start+len(value(10))+2, value(3))
+		assert.Error(t, err)
+	})
+
+	t.Run("Truncated DER", func(t *testing.T) {
+		b := nest(value(10), 10)
+		start := bytes.Index(b, value(10))
+		_, err := spliceDER(b[:len(b)-3], start, start+len(value(10)), value(3))
+		assert.Error(t, err)
+	})
+}
+
+// testAPReqCreds builds GSSAPI bind credentials - an RFC 2743
+// InitialContextToken around an AP-REQ - for a ticket to sname whose
+// encrypted part is cipherLen bytes long, wrapped in SPNEGO if asked.
+func testAPReqCreds(t *testing.T, sname types.PrincipalName, cipherLen int, wrapSPNEGO bool) []byte {
+	t.Helper()
+	apReq := messages.APReq{
+		PVNO:    5,
+		MsgType: 14,
+		Ticket: messages.Ticket{
+			TktVNO:  5,
+			Realm:   "DRACO.LOCAL",
+			SName:   sname,
+			EncPart: types.EncryptedData{EType: etypeID.AES256_CTS_HMAC_SHA1_96, KVNO: 3, Cipher: bytes.Repeat([]byte{0xee}, cipherLen)},
+		},
+		EncryptedAuthenticator: types.EncryptedData{EType: etypeID.AES256_CTS_HMAC_SHA1_96, Cipher: bytes.Repeat([]byte{0xaa}, 40)},
+	}
+	apReq.APOptions = types.NewKrbFlags()
+	apReqBytes, err := apReq.Marshal()
+	assert.NoError(t, err)
+
+	oid, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	assert.NoError(t, err)
+	mechToken := asn1tools.AddASNAppTag(concatBytes(oid, []byte{0x01, 0x00}, apReqBytes), 0)
+	if !wrapSPNEGO {
+		return mechToken
+	}
+
+	negToken := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDKRB5.OID()},
+			MechTokenBytes: mechToken,
+		},
+	}
+	creds, err := negToken.Marshal()
+	assert.NoError(t, err)
+	return creds
+}
+
+func TestReplaceSName(t *testing.T) {
+	spn := func(s string) types.PrincipalName {
+		return types.NewPrincipalName(nametype.KRB_NT_SRV_INST, s)
+	}
+	longHost := strings.Repeat("a", 200) + ".draco.local"
+
+	testCases := []struct {
+		name      string
+		old, new  string
+		cipherLen int
+	}{
+		{name: "Same length", old: "cifs/dc01.draco.local", new: "ldap/dc01.draco.local", cipherLen: 50},
+		{name: "Shorter", old: "cifs/dc01.draco.local", new: "ldap/dc01", cipherLen: 50},
+		{name: "Longer", old: "cifs/dc01", new: "ldap/dc01.draco.local", cipherLen: 50},
+		{name: "Ticket length crossing 128", old: "cifs/dc01", new: "ldap/" + strings.Repeat("b", 40), cipherLen: 20},
+		{name: "Ticket length crossing 256", old: "cifs/dc01", new: "ldap/" + strings.Repeat("b", 40), cipherLen: 130},
+		{name: "Much longer", old: "cifs/dc01", new: "ldap/" + longHost, cipherLen: 1000},
+		{name: "Much shorter", old: "host/" + longHost, new: "ldap/dc01", cipherLen: 1000},
+	}
+
+	for _, tc := range testCases {
+		for _, wrapSPNEGO := range []bool{false, true} {
+			name := tc.name + " (GSSAPI)"
+			if wrapSPNEGO {
+				name = tc.name + " (GSS-SPNEGO)"
+			}
+			t.Run(name, func(t *testing.T) {
+				creds := testAPReqCreds(t, spn(tc.old), tc.cipherLen, wrapSPNEGO)
+				out, err := replaceSName(creds, spn(tc.old), spn(tc.new))
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				apReq, err := apReqFromBindCreds(out)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, tc.new, apReq.Ticket.SName.PrincipalNameString())
+				assert.Equal(t, "DRACO.LOCAL", apReq.Ticket.Realm)
+				assert.Equal(t, tc.cipherLen, len(apReq.Ticket.EncPart.Cipher))
+				assert.Equal(t, 40, len(apReq.EncryptedAuthenticator.Cipher))
+			})
+		}
+	}
+
+	t.Run("Name not found", func(t *testing.T) {
+		creds := testAPReqCreds(t, spn("cifs/dc01"), 50, false)
+		_, err := replaceSName(creds, spn("http/dc01"), spn("ldap/dc01"))
+		assert.Error(t, err)
+	})
+
+	t.Run("Name found twice", func(t *testing.T) {
+		old := spn("cifs/dc01")
+		oldDER, err := asn1.Marshal(old)
+		assert.NoError(t, err)
+		creds := tlv(0x30, oldDER, oldDER)
+		_, err = replaceSName(creds, old, spn("ldap/dc01"))
+		assert.Error(t, err)
+	})
+}
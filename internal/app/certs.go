@@ -0,0 +1,389 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Macmod/ldapx/log"
+	"github.com/Macmod/ldapx/parser"
+	"github.com/Macmod/ldapx/proxy"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// loadCertificate loads a certificate and its private key, as used by
+// --upstream-cert and --listener-ca. spec is a PKCS#12 file with an optional
+// ":password" suffix, or a PEM file with the certificate (and any chain),
+// whose key is either in the same file or in keyPath.
+func loadCertificate(spec, keyPath string) (tls.Certificate, error) {
+	path, password := spec, ""
+	if _, err := os.Stat(spec); err != nil {
+		if idx := strings.LastIndex(spec, ":"); idx > 0 {
+			path, password = spec[:idx], spec[idx+1:]
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("reading certificate file: %w", err)
+	}
+
+	var blocks []*pem.Block
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for rest := data; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			blocks = append(blocks, block)
+		}
+	} else {
+		blocks, err = pkcs12.ToPEM(data, password)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("decoding PKCS#12 (a PFX using AES encryption may need re-exporting with `openssl pkcs12 -legacy`): %w", err)
+		}
+	}
+
+	var certs []*x509.Certificate
+	var key crypto.PrivateKey
+	for _, block := range blocks {
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return tls.Certificate{}, fmt.Errorf("parsing certificate: %w", err)
+			}
+			certs = append(certs, cert)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && key == nil:
+			if key, err = parsePrivateKeyDER(block.Bytes); err != nil {
+				return tls.Certificate{}, err
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return tls.Certificate{}, fmt.Errorf("no certificate found in '%s'", path)
+	}
+	if key == nil {
+		if keyPath == "" {
+			return tls.Certificate{}, fmt.Errorf("no private key in '%s' and no key file given", path)
+		}
+		if key, err = loadPrivateKeyFromFile(keyPath); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	// The leaf is whichever certificate matches the key; the rest is chain
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return tls.Certificate{}, fmt.Errorf("unsupported private key type %T", key)
+	}
+	leaf := -1
+	for i, cert := range certs {
+		if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(cert.PublicKey) {
+			leaf = i
+			break
+		}
+	}
+	if leaf < 0 {
+		return tls.Certificate{}, fmt.Errorf("no certificate in '%s' matches the private key", path)
+	}
+
+	result := tls.Certificate{
+		Certificate: [][]byte{certs[leaf].Raw},
+		PrivateKey:  key,
+		Leaf:        certs[leaf],
+	}
+	for i, cert := range certs {
+		if i != leaf {
+			result.Certificate = append(result.Certificate, cert.Raw)
+		}
+	}
+	return result, nil
+}
+
+// cloneListenerCert builds the --listener-clone certificate: a copy of the
+// target's certificate identity, signed by the --listener-ca CA or by a
+// generated one, which is optionally exported for clients to trust.
+func cloneListenerCert(targetAddr, socksServer string, ldaps bool, caSpec, caKeyPath, caExport string) (tls.Certificate, error) {
+	target, err := fetchTargetCertificate(targetAddr, socksServer, ldaps)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("fetching the target's certificate: %w", err)
+	}
+
+	var ca tls.Certificate
+	if caSpec != "" {
+		if ca, err = loadCertificate(caSpec, caKeyPath); err != nil {
+			return tls.Certificate{}, fmt.Errorf("loading --listener-ca: %w", err)
+		}
+	} else if ca, err = generateCA(target); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	cert, err := cloneCertificate(target, ca)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Log.Printf("[+] Listener certificate cloned from the target: '%s' (valid until %s), signed by '%s'", target.Subject, target.NotAfter.Format("2006-01-02"), ca.Leaf.Subject)
+
+	if caExport != "" {
+		if err := exportCA(caExport, ca, caSpec == ""); err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Log.Printf("[+] Listener CA certificate exported to '%s'", caExport)
+	}
+	return cert, nil
+}
+
+// fetchTargetCertificate connects to the target and returns the certificate
+// it presents, over LDAPS or, for a plain LDAP target, after StartTLS.
+func fetchTargetCertificate(targetAddr, socksServer string, ldaps bool) (*x509.Certificate, error) {
+	conn, err := proxy.Dial(targetAddr, socksServer, ldaps, insecureTlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ldaps || !ok {
+		if tlsConn, err = startTLS(conn, targetAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("the target presented no certificate")
+	}
+	return state.PeerCertificates[0], nil
+}
+
+// startTLS upgrades a plain LDAP connection with the StartTLS extended
+// operation (RFC 4511 4.14).
+func startTLS(conn net.Conn, targetAddr string) (*tls.Conn, error) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationExtendedRequest, nil, "Extended Request")
+	op.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, "1.3.6.1.4.1.1466.20037", "Request Name"))
+	request := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(1), "MessageID"))
+	request.AppendChild(op)
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return nil, err
+	}
+
+	response, err := ber.ReadPacket(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Children) < 2 || response.Children[1].Tag != parser.ApplicationExtendedResponse || len(response.Children[1].Children) < 3 {
+		return nil, fmt.Errorf("unexpected response to StartTLS")
+	}
+	if code, _ := response.Children[1].Children[0].Value.(int64); code != 0 {
+		diag, _ := response.Children[1].Children[2].Value.(string)
+		return nil, fmt.Errorf("StartTLS failed with result code %d: %s", code, diag)
+	}
+
+	tlsCfg := insecureTlsConfig.Clone()
+	if host, _, err := net.SplitHostPort(targetAddr); err == nil && net.ParseIP(host) == nil {
+		tlsCfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsCfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Extensions a cloned certificate never copies from the target's: the ones
+// crypto/x509 generates from the template itself, and the CRL and AIA
+// pointers, which would lead clients to the real CA.
+var uncopiedExtensions = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14},                     // Subject Key Identifier
+	{2, 5, 29, 15},                     // Key Usage
+	{2, 5, 29, 17},                     // Subject Alternative Name
+	{2, 5, 29, 19},                     // Basic Constraints
+	{2, 5, 29, 31},                     // CRL Distribution Points
+	{2, 5, 29, 35},                     // Authority Key Identifier
+	{2, 5, 29, 37},                     // Extended Key Usage
+	{1, 3, 6, 1, 5, 5, 7, 1, 1},        // Authority Information Access
+	{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}, // Certificate Transparency SCTs
+}
+
+// cloneCertificate mints a certificate with the target's subject, SANs,
+// validity window, serial number, key usages, other extensions and key
+// type, signed by ca.
+func cloneCertificate(target *x509.Certificate, ca tls.Certificate) (tls.Certificate, error) {
+	key, err := generateKeyLike(target.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:       target.SerialNumber,
+		RawSubject:         target.RawSubject,
+		NotBefore:          target.NotBefore,
+		NotAfter:           target.NotAfter,
+		KeyUsage:           target.KeyUsage,
+		ExtKeyUsage:        target.ExtKeyUsage,
+		UnknownExtKeyUsage: target.UnknownExtKeyUsage,
+		DNSNames:           target.DNSNames,
+		IPAddresses:        target.IPAddresses,
+		EmailAddresses:     target.EmailAddresses,
+		URIs:               target.URIs,
+	}
+	for _, ext := range target.Extensions {
+		if !slices.ContainsFunc(uncopiedExtensions, ext.Id.Equal) {
+			tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, ext)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Leaf, key.(crypto.Signer).Public(), ca.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// generateCA creates a local CA named after the target certificate's
+// issuer, valid for at least as long as the target certificate and for a
+// year from now.
+func generateCA(target *x509.Certificate) (tls.Certificate, error) {
+	key, err := generateKeyLike(target.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serialLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	notBefore := time.Now().Add(-1 * time.Hour)
+	if target.NotBefore.Before(notBefore) {
+		notBefore = target.NotBefore
+	}
+	notAfter := time.Now().Add(365 * 24 * time.Hour)
+	if target.NotAfter.After(notAfter) {
+		notAfter = target.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		RawSubject:            target.RawIssuer,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	signer := key.(crypto.Signer)
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// generateKeyLike generates a private key of the same type and size as pub.
+func generateKeyLike(pub crypto.PublicKey) (crypto.PrivateKey, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.GenerateKey(rand.Reader, pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return ecdsa.GenerateKey(pub.Curve, rand.Reader)
+	case ed25519.PublicKey:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// exportCA writes the CA certificate as PEM to path and, when withKey is
+// set, its private key to path + ".key", so the same CA can be passed back
+// with --listener-ca on later runs.
+func exportCA(path string, ca tls.Certificate, withKey bool) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw})
+	if err := os.WriteFile(path, certPEM, 0644); err != nil {
+		return fmt.Errorf("writing CA certificate: %w", err)
+	}
+	if !withKey {
+		return nil
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(path+".key", keyPEM, 0600); err != nil {
+		return fmt.Errorf("writing CA key: %w", err)
+	}
+	return nil
+}
+
+// loadPrivateKeyFromFile reads a PEM-encoded private key from the given path
+// and returns it as a crypto.PrivateKey. Supports PKCS#8 (the default for
+// openssl, modern ECDSA/Ed25519), EC SEC 1 (openssl ec), and RSA PKCS#1
+// (openssl rsa) formats.
+func loadPrivateKeyFromFile(path string) (crypto.PrivateKey, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in key file")
+	}
+	return parsePrivateKeyDER(block.Bytes)
+}
+
+// parsePrivateKeyDER parses a DER private key in any of the formats
+// loadPrivateKeyFromFile accepts.
+func parsePrivateKeyDER(der []byte) (crypto.PrivateKey, error) {
+	// Try PKCS#8 first (most common — openssl default, ECDSA, Ed25519)
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	// Try EC SEC 1
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	// Try RSA PKCS#1
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key format (expected PKCS#8, EC SEC 1, or RSA PKCS#1 PEM)")
+}
@@ -1,197 +0,0 @@
-package app
-
-import (
-	"strconv"
-	"strings"
-
-	"github.com/Macmod/ldapx/middlewares"
-	attrentriesmid "github.com/Macmod/ldapx/middlewares/attrentries"
-	attrlistmid "github.com/Macmod/ldapx/middlewares/attrlist"
-	basednmid "github.com/Macmod/ldapx/middlewares/basedn"
-	filtermid "github.com/Macmod/ldapx/middlewares/filter"
-)
-
-// Taken from:
-// https://learn.microsoft.com/en-us/windows/win32/adschema/attributes-anr
-// (Windows Server 2012)
-var ANRSet = []string{
-	"name", "displayname", "samaccountname",
-	"givenname", "legacyexchangedn", "sn", "proxyaddresses",
-	"physicaldeliveryofficename", "msds-additionalsamaccountName",
-	"msds-phoneticcompanyname", "msds-phoneticdepartment",
-	"msds-phoneticdisplayname", "msds-phoneticfirstname",
-	"msds-phoneticlastname",
-}
-
-var (
-	baseDNMidMap      map[string]basednmid.BaseDNMiddleware
-	filterMidMap      map[string]filtermid.FilterMiddleware
-	attrListMidMap    map[string]attrlistmid.AttrListMiddleware
-	attrEntriesMidMap map[string]attrentriesmid.AttrEntriesMiddleware
-)
-
-var baseDNMidFlags map[rune]string = map[rune]string{
-	'O': "OIDAttribute",
-	'C': "Case",
-	'X': "HexValue",
-	'S': "Spacing",
-	'Q': "DoubleQuotes",
-	'U': "GUIDFormat",
-	'I': "SIDFormat",
-	'W': "WKGUIDFormat",
-}
-
-var filterMidFlags map[rune]string = map[rune]string{
-	'O': "OIDAttribute",
-	'C': "Case",
-	'X': "HexValue",
-	'S': "Spacing",
-	'T': "ReplaceTautologies",
-	't': "TimestampGarbage",
-	'B': "AddBool",
-	'D': "DblNegBool",
-	'M': "DeMorganBool",
-	'R': "ReorderBool",
-	'b': "ExactBitwiseBreakout",
-	'd': "BitwiseDecomposition",
-	'I': "EqInclusion",
-	'E': "EqExclusion",
-	'G': "Garbage",
-	'A': "EqApproxMatch",
-	'x': "EqExtensible",
-	'Z': "PrependZeros",
-	's': "SubstringSplit",
-	'N': "NamesToANR",
-	'n': "ANRGarbageSubstring",
-	'P': "DNAttributesNoise",
-	'L': "TransitiveEval",
-	'F': "ObjectCategoryForm",
-	'U': "IgnorableUnicode",
-	'W': "AltSpace",
-}
-
-var attrListMidFlags map[rune]string = map[rune]string{
-	'O': "OIDAttribute",
-	'C': "Case",
-	'D': "Duplicate",
-	'G': "GarbageNonExisting",
-	'g': "GarbageExisting",
-	'W': "ReplaceWithWildcard",
-	'w': "AddWildcard",
-	'p': "AddPlus",
-	'E': "ReplaceWithEmpty",
-	'R': "ReorderList",
-	'r': "Range",
-}
-
-var attrEntriesMidFlags map[rune]string = map[rune]string{
-	'O': "OIDAttribute",
-	'C': "Case",
-	/*
-		'D': "Duplicate",
-		'G': "GarbageNonExisting",
-		'g': "GarbageExisting",
-	*/
-	'R': "ReorderList",
-	'D': "Duplicate",
-}
-
-func SetupMiddlewaresMap() {
-	baseDNMidMap = map[string]basednmid.BaseDNMiddleware{
-		"OIDAttribute": basednmid.OIDAttributeBaseDNObf(optInt("BDNOIDAttributeMaxSpaces"), optInt("BDNOIDAttributeMaxZeros"), optBool("BDNOIDAttributeIncludePrefix")),
-		"Case":         basednmid.RandCaseBaseDNObf(optFloat("BDNCaseProb")),
-		"HexValue":     basednmid.RandHexValueBaseDNObf(optFloat("BDNHexValueProb")),
-		"Spacing":      basednmid.RandSpacingBaseDNObf(optInt("BDNSpacingMaxElems")),
-		"DoubleQuotes": basednmid.DoubleQuotesBaseDNObf(),
-		"GUIDFormat":   basednmid.GUIDBaseDNObf(optStr("BDNGuid"), optStr("BDNMatch")),
-		"SIDFormat":    basednmid.SIDBaseDNObf(optStr("BDNSid"), optStr("BDNMatch")),
-		"WKGUIDFormat": basednmid.WKGUIDFormatBaseDNObf(),
-	}
-
-	filterMidMap = map[string]filtermid.FilterMiddleware{
-		"OIDAttribute":         filtermid.OIDAttributeFilterObf(optInt("FiltOIDAttributeMaxSpaces"), optInt("FiltOIDAttributeMaxZeros"), optBool("FiltOIDAttributeIncludePrefix")),
-		"Case":                 filtermid.RandCaseFilterObf(optFloat("FiltCaseProb")),
-		"HexValue":             filtermid.RandHexValueFilterObf(optFloat("FiltHexValueProb")),
-		"Spacing":              filtermid.RandSpacingFilterObf(optInt("FiltSpacingMaxSpaces")),
-		"ReplaceTautologies":   filtermid.ReplaceTautologiesFilterObf(),
-		"TimestampGarbage":     filtermid.RandTimestampSuffixFilterObf(optInt("FiltTimestampGarbageMaxChars"), optStr("FiltGarbageCharset"), optBool("FiltTimestampGarbageUseComma")),
-		"AddBool":              filtermid.RandAddBoolFilterObf(optInt("FiltAddBoolMaxDepth"), optFloat("FiltAddBoolProb")),
-		"DblNegBool":           filtermid.RandDblNegBoolFilterObf(optInt("FiltDblNegBoolMaxDepth"), optFloat("FiltDblNegBoolProb")),
-		"DeMorganBool":         filtermid.DeMorganBoolFilterObf(),
-		"ReorderBool":          filtermid.RandBoolReorderFilterObf(),
-		"ExactBitwiseBreakout": filtermid.ExactBitwiseBreakoutFilterObf(),
-		"BitwiseDecomposition": filtermid.BitwiseDecomposeFilterObf(optInt("FiltBitwiseDecompositionMaxBits")),
-		"EqInclusion":          filtermid.EqualityByInclusionFilterObf(),
-		"EqExclusion":          filtermid.EqualityByExclusionFilterObf(),
-		"Garbage":              filtermid.RandGarbageFilterObf(optInt("FiltGarbageMaxElems"), optInt("FiltGarbageMaxSize"), optStr("FiltGarbageCharset")),
-		"EqApproxMatch":        filtermid.EqualityToApproxMatchFilterObf(),
-		"EqExtensible":         filtermid.EqualityToExtensibleFilterObf(optBool("FiltEqExtensibleAppendDN")),
-		"PrependZeros":         filtermid.RandPrependZerosFilterObf(optInt("FiltPrependZerosMaxElems")),
-		"SubstringSplit":       filtermid.RandSubstringSplitFilterObf(optFloat("FiltSubstringSplitProb")),
-		"NamesToANR":           filtermid.ANRAttributeFilterObf(ANRSet),
-		"ANRGarbageSubstring":  filtermid.ANRSubstringGarbageFilterObf(optInt("FiltANRSubstringMaxElems"), optStr("FiltGarbageCharset")),
-		"DNAttributesNoise":    filtermid.RandDNAttributesNoiseFilterObf(optFloat("FiltDNAttrNoiseProb")),
-		"TransitiveEval":       filtermid.TransitiveEvalFilterObf(),
-		"ObjectCategoryForm":   filtermid.ObjectCategoryFormFilterObf(optStr("FiltObjCategoryRootDN")),
-		"IgnorableUnicode":     filtermid.RandIgnorableUnicodeFilterObf(optFloat("FiltIgnorableUnicodeProb"), optStr("FiltIgnorableUnicodeMode")),
-		"AltSpace":             filtermid.RandAltSpaceFilterObf(optFloat("FiltAltSpaceProb")),
-	}
-
-	attrListMidMap = map[string]attrlistmid.AttrListMiddleware{
-		"OIDAttribute":        attrlistmid.OIDAttributeAttrListObf(optInt("AttrsOIDAttributeMaxSpaces"), optInt("AttrsOIDAttributeMaxZeros"), optBool("AttrsOIDAttributeIncludePrefix")),
-		"Case":                attrlistmid.RandCaseAttrListObf(optFloat("AttrsCaseProb")),
-		"Duplicate":           attrlistmid.DuplicateAttrListObf(optFloat("AttrsDuplicateProb")),
-		"GarbageNonExisting":  attrlistmid.GarbageNonExistingAttrListObf(optInt("AttrsGarbageNonExistingMaxElems"), optInt("AttrsGarbageNonExistingMaxSize"), optStr("AttrsGarbageCharset")),
-		"GarbageExisting":     attrlistmid.GarbageExistingAttrListObf(optInt("AttrsGarbageExistingMaxElems")),
-		"ReplaceWithWildcard": attrlistmid.ReplaceWithWildcardAttrListObf(),
-		"AddWildcard":         attrlistmid.AddWildcardAttrListObf(),
-		"AddPlus":             attrlistmid.AddPlusAttrListObf(),
-		"ReplaceWithEmpty":    attrlistmid.ReplaceWithEmptyAttrListObf(),
-		"ReorderList":         attrlistmid.ReorderListAttrListObf(),
-		"Range":               attrlistmid.RangeAttrListObf(optStr("AttrsRangeOption")),
-	}
-
-	attrEntriesMidMap = map[string]attrentriesmid.AttrEntriesMiddleware{
-		"OIDAttribute": attrentriesmid.OIDAttributeAttrEntriesObf(optInt("AttrEntriesOIDAttributeMaxSpaces"), optInt("AttrEntriesOIDAttributeMaxZeros"), optBool("AttrEntriesOIDAttributeIncludePrefix")),
-		"Case":         attrentriesmid.RandCaseAttrEntriesObf(optFloat("AttrEntriesCaseProb")),
-		"ReorderList":  attrentriesmid.ReorderListAttrEntriesObf(),
-	}
-}
-
-func optStr(key string) string {
-	if value, ok := options.Get(key); ok {
-		return value
-	}
-	return middlewares.DefaultOptions[key]
-}
-
-func optInt(key string) int {
-	if value, ok := options.Get(key); ok {
-		i, err := strconv.Atoi(value)
-		if err == nil {
-			return i
-		}
-	}
-
-	result, _ := strconv.Atoi(middlewares.DefaultOptions[key])
-	return result
-}
-
-func optFloat(key string) float64 {
-	if value, ok := options.Get(key); ok {
-		i, err := strconv.ParseFloat(value, 64)
-		if err == nil {
-			return i
-		}
-	}
-
-	result, _ := strconv.ParseFloat(middlewares.DefaultOptions[key], 64)
-	return result
-}
-
-func optBool(key string) bool {
-	if value, ok := options.Get(key); ok {
-		return strings.ToLower(value) == "true"
-	}
-	return strings.ToLower(middlewares.DefaultOptions[key]) == "true"
-}
@@ -1,7 +1,7 @@
 package app
 
 import (
-	"crypto"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -10,42 +10,22 @@ import (
 	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
 	"os"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/Macmod/ldapx/decrypt"
 	"github.com/Macmod/ldapx/log"
-	attrentriesmid "github.com/Macmod/ldapx/middlewares/attrentries"
-	attrlistmid "github.com/Macmod/ldapx/middlewares/attrlist"
-	basednmid "github.com/Macmod/ldapx/middlewares/basedn"
-	filtermid "github.com/Macmod/ldapx/middlewares/filter"
+	"github.com/Macmod/ldapx/proxy"
 	"github.com/fatih/color"
 	"github.com/spf13/pflag"
+	"h12.io/socks"
 )
 
-type Stats struct {
-	sync.Mutex
-	Forward struct {
-		PacketsReceived uint64
-		PacketsSent     uint64
-		BytesReceived   uint64
-		BytesSent       uint64
-		CountsByType    map[int]uint64
-	}
-	Reverse struct {
-		PacketsReceived uint64
-		PacketsSent     uint64
-		BytesReceived   uint64
-		BytesSent       uint64
-		CountsByType    map[int]uint64
-	}
-}
-
 var version = "v1.3.3"
 
 var green = color.New(color.FgGreen)
@@ -53,145 +33,43 @@ var red = color.New(color.FgRed)
 var yellow = color.New(color.FgYellow)
 var blue = color.New(color.FgBlue)
 
-// cyan/magenta distinguish which leg of the proxy a message belongs to:
-// cyan for forward/target-bound traffic (C->T), magenta for reverse/
-// client-bound traffic (C<-T) - both mid-brightness, legible on light and
-// dark terminal backgrounds alike, and distinct from the semantic
-// red/yellow/green above (error/warning/changed) so direction and outcome
-// are never visually conflated.
-var cyan = color.New(color.FgCyan)
-var magenta = color.New(color.FgMagenta)
-
 var insecureTlsConfig = &tls.Config{
 	InsecureSkipVerify: true,
 }
 
-// upstreamTlsConfig is used for outbound LDAPS connections to the target.
-// Defaults to insecureTlsConfig (no client cert). When --key is provided,
-// upstreamClientKey is set and handleLDAPConnection builds a per-connection
-// tls.Config using the peer certificate from the inbound client's TLS
-// handshake + this private key.
-var upstreamTlsConfig = insecureTlsConfig
-
-// upstreamClientKey is loaded from --key at startup. When non-nil,
-// handleLDAPConnection pairs it with the TLS peer certificate from the
-// connecting client to authenticate as a TLS client to the upstream server.
-var upstreamClientKey crypto.PrivateKey
-
-var globalStats Stats
-
-// RuntimeConfig holds thread-safe runtime configuration
-type RuntimeConfig struct {
-	sync.RWMutex
-	targetAddr        string
-	verbFwd           uint
-	verbRev           uint
-	ldaps             bool
-	socksServer       string
-	interceptSearch   bool
-	interceptModify   bool
-	interceptAdd      bool
-	interceptDelete   bool
-	interceptModifyDN bool
-
-	decryptCfg decrypt.Config
-
-	spoofMechs []string
-	spoofGiven bool
-
-	splitWrapped string // "in", "out", "both", or "" (default = bundled)
-
-	tracking bool
-
-	tlsCertFile     string
-	tlsKeyFile      string
-	listenerTls     bool
-	upstreamKeyFile string
+// tlsKeyLog receives the secrets of every TLS connection ldapx makes or
+// accepts, in the NSS key log format (--tls-keylog or $SSLKEYLOGFILE), for
+// decrypting a capture of them in Wireshark. Nil when not enabled.
+var tlsKeyLog io.Writer
+
+// proxyOpts is the configuration of the proxy, as given on the command
+// line. Run completes it with the upstream credentials and the KDC proxy
+// before creating px from it.
+var proxyOpts proxy.Options
+
+// px is the proxy instance driven by Run and the shell.
+var px *proxy.Proxy
+
+// startupConfig holds the command line settings that are only used while
+// setting up the listener and the upstream credentials.
+type startupConfig struct {
+	kdcProxyAddr   string
+	kdcProxyTarget string
+
+	tlsCertFile      string
+	tlsKeyFile       string
+	listenerTls      bool
+	listenerClone    bool
+	listenerCASpec   string
+	listenerCAKey    string
+	listenerCAExport string
+	upstreamKeyFile  string
+	upstreamCertSpec string
 }
 
-// InterceptFlags bundles all interception settings
-type InterceptFlags struct {
-	Search   bool
-	Modify   bool
-	Add      bool
-	Delete   bool
-	ModifyDN bool
-}
-
-// GetInterceptFlags returns all interception flags in a single lock
-func (rc *RuntimeConfig) GetInterceptFlags() InterceptFlags {
-	rc.RLock()
-	defer rc.RUnlock()
-	return InterceptFlags{
-		Search:   rc.interceptSearch,
-		Modify:   rc.interceptModify,
-		Add:      rc.interceptAdd,
-		Delete:   rc.interceptDelete,
-		ModifyDN: rc.interceptModifyDN,
-	}
-}
-
-// GetVerbosity returns forward and reverse verbosity levels in a single lock
-func (rc *RuntimeConfig) GetVerbosity() (fwd, rev uint) {
-	rc.RLock()
-	defer rc.RUnlock()
-	return rc.verbFwd, rc.verbRev
-}
-
-// GetConnectionConfig returns connection settings in a single lock
-func (rc *RuntimeConfig) GetConnectionConfig() (targetAddr, socksServer string, ldaps bool) {
-	rc.RLock()
-	defer rc.RUnlock()
-	return rc.targetAddr, rc.socksServer, rc.ldaps
-}
-
-// GetDecryptionConfig returns the configured --decrypt-* credential
-// source(s) (immutable after startup - decryption credentials aren't
-// exposed through the interactive shell).
-func (rc *RuntimeConfig) GetDecryptionConfig() decrypt.Config {
-	rc.RLock()
-	defer rc.RUnlock()
-	return rc.decryptCfg
-}
-
-// GetSplitWrapped returns the --split-wrapped policy: "in", "out", "both",
-// or "" for the default bundling behavior.
-func (rc *RuntimeConfig) GetSplitWrapped() string {
-	rc.RLock()
-	defer rc.RUnlock()
-	return rc.splitWrapped
-}
-
-// GetSpoofMechConfig returns --spoof-mechs's resolved value list and
-// whether the flag was given at all - these are different states, since
-// "not given" leaves supportedSASLMechanisms untouched.
-func (rc *RuntimeConfig) GetSpoofMechConfig() (mechs []string, given bool) {
-	rc.RLock()
-	defer rc.RUnlock()
-	return rc.spoofMechs, rc.spoofGiven
-}
-
-// GetTracking returns whether the tracking algorithm for paged search
-// cookie management is enabled.
-func (rc *RuntimeConfig) GetTracking() bool {
-	rc.RLock()
-	defer rc.RUnlock()
-	return rc.tracking
-}
-
-var runtimeConfig RuntimeConfig
-
-// Middleware chain pointers - accessed atomically for thread safety
-var (
-	filterChainPtr      atomic.Value // *filtermid.FilterMiddlewareChain
-	attrListChainPtr    atomic.Value // *attrlistmid.AttrListMiddlewareChain
-	baseDNChainPtr      atomic.Value // *basednmid.BaseDNMiddlewareChain
-	attrEntriesChainPtr atomic.Value // *attrentriesmid.AttrEntriesMiddlewareChain
-)
+var startup startupConfig
 
 var (
-	shutdownChan = make(chan struct{})
-
 	proxyLDAPAddr string
 	noShell       bool
 	noColors      bool
@@ -199,6 +77,14 @@ var (
 	attrChain     string
 	baseChain     string
 	entriesChain  string
+	controlsChain string
+	bindNameChain string
+	filterPool    string
+	attrPool      string
+	basePool      string
+	entriesPool   string
+	controlsPool  string
+	bindNamePool  string
 	options       MapFlag
 	outputFile    string
 	listener      net.Listener
@@ -206,7 +92,9 @@ var (
 
 func shutdownProgram() {
 	fmt.Println("Bye!")
-	close(shutdownChan)
+	if px != nil {
+		px.Close()
+	}
 	os.Exit(0)
 }
 
@@ -232,7 +120,7 @@ func (mf *MapFlag) Set(value string) error {
 	if len(parts) != 2 {
 		return fmt.Errorf("invalid option format: %s", value)
 	}
-	if err := validateOptionValue(parts[0], parts[1]); err != nil {
+	if err := proxy.ValidateOptionValue(parts[0], parts[1]); err != nil {
 		return err
 	}
 	if mf.m == nil {
@@ -275,14 +163,40 @@ func init() {
 		decryptCCache      string
 		decryptSvcKeySpec  string
 		decryptSalt        string
+		decryptStore       string
+		decryptImport      []string
+		decryptDigestHA1   []string
+		kdcProxy           string
+		kdcProxyTarget     string
+		captureCreds       string
+		tlsKeyLogFile      string
+		exportKeytab       string
+		downgradeLayer     string
+		rewriteSName       string
+		translateAuth      string
+		translateUser      string
+		translatePassword  string
+		translateHash      string
+		translateCCache    string
+		translateKDC       string
+		translateSPN       string
 		spoofMechRaw       []string
+		opChains           []string
 		splitWrapped       string
+		splitSearch        string
 		tracking           bool
-
-		listenerCert string
-		listenerKey  string
-		listenerTls  bool
-		upstreamKey  string
+		cache              bool
+
+		listenerCert     string
+		listenerKey      string
+		listenerTls      bool
+		listenerClone    bool
+		listenerCA       string
+		listenerCAKey    string
+		listenerCAExport string
+		upstreamKey      string
+		upstreamCert     string
+		upstreamExternal bool
 	)
 
 	pflag.StringVarP(&proxyLDAPAddr, "listen", "l", ":389", "Address & port to listen on for incoming LDAP connections")
@@ -293,11 +207,21 @@ func init() {
 	pflag.StringVarP(&socksServer, "socks", "x", "", "SOCKS proxy address")
 	pflag.BoolVarP(&noShell, "no-shell", "N", false, "Don't show the ldapx shell")
 	pflag.BoolVarP(&noColors, "no-colors", "Z", false, "Disable colored output")
-	pflag.StringVarP(&filterChain, "filter", "f", "", "Chain of search filter middlewares")
+	pflag.StringVarP(&filterChain, "filter", "f", "", "Chain of search filter middlewares, as letters optionally followed by inline parameters overriding their options (e.g. C(prob=0.3)X(prob=0.9)B(depth=2) - see the shell's help for each chain); any filter middleware also takes a scope parameter restricting it to some attributes (e.g. X(scope='memberOf,@sid'))")
 	pflag.StringVarP(&attrChain, "attrlist", "a", "", "Chain of attribute list middlewares")
 	pflag.StringVarP(&baseChain, "basedn", "b", "", "Chain of baseDN middlewares")
 	pflag.StringVarP(&entriesChain, "attrentries", "e", "", "Chain of attribute entries middlewares")
+	pflag.StringVarP(&controlsChain, "controls", "c", "", "Chain of request controls middlewares")
+	pflag.StringVarP(&bindNameChain, "bindname", "B", "", "Chain of bind name middlewares")
+	pflag.StringVarP(&filterPool, "filter-pool", "", "", "Pool of search filter chains to draw one from for each request, instead of -f, as comma-separated CHAIN:WEIGHT entries (e.g. ODR:3,XSB:1,TMx:1); an entry in braces, as {OCXSB}:2, draws a random subset of its middlewares in random order")
+	pflag.StringVarP(&attrPool, "attrlist-pool", "", "", "Pool of attribute list chains to draw from for each request, instead of -a (see --filter-pool)")
+	pflag.StringVarP(&basePool, "basedn-pool", "", "", "Pool of baseDN chains to draw from for each request, instead of -b (see --filter-pool)")
+	pflag.StringVarP(&entriesPool, "attrentries-pool", "", "", "Pool of attribute entries chains to draw from for each request, instead of -e (see --filter-pool)")
+	pflag.StringVarP(&controlsPool, "controls-pool", "", "", "Pool of request controls chains to draw from for each request, instead of -c (see --filter-pool)")
+	pflag.StringVarP(&bindNamePool, "bindname-pool", "", "", "Pool of bind name chains to draw from for each request, instead of -B (see --filter-pool)")
+	pflag.StringArrayVarP(&opChains, "op-chain", "", nil, "Chain of one operation as NAME=CHAIN, used instead of the -b or -e chain for it (basedn.search, basedn.modify, basedn.add, basedn.delete, basedn.modifydn.entry, basedn.modifydn.newrdn, basedn.modifydn.newsuperior, attrentries.modify or attrentries.add; an empty CHAIN leaves the operation untransformed) - can be given multiple times")
 	pflag.BoolVarP(&tracking, "tracking", "T", true, "Applies a tracking algorithm to avoid issues where complex middlewares + paged searches break LDAP cookies (may be memory intensive)")
+	pflag.BoolVarP(&cache, "cache", "", false, "Cache the results of successful searches and serve repeated identical searches from the cache")
 	pflag.BoolP("version", "v", false, "Show version information")
 	pflag.VarP(&options, "option", "o", "Configuration options (key=value)")
 	pflag.StringVarP(&outputFile, "output", "O", "", "Output file to write log messages")
@@ -306,21 +230,57 @@ func init() {
 	pflag.BoolVarP(&interceptAdd, "add", "A", false, "Intercept LDAP Add operations")
 	pflag.BoolVarP(&interceptDelete, "delete", "D", false, "Intercept LDAP Delete operations")
 	pflag.BoolVarP(&interceptModifyDN, "modifydn", "L", false, "Intercept LDAP ModifyDN operations")
+	pflag.StringVarP(&splitSearch, "split-search", "", "", "Split each search into sub-searches and merge their results. \"or\" splits top-level OR filters, \"attrs\" splits the attributes list, \"both\" splits both; needs --search (default: no splitting)")
 	pflag.StringVarP(&splitWrapped, "split-wrapped", "", "", "Split bundled wrapped messages into individual seal frames. \"in\" splits C->T direction, \"out\" splits T->C direction, \"both\" splits both (default: keep original bundling) - this flag is experimental and should not be used in general")
 
 	pflag.StringVarP(&decryptHash, "decrypt-hash", "", "", "NT hash of the account being proxied for NTLM decryption (Sicily, SASL/GSSAPI, or SASL/GSS-SPNEGO)")
 	pflag.StringVarP(&decryptPassword, "decrypt-password", "", "", "Password of the account being proxied for decryption (Sicily (NTLM), SASL/GSSAPI (NTLM), SASL/GSS-SPNEGO (NTLM), or SASL/DIGEST-MD5)")
-	pflag.StringVarP(&decryptCCache, "decrypt-ccache", "", "", "Path to a ccache file containing the service ticket (ST) used in the connection for Kerberos decryption (SASL/GSSAPI or SASL/GSS-SPNEGO)")
+	pflag.StringVarP(&decryptCCache, "decrypt-ccache", "", "", "Path to a ccache or .kirbi file containing the service ticket (ST) used in the connection for Kerberos decryption (SASL/GSSAPI or SASL/GSS-SPNEGO)")
 	pflag.StringVarP(&decryptSvcPassword, "decrypt-svc-password", "", "", "Password of the target LDAP service's own account for Kerberos decryption")
 	pflag.StringVarP(&decryptSvcKeySpec, "decrypt-svc-key", "", "", "Hex-encoded Kerberos key of the target LDAP service's own account for Kerberos decryption (32 bytes=AES256, 16=AES128 or RC4-HMAC; the actual type is taken from the observed ticket)")
 	pflag.StringVarP(&decryptSvcKeytab, "decrypt-svc-keytab", "", "", "Path to a keytab holding the target LDAP service's own account key for Kerberos decryption")
 	pflag.StringVarP(&decryptSalt, "decrypt-salt", "", "", "Overrides the salt used to derive an AES Kerberos key from --decrypt-svc-password (default: REALM + the ticket's own SPN)")
+	pflag.StringVarP(&decryptStore, "decrypt-store", "", "", "Path to a credential store file mapping accounts (DOMAIN\\user or UPN) to passwords/NT hashes and service principals to keys/keytabs, picked per bind from the identity observed in it")
+	pflag.StringArrayVarP(&decryptImport, "decrypt-import", "", nil, "Import decryption credentials from secretsdump/NTDS output (NT hashes, Kerberos keys, cleartext passwords), a .kirbi, a base64 KRB-CRED or a ccache - can be given multiple times")
+	pflag.StringArrayVarP(&decryptDigestHA1, "decrypt-digest-ha1", "", nil, "H(user:realm:password) of a DIGEST-MD5 account, as 'user:realm:hex' (what OpenLDAP-style servers store instead of the password), used in its place for SASL/DIGEST-MD5 decryption - can be given multiple times")
+	pflag.StringVarP(&kdcProxy, "kdc-proxy", "", "", "Address to listen on (TCP and UDP) as a KDC proxy that relays to the real KDC and learns the session keys of the tickets clients obtain through it, decrypting their AS-REPs with --decrypt-password/--decrypt-hash/--decrypt-store/--decrypt-import credentials (e.g. ':88')")
+	pflag.StringVarP(&kdcProxyTarget, "kdc-proxy-target", "", "", "KDC to relay --kdc-proxy requests to (default: the target host, port 88)")
+	pflag.StringVarP(&captureCreds, "capture-creds", "", "", "Append the credentials seen in binds to this file in crackable formats (simple bind DN:password, NetNTLMv1/v2, Kerberos $krb5tgs$, DIGEST-MD5), each tagged with its connection")
+	pflag.StringVarP(&tlsKeyLogFile, "tls-keylog", "", os.Getenv("SSLKEYLOGFILE"), "Append the secrets of the listener's and the upstream TLS connections to this file in the NSS key log format, for decrypting them in Wireshark (default: $SSLKEYLOGFILE)")
+	pflag.StringVarP(&exportKeytab, "export-keytab", "", "", "Write the Kerberos session and service keys learned while decrypting binds to this keytab file, for decrypting the Kerberos traffic in Wireshark")
+	pflag.StringVarP(&downgradeLayer, "downgrade-layer", "", "", "Rewrite NTLM and SASL/GSSAPI binds so client and target agree on a weaker post-bind security layer: \"sign\" (no sealing) or \"none\" - needs the --decrypt-* credential of the bind")
+	pflag.StringVarP(&rewriteSName, "rewrite-sname", "", "", "Rewrite the service name of the tickets in Kerberos binds to this SPN (e.g. 'ldap/dc01.draco.local'), so tickets for another service of the same account (cifs/, host/...) can be used for LDAP")
+	pflag.StringVarP(&translateAuth, "translate-auth", "", "", "Answer client binds locally and bind upstream as the --translate-user account instead, with \"ntlm\" or \"kerberos\" (sealed over LDAP, channel-bound over LDAPS)")
+	pflag.StringVarP(&translateUser, "translate-user", "", "", "Account for --translate-auth, as DOMAIN\\user or user@domain (Kerberos needs the DNS domain)")
+	pflag.StringVarP(&translatePassword, "translate-password", "", "", "Password of the --translate-user account")
+	pflag.StringVarP(&translateHash, "translate-hash", "", "", "NT hash of the --translate-user account (Kerberos then uses RC4-HMAC)")
+	pflag.StringVarP(&translateCCache, "translate-ccache", "", "", "Path to a ccache or .kirbi with a TGT or service ticket for --translate-auth kerberos")
+	pflag.StringVarP(&translateKDC, "translate-kdc", "", "", "KDC for --translate-auth kerberos (default: the target host, port 88)")
+	pflag.StringVarP(&translateSPN, "translate-spn", "", "", "SPN to request a ticket for with --translate-auth kerberos (default: ldap/<target host>)")
 	pflag.StringSliceVarP(&spoofMechRaw, "spoof-mechs", "", nil, "Comma-separated list of SASL mechanisms to report in the rootDSE's supportedSASLMechanisms (aliases: gssapi, spnego, external, digest-md5 - or an exact string to pass through verbatim; use 'none' - or an empty value, --spoof-mechs='' - to remove the attribute entirely)")
 
 	pflag.StringVarP(&listenerCert, "listener-cert", "", "", "Path to TLS server certificate PEM (enables TLS on the listener)")
 	pflag.StringVarP(&listenerKey, "listener-key", "", "", "Path to TLS server private key PEM")
 	pflag.BoolVarP(&listenerTls, "listener-tls", "", false, "Enable TLS on the listener with an in-memory self-signed certificate (alternative to --listener-cert/--listener-key)")
-	pflag.StringVarP(&upstreamKey, "key", "", "", "Path to the private key PEM for TLS client authentication to the upstream server (the matching certificate is taken from the connecting client's TLS handshake)")
+	pflag.BoolVarP(&listenerClone, "listener-clone", "", false, "Enable TLS on the listener with a copy of the target's certificate identity (subject, SANs, validity and key type), signed by --listener-ca or a generated local CA")
+	pflag.StringVarP(&listenerCA, "listener-ca", "", "", "CA to sign the --listener-clone certificate with, as ca.pfx[:password] or a PEM file (its key in the same file or in --listener-ca-key)")
+	pflag.StringVarP(&listenerCAKey, "listener-ca-key", "", "", "Path to the private key PEM of --listener-ca")
+	pflag.StringVarP(&listenerCAExport, "listener-ca-export", "", "", "Write the --listener-clone CA certificate to this PEM file so clients can trust it (a generated CA's key is written to the same path + \".key\")")
+	pflag.StringVarP(&upstreamKey, "key", "", "", "Path to the private key PEM for TLS client authentication to the upstream server (the matching certificate is taken from the connecting client's TLS handshake, or from --upstream-cert)")
+	pflag.StringVarP(&upstreamCert, "upstream-cert", "", "", "Client certificate to always present to the upstream server over LDAPS, as cert.pfx[:password] or a PEM file (its key in the same file or in --key)")
+	pflag.BoolVarP(&upstreamExternal, "upstream-external", "", false, "Answer client binds locally and bind each upstream connection with SASL EXTERNAL as the --upstream-cert principal")
+
+	pflag.StringVarP(&queryCfg.bindAuth, "bind-auth", "", "simple", "How queries (ldapx query and the shell's search command) bind to the target: \"simple\" (anonymous without --bind-user), \"ntlm\", \"kerberos\" (sealed over LDAP, channel-bound over LDAPS) or \"cert\" (SASL EXTERNAL as --upstream-cert)")
+	pflag.StringVarP(&queryCfg.bindUser, "bind-user", "", "", "Account to bind as for queries - a DN or UPN for simple binds, DOMAIN\\user or user@domain for NTLM/Kerberos (Kerberos needs the DNS domain)")
+	pflag.StringVarP(&queryCfg.bindPassword, "bind-password", "", "", "Password of the --bind-user account")
+	pflag.StringVarP(&queryCfg.bindHash, "bind-hash", "", "", "NT hash of the --bind-user account for NTLM/Kerberos binds (Kerberos then uses RC4-HMAC)")
+	pflag.StringVarP(&queryCfg.bindCCache, "bind-ccache", "", "", "Path to a ccache or .kirbi with a TGT or service ticket for --bind-auth kerberos")
+	pflag.StringVarP(&queryCfg.bindKDC, "bind-kdc", "", "", "KDC for --bind-auth kerberos (default: the target host, port 88)")
+	pflag.StringVarP(&queryCfg.bindSPN, "bind-spn", "", "", "SPN to request a ticket for with --bind-auth kerberos (default: ldap/<target host>)")
+	pflag.StringVarP(&queryCfg.base, "base", "", "", "Search base of ldapx query (default: the target's defaultNamingContext)")
+	pflag.StringVarP(&queryCfg.scope, "scope", "", "sub", "Search scope of queries: base, one or sub")
+	pflag.Uint32VarP(&queryCfg.pageSize, "page-size", "", 500, "Page size of queries, fetching every page with the paged results control (0 disables paging)")
+	pflag.StringVarP(&queryCfg.format, "format", "", "ldif", "Output format of queries: ldif or json")
 
 	// Initialize runtime config after parsing
 	pflag.Parse()
@@ -329,146 +289,155 @@ func init() {
 		color.NoColor = true
 	}
 
-	runtimeConfig.targetAddr = targetLDAPAddr
-	runtimeConfig.verbFwd = verbFwd
-	runtimeConfig.verbRev = verbRev
-	runtimeConfig.ldaps = ldaps
-	runtimeConfig.socksServer = socksServer
-	runtimeConfig.interceptSearch = interceptSearch
-	runtimeConfig.interceptModify = interceptModify
-	runtimeConfig.interceptAdd = interceptAdd
-	runtimeConfig.interceptDelete = interceptDelete
-	runtimeConfig.interceptModifyDN = interceptModifyDN
+	proxyOpts.Target = targetLDAPAddr
+	proxyOpts.VerbFwd = verbFwd
+	proxyOpts.VerbRev = verbRev
+	proxyOpts.LDAPS = ldaps
+	proxyOpts.SOCKS = socksServer
+	proxyOpts.Intercept = proxy.InterceptFlags{
+		Search:   interceptSearch,
+		Modify:   interceptModify,
+		Add:      interceptAdd,
+		Delete:   interceptDelete,
+		ModifyDN: interceptModifyDN,
+	}
 
-	decryptCfg, err := decrypt.ResolveConfig(decryptHash, decryptPassword, decryptSvcPassword, decryptSvcKeytab, decryptCCache, decryptSvcKeySpec, decryptSalt)
+	decryptCfg, err := decrypt.ResolveConfig(decryptHash, decryptPassword, decryptSvcPassword, decryptSvcKeytab, decryptCCache, decryptSvcKeySpec, decryptSalt, decryptStore, decryptImport)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
-	runtimeConfig.decryptCfg = decryptCfg
-
-	runtimeConfig.spoofGiven = pflag.Lookup("spoof-mechs").Changed
-	runtimeConfig.spoofMechs = spoofMechRaw
-	runtimeConfig.splitWrapped = splitWrapped
-	runtimeConfig.tracking = tracking
-
-	runtimeConfig.tlsCertFile = listenerCert
-	runtimeConfig.tlsKeyFile = listenerKey
-	runtimeConfig.listenerTls = listenerTls
-	runtimeConfig.upstreamKeyFile = upstreamKey
-
-	pflag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		pflag.PrintDefaults()
+	if captureCreds != "" {
+		decryptCfg.Capture, err = decrypt.OpenCredentialCapture(captureCreds)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
 	}
-
-	globalStats.Forward.CountsByType = make(map[int]uint64)
-	globalStats.Reverse.CountsByType = make(map[int]uint64)
-
-}
-func updateFilterChain(chain string) error {
-	if err := validateFilterChain(chain); err != nil {
-		return err
+	if exportKeytab != "" {
+		decryptCfg.KeytabExport, err = decrypt.OpenKeytabExport(exportKeytab)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--export-keytab: %v\n", err)
+			os.Exit(1)
+		}
 	}
-
-	filterChain = chain
-	newChain := &filtermid.FilterMiddlewareChain{}
-	for _, c := range filterChain {
-		if middlewareName, exists := filterMidFlags[rune(c)]; exists {
-			newChain.Add(filtermid.FilterMiddlewareDefinition{
-				Name: middlewareName,
-				Func: func() filtermid.FilterMiddleware { return filterMidMap[middlewareName] },
-			})
+	if tlsKeyLogFile != "" {
+		f, err := os.OpenFile(tlsKeyLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--tls-keylog: %v\n", err)
+			os.Exit(1)
 		}
+		tlsKeyLog = f
+		insecureTlsConfig.KeyLogWriter = f
+		proxyOpts.KeyLogWriter = f
 	}
-	filterChainPtr.Store(newChain)
-	return nil
-}
-
-func getFilterChain() *filtermid.FilterMiddlewareChain {
-	if chain := filterChainPtr.Load(); chain != nil {
-		return chain.(*filtermid.FilterMiddlewareChain)
+	for _, spec := range decryptDigestHA1 {
+		ha1, err := decrypt.ParseDigestHA1(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--decrypt-digest-ha1: %v\n", err)
+			os.Exit(1)
+		}
+		decryptCfg.DigestHA1 = append(decryptCfg.DigestHA1, ha1)
 	}
-	return &filtermid.FilterMiddlewareChain{}
-}
-
-func updateBaseDNChain(chain string) error {
-	if err := validateBaseDNChain(chain); err != nil {
-		return err
+	decryptCfg.Downgrade, err = decrypt.ParseDowngradeLayer(downgradeLayer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--downgrade-layer: %v\n", err)
+		os.Exit(1)
 	}
-
-	baseChain = chain
-	newChain := &basednmid.BaseDNMiddlewareChain{}
-	for _, c := range baseChain {
-		if middlewareName, exists := baseDNMidFlags[rune(c)]; exists {
-			newChain.Add(basednmid.BaseDNMiddlewareDefinition{
-				Name: middlewareName,
-				Func: func() basednmid.BaseDNMiddleware { return baseDNMidMap[middlewareName] },
-			})
+	if rewriteSName != "" {
+		decryptCfg.SName, err = decrypt.ParseSName(rewriteSName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--rewrite-sname: %v\n", err)
+			os.Exit(1)
 		}
 	}
-	baseDNChainPtr.Store(newChain)
-	return nil
-}
-
-func getBaseDNChain() *basednmid.BaseDNMiddlewareChain {
-	if chain := baseDNChainPtr.Load(); chain != nil {
-		return chain.(*basednmid.BaseDNMiddlewareChain)
-	}
-	return &basednmid.BaseDNMiddlewareChain{}
-}
+	proxyOpts.Decrypt = decryptCfg
 
-func updateAttrListChain(chain string) error {
-	if err := validateChainRunes(chain, attrListMidFlags); err != nil {
-		return err
+	proxyOpts.Translate, err = decrypt.ResolveTranslateConfig(translateAuth, translateUser, translatePassword, translateHash, translateCCache, translateKDC, translateSPN)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
 
-	attrChain = chain
-	newChain := &attrlistmid.AttrListMiddlewareChain{}
-	for _, c := range attrChain {
-		if middlewareName, exists := attrListMidFlags[rune(c)]; exists {
-			newChain.Add(attrlistmid.AttrListMiddlewareDefinition{
-				Name: middlewareName,
-				Func: func() attrlistmid.AttrListMiddleware { return attrListMidMap[middlewareName] },
-			})
+	for _, spec := range opChains {
+		name, chain, ok := strings.Cut(spec, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "--op-chain: expected NAME=CHAIN, got '%s'\n", spec)
+			os.Exit(1)
+		}
+		if proxyOpts.OperationChains == nil {
+			proxyOpts.OperationChains = make(map[string]string)
 		}
+		proxyOpts.OperationChains[name] = chain
+	}
+
+	proxyOpts.SpoofMechsSet = pflag.Lookup("spoof-mechs").Changed
+	proxyOpts.SpoofMechs = spoofMechRaw
+	proxyOpts.SplitWrapped = splitWrapped
+	proxyOpts.SplitSearch = splitSearch
+	proxyOpts.Tracking = tracking
+	proxyOpts.Cache = cache
+	proxyOpts.UpstreamExternal = upstreamExternal
+
+	startup.kdcProxyAddr = kdcProxy
+	startup.kdcProxyTarget = kdcProxyTarget
+
+	startup.tlsCertFile = listenerCert
+	startup.tlsKeyFile = listenerKey
+	startup.listenerTls = listenerTls
+	startup.listenerClone = listenerClone
+	startup.listenerCASpec = listenerCA
+	startup.listenerCAKey = listenerCAKey
+	startup.listenerCAExport = listenerCAExport
+	startup.upstreamKeyFile = upstreamKey
+	startup.upstreamCertSpec = upstreamCert
+
+	if upstreamCert != "" && !ldaps {
+		fmt.Fprintf(os.Stderr, "--upstream-cert requires --ldaps\n")
+		os.Exit(1)
 	}
-	attrListChainPtr.Store(newChain)
-	return nil
-}
-
-func getAttrListChain() *attrlistmid.AttrListMiddlewareChain {
-	if chain := attrListChainPtr.Load(); chain != nil {
-		return chain.(*attrlistmid.AttrListMiddlewareChain)
+	if upstreamExternal && upstreamCert == "" {
+		fmt.Fprintf(os.Stderr, "--upstream-external requires --upstream-cert\n")
+		os.Exit(1)
 	}
-	return &attrlistmid.AttrListMiddlewareChain{}
-}
-
-func updateAttrEntriesChain(chain string) error {
-	if err := validateChainRunes(chain, attrEntriesMidFlags); err != nil {
-		return err
+	if listenerClone && (listenerCert != "" || listenerKey != "" || listenerTls) {
+		fmt.Fprintf(os.Stderr, "--listener-clone can't be combined with --listener-cert, --listener-key or --listener-tls\n")
+		os.Exit(1)
+	}
+	if !listenerClone && (listenerCA != "" || listenerCAKey != "" || listenerCAExport != "") {
+		fmt.Fprintf(os.Stderr, "--listener-ca, --listener-ca-key and --listener-ca-export require --listener-clone\n")
+		os.Exit(1)
+	}
+	if upstreamExternal && proxyOpts.Translate != nil {
+		fmt.Fprintf(os.Stderr, "--upstream-external and --translate-auth are mutually exclusive\n")
+		os.Exit(1)
+	}
+	if (downgradeLayer != "" || rewriteSName != "") && (proxyOpts.Translate != nil || upstreamExternal) {
+		fmt.Fprintf(os.Stderr, "--downgrade-layer and --rewrite-sname have no effect with --translate-auth or --upstream-external, which answer client binds locally\n")
+		os.Exit(1)
 	}
 
-	entriesChain = chain
-	newChain := &attrentriesmid.AttrEntriesMiddlewareChain{}
-	for _, c := range entriesChain {
-		if middlewareName, exists := attrEntriesMidFlags[rune(c)]; exists {
-			newChain.Add(attrentriesmid.AttrEntriesMiddlewareDefinition{
-				Name: middlewareName,
-				Func: func() attrentriesmid.AttrEntriesMiddleware { return attrEntriesMidMap[middlewareName] },
-			})
-		}
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s query [OPTIONS] [FILTER] [ATTRIBUTES...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		pflag.PrintDefaults()
 	}
-	attrEntriesChainPtr.Store(newChain)
-	return nil
+
 }
 
-func getAttrEntriesChain() *attrentriesmid.AttrEntriesMiddlewareChain {
-	if chain := attrEntriesChainPtr.Load(); chain != nil {
-		return chain.(*attrentriesmid.AttrEntriesMiddlewareChain)
+// startKDCProxy starts the --kdc-proxy listener, relaying to upstream the
+// same way LDAP traffic reaches the target (through --socks if set).
+func startKDCProxy(cfg decrypt.Config, listenAddr, upstream, socksServer string) (*decrypt.KDCProxy, error) {
+	dial := net.Dial
+	if socksServer != "" {
+		dial = socks.Dial(socksServer)
+	}
+	kdcProxy := decrypt.NewKDCProxy(cfg, upstream, dial)
+	if err := kdcProxy.Listen(listenAddr); err != nil {
+		return nil, err
 	}
-	return &attrentriesmid.AttrEntriesMiddlewareChain{}
+	return kdcProxy, nil
 }
 
 // generateSelfSignedCert creates an in-memory ECDSA P256 self-signed
@@ -522,84 +491,92 @@ func Run() {
 	}
 
 	log.InitLog(outputFile)
+	proxyOpts.Logger = log.Log
+	proxyOpts.Output = os.Stdout
 
-	SetupMiddlewaresMap()
-
-	// Validate and register middleware chains.
-	var startupErrors []string
-	if err := updateFilterChain(filterChain); err != nil {
-		startupErrors = append(startupErrors, fmt.Sprintf("filter: %v", err))
-	}
-	if err := updateBaseDNChain(baseChain); err != nil {
-		startupErrors = append(startupErrors, fmt.Sprintf("basedn: %v", err))
-	}
-	if err := updateAttrListChain(attrChain); err != nil {
-		startupErrors = append(startupErrors, fmt.Sprintf("attrlist: %v", err))
-	}
-	if err := updateAttrEntriesChain(entriesChain); err != nil {
-		startupErrors = append(startupErrors, fmt.Sprintf("attrentries: %v", err))
-	}
-	if len(startupErrors) > 0 {
-		for _, e := range startupErrors {
-			fmt.Fprintf(os.Stderr, "[-] %s\n", e)
+	// Fix addresses if the port is missing
+	if !strings.Contains(proxyOpts.Target, ":") {
+		if proxyOpts.LDAPS {
+			proxyOpts.Target = fmt.Sprintf("%s:%d", proxyOpts.Target, 636)
+		} else {
+			proxyOpts.Target = fmt.Sprintf("%s:%d", proxyOpts.Target, 389)
 		}
-		os.Exit(1)
 	}
+	targetAddr := proxyOpts.Target
+	socks := proxyOpts.SOCKS
+	ldaps := proxyOpts.LDAPS
+
+	proxyOpts.FilterChain = filterChain
+	proxyOpts.BaseDNChain = baseChain
+	proxyOpts.AttrListChain = attrChain
+	proxyOpts.AttrEntriesChain = entriesChain
+	proxyOpts.ControlsChain = controlsChain
+	proxyOpts.BindNameChain = bindNameChain
+	proxyOpts.FilterPool = filterPool
+	proxyOpts.BaseDNPool = basePool
+	proxyOpts.AttrListPool = attrPool
+	proxyOpts.AttrEntriesPool = entriesPool
+	proxyOpts.ControlsPool = controlsPool
+	proxyOpts.BindNamePool = bindNamePool
+	proxyOpts.MiddlewareOptions = make(map[string]string)
+	options.RLock()
+	for key, value := range options.m {
+		proxyOpts.MiddlewareOptions[key] = value
+	}
+	options.RUnlock()
 
-	// BaseDN middlewares
-	appliedBaseDNMiddlewares := []string{}
-	for _, c := range baseChain {
-		if middlewareName, exists := baseDNMidFlags[rune(c)]; exists {
-			appliedBaseDNMiddlewares = append(appliedBaseDNMiddlewares, middlewareName)
-		}
-	}
+	var err error
 
-	// Filter middlewares
-	appliedFilterMiddlewares := []string{}
-	for _, c := range filterChain {
-		if middlewareName, exists := filterMidFlags[rune(c)]; exists {
-			appliedFilterMiddlewares = append(appliedFilterMiddlewares, middlewareName)
+	// Upstream TLS client authentication: --upstream-cert is always
+	// presented, while a lone --key is paired per connection with the
+	// certificate the client presents to the listener.
+	var upstreamCert tls.Certificate
+	if startup.upstreamCertSpec != "" {
+		upstreamCert, err = loadCertificate(startup.upstreamCertSpec, startup.upstreamKeyFile)
+		if err != nil {
+			log.Log.Printf("[-] Failed to load --upstream-cert: %s", err)
+			shutdownProgram()
 		}
-	}
-
-	// AttrList middlewares
-	appliedAttrListMiddlewares := []string{}
-	for _, c := range attrChain {
-		if middlewareName, exists := attrListMidFlags[rune(c)]; exists {
-			appliedAttrListMiddlewares = append(appliedAttrListMiddlewares, middlewareName)
+		proxyOpts.UpstreamTLS = &tls.Config{
+			Certificates:       []tls.Certificate{upstreamCert},
+			InsecureSkipVerify: true,
+			KeyLogWriter:       tlsKeyLog,
+		}
+	} else if startup.upstreamKeyFile != "" {
+		proxyOpts.UpstreamClientKey, err = loadPrivateKeyFromFile(startup.upstreamKeyFile)
+		if err != nil {
+			log.Log.Printf("[-] Failed to load --key '%s': %s", startup.upstreamKeyFile, err)
+			shutdownProgram()
 		}
 	}
 
-	// AttrList middlewares
-	appliedAttrEntriesMiddlewares := []string{}
-	for _, c := range entriesChain {
-		if middlewareName, exists := attrEntriesMidFlags[rune(c)]; exists {
-			appliedAttrEntriesMiddlewares = append(appliedAttrEntriesMiddlewares, middlewareName)
-		}
+	// ldapx query: search the target through the chains and exit, without
+	// listening
+	if args := pflag.Args(); len(args) > 0 && args[0] == "query" {
+		px = newProxy()
+		runQueryCommand(args[1:])
+		return
 	}
 
-	// Fix addresses if the port is missing
-	runtimeConfig.Lock()
-	if !strings.Contains(runtimeConfig.targetAddr, ":") {
-		if runtimeConfig.ldaps {
-			runtimeConfig.targetAddr = fmt.Sprintf("%s:%d", runtimeConfig.targetAddr, 636)
-		} else {
-			runtimeConfig.targetAddr = fmt.Sprintf("%s:%d", runtimeConfig.targetAddr, 389)
+	kdcProxyAddr := startup.kdcProxyAddr
+	if kdcProxyAddr != "" {
+		kdcProxyTarget := startup.kdcProxyTarget
+		if kdcProxyTarget == "" {
+			host, _, _ := net.SplitHostPort(targetAddr)
+			kdcProxyTarget = net.JoinHostPort(host, "88")
+		}
+		proxyOpts.Decrypt.KDCProxy, err = startKDCProxy(proxyOpts.Decrypt, kdcProxyAddr, kdcProxyTarget, socks)
+		if err != nil {
+			log.Log.Printf("[-] Failed to start the KDC proxy on '%s': %s", kdcProxyAddr, err)
+			shutdownProgram()
 		}
 	}
-	targetAddr := runtimeConfig.targetAddr
-	socks := runtimeConfig.socksServer
-	ldaps := runtimeConfig.ldaps
-	runtimeConfig.Unlock()
 
-	var err error
+	px = newProxy()
 
-	runtimeConfig.RLock()
-	tlsCertFile := runtimeConfig.tlsCertFile
-	tlsKeyFile := runtimeConfig.tlsKeyFile
-	listenerTls := runtimeConfig.listenerTls
-	clientKeyFile := runtimeConfig.upstreamKeyFile
-	runtimeConfig.RUnlock()
+	tlsCertFile := startup.tlsCertFile
+	tlsKeyFile := startup.tlsKeyFile
+	listenerTls := startup.listenerTls || startup.listenerClone
 
 	// Default listen port: 636 if TLS is configured, otherwise 389.
 	// Only applies when the user didn't explicitly set --listen
@@ -645,6 +622,12 @@ func Run() {
 				log.Log.Printf("[-] Failed to load TLS certificate/key pair: %s", err)
 				shutdownProgram()
 			}
+		} else if startup.listenerClone {
+			cert, err = cloneListenerCert(targetAddr, socks, ldaps, startup.listenerCASpec, startup.listenerCAKey, startup.listenerCAExport)
+			if err != nil {
+				log.Log.Printf("[-] Failed to clone the target's certificate: %s", err)
+				shutdownProgram()
+			}
 		} else {
 			cert, err = generateSelfSignedCert()
 			if err != nil {
@@ -654,7 +637,7 @@ func Run() {
 		}
 
 		clientAuth := tls.NoClientCert
-		if clientKeyFile != "" {
+		if startup.upstreamKeyFile != "" && startup.upstreamCertSpec == "" {
 			clientAuth = tls.RequireAnyClientCert
 		}
 
@@ -662,6 +645,7 @@ func Run() {
 			Certificates: []tls.Certificate{cert},
 			MinVersion:   tls.VersionTLS12,
 			ClientAuth:   clientAuth,
+			KeyLogWriter: tlsKeyLog,
 		}
 
 		listenerIndicator = " (TLS)"
@@ -670,43 +654,132 @@ func Run() {
 		listener = baseListener
 	}
 
-	// Build upstream TLS config for outbound LDAPS connections
-	runtimeConfig.RLock()
-	upstreamKey := runtimeConfig.upstreamKeyFile
-	runtimeConfig.RUnlock()
-
 	if socks != "" {
 		log.Log.Printf("[+] LDAP Proxy listening on '%s'%s, forwarding to '%s'%s via '%s'", proxyLDAPAddr, listenerIndicator, targetAddr, targetIndicator, socks)
 	} else {
 		log.Log.Printf("[+] LDAP Proxy listening on '%s'%s, forwarding to '%s'%s", proxyLDAPAddr, listenerIndicator, targetAddr, targetIndicator)
 	}
 
-	if upstreamKey != "" {
-		key, err := loadPrivateKeyFromFile(upstreamKey)
-		if err != nil {
-			log.Log.Printf("[-] Failed to load --key '%s': %s", upstreamKey, err)
-			shutdownProgram()
+	if startup.upstreamCertSpec != "" {
+		log.Log.Printf("[+] Upstream TLS client certificate loaded: '%s'", upstreamCert.Leaf.Subject)
+		if proxyOpts.UpstreamExternal {
+			log.Log.Printf("[+] Upstream SASL EXTERNAL bind: enabled")
+		}
+	} else if startup.upstreamKeyFile != "" {
+		log.Log.Printf("[+] Upstream TLS client key loaded from '%s'", startup.upstreamKeyFile)
+	}
+
+	logChain("BaseDN", px.BaseDNChain(), px.BaseDNPool(), proxy.BaseDNMidFlags)
+	logChain("Filter", px.FilterChain(), px.FilterPool(), proxy.FilterMidFlags)
+	logChain("AttrList", px.AttrListChain(), px.AttrListPool(), proxy.AttrListMidFlags)
+	logChain("AttrEntries", px.AttrEntriesChain(), px.AttrEntriesPool(), proxy.AttrEntriesMidFlags)
+	logChain("Controls", px.ControlsChain(), px.ControlsPool(), proxy.ControlsMidFlags)
+	logChain("BindName", px.BindNameChain(), px.BindNamePool(), proxy.BindNameMidFlags)
+	for _, name := range proxy.OperationChainNames {
+		chain, set := px.OperationChain(name)
+		if !set {
+			continue
 		}
-		upstreamClientKey = key
-		log.Log.Printf("[+] Upstream TLS client key loaded from '%s'", upstreamKey)
+		log.Log.Printf("[+] %s Middlewares: [%s]", name, strings.Join(appliedMiddlewares(chain, operationChainFlags(name)), ","))
+	}
+	if berEncoding := px.BEREncoding(); berEncoding.Enabled() {
+		log.Log.Printf("[+] BER Encoding Variations: [%s]", strings.Join(berEncoding.Names(), ","))
+	}
+	settings := px.Settings()
+	if settings.Cache {
+		cacheTTL, _ := px.Option("CacheTTL")
+		log.Log.Printf("[+] Response Cache: enabled (TTL %ss)", cacheTTL)
+	}
+	if settings.SplitSearch != "" {
+		log.Log.Printf("[+] Search Splitting: '%s'", settings.SplitSearch)
+	}
+	if shaping := px.TrafficShapingSummary(); shaping != "" {
+		log.Log.Printf("[+] Traffic Shaping: [%s]", shaping)
 	}
-
-	log.Log.Printf("[+] BaseDNMiddlewares: [%s]", strings.Join(appliedBaseDNMiddlewares, ","))
-	log.Log.Printf("[+] FilterMiddlewares: [%s]", strings.Join(appliedFilterMiddlewares, ","))
-	log.Log.Printf("[+] AttrListMiddlewares: [%s]", strings.Join(appliedAttrListMiddlewares, ","))
-	log.Log.Printf("[+] AttrEntriesMiddlewares: [%s]", strings.Join(appliedAttrEntriesMiddlewares, ","))
 
 	if outputFile != "" {
 		log.Log.Printf("[+] Logging File: '%s'", outputFile)
 	}
 
-	// Main proxy loop
-	go startProxyLoop(listener)
+	decryptCfg := px.DecryptionConfig()
+	if store := decryptCfg.Store; store != nil {
+		users, services := store.Len()
+		log.Log.Printf("[+] Decryption Credential Store: %d account(s), %d service credential(s)", users, services)
+	}
+
+	if ha1 := decryptCfg.DigestHA1; len(ha1) > 0 {
+		log.Log.Printf("[+] DIGEST-MD5 H(A1) Credentials: %d account(s)", len(ha1))
+	}
+	if capture := decryptCfg.Capture; capture != nil {
+		log.Log.Printf("[+] Credential Capture File: '%s'", capture.Path())
+	}
+	if export := decryptCfg.KeytabExport; export != nil {
+		log.Log.Printf("[+] Kerberos Keytab Export File: '%s'", export.Path())
+	}
+	if f, ok := tlsKeyLog.(*os.File); ok {
+		log.Log.Printf("[+] TLS Key Log File: '%s'", f.Name())
+	}
+
+	if kdcProxyAddr != "" {
+		log.Log.Printf("[+] KDC Proxy listening on '%s' (TCP/UDP), relaying to '%s'", kdcProxyAddr, decryptCfg.KDCProxy.Upstream())
+	}
+
+	if sname := decryptCfg.SName; sname != nil {
+		log.Log.Printf("[+] Kerberos Service Name Rewrite: tickets presented as '%s'", strings.Join(sname, "/"))
+	}
+
+	if downgrade := decryptCfg.Downgrade; downgrade != decrypt.LayerUnknown {
+		log.Log.Printf("[+] Security Layer Downgrade: binds rewritten down to %s", downgrade)
+	}
+
+	if translate := px.TranslateConfig(); translate != nil {
+		log.Log.Printf("[+] Authentication Translation: binding upstream as '%s' (%s)", translate.Account(), translate.Mech)
+	}
 
 	// Start interactive shell in the main goroutine
 	if !noShell {
+		go px.Serve(context.Background(), listener)
 		RunShell()
-	} else {
-		<-shutdownChan
+	} else if err := px.Serve(context.Background(), listener); err != nil {
+		log.Log.Printf("[-] Proxy stopped: %s", err)
+	}
+}
+
+// newProxy creates the proxy from proxyOpts, which validates the settings
+// and registers the middleware chains, exiting on an invalid configuration.
+func newProxy() *proxy.Proxy {
+	p, err := proxy.New(proxyOpts)
+	if err != nil {
+		for _, e := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "[-] %s\n", e)
+		}
+		os.Exit(1)
+	}
+	return p
+}
+
+// logChain logs the chain of a family at startup, or its pool if it has
+// one.
+func logChain(family, chain, pool string, flags map[rune]string) {
+	if pool != "" {
+		log.Log.Printf("[+] %sMiddlewares: pool '%s'", family, pool)
+		return
+	}
+	log.Log.Printf("[+] %sMiddlewares: [%s]", family, strings.Join(appliedMiddlewares(chain, flags), ","))
+}
+
+// appliedMiddlewares names the middlewares of a chain, along with the
+// parameters given to them inline.
+func appliedMiddlewares(chain string, flags map[rune]string) []string {
+	names := []string{}
+	elements, _ := proxy.ParseChain(chain)
+	for _, e := range elements {
+		if middlewareName, exists := flags[e.Code]; exists {
+			if len(e.Params) > 0 {
+				middlewareName += strings.TrimPrefix(e.String(), string(e.Code))
+			}
+			names = append(names, middlewareName)
+		}
 	}
+	return names
 }
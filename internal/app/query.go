@@ -0,0 +1,545 @@
+package app
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Macmod/ldapx/decrypt"
+	"github.com/Macmod/ldapx/log"
+	"github.com/Macmod/ldapx/parser"
+	"github.com/Macmod/ldapx/proxy"
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// `ldapx query` and the shell's search command: ldapx as the LDAP client,
+// binding to the target on its own and sending a search through the
+// current filter, attrlist and basedn chains, to see what a transformed
+// query returns without routing a client through the proxy.
+
+// queryConfig holds the --bind-* and search flags of `ldapx query` and the
+// shell's search command.
+type queryConfig struct {
+	bindAuth     string
+	bindUser     string
+	bindPassword string
+	bindHash     string
+	bindCCache   string
+	bindKDC      string
+	bindSPN      string
+
+	base     string
+	scope    string
+	pageSize uint32
+	format   string
+}
+
+var queryCfg queryConfig
+
+// Search scopes (RFC 4511 §4.5.1.2)
+var queryScopes = map[string]int64{
+	"base": 0,
+	"one":  1,
+	"sub":  2,
+}
+
+// queryConn is a connection bound by queryBind, numbering the requests sent
+// over it.
+type queryConn struct {
+	net.Conn
+	r         *bufio.Reader
+	messageID int64
+}
+
+// queryEntry is a search result entry, as printed in JSON.
+type queryEntry struct {
+	DN         string              `json:"dn"`
+	Attributes map[string][]string `json:"attributes"`
+	names      []string            // attribute names in the order returned
+	values     map[string][][]byte // raw values, for LDIF
+}
+
+// runQueryCommand runs `ldapx query [filter] [attributes...]`, printing the
+// results to stdout.
+func runQueryCommand(args []string) {
+	filter := "(objectClass=*)"
+	if len(args) > 0 {
+		filter = args[0]
+	}
+
+	if err := runQuery(filter, queryCfg.base, args[min(len(args), 1):], os.Stdout); err != nil {
+		log.Log.Printf("[-] Query failed: %s", err)
+		os.Exit(1)
+	}
+}
+
+// runQuery binds to the target as the --bind-* account and searches it for
+// filterQuery under base (the defaultNamingContext if empty), after
+// applying the current middleware chains. The entries are written to out
+// as LDIF or JSON (--format).
+func runQuery(filterQuery, base string, attrs []string, out io.Writer) error {
+	scope, ok := queryScopes[strings.ToLower(queryCfg.scope)]
+	if !ok {
+		return fmt.Errorf("invalid --scope '%s' (use base, one or sub)", queryCfg.scope)
+	}
+	format := strings.ToLower(queryCfg.format)
+	if format != "ldif" && format != "json" {
+		return fmt.Errorf("invalid --format '%s' (use ldif or json)", queryCfg.format)
+	}
+
+	filter, err := parser.QueryToFilter(filterQuery)
+	if err != nil {
+		return fmt.Errorf("compile filter: %w", err)
+	}
+
+	conn, err := queryBind()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if base == "" {
+		base, err = conn.defaultNamingContext()
+		if err != nil {
+			return fmt.Errorf("look up the defaultNamingContext (set --base): %w", err)
+		}
+	}
+
+	newFilter, newBase, newAttrs := px.TransformSearchRequest(filter, base, attrs)
+	newFilterQuery, err := parser.FilterToQuery(newFilter)
+	if err != nil {
+		newFilterQuery = fmt.Sprintf("<%s>", err)
+	}
+	log.Log.Printf("[+] Search BaseDN: '%s'", newBase)
+	log.Log.Printf("[+] Search Filter: %s", newFilterQuery)
+	log.Log.Printf("[+] Search Attributes: %s", prettyList(newAttrs))
+
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationSearchRequest, nil, "Search Request")
+	request.AppendChild(proxy.EncodeBaseDN(newBase))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, scope, "Scope"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "Deref Aliases"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "Size Limit"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "Time Limit"))
+	request.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	request.AppendChild(parser.FilterToPacket(newFilter))
+	request.AppendChild(proxy.EncodeAttributeList(newAttrs))
+
+	var w entryWriter
+	if format == "json" {
+		w = &jsonEntryWriter{out: out}
+	} else {
+		w = &ldifEntryWriter{out: out}
+	}
+
+	entries, pages := 0, 0
+	var cookie []byte
+	for {
+		var controls *ber.Packet
+		if queryCfg.pageSize > 0 {
+			controls = parser.ControlsToPacket(parser.Controls{pagingControl(queryCfg.pageSize, cookie)})
+		}
+
+		cookie = nil
+		done, err := conn.search(request, controls, func(entry *queryEntry) error {
+			entries++
+			return w.write(entry)
+		})
+		if err != nil {
+			return err
+		}
+		pages++
+
+		code, diagnostic := ldapResult(done.Children[1])
+		switch code {
+		case parser.LDAPResultSuccess:
+		case parser.LDAPResultSizeLimitExceeded:
+			log.Log.Printf("[-] The target stopped the search at its size limit - lower --page-size or narrow the filter")
+		default:
+			w.close()
+			return fmt.Errorf("search failed: %s", describeResult(code, diagnostic))
+		}
+
+		if queryCfg.pageSize > 0 && len(done.Children) > 2 {
+			for _, control := range parser.PacketToControls(done.Children[2]) {
+				if control.OID == parser.ControlTypePaging {
+					cookie = pagingCookie(control.Value)
+				}
+			}
+		}
+		if len(cookie) == 0 {
+			break
+		}
+	}
+
+	if err := w.close(); err != nil {
+		return err
+	}
+	log.Log.Printf("[+] Query returned %d entries in %d page(s)", entries, pages)
+	return nil
+}
+
+// queryBind connects to the target with the current settings and binds it
+// with --bind-auth: a simple bind (anonymous without --bind-user), NTLM or
+// Kerberos as the --bind-* account, or SASL EXTERNAL as --upstream-cert.
+func queryBind() (*queryConn, error) {
+	settings := px.Settings()
+	host, _, _ := net.SplitHostPort(settings.Target)
+
+	tlsCfg := insecureTlsConfig
+	mech := strings.ToLower(queryCfg.bindAuth)
+	if mech == "cert" {
+		if proxyOpts.UpstreamTLS == nil {
+			return nil, errors.New("--bind-auth cert requires --upstream-cert")
+		}
+		tlsCfg = proxyOpts.UpstreamTLS
+	}
+
+	var tc *decrypt.TranslateConfig
+	switch mech {
+	case "", "simple", "cert":
+	case "ntlm", "kerberos":
+		var err error
+		tc, err = decrypt.ResolveBindConfig(mech, queryCfg.bindUser, queryCfg.bindPassword, queryCfg.bindHash, queryCfg.bindCCache, queryCfg.bindKDC, queryCfg.bindSPN)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid --bind-auth '%s' (use simple, ntlm, kerberos or cert)", queryCfg.bindAuth)
+	}
+
+	conn, err := proxy.Dial(settings.Target, settings.SOCKS, settings.LDAPS, tlsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("connect to '%s': %w", settings.Target, err)
+	}
+
+	switch mech {
+	case "ntlm", "kerberos":
+		sealed, err := decrypt.BindClient(conn, tc, host)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s bind: %w", mech, err)
+		}
+		log.Log.Printf("[+] Bound to '%s' as '%s' (%s, %s)", settings.Target, sealed.Identity(), mech, sealed.Layer())
+		return &queryConn{Conn: sealed, r: bufio.NewReader(sealed)}, nil
+	}
+
+	c := &queryConn{Conn: conn, r: bufio.NewReader(conn)}
+	bind := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationBindRequest, nil, "Bind Request")
+	bind.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(3), "Version"))
+	if mech == "cert" {
+		bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Name"))
+		sasl := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "SASL")
+		sasl.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "EXTERNAL", "Mechanism"))
+		bind.AppendChild(sasl)
+	} else {
+		bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, queryCfg.bindUser, "Name"))
+		bind.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, queryCfg.bindPassword, "Simple"))
+	}
+
+	response, err := c.roundTrip(bind)
+	if err == nil && response.Children[1].Tag != parser.ApplicationBindResponse {
+		err = fmt.Errorf("expected a BindResponse, got application %d", response.Children[1].Tag)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("bind: %w", err)
+	}
+	if code, diagnostic := ldapResult(response.Children[1]); code != parser.LDAPResultSuccess {
+		c.Close()
+		return nil, fmt.Errorf("bind: %s", describeResult(code, diagnostic))
+	}
+
+	switch {
+	case mech == "cert":
+		log.Log.Printf("[+] Bound to '%s' with SASL EXTERNAL as '%s'", settings.Target, proxyOpts.UpstreamTLS.Certificates[0].Leaf.Subject)
+	case queryCfg.bindUser == "":
+		log.Log.Printf("[+] Bound to '%s' anonymously", settings.Target)
+	default:
+		log.Log.Printf("[+] Bound to '%s' as '%s' (simple)", settings.Target, queryCfg.bindUser)
+	}
+	return c, nil
+}
+
+// send writes op as the next LDAPMessage, with controls if not nil.
+func (c *queryConn) send(op, controls *ber.Packet) error {
+	c.messageID++
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.messageID, "MessageID"))
+	message.AppendChild(op)
+	if controls != nil {
+		message.AppendChild(controls)
+	}
+	_, err := c.Write(message.Bytes())
+	return err
+}
+
+// receive reads the next LDAPMessage answering the last request sent.
+func (c *queryConn) receive() (*ber.Packet, error) {
+	for {
+		message, err := ber.ReadPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if len(message.Children) < 2 {
+			return nil, errors.New("malformed LDAP message")
+		}
+		// Unsolicited notifications (message ID 0) end the connection, as a
+		// Notice of Disconnection does
+		id, _ := message.Children[0].Value.(int64)
+		if id == 0 {
+			code, diagnostic := ldapResult(message.Children[1])
+			return nil, fmt.Errorf("disconnected by the target: %s", describeResult(code, diagnostic))
+		}
+		if id == c.messageID {
+			return message, nil
+		}
+	}
+}
+
+// roundTrip sends op and reads its single response.
+func (c *queryConn) roundTrip(op *ber.Packet) (*ber.Packet, error) {
+	if err := c.send(op, nil); err != nil {
+		return nil, err
+	}
+	return c.receive()
+}
+
+// search sends a search request, calls onEntry for each entry it returns
+// and logs its referrals, until the SearchResultDone message it returns.
+func (c *queryConn) search(request, controls *ber.Packet, onEntry func(*queryEntry) error) (*ber.Packet, error) {
+	if err := c.send(request, controls); err != nil {
+		return nil, err
+	}
+
+	for {
+		message, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		op := message.Children[1]
+		switch op.Tag {
+		case parser.ApplicationSearchResultEntry:
+			entry, err := decodeEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			if err := onEntry(entry); err != nil {
+				return nil, err
+			}
+		case parser.ApplicationSearchResultReference:
+			for _, uri := range op.Children {
+				log.Log.Printf("[+] Referral: %s", uri.Data.String())
+			}
+		case parser.ApplicationSearchResultDone:
+			return message, nil
+		default:
+			return nil, fmt.Errorf("unexpected application %d in a search response", op.Tag)
+		}
+	}
+}
+
+// defaultNamingContext reads the defaultNamingContext of the rootDSE.
+func (c *queryConn) defaultNamingContext() (string, error) {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationSearchRequest, nil, "Search Request")
+	request.AppendChild(proxy.EncodeBaseDN(""))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, queryScopes["base"], "Scope"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "Deref Aliases"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "Size Limit"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "Time Limit"))
+	request.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	request.AppendChild(parser.FilterToPacket(&parser.FilterPresent{AttributeDesc: "objectClass"}))
+	request.AppendChild(proxy.EncodeAttributeList([]string{"defaultNamingContext"}))
+
+	var namingContext string
+	done, err := c.search(request, nil, func(entry *queryEntry) error {
+		for name, values := range entry.values {
+			if strings.EqualFold(name, "defaultNamingContext") && len(values) > 0 {
+				namingContext = string(values[0])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if code, diagnostic := ldapResult(done.Children[1]); code != parser.LDAPResultSuccess {
+		return "", errors.New(describeResult(code, diagnostic))
+	}
+	if namingContext == "" {
+		return "", errors.New("the rootDSE has no defaultNamingContext")
+	}
+	return namingContext, nil
+}
+
+// decodeEntry decodes a SearchResultEntry protocolOp.
+func decodeEntry(op *ber.Packet) (*queryEntry, error) {
+	if len(op.Children) < 2 {
+		return nil, errors.New("malformed SearchResultEntry")
+	}
+
+	entry := &queryEntry{
+		DN:         op.Children[0].Data.String(),
+		Attributes: make(map[string][]string),
+		values:     make(map[string][][]byte),
+	}
+	for _, attr := range op.Children[1].Children {
+		if len(attr.Children) < 2 {
+			continue
+		}
+		name := attr.Children[0].Data.String()
+		if _, seen := entry.values[name]; !seen {
+			entry.names = append(entry.names, name)
+		}
+		for _, value := range attr.Children[1].Children {
+			raw := append([]byte(nil), value.Data.Bytes()...)
+			entry.values[name] = append(entry.values[name], raw)
+
+			// JSON strings can't hold arbitrary bytes
+			if utf8.Valid(raw) {
+				entry.Attributes[name] = append(entry.Attributes[name], string(raw))
+			} else {
+				entry.Attributes[name] = append(entry.Attributes[name], base64.StdEncoding.EncodeToString(raw))
+			}
+		}
+	}
+	return entry, nil
+}
+
+// ldapResult returns the resultCode and diagnosticMessage of an LDAPResult.
+func ldapResult(op *ber.Packet) (uint16, string) {
+	if len(op.Children) < 3 {
+		return parser.LDAPResultOther, "malformed LDAPResult"
+	}
+	code, _ := op.Children[0].Value.(int64)
+	return uint16(code), op.Children[2].Data.String()
+}
+
+func describeResult(code uint16, diagnostic string) string {
+	description, ok := parser.LDAPResultCodeMap[code]
+	if !ok {
+		description = "Unknown"
+	}
+	if diagnostic == "" {
+		return fmt.Sprintf("%s (%d)", description, code)
+	}
+	return fmt.Sprintf("%s (%d): %s", description, code, diagnostic)
+}
+
+// pagingControl builds a Simple Paged Results control (RFC 2696) asking for
+// pages of size entries, continuing from cookie.
+func pagingControl(size uint32, cookie []byte) parser.Control {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Search Control Value")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(size), "Paging Size"))
+	cookiePacket := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Cookie")
+	cookiePacket.Value = cookie
+	cookiePacket.Data.Write(cookie)
+	value.AppendChild(cookiePacket)
+
+	return parser.Control{OID: parser.ControlTypePaging, Value: value.Bytes(), HasValue: true}
+}
+
+// pagingCookie returns the cookie of a Simple Paged Results control value.
+func pagingCookie(value []byte) []byte {
+	packet, err := ber.DecodePacketErr(value)
+	if err != nil || len(packet.Children) < 2 {
+		return nil
+	}
+	return packet.Children[1].Data.Bytes()
+}
+
+// entryWriter prints search result entries.
+type entryWriter interface {
+	write(entry *queryEntry) error
+	close() error
+}
+
+// ldifEntryWriter prints entries as LDIF (RFC 2849), base64-encoding the
+// values that aren't safe strings.
+type ldifEntryWriter struct {
+	out io.Writer
+}
+
+func (w *ldifEntryWriter) write(entry *queryEntry) error {
+	var b strings.Builder
+	b.WriteString(ldifLine("dn", []byte(entry.DN)))
+	for _, name := range entry.names {
+		for _, value := range entry.values[name] {
+			b.WriteString(ldifLine(name, value))
+		}
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w.out, b.String())
+	return err
+}
+
+func (w *ldifEntryWriter) close() error {
+	return nil
+}
+
+func ldifLine(name string, value []byte) string {
+	if ldifSafe(value) {
+		return fmt.Sprintf("%s: %s\n", name, value)
+	}
+	return fmt.Sprintf("%s:: %s\n", name, base64.StdEncoding.EncodeToString(value))
+}
+
+// ldifSafe tells whether value can be written as a SAFE-STRING, which
+// excludes non-ASCII bytes, NUL, CR and LF, a leading space, colon or '<',
+// and (as most tools do) a trailing space.
+func ldifSafe(value []byte) bool {
+	if len(value) == 0 {
+		return true
+	}
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for _, c := range value {
+		if c == 0 || c == '\n' || c == '\r' || c > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonEntryWriter prints entries as a JSON array, one entry per line, with
+// the values that aren't valid UTF-8 base64-encoded.
+type jsonEntryWriter struct {
+	out     io.Writer
+	written bool
+}
+
+func (w *jsonEntryWriter) write(entry *queryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	sep := ",\n"
+	if !w.written {
+		sep = "[\n"
+		w.written = true
+	}
+	_, err = fmt.Fprintf(w.out, "%s%s", sep, data)
+	return err
+}
+
+func (w *jsonEntryWriter) close() error {
+	if !w.written {
+		_, err := io.WriteString(w.out, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(w.out, "\n]\n")
+	return err
+}
@@ -3,13 +3,18 @@ package app
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
+	"os"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Macmod/ldapx/log"
 	"github.com/Macmod/ldapx/middlewares"
 	"github.com/Macmod/ldapx/parser"
+	"github.com/Macmod/ldapx/proxy"
 	"github.com/c-bata/go-prompt"
 )
 
@@ -20,6 +25,7 @@ var suggestions = []prompt.Suggest{
 	{Text: "exit", Description: "Exit the program"},
 	{Text: "clear", Description: "Clear a configuration parameter"},
 	{Text: "test", Description: "Test an LDAP query through the middlewares"},
+	{Text: "search", Description: "Run an LDAP query against the target through the middlewares"},
 	{Text: "version", Description: "Show version information"},
 }
 
@@ -28,6 +34,8 @@ var setParamSuggestions = []prompt.Suggest{
 	{Text: "filter", Description: "Set filter middleware chain"},
 	{Text: "attrlist", Description: "Set attributes list middleware chain"},
 	{Text: "attrentries", Description: "Set attributes entries middleware chain"},
+	{Text: "controls", Description: "Set request controls middleware chain"},
+	{Text: "bindname", Description: "Set bind name middleware chain"},
 	{Text: "target", Description: "Set target LDAP server address"},
 	{Text: "ldaps", Description: "Set LDAPS connection mode (true/false)"},
 	{Text: "option", Description: "Set a middleware option"},
@@ -41,7 +49,9 @@ var setParamSuggestions = []prompt.Suggest{
 	{Text: "socks", Description: "Set the SOCKS server to use for the target connection"},
 	{Text: "spoof-mechs", Description: "Set SASL mechanisms to report in rootDSE supportedSASLMechanisms"},
 	{Text: "split-wrapped", Description: "Set split-wrapped policy (in/out/both)"},
+	{Text: "split-search", Description: "Set search splitting mode (or/attrs/both)"},
 	{Text: "tracking", Description: "Set tracking algorithm mode (true/false)"},
+	{Text: "cache", Description: "Set response cache mode (true/false)"},
 }
 
 var clearParamSuggestions = []prompt.Suggest{
@@ -49,6 +59,8 @@ var clearParamSuggestions = []prompt.Suggest{
 	{Text: "filter", Description: "Clear filter middleware chain"},
 	{Text: "attrlist", Description: "Clear attribute list middleware chain"},
 	{Text: "attrentries", Description: "Clear attributes entries middleware chain"},
+	{Text: "controls", Description: "Clear request controls middleware chain"},
+	{Text: "bindname", Description: "Clear bind name middleware chain"},
 	{Text: "stats", Description: "Clear statistics"},
 	{Text: "isearch", Description: "Clear search operation interception"},
 	{Text: "imodify", Description: "Clear modify operation interception"},
@@ -58,7 +70,9 @@ var clearParamSuggestions = []prompt.Suggest{
 	{Text: "socks", Description: "Clear configured SOCKS server"},
 	{Text: "spoof-mechs", Description: "Clear SASL mechanism spoofing"},
 	{Text: "split-wrapped", Description: "Clear split-wrapped policy"},
+	{Text: "split-search", Description: "Clear search splitting mode"},
 	{Text: "tracking", Description: "Clear tracking algorithm mode"},
+	{Text: "cache", Description: "Clear cached search results"},
 }
 
 var showParamSuggestions = []prompt.Suggest{
@@ -66,8 +80,11 @@ var showParamSuggestions = []prompt.Suggest{
 	{Text: "filter", Description: "Show filter middleware chain"},
 	{Text: "attrlist", Description: "Show attributes list middleware chain"},
 	{Text: "attrentries", Description: "Show attributes entries middleware chain"},
+	{Text: "controls", Description: "Show request controls middleware chain"},
+	{Text: "bindname", Description: "Show bind name middleware chain"},
 	{Text: "testbasedn", Description: "Show BaseDN to use for the `test` command"},
 	{Text: "testattrlist", Description: "Show attributes list to use for the `test` command"},
+	{Text: "testvariants", Description: "Show how many variants `test` samples from chain pools"},
 	{Text: "target", Description: "Show target address to connect upon receiving a connection"},
 	{Text: "ldaps", Description: "Show LDAPS connection mode"},
 	{Text: "option", Description: "Show current middleware options"},
@@ -82,16 +99,22 @@ var showParamSuggestions = []prompt.Suggest{
 	{Text: "socks", Description: "Show configured SOCKS server"},
 	{Text: "spoof-mechs", Description: "Show configured SASL mechanism spoofing"},
 	{Text: "split-wrapped", Description: "Show split-wrapped policy"},
+	{Text: "split-search", Description: "Show search splitting mode"},
 	{Text: "tracking", Description: "Show tracking algorithm mode"},
+	{Text: "cache", Description: "Show response cache mode and cached searches"},
 }
 
 var helpParamSuggestions = []prompt.Suggest{
 	{Text: "basedn", Description: "Show available basedn middlewares"},
 	{Text: "filter", Description: "Show available filter middlewares"},
+	{Text: "filter-scope", Description: "Show the scope parameter of filter middlewares"},
 	{Text: "attrlist", Description: "Show available attributes list middlewares"},
 	{Text: "attrentries", Description: "Show available attributes entries middlewares"},
+	{Text: "controls", Description: "Show available request controls middlewares"},
+	{Text: "bindname", Description: "Show available bind name middlewares"},
 	{Text: "testbasedn", Description: "Show testbasedn parameter info"},
 	{Text: "testattrlist", Description: "Show testattrlist parameter info"},
+	{Text: "testvariants", Description: "Show testvariants parameter info"},
 	{Text: "target", Description: "Show target parameter info"},
 	{Text: "ldaps", Description: "Show LDAPS parameter info"},
 	{Text: "option", Description: "Show option parameter info"},
@@ -101,12 +124,18 @@ var helpParamSuggestions = []prompt.Suggest{
 	{Text: "socks", Description: "Show socks parameter info"},
 	{Text: "spoof-mechs", Description: "Show spoof-mechs parameter info"},
 	{Text: "split-wrapped", Description: "Show split-wrapped parameter info"},
+	{Text: "split-search", Description: "Show split-search parameter info"},
 	{Text: "tracking", Description: "Show tracking parameter info"},
+	{Text: "cache", Description: "Show cache parameter info"},
 }
 
 var testBaseDN = "DC=test,DC=local"
 var testAttrList = []string{"cn", "objectClass", "sAMAccountName"}
 
+// testVariants is how many variants 'test' samples when a chain is drawn
+// from a pool.
+var testVariants = 3
+
 func completer(in prompt.Document) []prompt.Suggest {
 	w := in.GetWordBeforeCursor()
 
@@ -121,18 +150,85 @@ func completer(in prompt.Document) []prompt.Suggest {
 
 	switch args[0] {
 	case "set":
-		return prompt.FilterHasPrefix(setParamSuggestions, w, true)
+		return prompt.FilterHasPrefix(slices.Concat(setParamSuggestions, chainPoolSuggestions("Set"), operationChainSuggestions("Set")), w, true)
 	case "clear":
-		return prompt.FilterHasPrefix(clearParamSuggestions, w, true)
+		return prompt.FilterHasPrefix(slices.Concat(clearParamSuggestions, chainPoolSuggestions("Clear"), operationChainSuggestions("Clear")), w, true)
 	case "show":
-		return prompt.FilterHasPrefix(showParamSuggestions, w, true)
+		return prompt.FilterHasPrefix(slices.Concat(showParamSuggestions, chainPoolSuggestions("Show"), operationChainSuggestions("Show")), w, true)
 	case "help":
-		return prompt.FilterHasPrefix(helpParamSuggestions, w, true)
+		return prompt.FilterHasPrefix(slices.Concat(helpParamSuggestions, chainPoolSuggestions("Show help for")), w, true)
 	default:
 		return []prompt.Suggest{}
 	}
 }
 
+// chainPoolParams maps the shell parameters of the chain pools to their
+// families.
+var chainPoolParams = map[string]string{
+	"filter-pool":      "Filter",
+	"basedn-pool":      "BaseDN",
+	"attrlist-pool":    "AttrList",
+	"attrentries-pool": "AttrEntries",
+	"controls-pool":    "Controls",
+	"bindname-pool":    "BindName",
+}
+
+// chainPoolSuggestions suggests the chain pools for a command.
+func chainPoolSuggestions(verb string) []prompt.Suggest {
+	var suggestions []prompt.Suggest
+	for _, param := range slices.Sorted(maps.Keys(chainPoolParams)) {
+		suggestions = append(suggestions, prompt.Suggest{
+			Text:        param,
+			Description: fmt.Sprintf("%s the pool of %s chains drawn from per request", verb, chainPoolParams[param]),
+		})
+	}
+	return suggestions
+}
+
+func setChainPool(family, pool string) error {
+	switch family {
+	case "Filter":
+		return px.SetFilterPool(pool)
+	case "BaseDN":
+		return px.SetBaseDNPool(pool)
+	case "AttrList":
+		return px.SetAttrListPool(pool)
+	case "AttrEntries":
+		return px.SetAttrEntriesPool(pool)
+	case "Controls":
+		return px.SetControlsPool(pool)
+	}
+	return px.SetBindNamePool(pool)
+}
+
+func chainPool(family string) string {
+	switch family {
+	case "Filter":
+		return px.FilterPool()
+	case "BaseDN":
+		return px.BaseDNPool()
+	case "AttrList":
+		return px.AttrListPool()
+	case "AttrEntries":
+		return px.AttrEntriesPool()
+	case "Controls":
+		return px.ControlsPool()
+	}
+	return px.BindNamePool()
+}
+
+// operationChainSuggestions suggests the operation chains for a command.
+func operationChainSuggestions(verb string) []prompt.Suggest {
+	var suggestions []prompt.Suggest
+	for _, name := range proxy.OperationChainNames {
+		suggestions = append(suggestions, prompt.Suggest{
+			Text:        name,
+			Description: fmt.Sprintf("%s the %s chain of one operation", verb, operationChainFamily(name)),
+		})
+	}
+	return suggestions
+}
+
 func executor(in string) {
 	in = strings.TrimSpace(in)
 	blocks := strings.Split(in, " ")
@@ -147,10 +243,7 @@ func executor(in string) {
 		shutdownProgram()
 	case "clear":
 		if len(blocks) < 2 {
-			updateFilterChain("")
-			updateBaseDNChain("")
-			updateAttrListChain("")
-			updateAttrEntriesChain("")
+			px.ClearChains()
 			clearStatistics()
 			fmt.Printf("Middleware chains and statistics cleared.\n")
 			return
@@ -180,6 +273,12 @@ func executor(in string) {
 			return
 		}
 		handleTestCommand(strings.Join(blocks[1:], " "))
+	case "search":
+		if len(blocks) < 2 {
+			fmt.Println("Usage: search <ldap_query>")
+			return
+		}
+		handleSearchCommand(strings.Join(blocks[1:], " "))
 	case "version":
 		fmt.Printf("ldapx %s\n", version)
 	default:
@@ -199,68 +298,93 @@ func RunShell() {
 }
 
 func handleClearCommand(param string) {
+	if family, ok := chainPoolParams[param]; ok {
+		setChainPool(family, "")
+		fmt.Printf("Middleware pool %s cleared.\n", family)
+		return
+	}
+	if slices.Contains(proxy.OperationChainNames, param) {
+		px.ClearOperationChain(param)
+		fmt.Printf("Middleware chain %s cleared (the shared %s chain applies).\n", param, operationChainFamily(param))
+		return
+	}
+
 	switch param {
 	case "filter":
-		updateFilterChain("")
+		px.SetFilterChain("")
 		fmt.Printf("Middleware chain Filter cleared.\n")
 	case "basedn":
-		updateBaseDNChain("")
+		px.SetBaseDNChain("")
 		fmt.Printf("Middleware chain BaseDN cleared.\n")
 	case "attrlist":
-		updateAttrListChain("")
+		px.SetAttrListChain("")
 		fmt.Printf("Middleware chain AttrList cleared.\n")
 	case "attrentries":
-		updateAttrEntriesChain("")
+		px.SetAttrEntriesChain("")
 		fmt.Printf("Middleware chain AttrEntries cleared.\n")
+	case "controls":
+		px.SetControlsChain("")
+		fmt.Printf("Middleware chain Controls cleared.\n")
+	case "bindname":
+		px.SetBindNameChain("")
+		fmt.Printf("Middleware chain BindName cleared.\n")
 	case "stats":
 		clearStatistics()
 		fmt.Println("Statistics cleared.")
 	case "isearch":
-		runtimeConfig.Lock()
-		runtimeConfig.interceptSearch = false
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.Search = false
+		})
 		fmt.Printf("Search interception cleared.\n")
 	case "imodify":
-		runtimeConfig.Lock()
-		runtimeConfig.interceptModify = false
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.Modify = false
+		})
 		fmt.Printf("Modify interception cleared.\n")
 	case "iadd":
-		runtimeConfig.Lock()
-		runtimeConfig.interceptAdd = false
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.Add = false
+		})
 		fmt.Printf("Add interception cleared.\n")
 	case "idelete":
-		runtimeConfig.Lock()
-		runtimeConfig.interceptDelete = false
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.Delete = false
+		})
 		fmt.Printf("Delete interception cleared.\n")
 	case "imodifydn":
-		runtimeConfig.Lock()
-		runtimeConfig.interceptModifyDN = false
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.ModifyDN = false
+		})
 		fmt.Printf("ModifyDN interception cleared.\n")
 	case "socks":
-		runtimeConfig.Lock()
-		runtimeConfig.socksServer = ""
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.SOCKS = ""
+		})
 		fmt.Printf("SOCKS server cleared.\n")
 	case "spoof-mechs":
-		runtimeConfig.Lock()
-		runtimeConfig.spoofMechs = nil
-		runtimeConfig.spoofGiven = false
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.SpoofMechs = nil
+			s.SpoofMechsSet = false
+		})
 		fmt.Printf("SASL mechanism spoofing cleared.\n")
 	case "split-wrapped":
-		runtimeConfig.Lock()
-		runtimeConfig.splitWrapped = ""
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.SplitWrapped = ""
+		})
 		fmt.Printf("Split-wrapped policy cleared (bundling restored).\n")
+	case "split-search":
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.SplitSearch = ""
+		})
+		fmt.Printf("Search splitting cleared.\n")
 	case "tracking":
-		runtimeConfig.Lock()
-		runtimeConfig.tracking = true
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Tracking = true
+		})
 		fmt.Printf("Tracking algorithm reset to default (enabled).\n")
+	case "cache":
+		px.ClearCache()
+		fmt.Println("Cache cleared.")
 	default:
 		fmt.Printf("Unknown parameter: %s\n", param)
 	}
@@ -268,35 +392,72 @@ func handleClearCommand(param string) {
 
 func handleSetCommand(param string, values []string) {
 	value := strings.Join(values, " ")
+	if family, ok := chainPoolParams[param]; ok {
+		if err := setChainPool(family, value); err != nil {
+			fmt.Printf("[-] %s pool not updated: %v\n", family, err)
+			return
+		}
+		fmt.Printf("Middleware pool %s updated:\n", family)
+		showChainPool(family)
+		return
+	}
+	if slices.Contains(proxy.OperationChainNames, param) {
+		// '' sets an empty chain, leaving the operation untransformed
+		if value == "''" || value == `""` {
+			value = ""
+		}
+		if err := px.SetOperationChain(param, value); err != nil {
+			fmt.Printf("[-] %s chain not updated: %v\n", param, err)
+			return
+		}
+		fmt.Printf("Middleware chain %s updated:\n", param)
+		showOperationChain(param)
+		return
+	}
+
 	switch param {
 	case "filter":
-		if err := updateFilterChain(value); err != nil {
+		if err := px.SetFilterChain(value); err != nil {
 			fmt.Printf("[-] Filter chain not updated: %v\n", err)
 			return
 		}
 		fmt.Printf("Middleware chain Filter updated:\n")
-		showChainConfig("Filter", filterChain, filterMidFlags)
+		showChainConfig("Filter", px.FilterChain(), proxy.FilterMidFlags)
 	case "basedn":
-		if err := updateBaseDNChain(value); err != nil {
+		if err := px.SetBaseDNChain(value); err != nil {
 			fmt.Printf("[-] BaseDN chain not updated: %v\n", err)
 			return
 		}
 		fmt.Printf("Middleware chain BaseDN updated:\n")
-		showChainConfig("BaseDN", baseChain, baseDNMidFlags)
+		showChainConfig("BaseDN", px.BaseDNChain(), proxy.BaseDNMidFlags)
 	case "attrlist":
-		if err := updateAttrListChain(value); err != nil {
+		if err := px.SetAttrListChain(value); err != nil {
 			fmt.Printf("[-] AttrList chain not updated: %v\n", err)
 			return
 		}
 		fmt.Printf("Middleware chain AttrList updated:\n")
-		showChainConfig("AttrList", attrChain, attrListMidFlags)
+		showChainConfig("AttrList", px.AttrListChain(), proxy.AttrListMidFlags)
 	case "attrentries":
-		if err := updateAttrEntriesChain(value); err != nil {
+		if err := px.SetAttrEntriesChain(value); err != nil {
 			fmt.Printf("[-] AttrEntries chain not updated: %v\n", err)
 			return
 		}
 		fmt.Printf("Middleware chain AttrEntries updated:\n")
-		showChainConfig("AttrEntries", entriesChain, attrEntriesMidFlags)
+		showChainConfig("AttrEntries", px.AttrEntriesChain(), proxy.AttrEntriesMidFlags)
+	case "controls":
+		if err := px.SetControlsChain(value); err != nil {
+			fmt.Printf("[-] Controls chain not updated: %v\n", err)
+			return
+		}
+		fmt.Printf("Middleware chain Controls updated:\n")
+		showChainConfig("Controls", px.ControlsChain(), proxy.ControlsMidFlags)
+	case "bindname":
+		if err := px.SetBindNameChain(value); err != nil {
+			fmt.Printf("[-] BindName chain not updated: %v\n", err)
+			return
+		}
+		fmt.Printf("Middleware chain BindName updated:\n")
+		showChainConfig("BindName", px.BindNameChain(), proxy.BindNameMidFlags)
 	case "testbasedn":
 		testBaseDN = value
 		fmt.Printf("Test BaseDN set to: %s\n", testBaseDN)
@@ -306,10 +467,18 @@ func handleSetCommand(param string, values []string) {
 			testAttrList[i] = strings.TrimSpace(testAttrList[i])
 		}
 		fmt.Printf("Test attributes list set to: %v\n", testAttrList)
+	case "testvariants":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			fmt.Println("Invalid value for testvariants. Must be an integer >= 1.")
+			return
+		}
+		testVariants = n
+		fmt.Printf("Test variants set to: %d\n", testVariants)
 	case "target":
-		runtimeConfig.Lock()
-		runtimeConfig.targetAddr = value
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Target = value
+		})
 		fmt.Printf("Target LDAP server address set to: %s\n", value)
 		/*
 			fmt.Println("Connecting to the new target...")
@@ -325,13 +494,16 @@ func handleSetCommand(param string, values []string) {
 			fmt.Println("Usage: set option <key>=<value>")
 			return
 		}
-		if err := options.Set(values[0]); err != nil {
+		parts := strings.SplitN(values[0], "=", 2)
+		if len(parts) != 2 {
+			fmt.Printf("Invalid option: invalid option format: %s\n", values[0])
+			return
+		}
+		if err := px.SetOption(parts[0], parts[1]); err != nil {
 			fmt.Printf("Invalid option: %v\n", err)
 			return
 		}
 
-		SetupMiddlewaresMap()
-
 		fmt.Printf("Option set: %s\n", values[0])
 	case "verbfwd":
 		if len(values) != 1 {
@@ -343,9 +515,9 @@ func handleSetCommand(param string, values []string) {
 			fmt.Printf("Invalid verbosity level: %s\n", values[0])
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.verbFwd = uint(level)
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.VerbFwd = uint(level)
+		})
 		fmt.Printf("Forward verbosity level set to: %d\n", level)
 	case "verbrev":
 		if len(values) != 1 {
@@ -357,9 +529,9 @@ func handleSetCommand(param string, values []string) {
 			fmt.Printf("Invalid verbosity level: %s\n", values[0])
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.verbRev = uint(level)
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.VerbRev = uint(level)
+		})
 		fmt.Printf("Reverse verbosity level set to: %d\n", level)
 	case "ldaps":
 		if len(values) != 1 {
@@ -371,9 +543,9 @@ func handleSetCommand(param string, values []string) {
 			fmt.Printf("Invalid boolean value: %s\n", values[0])
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.ldaps = ldapsValue
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.LDAPS = ldapsValue
+		})
 		fmt.Printf("LDAPS mode set to: %v\n", ldapsValue)
 	case "isearch":
 		if len(values) != 1 {
@@ -385,9 +557,9 @@ func handleSetCommand(param string, values []string) {
 			fmt.Printf("Invalid boolean value: %s\n", values[0])
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.interceptSearch = val
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.Search = val
+		})
 		fmt.Printf("Search interception set to: %v\n", val)
 	case "imodify":
 		if len(values) != 1 {
@@ -399,9 +571,9 @@ func handleSetCommand(param string, values []string) {
 			fmt.Printf("Invalid boolean value: %s\n", values[0])
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.interceptModify = val
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.Modify = val
+		})
 		fmt.Printf("Modify interception set to: %v\n", val)
 	case "iadd":
 		if len(values) != 1 {
@@ -413,9 +585,9 @@ func handleSetCommand(param string, values []string) {
 			fmt.Printf("Invalid boolean value: %s\n", values[0])
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.interceptAdd = val
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.Add = val
+		})
 		fmt.Printf("Add interception set to: %v\n", val)
 	case "idelete":
 		if len(values) != 1 {
@@ -427,9 +599,9 @@ func handleSetCommand(param string, values []string) {
 			fmt.Printf("Invalid boolean value: %s\n", values[0])
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.interceptDelete = val
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.Delete = val
+		})
 		fmt.Printf("Delete interception set to: %v\n", val)
 	case "imodifydn":
 		if len(values) != 1 {
@@ -441,30 +613,30 @@ func handleSetCommand(param string, values []string) {
 			fmt.Printf("Invalid boolean value: %s\n", values[0])
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.interceptModifyDN = val
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Intercept.ModifyDN = val
+		})
 		fmt.Printf("ModifyDN interception set to: %v\n", val)
 	case "socks":
 		if len(values) != 1 {
 			fmt.Println("Usage: set socks <true/false>")
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.socksServer = values[0]
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.SOCKS = values[0]
+		})
 	case "spoof-mechs":
 		if len(values) == 1 && (values[0] == "" || values[0] == "none") {
-			runtimeConfig.Lock()
-			runtimeConfig.spoofMechs = nil
-			runtimeConfig.spoofGiven = true
-			runtimeConfig.Unlock()
+			px.UpdateSettings(func(s *proxy.Settings) {
+				s.SpoofMechs = nil
+				s.SpoofMechsSet = true
+			})
 			fmt.Printf("SASL mechanism spoofing disabled (mechanisms removed from rootDSE).\n")
 		} else {
-			runtimeConfig.Lock()
-			runtimeConfig.spoofMechs = values
-			runtimeConfig.spoofGiven = true
-			runtimeConfig.Unlock()
+			px.UpdateSettings(func(s *proxy.Settings) {
+				s.SpoofMechs = values
+				s.SpoofMechsSet = true
+			})
 			fmt.Printf("SASL mechanism spoofing set to: %v\n", values)
 		}
 	case "split-wrapped":
@@ -475,13 +647,26 @@ func handleSetCommand(param string, values []string) {
 		val := strings.ToLower(values[0])
 		switch val {
 		case "in", "out", "both", "":
-			runtimeConfig.Lock()
-			runtimeConfig.splitWrapped = val
-			runtimeConfig.Unlock()
+			px.UpdateSettings(func(s *proxy.Settings) {
+				s.SplitWrapped = val
+			})
 			fmt.Printf("Split-wrapped policy set to: '%s'\n", val)
 		default:
 			fmt.Printf("Invalid split-wrapped value: '%s' (use in, out, both, or empty string to disable)\n", val)
 		}
+	case "split-search":
+		if len(values) != 1 {
+			fmt.Println("Usage: set split-search <or|attrs|both|''>")
+			return
+		}
+		val := strings.ToLower(values[0])
+		if err := px.UpdateSettings(func(s *proxy.Settings) {
+			s.SplitSearch = val
+		}); err != nil {
+			fmt.Printf("Invalid split-search value: '%s' (use or, attrs, both, or empty string to disable)\n", val)
+			return
+		}
+		fmt.Printf("Search splitting set to: '%s'\n", val)
 	case "tracking":
 		if len(values) != 1 {
 			fmt.Println("Usage: set tracking <true/false>")
@@ -492,10 +677,24 @@ func handleSetCommand(param string, values []string) {
 			fmt.Printf("Invalid boolean value: %s\n", values[0])
 			return
 		}
-		runtimeConfig.Lock()
-		runtimeConfig.tracking = val
-		runtimeConfig.Unlock()
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Tracking = val
+		})
 		fmt.Printf("Tracking algorithm set to: %v\n", val)
+	case "cache":
+		if len(values) != 1 {
+			fmt.Println("Usage: set cache <true/false>")
+			return
+		}
+		val, err := strconv.ParseBool(values[0])
+		if err != nil {
+			fmt.Printf("Invalid boolean value: %s\n", values[0])
+			return
+		}
+		px.UpdateSettings(func(s *proxy.Settings) {
+			s.Cache = val
+		})
+		fmt.Printf("Response cache set to: %v\n", val)
 	default:
 		fmt.Printf("Unknown parameter for 'set': %s\n", param)
 	}
@@ -504,10 +703,26 @@ func handleSetCommand(param string, values []string) {
 func handleShowCommand(param string) {
 	if param == "" {
 		showGlobalConfig()
-		showChainConfig("Filter", filterChain, filterMidFlags)
-		showChainConfig("BaseDN", baseChain, baseDNMidFlags)
-		showChainConfig("AttrList", attrChain, attrListMidFlags)
-		showChainConfig("AttrEntries", entriesChain, attrEntriesMidFlags)
+		showFamilyChain("Filter", px.FilterChain(), proxy.FilterMidFlags)
+		showFamilyChain("BaseDN", px.BaseDNChain(), proxy.BaseDNMidFlags)
+		showFamilyChain("AttrList", px.AttrListChain(), proxy.AttrListMidFlags)
+		showFamilyChain("AttrEntries", px.AttrEntriesChain(), proxy.AttrEntriesMidFlags)
+		showFamilyChain("Controls", px.ControlsChain(), proxy.ControlsMidFlags)
+		showFamilyChain("BindName", px.BindNameChain(), proxy.BindNameMidFlags)
+		for _, name := range proxy.OperationChainNames {
+			if _, set := px.OperationChain(name); set {
+				showOperationChain(name)
+			}
+		}
+		return
+	}
+
+	if family, ok := chainPoolParams[param]; ok {
+		showChainPool(family)
+		return
+	}
+	if slices.Contains(proxy.OperationChainNames, param) {
+		showOperationChain(param)
 		return
 	}
 
@@ -515,69 +730,60 @@ func handleShowCommand(param string) {
 	case "global":
 		showGlobalConfig()
 	case "filter":
-		showChainConfig("Filter", filterChain, filterMidFlags)
+		showFamilyChain("Filter", px.FilterChain(), proxy.FilterMidFlags)
 	case "basedn":
-		showChainConfig("BaseDN", baseChain, baseDNMidFlags)
+		showFamilyChain("BaseDN", px.BaseDNChain(), proxy.BaseDNMidFlags)
 	case "attrlist":
-		showChainConfig("AttrList", attrChain, attrListMidFlags)
+		showFamilyChain("AttrList", px.AttrListChain(), proxy.AttrListMidFlags)
 	case "attrentries":
-		showChainConfig("AttrEntries", entriesChain, attrEntriesMidFlags)
+		showFamilyChain("AttrEntries", px.AttrEntriesChain(), proxy.AttrEntriesMidFlags)
+	case "controls":
+		showFamilyChain("Controls", px.ControlsChain(), proxy.ControlsMidFlags)
+	case "bindname":
+		showFamilyChain("BindName", px.BindNameChain(), proxy.BindNameMidFlags)
 	case "testbasedn":
 		fmt.Println(testBaseDN)
 	case "testattrlist":
 		fmt.Println(testAttrList)
+	case "testvariants":
+		fmt.Println(testVariants)
 	case "target":
-		runtimeConfig.RLock()
-		target := runtimeConfig.targetAddr
-		runtimeConfig.RUnlock()
-		fmt.Println(target)
+		fmt.Println(px.Settings().Target)
 	case "ldaps":
-		runtimeConfig.RLock()
-		ldapsMode := runtimeConfig.ldaps
-		runtimeConfig.RUnlock()
-		fmt.Printf("LDAPS mode: %v\n", ldapsMode)
+		fmt.Printf("LDAPS mode: %v\n", px.Settings().LDAPS)
 	case "options", "option":
 		showOptions()
 	case "stats":
 		showStatistics()
 	case "verbfwd":
-		runtimeConfig.RLock()
-		verbFwdLevel := runtimeConfig.verbFwd
-		runtimeConfig.RUnlock()
-		fmt.Printf("Forward verbosity level: %d\n", verbFwdLevel)
+		fmt.Printf("Forward verbosity level: %d\n", px.Settings().VerbFwd)
 	case "verbrev":
-		runtimeConfig.RLock()
-		verbRevLevel := runtimeConfig.verbRev
-		runtimeConfig.RUnlock()
-		fmt.Printf("Reverse verbosity level: %d\n", verbRevLevel)
+		fmt.Printf("Reverse verbosity level: %d\n", px.Settings().VerbRev)
 	case "socks":
-		runtimeConfig.RLock()
-		socksProxy := runtimeConfig.socksServer
-		runtimeConfig.RUnlock()
-		fmt.Printf("SOCKS proxy: '%s'\n", socksProxy)
+		fmt.Printf("SOCKS proxy: '%s'\n", px.Settings().SOCKS)
 	case "spoof-mechs":
-		runtimeConfig.RLock()
-		mechs, given := runtimeConfig.spoofMechs, runtimeConfig.spoofGiven
-		runtimeConfig.RUnlock()
-		if given {
-			fmt.Printf("SASL mechanism spoofing: %v\n", mechs)
+		if settings := px.Settings(); settings.SpoofMechsSet {
+			fmt.Printf("SASL mechanism spoofing: %v\n", settings.SpoofMechs)
 		} else {
 			fmt.Println("SASL mechanism spoofing: not configured")
 		}
 	case "split-wrapped":
-		runtimeConfig.RLock()
-		sw := runtimeConfig.splitWrapped
-		runtimeConfig.RUnlock()
-		if sw == "" {
+		if sw := px.Settings().SplitWrapped; sw == "" {
 			fmt.Println("Split-wrapped: default (bundling enabled)")
 		} else {
 			fmt.Printf("Split-wrapped: '%s'\n", sw)
 		}
+	case "split-search":
+		if ss := px.Settings().SplitSearch; ss == "" {
+			fmt.Println("Search splitting: disabled")
+		} else {
+			fmt.Printf("Search splitting: '%s'\n", ss)
+		}
 	case "tracking":
-		runtimeConfig.RLock()
-		t := runtimeConfig.tracking
-		runtimeConfig.RUnlock()
-		fmt.Printf("Tracking algorithm: %t\n", t)
+		fmt.Printf("Tracking algorithm: %t\n", px.Settings().Tracking)
+	case "cache":
+		fmt.Printf("Response cache: %t\n", px.Settings().Cache)
+		showCache()
 	default:
 		fmt.Printf("Unknown parameter for 'show': '%s'\n", param)
 	}
@@ -586,7 +792,7 @@ func showOptions() {
 	fmt.Println("[Middleware Options]")
 	for _, key := range middlewares.DefaultOptionsKeys {
 		defaultValue := middlewares.DefaultOptions[key]
-		if value, ok := options.Get(key); ok {
+		if value, ok := px.Option(key); ok {
 			fmt.Printf("  %s = %s (default = %s)\n", key, value, defaultValue)
 		} else {
 			fmt.Printf("  %s = %s\n", key, defaultValue)
@@ -604,17 +810,67 @@ func showChainConfig(name string, chain string, flags map[rune]string) {
 	}
 
 	fmt.Printf("  Chain: '%s'\n", chain)
-	for i, c := range chain {
-		if middlewareName, exists := flags[c]; exists {
+	elements, _ := proxy.ParseChain(chain)
+	for i, e := range elements {
+		if middlewareName, exists := flags[e.Code]; exists {
 			indent := strings.Repeat("  ", i)
-			fmt.Printf("  %s|> %s (%c)\n", indent, middlewareName, c)
+			fmt.Printf("  %s|> %s (%s)\n", indent, middlewareName, e)
 		}
 	}
 
 	fmt.Println("")
 }
 
-func printMiddlewareFlags(midFlags map[rune]string) {
+// showFamilyChain shows the chain of a family, or its pool if it has one.
+func showFamilyChain(family, chain string, flags map[rune]string) {
+	if chainPool(family) != "" {
+		showChainPool(family)
+		return
+	}
+	showChainConfig(family, chain, flags)
+}
+
+func showChainPool(family string) {
+	fmt.Printf("[%s pool]\n", family)
+	if pool := chainPool(family); pool != "" {
+		fmt.Printf("  Pool: '%s'\n", pool)
+		fmt.Println("  (a chain is drawn from the pool for each request - 'test' shows samples)")
+	} else {
+		fmt.Println("  (unset)")
+	}
+	fmt.Println("")
+}
+
+// showOperationChain shows an operation chain, or that the shared chain of
+// its family applies.
+func showOperationChain(name string) {
+	chain, set := px.OperationChain(name)
+	if !set {
+		fmt.Printf("[%s chain]\n", name)
+		fmt.Printf("  (unset - the shared %s chain applies)\n", operationChainFamily(name))
+		fmt.Println("")
+		return
+	}
+	showChainConfig(name, chain, operationChainFlags(name))
+}
+
+// operationChainFamily names the shared chain an operation chain overrides.
+func operationChainFamily(name string) string {
+	if strings.HasPrefix(name, "attrentries.") {
+		return "AttrEntries"
+	}
+	return "BaseDN"
+}
+
+// operationChainFlags returns the middleware letters of an operation chain.
+func operationChainFlags(name string) map[rune]string {
+	if operationChainFamily(name) == "AttrEntries" {
+		return proxy.AttrEntriesMidFlags
+	}
+	return proxy.BaseDNMidFlags
+}
+
+func printMiddlewareFlags(midFlags map[rune]string, params map[rune]map[string]string) {
 	var flags []rune
 	for flag := range midFlags {
 		flags = append(flags, flag)
@@ -623,8 +879,14 @@ func printMiddlewareFlags(midFlags map[rune]string) {
 		return flags[i] < flags[j]
 	})
 	for _, flag := range flags {
-		fmt.Printf("  %c - %s\n", flag, midFlags[flag])
+		if names := slices.Sorted(maps.Keys(params[flag])); len(names) > 0 {
+			fmt.Printf("  %c - %s (%s)\n", flag, midFlags[flag], strings.Join(names, ", "))
+		} else {
+			fmt.Printf("  %c - %s\n", flag, midFlags[flag])
+		}
 	}
+	fmt.Println("Parameters in parentheses can be given inline, overriding their options for that middleware")
+	fmt.Println("alone - e.g. 'C(prob=0.3)X(prob=0.9)'. Quote values holding commas: S(oids='1.2.3,1.2.4').")
 }
 
 func showHelp(args ...string) {
@@ -636,13 +898,21 @@ func showHelp(args ...string) {
 		fmt.Println("  help [<parameter>]         Show this help message or parameter-specific help")
 		fmt.Println("  exit                       Exit the program")
 		fmt.Println("  test <query>               Simulate an LDAP query through the middlewares without sending it")
+		fmt.Println("  search <query>             Send an LDAP query through the middlewares to the target and print the results")
 		fmt.Println("\nParameters:")
 		fmt.Println("  basedn        - BaseDN middleware chain")
 		fmt.Println("  filter        - Filter middleware chain")
 		fmt.Println("  attrlist      - Attributes list middleware chain")
 		fmt.Println("  attrentries   - AttrEntries middleware chain")
-		fmt.Println("  testbasedn    - BaseDN to use for the `test` command")
-		fmt.Println("  testattrlist  - Attributes list to use for the `test` command (separated by commas)")
+		fmt.Println("  controls      - Request controls middleware chain")
+		fmt.Println("  bindname      - Bind name middleware chain")
+		fmt.Println("  basedn.<op>   - BaseDN middleware chain of one operation, instead of the shared one")
+		fmt.Println("                  (search, modify, add, delete, modifydn.entry, modifydn.newrdn, modifydn.newsuperior)")
+		fmt.Println("  attrentries.<op> - AttrEntries middleware chain of one operation, instead of the shared one (modify, add)")
+		fmt.Println("  <chain>-pool  - Pool of chains to draw one from for each request, instead of the chain (e.g. filter-pool)")
+		fmt.Println("  testbasedn    - BaseDN to use for the `test` and `search` commands")
+		fmt.Println("  testattrlist  - Attributes list to use for the `test` and `search` commands (separated by commas)")
+		fmt.Println("  testvariants  - Variants the `test` command samples when a chain is drawn from a pool")
 		fmt.Println("  target        - Target address to connect upon receiving a connection")
 		fmt.Println("  ldaps         - Enable/disable LDAPS connection mode (true/false)")
 		fmt.Println("  stats         - Packet statistics")
@@ -657,7 +927,9 @@ func showHelp(args ...string) {
 		fmt.Println("  socks         - SOCKS proxy address to use for the target connection")
 		fmt.Println("  spoof-mechs   - SASL mechanisms to report in rootDSE supportedSASLMechanisms")
 		fmt.Println("  split-wrapped - Split bundled wrapped LDAP messages (in/out/both)")
+		fmt.Println("  split-search  - Split searches into sub-searches and merge the results (or/attrs/both)")
 		fmt.Println("  tracking      - Tracking algorithm for paged search cookie management (true/false)")
+		fmt.Println("  cache         - Response cache for repeated identical searches (true/false)")
 		fmt.Println("\nUse 'help <parameter>' for detailed information about specific parameters")
 		fmt.Println("")
 		return
@@ -666,20 +938,40 @@ func showHelp(args ...string) {
 	switch args[0] {
 	case "filter":
 		fmt.Println("Possible Filter middlewares:")
-		printMiddlewareFlags(filterMidFlags)
+		printMiddlewareFlags(proxy.FilterMidFlags, proxy.FilterChainParams)
+	case "filter-scope":
+		fmt.Println("scope - Restricts a filter middleware of the chain to the filter leaves on some attributes")
+		fmt.Println("  e.g.  set filter X(scope=memberOf)C  or  set filter R(scope='@sid,cn')O(scope=!objectClass)")
+		fmt.Println("  A scope is a comma-separated list of attribute patterns (* and ? wildcards) and syntax")
+		fmt.Println("  classes (@dn, @sid, @string, @int, @bool, @time, @oid); a '!' prefix excludes instead.")
+		fmt.Println("  A leaf is in scope if it matches an included entry (or none is given) and no excluded one.")
+		fmt.Println("  The middleware applies to the largest parts of the filter made only of leaves in scope.")
 	case "basedn":
 		fmt.Println("Possible BaseDN middlewares:")
-		printMiddlewareFlags(baseDNMidFlags)
+		printMiddlewareFlags(proxy.BaseDNMidFlags, proxy.BaseDNChainParams)
 	case "attrlist":
 		fmt.Println("Possible AttrList middlewares:")
-		printMiddlewareFlags(attrListMidFlags)
+		printMiddlewareFlags(proxy.AttrListMidFlags, proxy.AttrListChainParams)
 	case "attrentries":
 		fmt.Println("Possible AttrEntries middlewares:")
-		printMiddlewareFlags(attrEntriesMidFlags)
+		printMiddlewareFlags(proxy.AttrEntriesMidFlags, proxy.AttrEntriesChainParams)
+	case "controls":
+		fmt.Println("Possible Controls middlewares:")
+		printMiddlewareFlags(proxy.ControlsMidFlags, proxy.ControlsChainParams)
+	case "bindname":
+		fmt.Println("Possible BindName middlewares:")
+		printMiddlewareFlags(proxy.BindNameMidFlags, proxy.BindNameChainParams)
 	case "testbasedn":
-		fmt.Println("testbasedn - BaseDN to use for the `test` command")
+		fmt.Println("testbasedn - BaseDN to use for the `test` and `search` commands")
 	case "testattrlist":
-		fmt.Println("testattrlist - Attributes list to use for the `test` command (separated by commas)")
+		fmt.Println("testattrlist - Attributes list to use for the `test` and `search` commands (separated by commas)")
+	case "testvariants":
+		fmt.Println("testvariants - Variants the `test` command samples when the filter, basedn or attrlist chain is drawn from a pool")
+	case "filter-pool", "basedn-pool", "attrlist-pool", "attrentries-pool", "controls-pool", "bindname-pool":
+		fmt.Printf("%s - Pool of %s chains to draw one from for each request, replacing the %s chain\n", args[0], chainPoolParams[args[0]], chainPoolParams[args[0]])
+		fmt.Println("  A pool is a comma-separated list of CHAIN:WEIGHT entries (the weight defaults to 1),")
+		fmt.Println("  e.g. 'set filter-pool ODR:3,XSB:1,TMx:1'. An entry in braces, as '{OCXSB}:2', draws a random")
+		fmt.Println("  subset of its middlewares in random order. Each draw is logged.")
 	case "target":
 		fmt.Println("target - Target address to connect upon receiving a connection (can only be set or shown)")
 	case "ldaps":
@@ -710,10 +1002,21 @@ func showHelp(args ...string) {
 		fmt.Println("  'out'  - Split T->C direction")
 		fmt.Println("  'both' - Split both directions")
 		fmt.Println("  ''     - Disable splitting (default bundling)")
+	case "split-search":
+		fmt.Println("split-search - Send each search as several sub-searches and merge their results")
+		fmt.Println("  'or'    - One sub-search per element of a top-level OR filter")
+		fmt.Println("  'attrs' - One sub-search per SplitSearchAttrsPerSearch attributes of the attributes list")
+		fmt.Println("  'both'  - Every combination of the two")
+		fmt.Println("  ''      - Disable splitting (default)")
+		fmt.Println("  Searches carrying paging, sorting, VLV, DirSync, sync or notification controls are never split")
 	case "tracking":
 		fmt.Println("tracking - Enable/disable the tracking algorithm for paged search cookie management")
 		fmt.Println("  true  - Tracking enabled (avoids cookie desync with complex middlewares)")
 		fmt.Println("  false - Tracking disabled (may cause cookie desync issues)")
+	case "cache":
+		fmt.Println("cache - Enable/disable the response cache for repeated identical searches")
+		fmt.Println("  Results are kept for CacheTTL seconds, up to CacheMaxSearches searches of at most CacheMaxEntries entries")
+		fmt.Println("  'show cache' lists the cached searches and 'clear cache' empties the cache")
 	default:
 		fmt.Printf("Unknown parameter: %s\n", args[0])
 	}
@@ -721,30 +1024,32 @@ func showHelp(args ...string) {
 }
 func showGlobalConfig() {
 	fmt.Printf("[Global settings]\n")
-	verbFwd, verbRev := runtimeConfig.GetVerbosity()
-	targetAddr, socksProxy, ldapsMode := runtimeConfig.GetConnectionConfig()
-	intercepts := runtimeConfig.GetInterceptFlags()
+	settings := px.Settings()
+	intercepts := settings.Intercept
 
-	fmt.Printf("  Forward Verbosity: %d\n", verbFwd)
-	fmt.Printf("  Reverse Verbosity: %d\n", verbRev)
+	fmt.Printf("  Forward Verbosity: %d\n", settings.VerbFwd)
+	fmt.Printf("  Reverse Verbosity: %d\n", settings.VerbRev)
 	fmt.Printf("  Listen address: %s\n", proxyLDAPAddr)
-	fmt.Printf("  Target address: %s\n", targetAddr)
-	fmt.Printf("  Target LDAPS: %t\n", ldapsMode)
-	fmt.Printf("  SOCKS proxy: '%s'\n", socksProxy)
-	fmt.Printf("  Tracking algorithm: %t\n", runtimeConfig.GetTracking())
-	sw := runtimeConfig.GetSplitWrapped()
+	fmt.Printf("  Target address: %s\n", settings.Target)
+	fmt.Printf("  Target LDAPS: %t\n", settings.LDAPS)
+	fmt.Printf("  SOCKS proxy: '%s'\n", settings.SOCKS)
+	fmt.Printf("  Tracking algorithm: %t\n", settings.Tracking)
+	fmt.Printf("  Response cache: %t\n", settings.Cache)
+	sw := settings.SplitWrapped
 	if sw == "" {
 		fmt.Println("  Split-wrapped: default (bundling enabled)")
 	} else {
 		fmt.Printf("  Split-wrapped: '%s'\n", sw)
 	}
-	{
-		mechs, given := runtimeConfig.GetSpoofMechConfig()
-		if given {
-			fmt.Printf("  SASL mechanism spoofing: %v\n", mechs)
-		} else {
-			fmt.Println("  SASL mechanism spoofing: not configured")
-		}
+	if ss := settings.SplitSearch; ss == "" {
+		fmt.Println("  Search splitting: disabled")
+	} else {
+		fmt.Printf("  Search splitting: '%s'\n", ss)
+	}
+	if settings.SpoofMechsSet {
+		fmt.Printf("  SASL mechanism spoofing: %v\n", settings.SpoofMechs)
+	} else {
+		fmt.Println("  SASL mechanism spoofing: not configured")
 	}
 
 	fmt.Printf("\n[Interceptions]\n")
@@ -757,6 +1062,7 @@ func showGlobalConfig() {
 	fmt.Printf("  Test BaseDN: '%s'\n", testBaseDN)
 	testAttrs, _ := json.Marshal(testAttrList)
 	fmt.Printf("  Test Attributes: %s\n", testAttrs)
+	fmt.Printf("  Test Variants: %d\n", testVariants)
 	fmt.Println("")
 }
 
@@ -784,35 +1090,62 @@ func handleTestCommand(query string) {
 	inputMsg.WriteString(blue.Sprintf("  Filter: %s", parsed))
 	fmt.Println(inputMsg.String())
 
-	// Transform using current middleware chains
-	newFilter, newBaseDN, newAttrs := TransformSearchRequest(
-		filter,
-		testBaseDN,
-		testAttrList,
-	)
+	// Chains drawn from a pool differ between requests, so several
+	// variants are sampled to show what the pool produces
+	variants := 1
+	if px.FilterPool() != "" || px.BaseDNPool() != "" || px.AttrListPool() != "" {
+		variants = testVariants
+	}
 
-	newParsed, err := parser.FilterToQuery(newFilter)
-	if err != nil {
-		fmt.Println(red.Sprintf("Unknown error: '%v'", err))
+	for i := range variants {
+		// Transform using current middleware chains; each variant starts
+		// from a fresh copy, as middlewares may modify the filter in place
+		if i > 0 {
+			filter, _ = parser.QueryToFilter(query)
+		}
+		newFilter, newBaseDN, newAttrs := px.TransformSearchRequest(
+			filter,
+			testBaseDN,
+			slices.Clone(testAttrList),
+		)
+
+		newParsed, err := parser.FilterToQuery(newFilter)
+		if err != nil {
+			fmt.Println(red.Sprintf("Unknown error: '%v'", err))
+		}
+
+		var outputMsg strings.Builder
+		if variants > 1 {
+			outputMsg.WriteString(green.Sprintf("Output Request (variant %d/%d):\n", i+1, variants))
+		} else {
+			outputMsg.WriteString(green.Sprintf("Output Request:\n"))
+		}
+		outputMsg.WriteString(green.Sprintf("  BaseDN: %s\n", newBaseDN))
+		outputMsg.WriteString(green.Sprintf("  Attributes: %v\n", newAttrs))
+		outputMsg.WriteString(green.Sprintf("  Filter: %v", newParsed))
+		fmt.Println(outputMsg.String())
 	}
+}
+
+func handleSearchCommand(query string) {
+	fmt.Printf("%s\n", strings.Repeat("─", 55))
+	log.Log.Printf("[+] LDAP Search")
+	log.Log.Printf("[+] Input: %s", query)
 
-	var outputMsg strings.Builder
-	outputMsg.WriteString(green.Sprintf("Output Request:\n"))
-	outputMsg.WriteString(green.Sprintf("  BaseDN: %s\n", newBaseDN))
-	outputMsg.WriteString(green.Sprintf("  Attributes: %v\n", newAttrs))
-	outputMsg.WriteString(green.Sprintf("  Filter: %v", newParsed))
-	fmt.Println(outputMsg.String())
+	if err := runQuery(query, testBaseDN, testAttrList, os.Stdout); err != nil {
+		fmt.Println(red.Sprintf("Search failed: %v", err))
+	}
 }
 
 func showStatistics() {
-	globalStats.Lock()
+	stats := px.Stats()
 	fmt.Println("[Client -> Target]")
-	fmt.Printf("  Packets Received: %d\n", globalStats.Forward.PacketsReceived)
-	fmt.Printf("  Packets Sent: %d\n", globalStats.Forward.PacketsSent)
-	fmt.Printf("  Bytes Received: %d\n", globalStats.Forward.BytesReceived)
-	fmt.Printf("  Bytes Sent: %d\n", globalStats.Forward.BytesSent)
+	fmt.Printf("  Packets Received: %d\n", stats.Forward.PacketsReceived)
+	fmt.Printf("  Packets Sent: %d\n", stats.Forward.PacketsSent)
+	fmt.Printf("  Bytes Received: %d\n", stats.Forward.BytesReceived)
+	fmt.Printf("  Bytes Sent: %d\n", stats.Forward.BytesSent)
 	fmt.Println("  Counts by Type:")
-	for appType, count := range globalStats.Forward.CountsByType {
+	for appType, count := range stats.Forward.CountsByType {
 		appName, ok := parser.ApplicationMap[uint8(appType)]
 		if !ok {
 			appName = fmt.Sprintf("Unknown (%d)", appType)
@@ -821,36 +1154,35 @@ func showStatistics() {
 	}
 
 	fmt.Println("\n[Client <- Target]")
-	fmt.Printf("  Packets Received: %d\n", globalStats.Reverse.PacketsReceived)
-	fmt.Printf("  Packets Sent: %d\n", globalStats.Reverse.PacketsSent)
-	fmt.Printf("  Bytes Received: %d\n", globalStats.Reverse.BytesReceived)
-	fmt.Printf("  Bytes Sent: %d\n", globalStats.Reverse.BytesSent)
+	fmt.Printf("  Packets Received: %d\n", stats.Reverse.PacketsReceived)
+	fmt.Printf("  Packets Sent: %d\n", stats.Reverse.PacketsSent)
+	fmt.Printf("  Bytes Received: %d\n", stats.Reverse.BytesReceived)
+	fmt.Printf("  Bytes Sent: %d\n", stats.Reverse.BytesSent)
 	fmt.Println("  Counts by Type:")
-	for appType, count := range globalStats.Reverse.CountsByType {
+	for appType, count := range stats.Reverse.CountsByType {
 		appName, ok := parser.ApplicationMap[uint8(appType)]
 		if !ok {
 			appName = fmt.Sprintf("Unknown (%d)", appType)
 		}
 		fmt.Printf("    %s: %d\n", appName, count)
 	}
-	globalStats.Unlock()
 }
 
 func clearStatistics() {
-	globalStats.Lock()
-	globalStats.Forward.PacketsReceived = 0
-	globalStats.Forward.PacketsSent = 0
-	globalStats.Forward.BytesReceived = 0
-	globalStats.Forward.BytesSent = 0
-	for k := range globalStats.Forward.CountsByType {
-		delete(globalStats.Forward.CountsByType, k)
-	}
-	globalStats.Reverse.PacketsReceived = 0
-	globalStats.Reverse.PacketsSent = 0
-	globalStats.Reverse.BytesReceived = 0
-	globalStats.Reverse.BytesSent = 0
-	for k := range globalStats.Reverse.CountsByType {
-		delete(globalStats.Reverse.CountsByType, k)
-	}
-	globalStats.Unlock()
+	px.ResetStats()
+}
+
+func showCache() {
+	stats := px.CacheStats()
+	fmt.Printf("Cached searches: %d (hits: %d, misses: %d)\n", len(stats.Searches), stats.Hits, stats.Misses)
+
+	now := time.Now()
+	for _, search := range stats.Searches {
+		identity := search.Identity
+		if identity == "" {
+			identity = "anonymous"
+		}
+		fmt.Printf("  [%s] %s\n", identity, search.Description)
+		fmt.Printf("      Entries: %d | Hits: %d | Expires in: %s\n", search.Entries, search.Hits, search.Expires.Sub(now).Truncate(time.Second))
+	}
 }
@@ -0,0 +1,134 @@
+package bindname
+
+import (
+	"strings"
+
+	"github.com/Macmod/ldapx/middlewares/helpers"
+)
+
+/*
+	Obfuscation BindName Middlewares
+
+	AD accepts the name of a simple bind in several forms besides the DN
+	(MS-ADTS 5.1.1.1.1): the UPN (user@domain), the NT4 form (DOMAIN\user),
+	and the `<SID=...>` / `<GUID=...>` forms of the account. The forms that
+	can't be derived from the one the client sent are taken from options.
+
+	References:
+	- Microsoft Open Specifications - MS-ADTS 5.1.1.1.1 (Simple Authentication)
+*/
+
+// isDN reports whether a bind name is in DN form, as opposed to one of the
+// other forms AD accepts.
+func isDN(name string) bool {
+	return !strings.HasPrefix(name, "<") && strings.Contains(name, "=")
+}
+
+// shouldReplaceName reports whether a bind name is eligible for replacement
+// by another form. An empty (anonymous) name is never replaced; when match
+// is set, only the name it names is, so that only binds as one account are
+// rewritten.
+func shouldReplaceName(name string, match string) bool {
+	if name == "" {
+		return false
+	}
+
+	if match == "" {
+		return true
+	}
+
+	return strings.EqualFold(name, match)
+}
+
+// DNObfBindNameObf applies a BaseDN middleware to bind names in DN form,
+// leaving the other forms alone.
+func DNObfBindNameObf(mid func(string) string) func(BindName) BindName {
+	return func(bn BindName) BindName {
+		if mid != nil && isDN(bn.Name) {
+			bn.Name = mid(bn.Name)
+		}
+		return bn
+	}
+}
+
+// DNFormBindNameObf replaces the bind name with the DN of the account.
+func DNFormBindNameObf(dn string, match string) func(BindName) BindName {
+	return func(bn BindName) BindName {
+		if dn != "" && shouldReplaceName(bn.Name, match) {
+			bn.Name = dn
+		}
+		return bn
+	}
+}
+
+// UPNFormBindNameObf replaces the bind name with the UPN of the account, or
+// if none is given, converts an NT4 name to user@dnsDomain.
+func UPNFormBindNameObf(upn string, dnsDomain string, match string) func(BindName) BindName {
+	return func(bn BindName) BindName {
+		if !shouldReplaceName(bn.Name, match) {
+			return bn
+		}
+
+		if upn != "" {
+			bn.Name = upn
+		} else if _, user, ok := strings.Cut(bn.Name, `\`); ok && dnsDomain != "" && !isDN(bn.Name) {
+			bn.Name = user + "@" + dnsDomain
+		}
+		return bn
+	}
+}
+
+// NT4FormBindNameObf replaces the bind name with the DOMAIN\user name of
+// the account, or if none is given, converts a UPN to it. The NetBIOS
+// domain name defaults to the first label of the UPN suffix, which is what
+// it is unless the domain was renamed or named otherwise on creation.
+func NT4FormBindNameObf(nt4 string, netbiosDomain string, match string) func(BindName) BindName {
+	return func(bn BindName) BindName {
+		if !shouldReplaceName(bn.Name, match) {
+			return bn
+		}
+
+		if nt4 != "" {
+			bn.Name = nt4
+		} else if user, domain, ok := strings.Cut(bn.Name, "@"); ok && !isDN(bn.Name) {
+			netbios := netbiosDomain
+			if netbios == "" {
+				label, _, _ := strings.Cut(domain, ".")
+				netbios = strings.ToUpper(label)
+			}
+			bn.Name = netbios + `\` + user
+		}
+		return bn
+	}
+}
+
+// SIDFormBindNameObf replaces the bind name with the <SID=sid> form of the
+// account.
+func SIDFormBindNameObf(sid string, match string) func(BindName) BindName {
+	return func(bn BindName) BindName {
+		if sid != "" && shouldReplaceName(bn.Name, match) {
+			bn.Name = "<SID=" + sid + ">"
+		}
+		return bn
+	}
+}
+
+// GUIDFormBindNameObf replaces the bind name with the <GUID=guid> form of
+// the account.
+func GUIDFormBindNameObf(guidHex string, match string) func(BindName) BindName {
+	return func(bn BindName) BindName {
+		if guidHex != "" && shouldReplaceName(bn.Name, match) {
+			bn.Name = "<GUID=" + guidHex + ">"
+		}
+		return bn
+	}
+}
+
+// RandCaseMechanismBindNameObf randomly changes the case of the SASL
+// mechanism name, which AD matches case-insensitively.
+func RandCaseMechanismBindNameObf(prob float64) func(BindName) BindName {
+	return func(bn BindName) BindName {
+		bn.Mechanism = helpers.RandomlyChangeCaseString(bn.Mechanism, prob)
+		return bn
+	}
+}
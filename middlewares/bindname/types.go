@@ -0,0 +1,37 @@
+package bindname
+
+import "github.com/Macmod/ldapx/log"
+
+// BindName holds the parts of a BindRequest the BindName middlewares
+// rewrite: the name, and the mechanism of SASL binds ("" for other binds)
+type BindName struct {
+	Name      string
+	Mechanism string
+}
+
+// BindNameMiddleware is a function that takes a BindName and returns a new one
+type BindNameMiddleware func(BindName) BindName
+
+type BindNameMiddlewareDefinition struct {
+	Name string
+	Func func() BindNameMiddleware
+}
+
+type BindNameMiddlewareChain struct {
+	Middlewares []BindNameMiddlewareDefinition
+}
+
+func (c *BindNameMiddlewareChain) Add(m BindNameMiddlewareDefinition) {
+	c.Middlewares = append(c.Middlewares, m)
+}
+
+func (c *BindNameMiddlewareChain) Execute(name BindName, verbose bool) BindName {
+	current := name
+	for _, middleware := range c.Middlewares {
+		if verbose {
+			log.Log.Printf("[+] Applying middleware on BindName: %s", middleware.Name)
+		}
+		current = middleware.Func()(current)
+	}
+	return current
+}
@@ -0,0 +1,136 @@
+package controls
+
+import (
+	"math/rand"
+	"slices"
+
+	"github.com/Macmod/ldapx/middlewares/helpers"
+	"github.com/Macmod/ldapx/parser"
+)
+
+/*
+	Obfuscation Controls Middlewares
+
+	References:
+	- RFC 4511 section 4.1.11 - Controls
+	- Microsoft Open Specifications - MS-ADTS (LDAP Extended Controls)
+	  https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-adts/d2435927-0999-4c62-8c6d-13ba31a52e1a)
+*/
+
+// StripControlsObf removes every control whose OID is in oids
+func StripControlsObf(oids []string) ControlsMiddleware {
+	return func(controls parser.Controls) parser.Controls {
+		result := make(parser.Controls, 0, len(controls))
+		for _, control := range controls {
+			if !slices.Contains(oids, control.OID) {
+				result = append(result, control)
+			}
+		}
+		return result
+	}
+}
+
+// AddNoiseControlsObf appends up to maxElems controls picked from oids that
+// are not already present, each with criticality FALSE and no value. The
+// pool should only hold controls the server can ignore or that don't change
+// what the client is looking for.
+func AddNoiseControlsObf(maxElems int, oids []string) ControlsMiddleware {
+	return func(controls parser.Controls) parser.Controls {
+		result := make(parser.Controls, len(controls))
+		copy(result, controls)
+
+		if maxElems <= 0 {
+			return result
+		}
+
+		var candidates []string
+		for _, oid := range oids {
+			if !slices.ContainsFunc(result, func(c parser.Control) bool { return c.OID == oid }) {
+				candidates = append(candidates, oid)
+			}
+		}
+		if len(candidates) == 0 {
+			return result
+		}
+
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+
+		count := 1 + rand.Intn(maxElems)
+		if count > len(candidates) {
+			count = len(candidates)
+		}
+		for _, oid := range candidates[:count] {
+			result = append(result, parser.Control{
+				OID:                 oid,
+				Criticality:         false,
+				ExplicitCriticality: rand.Intn(2) == 0,
+			})
+		}
+
+		return result
+	}
+}
+
+// ReorderControlsObf randomly reorders the controls
+func ReorderControlsObf() ControlsMiddleware {
+	return func(controls parser.Controls) parser.Controls {
+		result := make(parser.Controls, len(controls))
+		copy(result, controls)
+
+		rand.Shuffle(len(result), func(i, j int) {
+			result[i], result[j] = result[j], result[i]
+		})
+
+		return result
+	}
+}
+
+// FlipCriticalityControlsObf flips the criticality of each control with
+// probability prob. A control that becomes non-critical is written with an
+// explicit FALSE half of the time and with the field omitted otherwise.
+// Note that raising a control the server doesn't support to critical makes
+// the operation fail with unavailableCriticalExtension. The paged results
+// control is left alone (see preservedControl).
+func FlipCriticalityControlsObf(prob float64) ControlsMiddleware {
+	return func(controls parser.Controls) parser.Controls {
+		result := make(parser.Controls, len(controls))
+		copy(result, controls)
+
+		for i := range result {
+			if preservedControl(result[i].OID) || rand.Float64() >= prob {
+				continue
+			}
+			result[i].Criticality = !result[i].Criticality
+			result[i].ExplicitCriticality = result[i].Criticality || rand.Intn(2) == 0
+		}
+
+		return result
+	}
+}
+
+// PrependZerosOIDControlsObf prepends random zeros to the arcs of each
+// control's OID, except the paged results control (see preservedControl)
+func PrependZerosOIDControlsObf(maxZeros int) ControlsMiddleware {
+	return func(controls parser.Controls) parser.Controls {
+		result := make(parser.Controls, len(controls))
+		copy(result, controls)
+
+		for i := range result {
+			if parser.IsOID(result[i].OID) && !preservedControl(result[i].OID) {
+				result[i].OID = helpers.RandomlyPrependZerosOID(result[i].OID, maxZeros)
+			}
+		}
+
+		return result
+	}
+}
+
+// preservedControl tells whether a control's OID and criticality must be kept
+// as they are. The paged results control is matched by its exact OID, both by
+// the proxy's paging tracking and by clients reading it back from responses,
+// so changing it breaks paging.
+func preservedControl(oid string) bool {
+	return oid == parser.ControlTypePaging
+}
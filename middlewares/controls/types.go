@@ -0,0 +1,33 @@
+package controls
+
+import (
+	"github.com/Macmod/ldapx/log"
+	"github.com/Macmod/ldapx/parser"
+)
+
+// ControlsMiddleware is a function that takes the controls of a request and returns a new list of controls
+type ControlsMiddleware func(parser.Controls) parser.Controls
+
+type ControlsMiddlewareDefinition struct {
+	Name string
+	Func func() ControlsMiddleware
+}
+
+type ControlsMiddlewareChain struct {
+	Middlewares []ControlsMiddlewareDefinition
+}
+
+func (c *ControlsMiddlewareChain) Add(m ControlsMiddlewareDefinition) {
+	c.Middlewares = append(c.Middlewares, m)
+}
+
+func (c *ControlsMiddlewareChain) Execute(controls parser.Controls, verbose bool) parser.Controls {
+	current := controls
+	for _, middleware := range c.Middlewares {
+		if verbose {
+			log.Log.Printf("[+] Applying middleware on Controls: %s", middleware.Name)
+		}
+		current = middleware.Func()(current)
+	}
+	return current
+}
@@ -0,0 +1,197 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Macmod/ldapx/parser"
+)
+
+// AttrSyntaxClasses group the token formats of parser.AttrContexts into the
+// syntax classes an AttrScope can name as @class.
+var AttrSyntaxClasses = map[string][]parser.LDAPTokenFormat{
+	"dn":     {parser.TokenDNString, parser.TokenDNWithBinary},
+	"sid":    {parser.TokenSID},
+	"string": {parser.TokenStringUnicode, parser.TokenStringIA5, parser.TokenStringTeletex, parser.TokenStringNumeric},
+	"int":    {parser.TokenIntEnumeration, parser.TokenIntTimeInterval, parser.TokenBitwise},
+	"bool":   {parser.TokenBoolean},
+	"time":   {parser.TokenDateTime},
+	"oid":    {parser.TokenStringObjectIdentifier, parser.TokenOID},
+}
+
+// AttrScope restricts a filter middleware to the leaves of a filter on some
+// attributes. Include and Exclude hold attribute name patterns, with '*'
+// and '?' wildcards, and syntax classes as @class (see AttrSyntaxClasses).
+// A leaf is in scope if it matches an Include entry (or Include is empty)
+// and no Exclude entry.
+type AttrScope struct {
+	Include []string
+	Exclude []string
+}
+
+// ParseAttrScope parses a comma-separated list of patterns and @classes,
+// where a leading '!' makes an entry an exclusion - e.g.
+// "memberOf,@sid,!objectClass".
+func ParseAttrScope(spec string) (AttrScope, error) {
+	var scope AttrScope
+	for _, term := range strings.Split(spec, ",") {
+		term = strings.TrimSpace(term)
+		exclude := strings.HasPrefix(term, "!")
+		term = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(term, "!")))
+		if term == "" {
+			continue
+		}
+
+		if class, isClass := strings.CutPrefix(term, "@"); isClass {
+			if _, ok := AttrSyntaxClasses[class]; !ok {
+				return AttrScope{}, fmt.Errorf("unknown syntax class '@%s' (use %s)", class, strings.Join(attrSyntaxClassNames(), ", "))
+			}
+		} else if _, err := path.Match(term, ""); err != nil {
+			return AttrScope{}, fmt.Errorf("invalid attribute pattern '%s'", term)
+		}
+
+		if exclude {
+			scope.Exclude = append(scope.Exclude, term)
+		} else {
+			scope.Include = append(scope.Include, term)
+		}
+	}
+	return scope, nil
+}
+
+// String returns the scope in the form ParseAttrScope reads.
+func (s AttrScope) String() string {
+	terms := append([]string(nil), s.Include...)
+	for _, term := range s.Exclude {
+		terms = append(terms, "!"+term)
+	}
+	return strings.Join(terms, ",")
+}
+
+// Empty tells whether the scope puts every leaf in scope.
+func (s AttrScope) Empty() bool {
+	return len(s.Include) == 0 && len(s.Exclude) == 0
+}
+
+// Matches tells whether a leaf on attributeDesc is in scope. The attribute
+// is also recognized in the OID forms OIDAttribute produces.
+func (s AttrScope) Matches(attributeDesc string) bool {
+	name, format, known := resolveAttr(attributeDesc)
+
+	matches := func(terms []string) bool {
+		for _, term := range terms {
+			if class, isClass := strings.CutPrefix(term, "@"); isClass {
+				if known && slices.Contains(AttrSyntaxClasses[class], format) {
+					return true
+				}
+			} else if ok, _ := path.Match(term, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(s.Include) > 0 && !matches(s.Include) {
+		return false
+	}
+	return !matches(s.Exclude)
+}
+
+// ScopedFilterMiddleware applies fm to the largest subtrees of a filter
+// whose leaves are all in scope, and leaves the rest of the filter as it
+// is. Leaf middlewares thus reach every leaf in scope, and structural ones
+// (reordering, De Morgan, added booleans) still get the AND/OR/NOT nodes
+// made only of leaves in scope, rather than single leaves to do nothing on.
+func ScopedFilterMiddleware(fm FilterMiddleware, scope AttrScope) FilterMiddleware {
+	if scope.Empty() {
+		return fm
+	}
+
+	var applier FilterMiddleware
+	applier = func(filter parser.Filter) parser.Filter {
+		if scope.covers(filter) {
+			return fm(filter)
+		}
+
+		switch f := filter.(type) {
+		case *parser.FilterAnd:
+			newFilters := make([]parser.Filter, len(f.Filters))
+			for i, subFilter := range f.Filters {
+				newFilters[i] = applier(subFilter)
+			}
+			return &parser.FilterAnd{Filters: newFilters}
+		case *parser.FilterOr:
+			newFilters := make([]parser.Filter, len(f.Filters))
+			for i, subFilter := range f.Filters {
+				newFilters[i] = applier(subFilter)
+			}
+			return &parser.FilterOr{Filters: newFilters}
+		case *parser.FilterNot:
+			return &parser.FilterNot{Filter: applier(f.Filter)}
+		}
+		return filter
+	}
+	return applier
+}
+
+// covers tells whether every leaf of filter is in scope.
+func (s AttrScope) covers(filter parser.Filter) bool {
+	switch f := filter.(type) {
+	case *parser.FilterAnd:
+		return !slices.ContainsFunc(f.Filters, func(sub parser.Filter) bool { return !s.covers(sub) })
+	case *parser.FilterOr:
+		return !slices.ContainsFunc(f.Filters, func(sub parser.Filter) bool { return !s.covers(sub) })
+	case *parser.FilterNot:
+		return s.covers(f.Filter)
+	}
+
+	attributeDesc, err := parser.GetAttrName(filter)
+	return err == nil && attributeDesc != "" && s.Matches(attributeDesc)
+}
+
+func attrSyntaxClassNames() []string {
+	names := make([]string, 0, len(AttrSyntaxClasses))
+	for name := range AttrSyntaxClasses {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// attrsByOID maps the OIDs of parser.AttrContexts to their keys.
+var attrsByOID = sync.OnceValue(func() map[string]string {
+	m := make(map[string]string, len(parser.AttrContexts))
+	for key, context := range parser.AttrContexts {
+		m[context.OID] = key
+	}
+	return m
+})
+
+// resolveAttr returns the lowercase name of an attribute description,
+// without options, and its token format if it is in parser.AttrContexts.
+// OIDs, with or without the "oid." prefix, padding zeros or trailing
+// spaces, resolve to the name they stand for.
+func resolveAttr(attributeDesc string) (string, parser.LDAPTokenFormat, bool) {
+	name, _, _ := strings.Cut(attributeDesc, ";")
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if parser.IsOID(name) {
+		arcs := strings.Split(strings.TrimPrefix(name, "oid."), ".")
+		for i, arc := range arcs {
+			if n, err := strconv.ParseUint(arc, 10, 64); err == nil {
+				arcs[i] = strconv.FormatUint(n, 10)
+			}
+		}
+		name = strings.Join(arcs, ".")
+		if key, ok := attrsByOID()[name]; ok {
+			name = key
+		}
+	}
+
+	context, ok := parser.AttrContexts[name]
+	return name, context.Format, ok
+}
@@ -0,0 +1,106 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/Macmod/ldapx/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAttrScope(t *testing.T) {
+	testCases := []struct {
+		name     string
+		spec     string
+		expected AttrScope
+		wantErr  bool
+	}{
+		{name: "Empty", spec: "", expected: AttrScope{}},
+		{name: "Single attribute", spec: "memberOf", expected: AttrScope{Include: []string{"memberof"}}},
+		{name: "Include and exclude", spec: "cn, !objectClass,sn", expected: AttrScope{Include: []string{"cn", "sn"}, Exclude: []string{"objectclass"}}},
+		{name: "Syntax classes", spec: "@sid,!@dn", expected: AttrScope{Include: []string{"@sid"}, Exclude: []string{"@dn"}}},
+		{name: "Wildcards", spec: "ms-DS-*,!?n", expected: AttrScope{Include: []string{"ms-ds-*"}, Exclude: []string{"?n"}}},
+		{name: "Empty terms", spec: ",cn,,", expected: AttrScope{Include: []string{"cn"}}},
+		{name: "Unknown syntax class", spec: "@nope", wantErr: true},
+		{name: "Invalid pattern", spec: "cn[", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scope, err := ParseAttrScope(tc.spec)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, scope)
+		})
+	}
+}
+
+func TestAttrScopeMatches(t *testing.T) {
+	testCases := []struct {
+		name          string
+		spec          string
+		attributeDesc string
+		expected      bool
+	}{
+		{name: "Empty scope", spec: "", attributeDesc: "cn", expected: true},
+		{name: "Included", spec: "memberOf", attributeDesc: "memberOf", expected: true},
+		{name: "Included case-insensitively", spec: "memberOf", attributeDesc: "MEMBEROF", expected: true},
+		{name: "Not included", spec: "memberOf", attributeDesc: "cn", expected: false},
+		{name: "Excluded", spec: "!objectClass", attributeDesc: "objectClass", expected: false},
+		{name: "Not excluded", spec: "!objectClass", attributeDesc: "cn", expected: true},
+		{name: "Exclusion wins over inclusion", spec: "*,!cn", attributeDesc: "cn", expected: false},
+		{name: "Wildcard", spec: "member*", attributeDesc: "memberOf", expected: true},
+		{name: "Syntax class", spec: "@sid", attributeDesc: "objectSid", expected: true},
+		{name: "Other syntax class", spec: "@sid", attributeDesc: "memberOf", expected: false},
+		{name: "Excluded syntax class", spec: "!@dn", attributeDesc: "memberOf", expected: false},
+		{name: "Unknown attribute in a class", spec: "@dn", attributeDesc: "notAnAttribute", expected: false},
+		{name: "Attribute options", spec: "member", attributeDesc: "member;range=0-*", expected: true},
+		{name: "OID", spec: "objectSid", attributeDesc: "1.2.840.113556.1.4.146", expected: true},
+		{name: "OID with prefix", spec: "objectSid", attributeDesc: "oid.1.2.840.113556.1.4.146", expected: true},
+		{name: "OID with prefix, zeros and spaces", spec: "@sid", attributeDesc: "OID.01.002.0840.113556.1.4.146  ", expected: true},
+		{name: "OID of another attribute", spec: "objectSid", attributeDesc: "oid.2.5.4.3", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scope, err := ParseAttrScope(tc.spec)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, scope.Matches(tc.attributeDesc))
+		})
+	}
+}
+
+func TestScopedFilterMiddleware(t *testing.T) {
+	// Wraps whatever it is given in a NOT, so the tests show which parts of
+	// the filter it was applied to
+	wrap := func(f parser.Filter) parser.Filter { return &parser.FilterNot{Filter: f} }
+
+	testCases := []struct {
+		name     string
+		spec     string
+		query    string
+		expected string
+	}{
+		{name: "Empty scope", spec: "", query: "(&(cn=a)(sn=b))", expected: "(!(&(cn=a)(sn=b)))"},
+		{name: "Leaf in scope", spec: "cn", query: "(cn=a)", expected: "(!(cn=a))"},
+		{name: "Leaf out of scope", spec: "cn", query: "(sn=a)", expected: "(sn=a)"},
+		{name: "Mixed node", spec: "cn", query: "(&(cn=a)(sn=b))", expected: "(&(!(cn=a))(sn=b))"},
+		{name: "Node in scope", spec: "cn,sn", query: "(&(objectClass=user)(|(cn=a)(sn=b)))", expected: "(&(objectClass=user)(!(|(cn=a)(sn=b))))"},
+		{name: "Whole filter in scope", spec: "!objectClass", query: "(|(cn=a)(!(sn=b)))", expected: "(!(|(cn=a)(!(sn=b))))"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scope, err := ParseAttrScope(tc.spec)
+			assert.NoError(t, err)
+			filter, err := parser.QueryToFilter(tc.query)
+			assert.NoError(t, err)
+
+			result, err := parser.FilterToQuery(ScopedFilterMiddleware(wrap, scope)(filter))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+}
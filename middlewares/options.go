@@ -52,6 +52,49 @@ var DefaultOptions = map[string]string{
 	"AttrEntriesOIDAttributeMaxSpaces":     "4",
 	"AttrEntriesOIDAttributeMaxZeros":      "4",
 	"AttrEntriesOIDAttributeIncludePrefix": "true",
+
+	"CtrlStripOIDs":       "",
+	"CtrlNoiseMaxElems":   "2",
+	"CtrlNoiseOIDs":       "1.2.840.113556.1.4.417,1.2.840.113556.1.4.2309,1.2.840.113556.1.4.1339",
+	"CtrlCriticalityProb": "0.5",
+	"CtrlOIDMaxZeros":     "4",
+
+	"BindUPN":           "",
+	"BindNT4":           "",
+	"BindDN":            "",
+	"BindSid":           "",
+	"BindGuid":          "",
+	"BindMatch":         "",
+	"BindDNSDomain":     "",
+	"BindNetBIOSDomain": "",
+	"BindMechCaseProb":  "0.7",
+
+	"BERLongLength":           "false",
+	"BERLongLengthProb":       "0.5",
+	"BERPaddedLength":         "false",
+	"BERPaddedLengthProb":     "0.5",
+	"BERPaddedLengthMaxBytes": "2",
+	"BERIndefiniteLength":     "false",
+	"BERIndefiniteLengthProb": "0.5",
+	"BERIntPadding":           "false",
+	"BERIntPaddingProb":       "0.5",
+	"BERIntPaddingMaxBytes":   "2",
+
+	"NetSegment":           "false",
+	"NetSegmentMinBytes":   "1",
+	"NetSegmentMaxBytes":   "16",
+	"NetSegmentMaxDelayMs": "5",
+	"NetRequestDelayMs":    "0",
+	"NetRequestJitterMs":   "0",
+	"NetConnDelayMs":       "0",
+	"NetConnJitterMs":      "0",
+	"NetRateLimit":         "0",
+
+	"SplitSearchAttrsPerSearch": "1",
+
+	"CacheTTL":         "300",
+	"CacheMaxSearches": "256",
+	"CacheMaxEntries":  "1000",
 }
 
 var DefaultOptionsKeys = []string{
@@ -106,4 +149,47 @@ var DefaultOptionsKeys = []string{
 	"AttrEntriesOIDAttributeMaxSpaces",
 	"AttrEntriesOIDAttributeMaxZeros",
 	"AttrEntriesOIDAttributeIncludePrefix",
+
+	"CtrlStripOIDs",
+	"CtrlNoiseMaxElems",
+	"CtrlNoiseOIDs",
+	"CtrlCriticalityProb",
+	"CtrlOIDMaxZeros",
+
+	"BindUPN",
+	"BindNT4",
+	"BindDN",
+	"BindSid",
+	"BindGuid",
+	"BindMatch",
+	"BindDNSDomain",
+	"BindNetBIOSDomain",
+	"BindMechCaseProb",
+
+	"BERLongLength",
+	"BERLongLengthProb",
+	"BERPaddedLength",
+	"BERPaddedLengthProb",
+	"BERPaddedLengthMaxBytes",
+	"BERIndefiniteLength",
+	"BERIndefiniteLengthProb",
+	"BERIntPadding",
+	"BERIntPaddingProb",
+	"BERIntPaddingMaxBytes",
+
+	"NetSegment",
+	"NetSegmentMinBytes",
+	"NetSegmentMaxBytes",
+	"NetSegmentMaxDelayMs",
+	"NetRequestDelayMs",
+	"NetRequestJitterMs",
+	"NetConnDelayMs",
+	"NetConnJitterMs",
+	"NetRateLimit",
+
+	"SplitSearchAttrsPerSearch",
+
+	"CacheTTL",
+	"CacheMaxSearches",
+	"CacheMaxEntries",
 }
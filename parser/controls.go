@@ -0,0 +1,91 @@
+package parser
+
+import (
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// Control is a decoded RFC 4511 §4.1.11 Control:
+//
+//	Control ::= SEQUENCE {
+//	     controlType             LDAPOID,
+//	     criticality             BOOLEAN DEFAULT FALSE,
+//	     controlValue            OCTET STRING OPTIONAL }
+//
+// ExplicitCriticality records whether the criticality field was present on
+// the wire, since a BOOLEAN FALSE and an omitted DEFAULT FALSE decode to
+// the same value but encode differently.
+type Control struct {
+	OID                 string
+	Criticality         bool
+	ExplicitCriticality bool
+	Value               []byte
+	HasValue            bool
+}
+
+type Controls []Control
+
+// PacketToControls decodes the [0] Controls element of an LDAPMessage.
+// Elements that don't have the shape of a Control are skipped.
+func PacketToControls(packet *ber.Packet) Controls {
+	var controls Controls
+	if packet == nil {
+		return controls
+	}
+
+	for _, child := range packet.Children {
+		if len(child.Children) == 0 {
+			continue
+		}
+
+		control := Control{OID: string(child.Children[0].Data.Bytes())}
+		for _, field := range child.Children[1:] {
+			switch field.Tag {
+			case ber.TagBoolean:
+				data := field.Data.Bytes()
+				control.Criticality = len(data) > 0 && data[0] != 0
+				control.ExplicitCriticality = true
+			case ber.TagOctetString:
+				control.Value = append([]byte(nil), field.Data.Bytes()...)
+				control.HasValue = true
+			}
+		}
+		controls = append(controls, control)
+	}
+
+	return controls
+}
+
+// ControlsToPacket encodes controls as the [0] Controls element of an
+// LDAPMessage.
+func ControlsToPacket(controls Controls) *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	for _, control := range controls {
+		packet.AppendChild(ControlToPacket(control))
+	}
+	return packet
+}
+
+// ControlToPacket encodes a single Control. A TRUE criticality is always
+// written; a FALSE one only when ExplicitCriticality is set.
+func ControlToPacket(control Control) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+
+	description := "Control Type"
+	if name, ok := ControlTypeMap[control.OID]; ok {
+		description += " (" + name + ")"
+	}
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, control.OID, description))
+
+	if control.Criticality || control.ExplicitCriticality {
+		packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, control.Criticality, "Criticality"))
+	}
+
+	if control.HasValue {
+		value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value")
+		value.Value = control.Value
+		value.Data.Write(control.Value)
+		packet.AppendChild(value)
+	}
+
+	return packet
+}
@@ -0,0 +1,32 @@
+package parser
+
+import (
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Controls Tests
+*/
+
+func TestControls_RoundTrip(t *testing.T) {
+	controls := Controls{
+		{OID: ControlTypePaging, Criticality: true, ExplicitCriticality: true, Value: []byte{0x30, 0x05, 0x02, 0x01, 0x64, 0x04, 0x00}, HasValue: true},
+		{OID: ControlTypeMicrosoftShowDeleted},
+		{OID: ControlTypeMicrosoftDomainScope, ExplicitCriticality: true},
+	}
+
+	decoded := ber.DecodePacket(ControlsToPacket(controls).Bytes())
+	assert.Equal(t, controls, PacketToControls(decoded))
+}
+
+func TestControlToPacket_OmitsDefaultCriticality(t *testing.T) {
+	packet := ControlToPacket(Control{OID: ControlTypeMicrosoftShowDeleted})
+	assert.Len(t, packet.Children, 1)
+
+	packet = ControlToPacket(Control{OID: ControlTypeMicrosoftShowDeleted, ExplicitCriticality: true})
+	assert.Len(t, packet.Children, 2)
+	assert.Equal(t, false, packet.Children[1].Value)
+}
@@ -89,6 +89,8 @@ const (
 	ControlTypeMicrosoftServerLinkTTL = "1.2.840.113556.1.4.2309"
 	// ControlTypeDirSync - Active Directory DirSync - https://msdn.microsoft.com/en-us/library/aa366978(v=vs.85).aspx
 	ControlTypeDirSync = "1.2.840.113556.1.4.841"
+	// ControlTypeMicrosoftDomainScope - MS-ADTS LDAP_SERVER_DOMAIN_SCOPE_OID
+	ControlTypeMicrosoftDomainScope = "1.2.840.113556.1.4.1339"
 
 	// ControlTypeSyncRequest - https://www.ietf.org/rfc/rfc4533.txt
 	ControlTypeSyncRequest = "1.3.6.1.4.1.4203.1.9.1.1"
@@ -109,6 +111,7 @@ var ControlTypeMap = map[string]string{
 	ControlTypeMicrosoftNotification:   "Change Notification - Microsoft",
 	ControlTypeMicrosoftShowDeleted:    "Show Deleted Objects - Microsoft",
 	ControlTypeMicrosoftServerLinkTTL:  "Return TTL-DNs for link values with associated expiry times - Microsoft",
+	ControlTypeMicrosoftDomainScope:    "Domain Scope - Microsoft",
 	ControlTypeServerSideSorting:       "Server Side Sorting Request - LDAP Control Extension for Server Side Sorting of Search Results (RFC2891)",
 	ControlTypeServerSideSortingResult: "Server Side Sorting Results - LDAP Control Extension for Server Side Sorting of Search Results (RFC2891)",
 	ControlTypeDirSync:                 "DirSync",
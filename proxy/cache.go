@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Macmod/ldapx/parser"
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+/*
+	Response Cache
+
+	With --cache, the results of successful searches are kept for CacheTTL
+	seconds and served straight from ldapx when the same search is repeated,
+	under the repeating client's own messageID. Searches are matched on the
+	request as the client sent it, before any middleware:
+
+	- baseDN (case-insensitive), scope, derefAliases, sizeLimit, timeLimit
+	  and typesOnly
+	- the filter, compared in its normalized string form
+	- the attributes list, in any order and case
+	- the controls
+	- the identity the connection is bound as (see decrypt.BindSession.Identity)
+
+	Searches carrying any of resultSetControls are never cached, and neither
+	are results with more than CacheMaxEntries entries. At most
+	CacheMaxSearches results are kept; the oldest is evicted first.
+
+	Any successful add, modify, delete or modifyDN relayed through ldapx
+	empties the cache, whoever made it, since it may change the results of
+	searches cached under any identity.
+*/
+
+type cachedSearch struct {
+	description string
+	identity    string
+	messages    []*ber.Packet // responses, in order, ending with SearchResultDone
+	entries     int
+	expires     time.Time
+	hits        uint64
+}
+
+type responseCache struct {
+	sync.Mutex
+	searches map[string]*cachedSearch
+	order    []string
+	hits     uint64
+	misses   uint64
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{searches: make(map[string]*cachedSearch)}
+}
+
+// Get returns the cached responses for key readdressed to messageID, or nil
+// on a miss.
+func (c *responseCache) Get(key string, messageID int64) []*ber.Packet {
+	c.Lock()
+	defer c.Unlock()
+
+	search, ok := c.searches[key]
+	if ok && time.Now().After(search.expires) {
+		c.remove(key)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil
+	}
+
+	c.hits++
+	search.hits++
+
+	result := make([]*ber.Packet, 0, len(search.messages))
+	for _, message := range search.messages {
+		// Decoded afresh so the cached copy is never shared with the
+		// connection writing it out
+		copied := ber.DecodePacket(message.Bytes())
+		result = append(result, envelope(messageID, copied.Children[1], copied.Children[2:]...))
+	}
+	return result
+}
+
+// Put stores a search, evicting the oldest ones to keep at most maxSearches.
+func (c *responseCache) Put(key string, search *cachedSearch, maxSearches int) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for _, k := range append([]string(nil), c.order...) {
+		if now.After(c.searches[k].expires) {
+			c.remove(k)
+		}
+	}
+
+	if _, exists := c.searches[key]; exists {
+		c.remove(key)
+	}
+
+	for len(c.order) > 0 && len(c.order) >= maxSearches {
+		c.remove(c.order[0])
+	}
+	if maxSearches <= 0 {
+		return
+	}
+
+	c.searches[key] = search
+	c.order = append(c.order, key)
+}
+
+// remove drops key from the cache. Caller holds the lock.
+func (c *responseCache) remove(key string) {
+	delete(c.searches, key)
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// writeResponses are the responses to the operations that change the
+// directory.
+var writeResponses = map[uint8]bool{
+	parser.ApplicationAddResponse:      true,
+	parser.ApplicationModifyResponse:   true,
+	parser.ApplicationDelResponse:      true,
+	parser.ApplicationModifyDNResponse: true,
+}
+
+// Invalidate drops every cached search if packet is the successful response
+// to a write, reporting whether it was. Hit and miss counts are kept.
+func (c *responseCache) Invalidate(packet *ber.Packet) bool {
+	if len(packet.Children) < 2 || !writeResponses[uint8(packet.Children[1].Tag)] || resultCode(packet) != 0 {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.searches = make(map[string]*cachedSearch)
+	c.order = nil
+	return true
+}
+
+func (c *responseCache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.searches = make(map[string]*cachedSearch)
+	c.order = nil
+	c.hits = 0
+	c.misses = 0
+}
+
+// CachedSearch describes a search held in the response cache.
+type CachedSearch struct {
+	// Identity is the identity the search was made under ("" when
+	// anonymous), and Description its baseDN, filter and attributes.
+	Identity    string
+	Description string
+
+	Entries int
+	Hits    uint64
+	Expires time.Time
+}
+
+// CacheStats describes the response cache.
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Searches []CachedSearch
+}
+
+// CacheStats returns the searches held in the response cache, oldest first.
+func (p *Proxy) CacheStats() CacheStats {
+	c := p.cache
+	c.Lock()
+	defer c.Unlock()
+
+	stats := CacheStats{Hits: c.hits, Misses: c.misses}
+	for _, key := range c.order {
+		search := c.searches[key]
+		stats.Searches = append(stats.Searches, CachedSearch{
+			Identity:    search.identity,
+			Description: search.description,
+			Entries:     search.entries,
+			Hits:        search.hits,
+			Expires:     search.expires,
+		})
+	}
+	return stats
+}
+
+// ClearCache empties the response cache.
+func (p *Proxy) ClearCache() {
+	p.cache.Clear()
+}
+
+// searchCacheKey builds the cache key of a SearchRequest message as bound
+// under identity. ok is false if the search must not be cached.
+func searchCacheKey(packet *ber.Packet, identity string) (key string, description string, ok bool) {
+	if len(packet.Children) < 2 || len(packet.Children[1].Children) < 8 {
+		return "", "", false
+	}
+	request := packet.Children[1]
+
+	var controls parser.Controls
+	if len(packet.Children) > 2 {
+		controls = parser.PacketToControls(packet.Children[2])
+	}
+	for _, control := range controls {
+		if _, stateful := resultSetControls[control.OID]; stateful {
+			return "", "", false
+		}
+	}
+
+	baseDN, _ := request.Children[0].Value.(string)
+
+	filterStr := hex.EncodeToString(request.Children[6].Bytes())
+	if filter, err := parser.PacketToFilter(request.Children[6]); err == nil {
+		if query, err := parser.FilterToQuery(filter); err == nil {
+			filterStr = query
+		}
+	}
+
+	attrs := BerChildrenToList(request.Children[7])
+	normalizedAttrs := make([]string, len(attrs))
+	for i, attr := range attrs {
+		normalizedAttrs[i] = strings.ToLower(attr)
+	}
+	sort.Strings(normalizedAttrs)
+
+	parts := []string{identity, strings.ToLower(baseDN), filterStr, strings.Join(normalizedAttrs, ",")}
+	// Scope, derefAliases, limits and typesOnly, by value so that their
+	// encoding doesn't matter
+	for _, child := range request.Children[1:6] {
+		if child.Value != nil {
+			parts = append(parts, fmt.Sprint(child.Value))
+		} else {
+			parts = append(parts, hex.EncodeToString(child.Data.Bytes()))
+		}
+	}
+	for _, control := range controls {
+		parts = append(parts, control.OID+"/"+strconv.FormatBool(control.Criticality)+"/"+hex.EncodeToString(control.Value))
+	}
+
+	description = fmt.Sprintf("BaseDN: '%s' | Filter: %s | Attributes: %s", baseDN, filterStr, prettyList(attrs))
+	return strings.Join(parts, "\x00"), description, true
+}
+
+// cacheRecorder collects the responses to the cacheable searches of a single
+// client connection until they are done.
+type cacheRecorder struct {
+	sync.Mutex
+	p       *Proxy
+	pending map[int64]*pendingCacheEntry
+}
+
+type pendingCacheEntry struct {
+	key    string
+	search *cachedSearch
+}
+
+func newCacheRecorder(p *Proxy) *cacheRecorder {
+	return &cacheRecorder{p: p, pending: make(map[int64]*pendingCacheEntry)}
+}
+
+// Track starts recording the responses to messageID under key.
+func (r *cacheRecorder) Track(messageID int64, key, description, identity string) {
+	r.Lock()
+	defer r.Unlock()
+	r.pending[messageID] = &pendingCacheEntry{
+		key:    key,
+		search: &cachedSearch{description: description, identity: identity},
+	}
+}
+
+// Record takes a response message on its way to the client, storing the
+// search it completes in the cache if it was successful.
+func (r *cacheRecorder) Record(packet *ber.Packet) {
+	messageID, _ := packet.Children[0].Value.(int64)
+
+	r.Lock()
+	defer r.Unlock()
+
+	pending, ok := r.pending[messageID]
+	if !ok {
+		return
+	}
+
+	search := pending.search
+	search.messages = append(search.messages, ber.DecodePacket(packet.Bytes()))
+
+	switch packet.Children[1].Tag {
+	case parser.ApplicationSearchResultEntry:
+		search.entries++
+		if search.entries > r.p.optInt("CacheMaxEntries") {
+			delete(r.pending, messageID)
+		}
+	case parser.ApplicationSearchResultDone:
+		delete(r.pending, messageID)
+		if resultCode(packet) == 0 {
+			search.expires = time.Now().Add(time.Duration(r.p.optInt("CacheTTL")) * time.Second)
+			r.p.cache.Put(pending.key, search, r.p.optInt("CacheMaxSearches"))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Macmod/ldapx/berenc"
+	"github.com/Macmod/ldapx/parser"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchCacheKey(t *testing.T) {
+	withControls := func(packet *ber.Packet, controls ...parser.Control) *ber.Packet {
+		return ber.DecodePacket(envelope(1, packet.Children[1], parser.ControlsToPacket(controls)).Bytes())
+	}
+	search := func(query string, attrs ...string) *ber.Packet {
+		return testSearchRequest(t, 1, query, attrs, 0)
+	}
+
+	base := search("(&(objectClass=user)(cn=a))", "cn", "sn")
+	baseKey, _, ok := searchCacheKey(base, "simple:alice")
+	assert.True(t, ok)
+
+	testCases := []struct {
+		name     string
+		packet   *ber.Packet
+		identity string
+		same     bool
+	}{
+		{name: "Same request", packet: search("(&(objectClass=user)(cn=a))", "cn", "sn"), identity: "simple:alice", same: true},
+		{name: "Other message ID", packet: testSearchRequest(t, 9, "(&(objectClass=user)(cn=a))", []string{"cn", "sn"}, 0), identity: "simple:alice", same: true},
+		{name: "Other BER encoding", packet: ber.DecodePacket(berenc.EncodeMessage(base, berenc.Options{LongLength: true, LongLengthProb: 1, IntPadding: true, IntPaddingProb: 1, IntPaddingMaxBytes: 2})), identity: "simple:alice", same: true},
+		{name: "Escaped filter value", packet: search("(&(objectClass=user)(cn=\\61))", "cn", "sn"), identity: "simple:alice", same: true},
+		{name: "Attributes in another order and case", packet: search("(&(objectClass=user)(cn=a))", "SN", "cn"), identity: "simple:alice", same: true},
+		{name: "Other filter", packet: search("(&(objectClass=user)(cn=b))", "cn", "sn"), identity: "simple:alice", same: false},
+		{name: "Other attributes", packet: search("(&(objectClass=user)(cn=a))", "cn"), identity: "simple:alice", same: false},
+		{name: "Other size limit", packet: testSearchRequest(t, 1, "(&(objectClass=user)(cn=a))", []string{"cn", "sn"}, 5), identity: "simple:alice", same: false},
+		{name: "Other identity", packet: search("(&(objectClass=user)(cn=a))", "cn", "sn"), identity: "simple:bob", same: false},
+		{name: "Anonymous", packet: search("(&(objectClass=user)(cn=a))", "cn", "sn"), identity: "", same: false},
+		{name: "Control", packet: withControls(base, parser.Control{OID: "1.2.840.113556.1.4.801", Value: []byte{0x30, 0x03, 0x02, 0x01, 0x07}, HasValue: true}), identity: "simple:alice", same: false},
+		{name: "Control criticality", packet: withControls(base, parser.Control{OID: "1.2.840.113556.1.4.417", Criticality: true, ExplicitCriticality: true}), identity: "simple:alice", same: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, _, ok := searchCacheKey(tc.packet, tc.identity)
+			assert.True(t, ok)
+			if tc.same {
+				assert.Equal(t, baseKey, key)
+			} else {
+				assert.NotEqual(t, baseKey, key)
+			}
+		})
+	}
+
+	t.Run("Control values", func(t *testing.T) {
+		a, _, _ := searchCacheKey(withControls(base, parser.Control{OID: "1.2.840.113556.1.4.801", Value: []byte{0x30, 0x03, 0x02, 0x01, 0x07}, HasValue: true}), "simple:alice")
+		b, _, _ := searchCacheKey(withControls(base, parser.Control{OID: "1.2.840.113556.1.4.801", Value: []byte{0x30, 0x03, 0x02, 0x01, 0x04}, HasValue: true}), "simple:alice")
+		assert.NotEqual(t, a, b)
+	})
+
+	t.Run("Result set controls are not cached", func(t *testing.T) {
+		_, _, ok := searchCacheKey(withControls(base, parser.Control{OID: parser.ControlTypePaging, Value: []byte{0x30, 0x05, 0x02, 0x01, 0x0a, 0x04, 0x00}, HasValue: true}), "simple:alice")
+		assert.False(t, ok)
+	})
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	// An LDAPResult-shaped response of the given operation
+	response := func(tag uint8, code int64) *ber.Packet {
+		op := ber.DecodePacket(searchResultDone(code).Bytes())
+		op.Tag = ber.Tag(tag)
+		return ber.DecodePacket(envelope(2, op).Bytes())
+	}
+
+	testCases := []struct {
+		name        string
+		packet      *ber.Packet
+		invalidates bool
+	}{
+		{name: "Add", packet: response(parser.ApplicationAddResponse, 0), invalidates: true},
+		{name: "Modify", packet: response(parser.ApplicationModifyResponse, 0), invalidates: true},
+		{name: "Delete", packet: response(parser.ApplicationDelResponse, 0), invalidates: true},
+		{name: "ModifyDN", packet: response(parser.ApplicationModifyDNResponse, 0), invalidates: true},
+		{name: "Failed modify", packet: response(parser.ApplicationModifyResponse, 50), invalidates: false},
+		{name: "Compare", packet: response(parser.ApplicationCompareResponse, 6), invalidates: false},
+		{name: "Search", packet: testSearchDone(2, 0), invalidates: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := newResponseCache()
+			cache.Put("key", &cachedSearch{messages: []*ber.Packet{testSearchDone(1, 0)}, expires: time.Now().Add(time.Minute)}, 10)
+			assert.NotNil(t, cache.Get("key", 1))
+
+			assert.Equal(t, tc.invalidates, cache.Invalidate(tc.packet))
+			// The counters survive
+			assert.Equal(t, uint64(1), cache.hits)
+			if tc.invalidates {
+				assert.Nil(t, cache.Get("key", 1))
+			} else {
+				assert.NotNil(t, cache.Get("key", 1))
+			}
+		})
+	}
+}
@@ -0,0 +1,666 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Macmod/ldapx/berenc"
+	attrentriesmid "github.com/Macmod/ldapx/middlewares/attrentries"
+	attrlistmid "github.com/Macmod/ldapx/middlewares/attrlist"
+	basednmid "github.com/Macmod/ldapx/middlewares/basedn"
+	bindnamemid "github.com/Macmod/ldapx/middlewares/bindname"
+	controlsmid "github.com/Macmod/ldapx/middlewares/controls"
+	filtermid "github.com/Macmod/ldapx/middlewares/filter"
+)
+
+// chainState pairs a middleware chain, or a pool of them, with the string
+// it was built from.
+type chainState[T any] struct {
+	spec  string
+	chain *T
+	pool  *chainPool[T]
+}
+
+// get returns the chain to apply to a request, drawing it from the pool if
+// there is one.
+func (s *chainState[T]) get() *T {
+	if s.pool != nil {
+		return s.pool.draw()
+	}
+	return s.chain
+}
+
+// chainSpec returns the spec of a state holding a chain rather than a pool.
+func chainSpec[T any](s *chainState[T]) string {
+	if s != nil && s.pool == nil {
+		return s.spec
+	}
+	return ""
+}
+
+// chainsOf returns the chain of a state, or every chain its pool can draw
+// from, without drawing.
+func chainsOf[T any](s *chainState[T]) []*T {
+	switch {
+	case s == nil:
+		return nil
+	case s.pool != nil:
+		return s.pool.chains()
+	}
+	return []*T{s.chain}
+}
+
+// poolSpec returns the spec of a state holding a pool.
+func poolSpec[T any](s *chainState[T]) string {
+	if s != nil && s.pool != nil {
+		return s.spec
+	}
+	return ""
+}
+
+// Middleware chains of a Proxy - accessed atomically for thread safety
+type chains struct {
+	filter      atomic.Pointer[chainState[filtermid.FilterMiddlewareChain]]
+	attrList    atomic.Pointer[chainState[attrlistmid.AttrListMiddlewareChain]]
+	baseDN      atomic.Pointer[chainState[basednmid.BaseDNMiddlewareChain]]
+	attrEntries atomic.Pointer[chainState[attrentriesmid.AttrEntriesMiddlewareChain]]
+	controls    atomic.Pointer[chainState[controlsmid.ControlsMiddlewareChain]]
+	bindName    atomic.Pointer[chainState[bindnamemid.BindNameMiddlewareChain]]
+
+	// Operation chains, keyed by their name (see OperationChainNames).
+	// Replaced as a whole under opsMu.
+	baseDNOps      atomic.Pointer[opChains[basednmid.BaseDNMiddlewareChain]]
+	attrEntriesOps atomic.Pointer[opChains[attrentriesmid.AttrEntriesMiddlewareChain]]
+	opsMu          sync.Mutex
+}
+
+// opChains maps operation chain names to their chains.
+type opChains[T any] map[string]*chainState[T]
+
+// OperationChainNames are the chains that can be set per operation with
+// SetOperationChain, as <family>.<operation>[.<field>]. Each one is used
+// for that operation (and field) instead of the shared chain of its
+// family, e.g. to obfuscate searches aggressively while leaving writes
+// alone.
+var OperationChainNames = []string{
+	"basedn.search",
+	"basedn.modify",
+	"basedn.add",
+	"basedn.delete",
+	"basedn.modifydn.entry",
+	"basedn.modifydn.newrdn",
+	"basedn.modifydn.newsuperior",
+	"attrentries.modify",
+	"attrentries.add",
+}
+
+// SetFilterChain validates and applies a chain of Filter middlewares,
+// given by their letters (see FilterMidFlags) and inline parameters (see
+// ParseChain and FilterChainParams). Any of them can also be restricted to
+// some attributes with the scope parameter (see FilterScopeParam).
+func (p *Proxy) SetFilterChain(chain string) error {
+	state, err := p.buildFilterChain(chain)
+	if err != nil {
+		return err
+	}
+	p.chains.filter.Store(state)
+	return nil
+}
+
+func (p *Proxy) buildFilterChain(chain string) (*chainState[filtermid.FilterMiddlewareChain], error) {
+	elements, err := p.validateFilterChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	newChain := &filtermid.FilterMiddlewareChain{}
+	for _, e := range elements {
+		middlewareName := FilterMidFlags[e.Code]
+		mid := chainMiddleware(p, e, func(m *middlewareSet) filtermid.FilterMiddleware { return m.filter[middlewareName] })
+		newChain.Add(filtermid.FilterMiddlewareDefinition{
+			Name: middlewareName,
+			Func: func() filtermid.FilterMiddleware {
+				return filtermid.ScopedFilterMiddleware(mid(), e.scope)
+			},
+		})
+	}
+	return &chainState[filtermid.FilterMiddlewareChain]{spec: chain, chain: newChain}, nil
+}
+
+// FilterChain returns the Filter chain, as given to SetFilterChain.
+func (p *Proxy) FilterChain() string {
+	return chainSpec(p.chains.filter.Load())
+}
+
+// SetFilterPool validates and applies a pool of Filter chains, replacing
+// the Filter chain: a different chain is drawn from the pool for each
+// request, and logged. The pool is a comma-separated list of chains, each
+// with an optional weight after a ':' (1 by default) - e.g.
+// "ODR:3,XSB:1,TMx:1". A chain in braces, as "{OCXSB}:2", is an alphabet
+// instead, from which a random subset of middlewares is drawn in random
+// order. An empty pool clears it.
+func (p *Proxy) SetFilterPool(pool string) error {
+	if pool == "" {
+		p.chains.filter.Store(nil)
+		return nil
+	}
+
+	cp, err := newChainPool(pool, "Filter", p.logger, p.buildFilterChain, func(c *filtermid.FilterMiddlewareChain, indexes []int) *filtermid.FilterMiddlewareChain {
+		drawn := &filtermid.FilterMiddlewareChain{}
+		for _, i := range indexes {
+			drawn.Add(c.Middlewares[i])
+		}
+		return drawn
+	})
+	if err != nil {
+		return err
+	}
+	p.chains.filter.Store(&chainState[filtermid.FilterMiddlewareChain]{spec: pool, pool: cp})
+	return nil
+}
+
+// FilterPool returns the Filter pool, as given to SetFilterPool.
+func (p *Proxy) FilterPool() string {
+	return poolSpec(p.chains.filter.Load())
+}
+
+func (p *Proxy) getFilterChain() *filtermid.FilterMiddlewareChain {
+	if state := p.chains.filter.Load(); state != nil {
+		return state.get()
+	}
+	return &filtermid.FilterMiddlewareChain{}
+}
+
+// SetBaseDNChain validates and applies a chain of BaseDN middlewares, given
+// by their letters (see BaseDNMidFlags) and inline parameters (see
+// BaseDNChainParams).
+func (p *Proxy) SetBaseDNChain(chain string) error {
+	state, err := p.buildBaseDNChain(chain)
+	if err != nil {
+		return err
+	}
+	p.chains.baseDN.Store(state)
+	return nil
+}
+
+func (p *Proxy) buildBaseDNChain(chain string) (*chainState[basednmid.BaseDNMiddlewareChain], error) {
+	elements, err := p.validateBaseDNChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	newChain := &basednmid.BaseDNMiddlewareChain{}
+	for _, e := range elements {
+		middlewareName := BaseDNMidFlags[e.Code]
+		newChain.Add(basednmid.BaseDNMiddlewareDefinition{
+			Name: middlewareName,
+			Func: chainMiddleware(p, e, func(m *middlewareSet) basednmid.BaseDNMiddleware { return m.baseDN[middlewareName] }),
+		})
+	}
+	return &chainState[basednmid.BaseDNMiddlewareChain]{spec: chain, chain: newChain}, nil
+}
+
+// BaseDNChain returns the BaseDN chain, as given to SetBaseDNChain.
+func (p *Proxy) BaseDNChain() string {
+	return chainSpec(p.chains.baseDN.Load())
+}
+
+// SetBaseDNPool validates and applies a pool of BaseDN chains (see
+// SetFilterPool), replacing the BaseDN chain. An empty pool clears it.
+func (p *Proxy) SetBaseDNPool(pool string) error {
+	if pool == "" {
+		p.chains.baseDN.Store(nil)
+		return nil
+	}
+
+	cp, err := newChainPool(pool, "BaseDN", p.logger, p.buildBaseDNChain, func(c *basednmid.BaseDNMiddlewareChain, indexes []int) *basednmid.BaseDNMiddlewareChain {
+		drawn := &basednmid.BaseDNMiddlewareChain{}
+		for _, i := range indexes {
+			drawn.Add(c.Middlewares[i])
+		}
+		return drawn
+	})
+	if err != nil {
+		return err
+	}
+	p.chains.baseDN.Store(&chainState[basednmid.BaseDNMiddlewareChain]{spec: pool, pool: cp})
+	return nil
+}
+
+// BaseDNPool returns the BaseDN pool, as given to SetBaseDNPool.
+func (p *Proxy) BaseDNPool() string {
+	return poolSpec(p.chains.baseDN.Load())
+}
+
+func (p *Proxy) getBaseDNChain() *basednmid.BaseDNMiddlewareChain {
+	if state := p.chains.baseDN.Load(); state != nil {
+		return state.get()
+	}
+	return &basednmid.BaseDNMiddlewareChain{}
+}
+
+// SetAttrListChain validates and applies a chain of AttrList middlewares,
+// given by their letters (see AttrListMidFlags) and inline parameters (see
+// AttrListChainParams).
+func (p *Proxy) SetAttrListChain(chain string) error {
+	state, err := p.buildAttrListChain(chain)
+	if err != nil {
+		return err
+	}
+	p.chains.attrList.Store(state)
+	return nil
+}
+
+func (p *Proxy) buildAttrListChain(chain string) (*chainState[attrlistmid.AttrListMiddlewareChain], error) {
+	elements, err := validateChainRunes(chain, AttrListMidFlags, AttrListChainParams)
+	if err != nil {
+		return nil, err
+	}
+
+	newChain := &attrlistmid.AttrListMiddlewareChain{}
+	for _, e := range elements {
+		middlewareName := AttrListMidFlags[e.Code]
+		newChain.Add(attrlistmid.AttrListMiddlewareDefinition{
+			Name: middlewareName,
+			Func: chainMiddleware(p, e, func(m *middlewareSet) attrlistmid.AttrListMiddleware { return m.attrList[middlewareName] }),
+		})
+	}
+	return &chainState[attrlistmid.AttrListMiddlewareChain]{spec: chain, chain: newChain}, nil
+}
+
+// AttrListChain returns the AttrList chain, as given to SetAttrListChain.
+func (p *Proxy) AttrListChain() string {
+	return chainSpec(p.chains.attrList.Load())
+}
+
+// SetAttrListPool validates and applies a pool of AttrList chains (see
+// SetFilterPool), replacing the AttrList chain. An empty pool clears it.
+func (p *Proxy) SetAttrListPool(pool string) error {
+	if pool == "" {
+		p.chains.attrList.Store(nil)
+		return nil
+	}
+
+	cp, err := newChainPool(pool, "AttrList", p.logger, p.buildAttrListChain, func(c *attrlistmid.AttrListMiddlewareChain, indexes []int) *attrlistmid.AttrListMiddlewareChain {
+		drawn := &attrlistmid.AttrListMiddlewareChain{}
+		for _, i := range indexes {
+			drawn.Add(c.Middlewares[i])
+		}
+		return drawn
+	})
+	if err != nil {
+		return err
+	}
+	p.chains.attrList.Store(&chainState[attrlistmid.AttrListMiddlewareChain]{spec: pool, pool: cp})
+	return nil
+}
+
+// AttrListPool returns the AttrList pool, as given to SetAttrListPool.
+func (p *Proxy) AttrListPool() string {
+	return poolSpec(p.chains.attrList.Load())
+}
+
+func (p *Proxy) getAttrListChain() *attrlistmid.AttrListMiddlewareChain {
+	if state := p.chains.attrList.Load(); state != nil {
+		return state.get()
+	}
+	return &attrlistmid.AttrListMiddlewareChain{}
+}
+
+// SetAttrEntriesChain validates and applies a chain of AttrEntries
+// middlewares, given by their letters (see AttrEntriesMidFlags) and inline
+// parameters (see AttrEntriesChainParams).
+func (p *Proxy) SetAttrEntriesChain(chain string) error {
+	state, err := p.buildAttrEntriesChain(chain)
+	if err != nil {
+		return err
+	}
+	p.chains.attrEntries.Store(state)
+	return nil
+}
+
+func (p *Proxy) buildAttrEntriesChain(chain string) (*chainState[attrentriesmid.AttrEntriesMiddlewareChain], error) {
+	elements, err := validateChainRunes(chain, AttrEntriesMidFlags, AttrEntriesChainParams)
+	if err != nil {
+		return nil, err
+	}
+
+	newChain := &attrentriesmid.AttrEntriesMiddlewareChain{}
+	for _, e := range elements {
+		middlewareName := AttrEntriesMidFlags[e.Code]
+		newChain.Add(attrentriesmid.AttrEntriesMiddlewareDefinition{
+			Name: middlewareName,
+			Func: chainMiddleware(p, e, func(m *middlewareSet) attrentriesmid.AttrEntriesMiddleware { return m.attrEntries[middlewareName] }),
+		})
+	}
+	return &chainState[attrentriesmid.AttrEntriesMiddlewareChain]{spec: chain, chain: newChain}, nil
+}
+
+// AttrEntriesChain returns the AttrEntries chain, as given to
+// SetAttrEntriesChain.
+func (p *Proxy) AttrEntriesChain() string {
+	return chainSpec(p.chains.attrEntries.Load())
+}
+
+// SetAttrEntriesPool validates and applies a pool of AttrEntries chains (see
+// SetFilterPool), replacing the AttrEntries chain. An empty pool clears it.
+func (p *Proxy) SetAttrEntriesPool(pool string) error {
+	if pool == "" {
+		p.chains.attrEntries.Store(nil)
+		return nil
+	}
+
+	cp, err := newChainPool(pool, "AttrEntries", p.logger, p.buildAttrEntriesChain, func(c *attrentriesmid.AttrEntriesMiddlewareChain, indexes []int) *attrentriesmid.AttrEntriesMiddlewareChain {
+		drawn := &attrentriesmid.AttrEntriesMiddlewareChain{}
+		for _, i := range indexes {
+			drawn.Add(c.Middlewares[i])
+		}
+		return drawn
+	})
+	if err != nil {
+		return err
+	}
+	p.chains.attrEntries.Store(&chainState[attrentriesmid.AttrEntriesMiddlewareChain]{spec: pool, pool: cp})
+	return nil
+}
+
+// AttrEntriesPool returns the AttrEntries pool, as given to SetAttrEntriesPool.
+func (p *Proxy) AttrEntriesPool() string {
+	return poolSpec(p.chains.attrEntries.Load())
+}
+
+func (p *Proxy) getAttrEntriesChain() *attrentriesmid.AttrEntriesMiddlewareChain {
+	if state := p.chains.attrEntries.Load(); state != nil {
+		return state.get()
+	}
+	return &attrentriesmid.AttrEntriesMiddlewareChain{}
+}
+
+// SetControlsChain validates and applies a chain of Controls middlewares,
+// given by their letters (see ControlsMidFlags) and inline parameters (see
+// ControlsChainParams).
+func (p *Proxy) SetControlsChain(chain string) error {
+	state, err := p.buildControlsChain(chain)
+	if err != nil {
+		return err
+	}
+	p.chains.controls.Store(state)
+	return nil
+}
+
+func (p *Proxy) buildControlsChain(chain string) (*chainState[controlsmid.ControlsMiddlewareChain], error) {
+	elements, err := p.validateControlsChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	newChain := &controlsmid.ControlsMiddlewareChain{}
+	for _, e := range elements {
+		middlewareName := ControlsMidFlags[e.Code]
+		newChain.Add(controlsmid.ControlsMiddlewareDefinition{
+			Name: middlewareName,
+			Func: chainMiddleware(p, e, func(m *middlewareSet) controlsmid.ControlsMiddleware { return m.controls[middlewareName] }),
+		})
+	}
+	return &chainState[controlsmid.ControlsMiddlewareChain]{spec: chain, chain: newChain}, nil
+}
+
+// ControlsChain returns the Controls chain, as given to SetControlsChain.
+func (p *Proxy) ControlsChain() string {
+	return chainSpec(p.chains.controls.Load())
+}
+
+// SetControlsPool validates and applies a pool of Controls chains (see
+// SetFilterPool), replacing the Controls chain. An empty pool clears it.
+func (p *Proxy) SetControlsPool(pool string) error {
+	if pool == "" {
+		p.chains.controls.Store(nil)
+		return nil
+	}
+
+	cp, err := newChainPool(pool, "Controls", p.logger, p.buildControlsChain, func(c *controlsmid.ControlsMiddlewareChain, indexes []int) *controlsmid.ControlsMiddlewareChain {
+		drawn := &controlsmid.ControlsMiddlewareChain{}
+		for _, i := range indexes {
+			drawn.Add(c.Middlewares[i])
+		}
+		return drawn
+	})
+	if err != nil {
+		return err
+	}
+	p.chains.controls.Store(&chainState[controlsmid.ControlsMiddlewareChain]{spec: pool, pool: cp})
+	return nil
+}
+
+// ControlsPool returns the Controls pool, as given to SetControlsPool.
+func (p *Proxy) ControlsPool() string {
+	return poolSpec(p.chains.controls.Load())
+}
+
+// hasControlsChain tells whether a request may go through Controls
+// middlewares.
+func (p *Proxy) hasControlsChain() bool {
+	return slices.ContainsFunc(chainsOf(p.chains.controls.Load()), func(c *controlsmid.ControlsMiddlewareChain) bool {
+		return len(c.Middlewares) > 0
+	})
+}
+
+func (p *Proxy) getControlsChain() *controlsmid.ControlsMiddlewareChain {
+	if state := p.chains.controls.Load(); state != nil {
+		return state.get()
+	}
+	return &controlsmid.ControlsMiddlewareChain{}
+}
+
+// SetBindNameChain validates and applies a chain of BindName middlewares,
+// given by their letters (see BindNameMidFlags) and inline parameters (see
+// BindNameChainParams).
+func (p *Proxy) SetBindNameChain(chain string) error {
+	state, err := p.buildBindNameChain(chain)
+	if err != nil {
+		return err
+	}
+	p.chains.bindName.Store(state)
+	return nil
+}
+
+func (p *Proxy) buildBindNameChain(chain string) (*chainState[bindnamemid.BindNameMiddlewareChain], error) {
+	elements, err := p.validateBindNameChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	newChain := &bindnamemid.BindNameMiddlewareChain{}
+	for _, e := range elements {
+		middlewareName := BindNameMidFlags[e.Code]
+		newChain.Add(bindnamemid.BindNameMiddlewareDefinition{
+			Name: middlewareName,
+			Func: chainMiddleware(p, e, func(m *middlewareSet) bindnamemid.BindNameMiddleware { return m.bindName[middlewareName] }),
+		})
+	}
+	return &chainState[bindnamemid.BindNameMiddlewareChain]{spec: chain, chain: newChain}, nil
+}
+
+// BindNameChain returns the BindName chain, as given to SetBindNameChain.
+func (p *Proxy) BindNameChain() string {
+	return chainSpec(p.chains.bindName.Load())
+}
+
+// SetBindNamePool validates and applies a pool of BindName chains (see
+// SetFilterPool), replacing the BindName chain. An empty pool clears it.
+func (p *Proxy) SetBindNamePool(pool string) error {
+	if pool == "" {
+		p.chains.bindName.Store(nil)
+		return nil
+	}
+
+	cp, err := newChainPool(pool, "BindName", p.logger, p.buildBindNameChain, func(c *bindnamemid.BindNameMiddlewareChain, indexes []int) *bindnamemid.BindNameMiddlewareChain {
+		drawn := &bindnamemid.BindNameMiddlewareChain{}
+		for _, i := range indexes {
+			drawn.Add(c.Middlewares[i])
+		}
+		return drawn
+	})
+	if err != nil {
+		return err
+	}
+	p.chains.bindName.Store(&chainState[bindnamemid.BindNameMiddlewareChain]{spec: pool, pool: cp})
+	return nil
+}
+
+// BindNamePool returns the BindName pool, as given to SetBindNamePool.
+func (p *Proxy) BindNamePool() string {
+	return poolSpec(p.chains.bindName.Load())
+}
+
+// hasBindNameChain tells whether a bind may go through BindName
+// middlewares.
+func (p *Proxy) hasBindNameChain() bool {
+	return slices.ContainsFunc(chainsOf(p.chains.bindName.Load()), func(c *bindnamemid.BindNameMiddlewareChain) bool {
+		return len(c.Middlewares) > 0
+	})
+}
+
+func (p *Proxy) getBindNameChain() *bindnamemid.BindNameMiddlewareChain {
+	if state := p.chains.bindName.Load(); state != nil {
+		return state.get()
+	}
+	return &bindnamemid.BindNameMiddlewareChain{}
+}
+
+// SetOperationChain validates and applies the chain of one operation (see
+// OperationChainNames), given as the chain of its family would be.
+// An empty chain leaves the operation untransformed, whatever the shared
+// chain is.
+func (p *Proxy) SetOperationChain(name, chain string) error {
+	if !slices.Contains(OperationChainNames, name) {
+		return fmt.Errorf("unknown operation chain '%s' (use %s)", name, strings.Join(OperationChainNames, ", "))
+	}
+
+	switch family, _, _ := strings.Cut(name, "."); family {
+	case "basedn":
+		state, err := p.buildBaseDNChain(chain)
+		if err != nil {
+			return err
+		}
+		storeOpChain(&p.chains.baseDNOps, &p.chains.opsMu, name, state)
+	case "attrentries":
+		state, err := p.buildAttrEntriesChain(chain)
+		if err != nil {
+			return err
+		}
+		storeOpChain(&p.chains.attrEntriesOps, &p.chains.opsMu, name, state)
+	}
+	return nil
+}
+
+// ClearOperationChain makes an operation use the shared chain of its family
+// again.
+func (p *Proxy) ClearOperationChain(name string) {
+	storeOpChain(&p.chains.baseDNOps, &p.chains.opsMu, name, nil)
+	storeOpChain(&p.chains.attrEntriesOps, &p.chains.opsMu, name, nil)
+}
+
+// OperationChain returns the chain of an operation, as given to
+// SetOperationChain, and whether it is set.
+func (p *Proxy) OperationChain(name string) (string, bool) {
+	if state := loadOpChain(&p.chains.baseDNOps, name); state != nil {
+		return state.spec, true
+	}
+	if state := loadOpChain(&p.chains.attrEntriesOps, name); state != nil {
+		return state.spec, true
+	}
+	return "", false
+}
+
+// getBaseDNChainFor returns the chain of a basedn.* operation, falling back
+// to the shared BaseDN chain.
+func (p *Proxy) getBaseDNChainFor(name string) *basednmid.BaseDNMiddlewareChain {
+	if state := loadOpChain(&p.chains.baseDNOps, name); state != nil {
+		return state.get()
+	}
+	return p.getBaseDNChain()
+}
+
+// getBaseDNChainsFor returns the chains of the basedn.* operations of one
+// request, drawing each pool they share only once, so that all the DNs of
+// the request go through the same drawn chain.
+func (p *Proxy) getBaseDNChainsFor(names ...string) []*basednmid.BaseDNMiddlewareChain {
+	drawn := make(map[*chainState[basednmid.BaseDNMiddlewareChain]]*basednmid.BaseDNMiddlewareChain)
+	chains := make([]*basednmid.BaseDNMiddlewareChain, len(names))
+	for i, name := range names {
+		state := loadOpChain(&p.chains.baseDNOps, name)
+		if state == nil {
+			state = p.chains.baseDN.Load()
+		}
+		if state == nil {
+			chains[i] = &basednmid.BaseDNMiddlewareChain{}
+			continue
+		}
+		if _, ok := drawn[state]; !ok {
+			drawn[state] = state.get()
+		}
+		chains[i] = drawn[state]
+	}
+	return chains
+}
+
+// getAttrEntriesChainFor returns the chain of an attrentries.* operation,
+// falling back to the shared AttrEntries chain.
+func (p *Proxy) getAttrEntriesChainFor(name string) *attrentriesmid.AttrEntriesMiddlewareChain {
+	if state := loadOpChain(&p.chains.attrEntriesOps, name); state != nil {
+		return state.get()
+	}
+	return p.getAttrEntriesChain()
+}
+
+func loadOpChain[T any](ops *atomic.Pointer[opChains[T]], name string) *chainState[T] {
+	if m := ops.Load(); m != nil {
+		return (*m)[name]
+	}
+	return nil
+}
+
+// storeOpChain sets (or, with a nil state, removes) an operation chain,
+// copying the map so that readers never see it change.
+func storeOpChain[T any](ops *atomic.Pointer[opChains[T]], mu *sync.Mutex, name string, state *chainState[T]) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	m := opChains[T]{}
+	if current := ops.Load(); current != nil {
+		maps.Copy(m, *current)
+	}
+	if state == nil {
+		delete(m, name)
+	} else {
+		m[name] = state
+	}
+	ops.Store(&m)
+}
+
+// ClearChains empties every middleware chain, including the operation
+// chains.
+func (p *Proxy) ClearChains() {
+	p.chains.filter.Store(nil)
+	p.chains.baseDN.Store(nil)
+	p.chains.attrList.Store(nil)
+	p.chains.attrEntries.Store(nil)
+	p.chains.controls.Store(nil)
+	p.chains.bindName.Store(nil)
+	p.chains.baseDNOps.Store(nil)
+	p.chains.attrEntriesOps.Store(nil)
+}
+
+// BEREncoding returns the BER encoding variations enabled through the BER*
+// options.
+func (p *Proxy) BEREncoding() berenc.Options {
+	if o := p.berEncoding.Load(); o != nil {
+		return *o
+	}
+	return berenc.Options{}
+}
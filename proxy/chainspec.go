@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	filtermid "github.com/Macmod/ldapx/middlewares/filter"
+)
+
+// ChainElement is one middleware of a chain: its letter, and the parameters
+// given to it inline, as in "C(prob=0.3)" (see the *ChainParams maps).
+type ChainElement struct {
+	Code   rune
+	Params map[string]string
+
+	// options maps the option each parameter overrides to its value, once
+	// the element has gone through validateChainRunes
+	options map[string]string
+
+	// scope restricts a Filter middleware to some attributes, as given by
+	// its scope parameter
+	scope filtermid.AttrScope
+}
+
+// String returns the element in the form ParseChain reads, with its
+// parameters sorted by name.
+func (e ChainElement) String() string {
+	if len(e.Params) == 0 {
+		return string(e.Code)
+	}
+
+	params := make([]string, 0, len(e.Params))
+	for _, name := range slices.Sorted(maps.Keys(e.Params)) {
+		value := e.Params[name]
+		if value == "" || strings.ContainsAny(value, ",() ") {
+			value = "'" + value + "'"
+		}
+		params = append(params, name+"="+value)
+	}
+	return fmt.Sprintf("%c(%s)", e.Code, strings.Join(params, ","))
+}
+
+// ParseChain splits a chain into its elements. An element is a middleware
+// letter, optionally followed by name=value parameters in parentheses,
+// separated by commas - e.g. "C(prob=0.3)X(prob=0.9)B(depth=2)". A value
+// holding commas or parentheses can be single-quoted, as in
+// "S(oids='1.2.3,1.2.4')". Letters and parameter names are not checked
+// against any family; validateChainRunes does that.
+func ParseChain(chain string) ([]ChainElement, error) {
+	var elements []ChainElement
+	for i := 0; i < len(chain); {
+		c, size := utf8.DecodeRuneInString(chain[i:])
+		if c == '(' {
+			return nil, fmt.Errorf("unexpected '(' at position %d - parameters must follow a middleware letter", i+1)
+		}
+		i += size
+
+		element := ChainElement{Code: c}
+		if i < len(chain) && chain[i] == '(' {
+			params, n, err := parseChainParams(chain[i:])
+			if err != nil {
+				return nil, fmt.Errorf("middleware %q: %w", string(c), err)
+			}
+			element.Params = params
+			i += n
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// parseChainParams parses the parenthesized parameters at the start of s,
+// returning them and the length of s they take.
+func parseChainParams(s string) (map[string]string, int, error) {
+	var (
+		terms  []string
+		term   strings.Builder
+		quoted bool
+		end    = -1
+	)
+	for i := 1; i < len(s) && end < 0; i++ {
+		switch ch := s[i]; {
+		case ch == '\'':
+			quoted = !quoted
+			term.WriteByte(ch)
+		case quoted:
+			term.WriteByte(ch)
+		case ch == '(':
+			return nil, 0, fmt.Errorf("unexpected '(' in parameters - quote values holding parentheses")
+		case ch == ',':
+			terms = append(terms, term.String())
+			term.Reset()
+		case ch == ')':
+			terms = append(terms, term.String())
+			end = i + 1
+		default:
+			term.WriteByte(ch)
+		}
+	}
+	if end < 0 {
+		if quoted {
+			return nil, 0, fmt.Errorf("unterminated quote in parameters")
+		}
+		return nil, 0, fmt.Errorf("missing ')' after parameters")
+	}
+
+	params := make(map[string]string)
+	for _, term := range terms {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(term, "=")
+		if !ok {
+			return nil, 0, fmt.Errorf("parameter '%s' must be given as name=value", strings.TrimSpace(term))
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		if _, dup := params[name]; dup {
+			return nil, 0, fmt.Errorf("parameter '%s' given more than once", name)
+		}
+		params[name] = value
+	}
+	return params, end, nil
+}
+
+// chainMiddleware returns the middleware function of a chain element, given
+// pick to find it in a middlewareSet. Without inline options the element
+// uses the shared middlewares of the Proxy. With them it gets middlewares
+// of its own, rebuilt along with the shared ones so that the options it
+// leaves alone still follow SetOption.
+func chainMiddleware[T any](p *Proxy, e ChainElement, pick func(*middlewareSet) T) func() T {
+	if len(e.options) == 0 {
+		return func() T { return pick(p.mids.Load()) }
+	}
+
+	var (
+		mu    sync.Mutex
+		built *middlewareSet
+		own   *middlewareSet
+	)
+	return func() T {
+		shared := p.mids.Load()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if built != shared {
+			own = newMiddlewareSet(p.midOpts(e.options))
+			built = shared
+		}
+		return pick(own)
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChain(t *testing.T) {
+	testCases := []struct {
+		name     string
+		chain    string
+		expected []ChainElement
+		wantErr  bool
+	}{
+		{name: "Empty", chain: "", expected: nil},
+		{name: "Letters only", chain: "CX", expected: []ChainElement{{Code: 'C'}, {Code: 'X'}}},
+		{name: "Parameters", chain: "C(prob=0.3)X", expected: []ChainElement{{Code: 'C', Params: map[string]string{"prob": "0.3"}}, {Code: 'X'}}},
+		{name: "Several parameters", chain: "B(depth=2, prob=0.5)", expected: []ChainElement{{Code: 'B', Params: map[string]string{"depth": "2", "prob": "0.5"}}}},
+		{name: "Names are case-insensitive", chain: "C(PROB=0.3)", expected: []ChainElement{{Code: 'C', Params: map[string]string{"prob": "0.3"}}}},
+		{name: "Empty parentheses", chain: "C()X", expected: []ChainElement{{Code: 'C', Params: map[string]string{}}, {Code: 'X'}}},
+		{name: "Quoted value", chain: "S(oids='1.2.3,1.2.4')", expected: []ChainElement{{Code: 'S', Params: map[string]string{"oids": "1.2.3,1.2.4"}}}},
+		{name: "Parentheses inside quotes", chain: "F(rootdn='CN=a(b),DC=c')Z", expected: []ChainElement{{Code: 'F', Params: map[string]string{"rootdn": "CN=a(b),DC=c"}}, {Code: 'Z'}}},
+		{name: "Empty quoted value", chain: "t(charset='')", expected: []ChainElement{{Code: 't', Params: map[string]string{"charset": ""}}}},
+		{name: "Unknown parameter names are kept", chain: "C(foo=1)", expected: []ChainElement{{Code: 'C', Params: map[string]string{"foo": "1"}}}},
+		{name: "Parameters without a letter", chain: "(prob=1)", wantErr: true},
+		{name: "Nested parentheses", chain: "C(prob=(0.3))", wantErr: true},
+		{name: "Missing closing parenthesis", chain: "C(prob=0.3", wantErr: true},
+		{name: "Unterminated quote", chain: "S(oids='1.2.3)", wantErr: true},
+		{name: "Duplicate parameter", chain: "C(prob=0.3,Prob=0.4)", wantErr: true},
+		{name: "Parameter without a value", chain: "C(prob)", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			elements, err := ParseChain(tc.chain)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, elements)
+		})
+	}
+}
+
+func TestParseChainParams(t *testing.T) {
+	testCases := []struct {
+		name     string
+		params   string
+		expected map[string]string
+		length   int
+		wantErr  bool
+	}{
+		{name: "Empty", params: "()", expected: map[string]string{}, length: 2},
+		{name: "Stops at the closing parenthesis", params: "(prob=1)CX", expected: map[string]string{"prob": "1"}, length: 8},
+		{name: "Spaces and empty terms", params: "( prob = 1 ,, depth=2 )", expected: map[string]string{"prob": "1", "depth": "2"}, length: 23},
+		{name: "Closing parenthesis inside quotes", params: "(x=')')", expected: map[string]string{"x": ")"}, length: 7},
+		{name: "Duplicate", params: "(a=1,a=2)", wantErr: true},
+		{name: "Unterminated", params: "(a=1", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			params, n, err := parseChainParams(tc.params)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, params)
+			assert.Equal(t, tc.length, n)
+		})
+	}
+}
+
+func TestValidateChainRunes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		chain   string
+		wantErr bool
+	}{
+		{name: "Valid probability", chain: "C(prob=0.3)X(prob=1)"},
+		{name: "Valid integer and boolean", chain: "B(depth=2)O(prefix=FALSE,maxzeros=0)"},
+		{name: "Free-form string", chain: "U(mode=zw)G(charset='a,b')"},
+		{name: "Unknown letter", chain: "Cq", wantErr: true},
+		{name: "Unknown parameter", chain: "C(foo=1)", wantErr: true},
+		{name: "Parameter of a middleware without any", chain: "T(prob=1)", wantErr: true},
+		{name: "Probability that is not a number", chain: "C(prob=abc)", wantErr: true},
+		{name: "Probability out of range", chain: "C(prob=5)", wantErr: true},
+		{name: "Negative probability", chain: "X(prob=-0.1)", wantErr: true},
+		{name: "Integer that is not a number", chain: "B(depth=1.5)", wantErr: true},
+		{name: "Integer below its minimum", chain: "B(depth=0)", wantErr: true},
+		{name: "Boolean that is not one", chain: "O(prefix=yes)", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := validateChainRunes(tc.chain, FilterMidFlags, FilterChainParams)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Macmod/ldapx/berenc"
+	"github.com/Macmod/ldapx/middlewares"
+	attrentriesmid "github.com/Macmod/ldapx/middlewares/attrentries"
+	attrlistmid "github.com/Macmod/ldapx/middlewares/attrlist"
+	basednmid "github.com/Macmod/ldapx/middlewares/basedn"
+	bindnamemid "github.com/Macmod/ldapx/middlewares/bindname"
+	controlsmid "github.com/Macmod/ldapx/middlewares/controls"
+	filtermid "github.com/Macmod/ldapx/middlewares/filter"
+)
+
+// Taken from:
+// https://learn.microsoft.com/en-us/windows/win32/adschema/attributes-anr
+// (Windows Server 2012)
+var ANRSet = []string{
+	"name", "displayname", "samaccountname",
+	"givenname", "legacyexchangedn", "sn", "proxyaddresses",
+	"physicaldeliveryofficename", "msds-additionalsamaccountName",
+	"msds-phoneticcompanyname", "msds-phoneticdepartment",
+	"msds-phoneticdisplayname", "msds-phoneticfirstname",
+	"msds-phoneticlastname",
+}
+
+// middlewareSet holds the middlewares of a Proxy, built with its options.
+type middlewareSet struct {
+	baseDN      map[string]basednmid.BaseDNMiddleware
+	filter      map[string]filtermid.FilterMiddleware
+	attrList    map[string]attrlistmid.AttrListMiddleware
+	attrEntries map[string]attrentriesmid.AttrEntriesMiddleware
+	controls    map[string]controlsmid.ControlsMiddleware
+	bindName    map[string]bindnamemid.BindNameMiddleware
+}
+
+// The *MidFlags maps name the middleware behind each letter of a chain.
+
+var BaseDNMidFlags map[rune]string = map[rune]string{
+	'O': "OIDAttribute",
+	'C': "Case",
+	'X': "HexValue",
+	'S': "Spacing",
+	'Q': "DoubleQuotes",
+	'U': "GUIDFormat",
+	'I': "SIDFormat",
+	'W': "WKGUIDFormat",
+}
+
+var FilterMidFlags map[rune]string = map[rune]string{
+	'O': "OIDAttribute",
+	'C': "Case",
+	'X': "HexValue",
+	'S': "Spacing",
+	'T': "ReplaceTautologies",
+	't': "TimestampGarbage",
+	'B': "AddBool",
+	'D': "DblNegBool",
+	'M': "DeMorganBool",
+	'R': "ReorderBool",
+	'b': "ExactBitwiseBreakout",
+	'd': "BitwiseDecomposition",
+	'I': "EqInclusion",
+	'E': "EqExclusion",
+	'G': "Garbage",
+	'A': "EqApproxMatch",
+	'x': "EqExtensible",
+	'Z': "PrependZeros",
+	's': "SubstringSplit",
+	'N': "NamesToANR",
+	'n': "ANRGarbageSubstring",
+	'P': "DNAttributesNoise",
+	'L': "TransitiveEval",
+	'F': "ObjectCategoryForm",
+	'U': "IgnorableUnicode",
+	'W': "AltSpace",
+}
+
+var AttrListMidFlags map[rune]string = map[rune]string{
+	'O': "OIDAttribute",
+	'C': "Case",
+	'D': "Duplicate",
+	'G': "GarbageNonExisting",
+	'g': "GarbageExisting",
+	'W': "ReplaceWithWildcard",
+	'w': "AddWildcard",
+	'p': "AddPlus",
+	'E': "ReplaceWithEmpty",
+	'R': "ReorderList",
+	'r': "Range",
+}
+
+var AttrEntriesMidFlags map[rune]string = map[rune]string{
+	'O': "OIDAttribute",
+	'C': "Case",
+	/*
+		'D': "Duplicate",
+		'G': "GarbageNonExisting",
+		'g': "GarbageExisting",
+	*/
+	'R': "ReorderList",
+	'D': "Duplicate",
+}
+
+var ControlsMidFlags map[rune]string = map[rune]string{
+	'S': "Strip",
+	'N': "Noise",
+	'R': "ReorderList",
+	'C': "FlipCriticality",
+	'Z': "PrependZeros",
+}
+
+var BindNameMidFlags map[rune]string = map[rune]string{
+	'O': "OIDAttribute",
+	'C': "Case",
+	'X': "HexValue",
+	'S': "Spacing",
+	'D': "DNForm",
+	'U': "UPNForm",
+	'N': "NT4Form",
+	'I': "SIDForm",
+	'G': "GUIDForm",
+	'M': "MechanismCase",
+}
+
+// The *ChainParams maps name the parameters a middleware takes inline in a
+// chain, as in "C(prob=0.3)", and the option each one overrides for that
+// occurrence of the middleware alone.
+
+var BaseDNChainParams = map[rune]map[string]string{
+	'O': {"maxspaces": "BDNOIDAttributeMaxSpaces", "maxzeros": "BDNOIDAttributeMaxZeros", "prefix": "BDNOIDAttributeIncludePrefix"},
+	'C': {"prob": "BDNCaseProb"},
+	'X': {"prob": "BDNHexValueProb"},
+	'S': {"maxelems": "BDNSpacingMaxElems"},
+	'U': {"guid": "BDNGuid", "match": "BDNMatch"},
+	'I': {"sid": "BDNSid", "match": "BDNMatch"},
+}
+
+var FilterChainParams = map[rune]map[string]string{
+	'O': {"maxspaces": "FiltOIDAttributeMaxSpaces", "maxzeros": "FiltOIDAttributeMaxZeros", "prefix": "FiltOIDAttributeIncludePrefix"},
+	'C': {"prob": "FiltCaseProb"},
+	'X': {"prob": "FiltHexValueProb"},
+	'S': {"maxspaces": "FiltSpacingMaxSpaces"},
+	't': {"maxchars": "FiltTimestampGarbageMaxChars", "charset": "FiltGarbageCharset", "comma": "FiltTimestampGarbageUseComma"},
+	'B': {"depth": "FiltAddBoolMaxDepth", "prob": "FiltAddBoolProb"},
+	'D': {"depth": "FiltDblNegBoolMaxDepth", "prob": "FiltDblNegBoolProb"},
+	'd': {"maxbits": "FiltBitwiseDecompositionMaxBits"},
+	'G': {"maxelems": "FiltGarbageMaxElems", "maxsize": "FiltGarbageMaxSize", "charset": "FiltGarbageCharset"},
+	'x': {"appenddn": "FiltEqExtensibleAppendDN"},
+	'Z': {"maxelems": "FiltPrependZerosMaxElems"},
+	's': {"prob": "FiltSubstringSplitProb"},
+	'n': {"maxelems": "FiltANRSubstringMaxElems", "charset": "FiltGarbageCharset"},
+	'P': {"prob": "FiltDNAttrNoiseProb"},
+	'F': {"rootdn": "FiltObjCategoryRootDN"},
+	'U': {"prob": "FiltIgnorableUnicodeProb", "mode": "FiltIgnorableUnicodeMode"},
+	'W': {"prob": "FiltAltSpaceProb"},
+}
+
+var AttrListChainParams = map[rune]map[string]string{
+	'O': {"maxspaces": "AttrsOIDAttributeMaxSpaces", "maxzeros": "AttrsOIDAttributeMaxZeros", "prefix": "AttrsOIDAttributeIncludePrefix"},
+	'C': {"prob": "AttrsCaseProb"},
+	'D': {"prob": "AttrsDuplicateProb"},
+	'G': {"maxelems": "AttrsGarbageNonExistingMaxElems", "maxsize": "AttrsGarbageNonExistingMaxSize", "charset": "AttrsGarbageCharset"},
+	'g': {"maxelems": "AttrsGarbageExistingMaxElems"},
+	'r': {"range": "AttrsRangeOption"},
+}
+
+var AttrEntriesChainParams = map[rune]map[string]string{
+	'O': {"maxspaces": "AttrEntriesOIDAttributeMaxSpaces", "maxzeros": "AttrEntriesOIDAttributeMaxZeros", "prefix": "AttrEntriesOIDAttributeIncludePrefix"},
+	'C': {"prob": "AttrEntriesCaseProb"},
+}
+
+var ControlsChainParams = map[rune]map[string]string{
+	'S': {"oids": "CtrlStripOIDs"},
+	'N': {"maxelems": "CtrlNoiseMaxElems", "oids": "CtrlNoiseOIDs"},
+	'C': {"prob": "CtrlCriticalityProb"},
+	'Z': {"maxzeros": "CtrlOIDMaxZeros"},
+}
+
+var BindNameChainParams = map[rune]map[string]string{
+	'O': BaseDNChainParams['O'],
+	'C': BaseDNChainParams['C'],
+	'X': BaseDNChainParams['X'],
+	'S': BaseDNChainParams['S'],
+	'D': {"dn": "BindDN", "match": "BindMatch"},
+	'U': {"upn": "BindUPN", "domain": "BindDNSDomain", "match": "BindMatch"},
+	'N': {"nt4": "BindNT4", "domain": "BindNetBIOSDomain", "match": "BindMatch"},
+	'I': {"sid": "BindSid", "match": "BindMatch"},
+	'G': {"guid": "BindGuid", "match": "BindMatch"},
+	'M': {"prob": "BindMechCaseProb"},
+}
+
+// setupMiddlewares (re)builds the middlewares with the current options.
+func (p *Proxy) setupMiddlewares() {
+	p.mids.Store(newMiddlewareSet(p.midOpts(nil)))
+
+	p.berEncoding.Store(&berenc.Options{
+		LongLength:           p.optBool("BERLongLength"),
+		LongLengthProb:       p.optFloat("BERLongLengthProb"),
+		PaddedLength:         p.optBool("BERPaddedLength"),
+		PaddedLengthProb:     p.optFloat("BERPaddedLengthProb"),
+		PaddedLengthMaxBytes: p.optInt("BERPaddedLengthMaxBytes"),
+		IndefiniteLength:     p.optBool("BERIndefiniteLength"),
+		IndefiniteLengthProb: p.optFloat("BERIndefiniteLengthProb"),
+		IntPadding:           p.optBool("BERIntPadding"),
+		IntPaddingProb:       p.optFloat("BERIntPaddingProb"),
+		IntPaddingMaxBytes:   p.optInt("BERIntPaddingMaxBytes"),
+	})
+
+	p.setupTrafficShaping()
+}
+
+// newMiddlewareSet builds every middleware with the options of o.
+func newMiddlewareSet(o middlewareOptions) *middlewareSet {
+	var mids middlewareSet
+
+	mids.baseDN = map[string]basednmid.BaseDNMiddleware{
+		"OIDAttribute": basednmid.OIDAttributeBaseDNObf(o.int("BDNOIDAttributeMaxSpaces"), o.int("BDNOIDAttributeMaxZeros"), o.bool("BDNOIDAttributeIncludePrefix")),
+		"Case":         basednmid.RandCaseBaseDNObf(o.float("BDNCaseProb")),
+		"HexValue":     basednmid.RandHexValueBaseDNObf(o.float("BDNHexValueProb")),
+		"Spacing":      basednmid.RandSpacingBaseDNObf(o.int("BDNSpacingMaxElems")),
+		"DoubleQuotes": basednmid.DoubleQuotesBaseDNObf(),
+		"GUIDFormat":   basednmid.GUIDBaseDNObf(o.str("BDNGuid"), o.str("BDNMatch")),
+		"SIDFormat":    basednmid.SIDBaseDNObf(o.str("BDNSid"), o.str("BDNMatch")),
+		"WKGUIDFormat": basednmid.WKGUIDFormatBaseDNObf(),
+	}
+
+	mids.filter = map[string]filtermid.FilterMiddleware{
+		"OIDAttribute":         filtermid.OIDAttributeFilterObf(o.int("FiltOIDAttributeMaxSpaces"), o.int("FiltOIDAttributeMaxZeros"), o.bool("FiltOIDAttributeIncludePrefix")),
+		"Case":                 filtermid.RandCaseFilterObf(o.float("FiltCaseProb")),
+		"HexValue":             filtermid.RandHexValueFilterObf(o.float("FiltHexValueProb")),
+		"Spacing":              filtermid.RandSpacingFilterObf(o.int("FiltSpacingMaxSpaces")),
+		"ReplaceTautologies":   filtermid.ReplaceTautologiesFilterObf(),
+		"TimestampGarbage":     filtermid.RandTimestampSuffixFilterObf(o.int("FiltTimestampGarbageMaxChars"), o.str("FiltGarbageCharset"), o.bool("FiltTimestampGarbageUseComma")),
+		"AddBool":              filtermid.RandAddBoolFilterObf(o.int("FiltAddBoolMaxDepth"), o.float("FiltAddBoolProb")),
+		"DblNegBool":           filtermid.RandDblNegBoolFilterObf(o.int("FiltDblNegBoolMaxDepth"), o.float("FiltDblNegBoolProb")),
+		"DeMorganBool":         filtermid.DeMorganBoolFilterObf(),
+		"ReorderBool":          filtermid.RandBoolReorderFilterObf(),
+		"ExactBitwiseBreakout": filtermid.ExactBitwiseBreakoutFilterObf(),
+		"BitwiseDecomposition": filtermid.BitwiseDecomposeFilterObf(o.int("FiltBitwiseDecompositionMaxBits")),
+		"EqInclusion":          filtermid.EqualityByInclusionFilterObf(),
+		"EqExclusion":          filtermid.EqualityByExclusionFilterObf(),
+		"Garbage":              filtermid.RandGarbageFilterObf(o.int("FiltGarbageMaxElems"), o.int("FiltGarbageMaxSize"), o.str("FiltGarbageCharset")),
+		"EqApproxMatch":        filtermid.EqualityToApproxMatchFilterObf(),
+		"EqExtensible":         filtermid.EqualityToExtensibleFilterObf(o.bool("FiltEqExtensibleAppendDN")),
+		"PrependZeros":         filtermid.RandPrependZerosFilterObf(o.int("FiltPrependZerosMaxElems")),
+		"SubstringSplit":       filtermid.RandSubstringSplitFilterObf(o.float("FiltSubstringSplitProb")),
+		"NamesToANR":           filtermid.ANRAttributeFilterObf(ANRSet),
+		"ANRGarbageSubstring":  filtermid.ANRSubstringGarbageFilterObf(o.int("FiltANRSubstringMaxElems"), o.str("FiltGarbageCharset")),
+		"DNAttributesNoise":    filtermid.RandDNAttributesNoiseFilterObf(o.float("FiltDNAttrNoiseProb")),
+		"TransitiveEval":       filtermid.TransitiveEvalFilterObf(),
+		"ObjectCategoryForm":   filtermid.ObjectCategoryFormFilterObf(o.str("FiltObjCategoryRootDN")),
+		"IgnorableUnicode":     filtermid.RandIgnorableUnicodeFilterObf(o.float("FiltIgnorableUnicodeProb"), o.str("FiltIgnorableUnicodeMode")),
+		"AltSpace":             filtermid.RandAltSpaceFilterObf(o.float("FiltAltSpaceProb")),
+	}
+
+	mids.attrList = map[string]attrlistmid.AttrListMiddleware{
+		"OIDAttribute":        attrlistmid.OIDAttributeAttrListObf(o.int("AttrsOIDAttributeMaxSpaces"), o.int("AttrsOIDAttributeMaxZeros"), o.bool("AttrsOIDAttributeIncludePrefix")),
+		"Case":                attrlistmid.RandCaseAttrListObf(o.float("AttrsCaseProb")),
+		"Duplicate":           attrlistmid.DuplicateAttrListObf(o.float("AttrsDuplicateProb")),
+		"GarbageNonExisting":  attrlistmid.GarbageNonExistingAttrListObf(o.int("AttrsGarbageNonExistingMaxElems"), o.int("AttrsGarbageNonExistingMaxSize"), o.str("AttrsGarbageCharset")),
+		"GarbageExisting":     attrlistmid.GarbageExistingAttrListObf(o.int("AttrsGarbageExistingMaxElems")),
+		"ReplaceWithWildcard": attrlistmid.ReplaceWithWildcardAttrListObf(),
+		"AddWildcard":         attrlistmid.AddWildcardAttrListObf(),
+		"AddPlus":             attrlistmid.AddPlusAttrListObf(),
+		"ReplaceWithEmpty":    attrlistmid.ReplaceWithEmptyAttrListObf(),
+		"ReorderList":         attrlistmid.ReorderListAttrListObf(),
+		"Range":               attrlistmid.RangeAttrListObf(o.str("AttrsRangeOption")),
+	}
+
+	mids.attrEntries = map[string]attrentriesmid.AttrEntriesMiddleware{
+		"OIDAttribute": attrentriesmid.OIDAttributeAttrEntriesObf(o.int("AttrEntriesOIDAttributeMaxSpaces"), o.int("AttrEntriesOIDAttributeMaxZeros"), o.bool("AttrEntriesOIDAttributeIncludePrefix")),
+		"Case":         attrentriesmid.RandCaseAttrEntriesObf(o.float("AttrEntriesCaseProb")),
+		"ReorderList":  attrentriesmid.ReorderListAttrEntriesObf(),
+	}
+
+	mids.controls = map[string]controlsmid.ControlsMiddleware{
+		"Strip":           controlsmid.StripControlsObf(o.list("CtrlStripOIDs")),
+		"Noise":           controlsmid.AddNoiseControlsObf(o.int("CtrlNoiseMaxElems"), o.list("CtrlNoiseOIDs")),
+		"ReorderList":     controlsmid.ReorderControlsObf(),
+		"FlipCriticality": controlsmid.FlipCriticalityControlsObf(o.float("CtrlCriticalityProb")),
+		"PrependZeros":    controlsmid.PrependZerosOIDControlsObf(o.int("CtrlOIDMaxZeros")),
+	}
+
+	// DN-form bind names go through the BaseDN middlewares, options included
+	mids.bindName = map[string]bindnamemid.BindNameMiddleware{
+		"OIDAttribute":  bindnamemid.DNObfBindNameObf(mids.baseDN["OIDAttribute"]),
+		"Case":          bindnamemid.DNObfBindNameObf(mids.baseDN["Case"]),
+		"HexValue":      bindnamemid.DNObfBindNameObf(mids.baseDN["HexValue"]),
+		"Spacing":       bindnamemid.DNObfBindNameObf(mids.baseDN["Spacing"]),
+		"DNForm":        bindnamemid.DNFormBindNameObf(o.str("BindDN"), o.str("BindMatch")),
+		"UPNForm":       bindnamemid.UPNFormBindNameObf(o.str("BindUPN"), o.str("BindDNSDomain"), o.str("BindMatch")),
+		"NT4Form":       bindnamemid.NT4FormBindNameObf(o.str("BindNT4"), o.str("BindNetBIOSDomain"), o.str("BindMatch")),
+		"SIDForm":       bindnamemid.SIDFormBindNameObf(o.str("BindSid"), o.str("BindMatch")),
+		"GUIDForm":      bindnamemid.GUIDFormBindNameObf(o.str("BindGuid"), o.str("BindMatch")),
+		"MechanismCase": bindnamemid.RandCaseMechanismBindNameObf(o.float("BindMechCaseProb")),
+	}
+
+	return &mids
+}
+
+// middlewareOptions reads the middleware options of a Proxy, with overrides
+// (keyed like middlewares.DefaultOptions) taking precedence over them - the
+// options given inline to an element of a chain.
+type middlewareOptions struct {
+	p         *Proxy
+	overrides map[string]string
+}
+
+func (p *Proxy) midOpts(overrides map[string]string) middlewareOptions {
+	return middlewareOptions{p: p, overrides: overrides}
+}
+
+// get returns an option only if it is overridden or set.
+func (o middlewareOptions) get(key string) (string, bool) {
+	if value, ok := o.overrides[key]; ok {
+		return value, true
+	}
+	return o.p.options.get(key)
+}
+
+func (o middlewareOptions) str(key string) string {
+	if value, ok := o.get(key); ok {
+		return value
+	}
+	return middlewares.DefaultOptions[key]
+}
+
+// list splits a comma-separated option into its trimmed, non-empty items.
+func (o middlewareOptions) list(key string) []string {
+	var result []string
+	for _, item := range strings.Split(o.str(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (o middlewareOptions) int(key string) int {
+	if value, ok := o.get(key); ok {
+		i, err := strconv.Atoi(value)
+		if err == nil {
+			return i
+		}
+	}
+
+	result, _ := strconv.Atoi(middlewares.DefaultOptions[key])
+	return result
+}
+
+func (o middlewareOptions) float(key string) float64 {
+	if value, ok := o.get(key); ok {
+		i, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return i
+		}
+	}
+
+	result, _ := strconv.ParseFloat(middlewares.DefaultOptions[key], 64)
+	return result
+}
+
+func (o middlewareOptions) bool(key string) bool {
+	if value, ok := o.get(key); ok {
+		return strings.ToLower(value) == "true"
+	}
+	return strings.ToLower(middlewares.DefaultOptions[key]) == "true"
+}
+
+func (p *Proxy) optStr(key string) string    { return p.midOpts(nil).str(key) }
+func (p *Proxy) optList(key string) []string { return p.midOpts(nil).list(key) }
+func (p *Proxy) optInt(key string) int       { return p.midOpts(nil).int(key) }
+func (p *Proxy) optFloat(key string) float64 { return p.midOpts(nil).float(key) }
+func (p *Proxy) optBool(key string) bool     { return p.midOpts(nil).bool(key) }
@@ -1,4 +1,4 @@
-package app
+package proxy
 
 import (
 	"crypto/sha256"
@@ -9,48 +9,58 @@ import (
 
 	"github.com/fatih/color"
 
-	"github.com/Macmod/ldapx/log"
+	bindnamemid "github.com/Macmod/ldapx/middlewares/bindname"
 	"github.com/Macmod/ldapx/parser"
 	ber "github.com/go-asn1-ber/asn1-ber"
 )
 
 // General logic behind the transformations that ldapx
 // is capable of applying to each LDAP operation.
-func TransformSearchRequest(filter parser.Filter, baseDN string, attrs []string) (parser.Filter, string, []string) {
-	newFilter := getFilterChain().Execute(filter, true)
-	newAttrs := getAttrListChain().Execute(attrs, true)
-	newBaseDN := getBaseDNChain().Execute(baseDN, true)
+func (p *Proxy) TransformSearchRequest(filter parser.Filter, baseDN string, attrs []string) (parser.Filter, string, []string) {
+	newFilter := p.getFilterChain().Execute(filter, true)
+	newAttrs := p.getAttrListChain().Execute(attrs, true)
+	newBaseDN := p.getBaseDNChainFor("basedn.search").Execute(baseDN, true)
 
 	return newFilter, newBaseDN, newAttrs
 }
 
-func TransformModifyRequest(targetDN string, changes []ChangeRequest) (string, []ChangeRequest) {
-	newTargetDN := getBaseDNChain().Execute(targetDN, true)
+func (p *Proxy) TransformControls(controls parser.Controls) parser.Controls {
+	return p.getControlsChain().Execute(controls, true)
+}
+
+func (p *Proxy) TransformBindRequest(name bindnamemid.BindName) bindnamemid.BindName {
+	return p.getBindNameChain().Execute(name, true)
+}
+
+func (p *Proxy) TransformModifyRequest(targetDN string, changes []ChangeRequest) (string, []ChangeRequest) {
+	newTargetDN := p.getBaseDNChainFor("basedn.modify").Execute(targetDN, true)
 	newChanges := make([]ChangeRequest, len(changes))
 
+	entriesChain := p.getAttrEntriesChainFor("attrentries.modify")
 	for idx := range newChanges {
 		newChanges[idx].OperationId = changes[idx].OperationId
-		newChanges[idx].Modifications = getAttrEntriesChain().Execute(changes[idx].Modifications, true)
+		newChanges[idx].Modifications = entriesChain.Execute(changes[idx].Modifications, true)
 	}
 
 	return newTargetDN, newChanges
 }
 
-func TransformAddRequest(targetDN string, entries parser.AttrEntries) (string, parser.AttrEntries) {
-	newTargetDN := getBaseDNChain().Execute(targetDN, true)
-	newEntries := getAttrEntriesChain().Execute(entries, true)
+func (p *Proxy) TransformAddRequest(targetDN string, entries parser.AttrEntries) (string, parser.AttrEntries) {
+	newTargetDN := p.getBaseDNChainFor("basedn.add").Execute(targetDN, true)
+	newEntries := p.getAttrEntriesChainFor("attrentries.add").Execute(entries, true)
 
 	return newTargetDN, newEntries
 }
 
-func TransformDeleteRequest(targetDN string) string {
-	return getBaseDNChain().Execute(targetDN, true)
+func (p *Proxy) TransformDeleteRequest(targetDN string) string {
+	return p.getBaseDNChainFor("basedn.delete").Execute(targetDN, true)
 }
 
-func TransformModifyDNRequest(entry string, newRDN string, delOld bool, newSuperior string) (string, string, bool, string) {
-	newEntry := getBaseDNChain().Execute(entry, true)
-	newNSuperior := getBaseDNChain().Execute(newSuperior, true)
-	newNRDN := getBaseDNChain().Execute(newRDN, true)
+func (p *Proxy) TransformModifyDNRequest(entry string, newRDN string, delOld bool, newSuperior string) (string, string, bool, string) {
+	chains := p.getBaseDNChainsFor("basedn.modifydn.entry", "basedn.modifydn.newsuperior", "basedn.modifydn.newrdn")
+	newEntry := chains[0].Execute(entry, true)
+	newNSuperior := chains[1].Execute(newSuperior, true)
+	newNRDN := chains[2].Execute(newRDN, true)
 	newDelOld := delOld // Not processed
 
 	return newEntry, newNRDN, newDelOld, newNSuperior
@@ -59,8 +69,8 @@ func TransformModifyDNRequest(entry string, newRDN string, delOld bool, newSuper
 // Basic packet processing logic behind the transformations that ldapx
 // is capable of applying to each LDAP operation.
 
-func ProcessSearchRequest(packet *ber.Packet, searchRequestMap map[string]*ber.Packet) *ber.Packet {
-	if runtimeConfig.GetTracking() {
+func (p *Proxy) ProcessSearchRequest(packet *ber.Packet, searchRequestMap map[string]*ber.Packet) *ber.Packet {
+	if p.Settings().Tracking {
 		// Handle possible cookie desync by tracking the original corresponding request
 		// If the current search request is paged and has a cookie, forward the original request
 		// that generated the paging, including the current paging control
@@ -78,7 +88,7 @@ func ProcessSearchRequest(packet *ber.Packet, searchRequestMap map[string]*ber.P
 					}
 					searchControlValue := ber.DecodePacket(control.Children[valueIdx].Data.Bytes())
 					if searchControlValue == nil || len(searchControlValue.Children) < 2 {
-						log.Log.Print(yellow.Sprintf("[-] Malformed paged results control value - skipping tracking for this control"))
+						p.logger.Print(yellow.Sprintf("[-] Malformed paged results control value - skipping tracking for this control"))
 						continue
 					}
 					cookie := searchControlValue.Children[1].Data.Bytes()
@@ -95,11 +105,11 @@ func ProcessSearchRequest(packet *ber.Packet, searchRequestMap map[string]*ber.P
 							forwardPacket.AppendChild(searchPacket.Children[1])
 							forwardPacket.AppendChild(packet.Children[2])
 
-							log.Log.Printf("[+] [Paging] Search Request Forwarded")
+							p.logger.Printf("[+] [Paging] Search Request Forwarded")
 
 							return forwardPacket
 						} else {
-							log.Log.Print(yellow.Sprintf("[-] Error finding previous packet (tracking algorithm)"))
+							p.logger.Print(yellow.Sprintf("[-] Error finding previous packet (tracking algorithm)"))
 						}
 					}
 				}
@@ -117,27 +127,27 @@ func ProcessSearchRequest(packet *ber.Packet, searchRequestMap map[string]*ber.P
 
 	filter, err := parser.PacketToFilter(filterData)
 	if err != nil {
-		fmt.Println(red.Sprintf("[ERROR] %s", err))
+		fmt.Fprintln(p.out, red.Sprintf("[ERROR] %s", err))
 		return packet
 	}
 
 	oldFilterStr, err := parser.FilterToQuery(filter)
 	if err != nil {
-		fmt.Println(yellow.Sprintf("[WARNING] %s", err))
+		fmt.Fprintln(p.out, yellow.Sprintf("[WARNING] %s", err))
 	}
 
-	fmt.Println(blue.Sprintf(
+	fmt.Fprintln(p.out, blue.Sprintf(
 		"Intercepted Search\n    BaseDN: '%s'\n    Filter: %s\n    Attributes: %s",
 		baseDN, oldFilterStr, prettyList(attrs),
 	))
 
-	newFilter, newBaseDN, newAttrs := TransformSearchRequest(
+	newFilter, newBaseDN, newAttrs := p.TransformSearchRequest(
 		filter, baseDN, attrs,
 	)
 
 	newFilterStr, err := parser.FilterToQuery(newFilter)
 	if err != nil {
-		fmt.Println(yellow.Sprintf("[WARNING] %s", err))
+		fmt.Fprintln(p.out, yellow.Sprintf("[WARNING] %s", err))
 	}
 
 	// Change the fields that need to be changed
@@ -159,12 +169,12 @@ func ProcessSearchRequest(packet *ber.Packet, searchRequestMap map[string]*ber.P
 	}
 
 	if updatedFlag {
-		fmt.Println(green.Sprintf("Changed Search\n    BaseDN: '%s'\n    Filter: %s\n    Attributes: %s", newBaseDN, newFilterStr, prettyList(newAttrs)))
+		fmt.Fprintln(p.out, green.Sprintf("Changed Search\n    BaseDN: '%s'\n    Filter: %s\n    Attributes: %s", newBaseDN, newFilterStr, prettyList(newAttrs)))
 
 		// We need to copy it to refresh the internal Data of the parent packet
 		return CopyBerPacket(packet)
 	} else {
-		fmt.Println(blue.Sprintf("Nothing changed in the request"))
+		fmt.Fprintln(p.out, blue.Sprintf("Nothing changed in the request"))
 	}
 
 	return packet
@@ -199,7 +209,7 @@ func (change *ChangeRequest) FormatChanges(c *color.Color) string {
 }
 
 // https://ldap.com/ldapv3-wire-protocol-reference-modify/
-func ProcessModifyRequest(packet *ber.Packet) *ber.Packet {
+func (p *Proxy) ProcessModifyRequest(packet *ber.Packet) *ber.Packet {
 	if len(packet.Children) > 1 {
 		modPacket := packet.Children[1]
 
@@ -232,9 +242,9 @@ func ProcessModifyRequest(packet *ber.Packet) *ber.Packet {
 		for _, req := range changeRequests {
 			msg.WriteString(req.FormatChanges(blue))
 		}
-		fmt.Print(msg.String())
+		fmt.Fprint(p.out, msg.String())
 
-		newTargetDN, newChangeRequests := TransformModifyRequest(targetDN, changeRequests)
+		newTargetDN, newChangeRequests := p.TransformModifyRequest(targetDN, changeRequests)
 
 		updatedFlag := false
 		if newTargetDN != targetDN {
@@ -278,22 +288,22 @@ func ProcessModifyRequest(packet *ber.Packet) *ber.Packet {
 			for _, req := range newChangeRequests {
 				msg.WriteString(req.FormatChanges(green))
 			}
-			fmt.Print(msg.String())
+			fmt.Fprint(p.out, msg.String())
 
 			// We need to copy it to refresh the internal Data of the parent packet
 			return CopyBerPacket(packet)
 		} else {
-			fmt.Println(blue.Sprintf("Nothing changed in the request"))
+			fmt.Fprintln(p.out, blue.Sprintf("Nothing changed in the request"))
 		}
 	} else {
-		fmt.Println(red.Sprintf("Malformed request (missing required fields)"))
+		fmt.Fprintln(p.out, red.Sprintf("Malformed request (missing required fields)"))
 	}
 
 	return packet
 }
 
 // https://ldap.com/ldapv3-wire-protocol-reference-add/
-func ProcessAddRequest(packet *ber.Packet) *ber.Packet {
+func (p *Proxy) ProcessAddRequest(packet *ber.Packet) *ber.Packet {
 	if len(packet.Children) > 1 {
 		addPacket := packet.Children[1]
 		targetDN := string(addPacket.Children[0].Data.Bytes())
@@ -316,11 +326,11 @@ func ProcessAddRequest(packet *ber.Packet) *ber.Packet {
 				msg.WriteString(blue.Sprintf("      '%s': '%s'\n", attrEntry.Name, attrVal))
 			}
 		}
-		fmt.Print(msg.String())
+		fmt.Fprint(p.out, msg.String())
 
 		updatedFlag := false
 
-		newTargetDN, newTargetAttrEntries := TransformAddRequest(targetDN, targetAttrEntries)
+		newTargetDN, newTargetAttrEntries := p.TransformAddRequest(targetDN, targetAttrEntries)
 		if newTargetDN != targetDN {
 			newEncodedDN := ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, newTargetDN, "")
 			UpdateBerChildLeaf(packet.Children[1], 0, newEncodedDN)
@@ -355,44 +365,44 @@ func ProcessAddRequest(packet *ber.Packet) *ber.Packet {
 					msg.WriteString(green.Sprintf("      '%s': '%s'\n", attrEntry.Name, attrVal))
 				}
 			}
-			fmt.Print(msg.String())
+			fmt.Fprint(p.out, msg.String())
 
 			// We need to copy it to refresh the internal Data of the parent packet
 			return CopyBerPacket(packet)
 		} else {
-			fmt.Println(blue.Sprintf("Nothing changed in the request"))
+			fmt.Fprintln(p.out, blue.Sprintf("Nothing changed in the request"))
 		}
 	} else {
-		fmt.Println(red.Sprintf("Malformed request (missing required fields)"))
+		fmt.Fprintln(p.out, red.Sprintf("Malformed request (missing required fields)"))
 	}
 
 	return packet
 }
 
 // https://ldap.com/ldapv3-wire-protocol-reference-delete/
-func ProcessDeleteRequest(packet *ber.Packet) *ber.Packet {
+func (p *Proxy) ProcessDeleteRequest(packet *ber.Packet) *ber.Packet {
 	if len(packet.Children) > 1 {
 		targetDN := string(packet.Children[1].Data.Bytes())
 
-		fmt.Println(blue.Sprintf("Intercepted Delete\n    TargetDN: '%s'", targetDN))
+		fmt.Fprintln(p.out, blue.Sprintf("Intercepted Delete\n    TargetDN: '%s'", targetDN))
 
-		newTargetDN := TransformDeleteRequest(targetDN)
+		newTargetDN := p.TransformDeleteRequest(targetDN)
 		newEncodedDN := ber.NewString(ber.ClassApplication, ber.TypePrimitive, 0x0A, newTargetDN, "")
 		if newTargetDN != targetDN {
-			fmt.Println(green.Sprintf("Changed Delete\n    TargetDN: '%s'", newTargetDN))
+			fmt.Fprintln(p.out, green.Sprintf("Changed Delete\n    TargetDN: '%s'", newTargetDN))
 			UpdateBerChildLeaf(packet, 1, newEncodedDN)
 		} else {
-			fmt.Println(blue.Sprintf("Nothing changed in the request"))
+			fmt.Fprintln(p.out, blue.Sprintf("Nothing changed in the request"))
 		}
 	} else {
-		fmt.Println(red.Sprintf("Malformed request (missing required fields)"))
+		fmt.Fprintln(p.out, red.Sprintf("Malformed request (missing required fields)"))
 	}
 
 	return packet
 }
 
 // https://ldap.com/ldapv3-wire-protocol-reference-modify-dn/
-func ProcessModifyDNRequest(packet *ber.Packet) *ber.Packet {
+func (p *Proxy) ProcessModifyDNRequest(packet *ber.Packet) *ber.Packet {
 	if len(packet.Children) > 1 {
 		modDNPacket := packet.Children[1]
 
@@ -402,9 +412,9 @@ func ProcessModifyDNRequest(packet *ber.Packet) *ber.Packet {
 			delOld := len(modDNPacket.Children[2].Data.Bytes()) > 0 && modDNPacket.Children[3].Data.Bytes()[0] != byte(0)
 			newSuperior := string(modDNPacket.Children[3].Data.Bytes())
 
-			fmt.Println(blue.Sprintf("Intercepted ModifyDN\n    Entry: '%s'\n    NewRDN: '%s'\n    DeleteOldRDN: '%t'\n    NewSuperior: '%s'", entry, newRDN, delOld, newSuperior))
+			fmt.Fprintln(p.out, blue.Sprintf("Intercepted ModifyDN\n    Entry: '%s'\n    NewRDN: '%s'\n    DeleteOldRDN: '%t'\n    NewSuperior: '%s'", entry, newRDN, delOld, newSuperior))
 
-			newEntry, newNRDN, newDelOld, newNSuperior := TransformModifyDNRequest(entry, newRDN, delOld, newSuperior)
+			newEntry, newNRDN, newDelOld, newNSuperior := p.TransformModifyDNRequest(entry, newRDN, delOld, newSuperior)
 
 			updatedFlag := false
 			if newEntry != entry {
@@ -432,32 +442,133 @@ func ProcessModifyDNRequest(packet *ber.Packet) *ber.Packet {
 			}
 
 			if updatedFlag {
-				fmt.Println(green.Sprintf("Changed ModifyDN\n    Entry: '%s'\n    NewRDN: '%s'\n    DeleteOldRDN: '%t'\n    NewSuperior: '%s'", newEntry, newNRDN, newDelOld, newNSuperior))
+				fmt.Fprintln(p.out, green.Sprintf("Changed ModifyDN\n    Entry: '%s'\n    NewRDN: '%s'\n    DeleteOldRDN: '%t'\n    NewSuperior: '%s'", newEntry, newNRDN, newDelOld, newNSuperior))
 				return CopyBerPacket(packet)
 			} else {
-				fmt.Println(blue.Sprintf("Nothing changed in the request"))
+				fmt.Fprintln(p.out, blue.Sprintf("Nothing changed in the request"))
 			}
 		} else {
-			fmt.Println(red.Sprintf("Malformed request (missing required fields)"))
+			fmt.Fprintln(p.out, red.Sprintf("Malformed request (missing required fields)"))
 		}
 	} else {
-		fmt.Println(red.Sprintf("Malformed request (missing required fields)"))
+		fmt.Fprintln(p.out, red.Sprintf("Malformed request (missing required fields)"))
 	}
 
 	return packet
 }
 
-// attrListChainHasRange reports whether the active AttrList chain contains the
-// Range middleware, i.e. whether ldapx is the one attaching range options to
-// outgoing requests. Response de-decoration is applied only in that case.
-func attrListChainHasRange() bool {
-	chain := getAttrListChain()
-	if chain == nil {
-		return false
+// https://ldap.com/ldapv3-wire-protocol-reference-bind/
+func (p *Proxy) ProcessBindRequest(packet *ber.Packet) *ber.Packet {
+	if len(packet.Children) < 2 || len(packet.Children[1].Children) < 3 {
+		fmt.Fprintln(p.out, red.Sprintf("Malformed request (missing required fields)"))
+		return packet
 	}
-	for _, m := range chain.Middlewares {
-		if m.Name == "Range" {
-			return true
+
+	bindReq := packet.Children[1]
+	auth := bindReq.Children[2]
+	isSASL := auth.ClassType == ber.ClassContext && auth.Tag == 3 && len(auth.Children) > 0
+
+	var name bindnamemid.BindName
+	name.Name = bindReq.Children[1].Data.String()
+	if isSASL {
+		name.Mechanism = auth.Children[0].Data.String()
+	}
+
+	fmt.Fprintln(p.out, blue.Sprintf("Intercepted Bind\n    Name: '%s'\n    Mechanism: '%s'", name.Name, name.Mechanism))
+
+	newName := p.TransformBindRequest(name)
+	if newName == name {
+		fmt.Fprintln(p.out, blue.Sprintf("Nothing changed in the request"))
+		return packet
+	}
+
+	fmt.Fprintln(p.out, green.Sprintf("Changed Bind\n    Name: '%s'\n    Mechanism: '%s'", newName.Name, newName.Mechanism))
+
+	if newName.Name != name.Name {
+		UpdateBerChildLeaf(bindReq, 1, ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, newName.Name, "Name"))
+	}
+	if isSASL && newName.Mechanism != name.Mechanism {
+		UpdateBerChildLeaf(auth, 0, ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, newName.Mechanism, "Mechanism"))
+	}
+
+	return CopyBerPacket(packet)
+}
+
+// controlsApplications are the operations whose request controls the
+// controls chain is applied to. Binds are left alone so the authentication
+// exchange reaches the server exactly as the client sent it.
+var controlsApplications = map[uint8]bool{
+	parser.ApplicationSearchRequest:   true,
+	parser.ApplicationModifyRequest:   true,
+	parser.ApplicationAddRequest:      true,
+	parser.ApplicationDelRequest:      true,
+	parser.ApplicationModifyDNRequest: true,
+	parser.ApplicationCompareRequest:  true,
+}
+
+func prettyList(list []string) string {
+	str, _ := json.Marshal(list)
+	return string(str)
+}
+
+// formatControls renders controls as a list of "OID (Name)" entries, with
+// critical ones marked.
+func formatControls(controls parser.Controls) string {
+	entries := make([]string, len(controls))
+	for i, control := range controls {
+		entry := control.OID
+		if name, ok := parser.ControlTypeMap[control.OID]; ok {
+			entry += " (" + name + ")"
+		}
+		if control.Criticality {
+			entry += " [critical]"
+		}
+		entries[i] = entry
+	}
+	return prettyList(entries)
+}
+
+// https://ldap.com/ldapv3-wire-protocol-reference-ldap-message/
+func (p *Proxy) ProcessRequestControls(packet *ber.Packet) *ber.Packet {
+	if len(packet.Children) < 2 || !p.hasControlsChain() {
+		return packet
+	}
+
+	var controls parser.Controls
+	if len(packet.Children) > 2 {
+		controls = parser.PacketToControls(packet.Children[2])
+	}
+
+	fmt.Fprintln(p.out, blue.Sprintf("Intercepted Controls\n    Controls: %s", formatControls(controls)))
+
+	newControls := p.TransformControls(controls)
+	if (len(controls) == 0 && len(newControls) == 0) || reflect.DeepEqual(controls, newControls) {
+		fmt.Fprintln(p.out, blue.Sprintf("Nothing changed in the controls"))
+		return packet
+	}
+
+	fmt.Fprintln(p.out, green.Sprintf("Changed Controls\n    Controls: %s", formatControls(newControls)))
+
+	newPacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	newPacket.AppendChild(packet.Children[0])
+	newPacket.AppendChild(packet.Children[1])
+	if len(newControls) > 0 {
+		newPacket.AppendChild(parser.ControlsToPacket(newControls))
+	}
+
+	return newPacket
+}
+
+// attrListChainHasRange reports whether the active AttrList chain (or any
+// chain its pool may draw) contains the Range middleware, i.e. whether ldapx
+// may be the one attaching range options to outgoing requests. Response
+// de-decoration is applied only in that case.
+func (p *Proxy) attrListChainHasRange() bool {
+	for _, chain := range chainsOf(p.chains.attrList.Load()) {
+		for _, m := range chain.Middlewares {
+			if m.Name == "Range" {
+				return true
+			}
 		}
 	}
 	return false
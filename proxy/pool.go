@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// chainPool is a weighted set of chains of one family, one of which is
+// drawn for each request. An entry is either a chain, used as it is, or an
+// alphabet of middlewares, from which a random subset is drawn in random
+// order.
+type chainPool[T any] struct {
+	family  string
+	entries []poolEntry[T]
+	total   int
+	logger  *log.Logger
+
+	// subset builds a chain from the middlewares of chain at indexes
+	subset func(chain *T, indexes []int) *T
+}
+
+type poolEntry[T any] struct {
+	weight   int
+	alphabet bool
+	elements []ChainElement
+	chain    *T
+}
+
+// newChainPool parses a pool of chains (see SetFilterPool), building each
+// entry with build, which validates it as a chain of the family.
+func newChainPool[T any](spec, family string, logger *log.Logger, build func(string) (*chainState[T], error), subset func(*T, []int) *T) (*chainPool[T], error) {
+	terms, err := splitPoolSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &chainPool[T]{family: family, logger: logger, subset: subset}
+	for _, term := range terms {
+		chain, weight, err := parsePoolTerm(term)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := poolEntry[T]{weight: weight}
+		if inner, ok := strings.CutPrefix(chain, "{"); ok {
+			chain, ok = strings.CutSuffix(inner, "}")
+			if !ok || chain == "" {
+				return nil, fmt.Errorf("pool entry '%s': an alphabet must be a non-empty chain in braces", term)
+			}
+			entry.alphabet = true
+		}
+
+		if entry.elements, err = ParseChain(chain); err != nil {
+			return nil, fmt.Errorf("pool entry '%s': %w", term, err)
+		}
+		state, err := build(chain)
+		if err != nil {
+			return nil, fmt.Errorf("pool entry '%s': %w", term, err)
+		}
+		entry.chain = state.chain
+
+		// Whatever order the alphabet is drawn in must make a valid chain;
+		// the ordering rules only involve pairs of middlewares, so checking
+		// the reverse order too covers every draw
+		if entry.alphabet {
+			reversed := slices.Clone(entry.elements)
+			slices.Reverse(reversed)
+			if _, err := build(joinChainElements(reversed)); err != nil {
+				return nil, fmt.Errorf("pool entry '%s' cannot be drawn in any order: %w", term, err)
+			}
+		}
+
+		pool.entries = append(pool.entries, entry)
+		pool.total += weight
+	}
+
+	if len(pool.entries) == 0 {
+		return nil, fmt.Errorf("empty pool")
+	}
+	return pool, nil
+}
+
+// draw picks a chain for one request, logging which.
+func (pool *chainPool[T]) draw() *T {
+	n := rand.Intn(pool.total)
+	entry := pool.entries[len(pool.entries)-1]
+	for _, e := range pool.entries {
+		if n < e.weight {
+			entry = e
+			break
+		}
+		n -= e.weight
+	}
+
+	if !entry.alphabet {
+		pool.logger.Printf("[+] %s pool drew chain '%s'", pool.family, joinChainElements(entry.elements))
+		return entry.chain
+	}
+
+	indexes := rand.Perm(len(entry.elements))[:1+rand.Intn(len(entry.elements))]
+	drawn := make([]ChainElement, len(indexes))
+	for i, index := range indexes {
+		drawn[i] = entry.elements[index]
+	}
+	pool.logger.Printf("[+] %s pool drew chain '%s'", pool.family, joinChainElements(drawn))
+	return pool.subset(entry.chain, indexes)
+}
+
+// chains returns the chain of every entry, with the whole alphabet for the
+// alphabet entries, so that callers can tell what a draw may contain.
+func (pool *chainPool[T]) chains() []*T {
+	chains := make([]*T, len(pool.entries))
+	for i, e := range pool.entries {
+		chains[i] = e.chain
+	}
+	return chains
+}
+
+func joinChainElements(elements []ChainElement) string {
+	var b strings.Builder
+	for _, e := range elements {
+		b.WriteString(e.String())
+	}
+	return b.String()
+}
+
+// splitPoolSpec splits a pool at the commas outside of parameters and
+// quotes.
+func splitPoolSpec(spec string) ([]string, error) {
+	var (
+		terms  []string
+		start  int
+		depth  int
+		quoted bool
+	)
+	for i := 0; i < len(spec); i++ {
+		switch ch := spec[i]; {
+		case ch == '\'':
+			quoted = !quoted
+		case quoted:
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+		case ch == ',' && depth == 0:
+			terms = append(terms, spec[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in pool")
+	}
+	terms = append(terms, spec[start:])
+
+	nonEmpty := terms[:0]
+	for _, term := range terms {
+		if term = strings.TrimSpace(term); term != "" {
+			nonEmpty = append(nonEmpty, term)
+		}
+	}
+	return nonEmpty, nil
+}
+
+// parsePoolTerm splits a pool entry into its chain and its weight, which
+// follows the last ':' outside of parameters and defaults to 1.
+func parsePoolTerm(term string) (string, int, error) {
+	colon := -1
+	depth, quoted := 0, false
+	for i := 0; i < len(term); i++ {
+		switch ch := term[i]; {
+		case ch == '\'':
+			quoted = !quoted
+		case quoted:
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+		case ch == ':' && depth == 0:
+			colon = i
+		}
+	}
+	if colon < 0 {
+		return term, 1, nil
+	}
+
+	weight, err := strconv.Atoi(strings.TrimSpace(term[colon+1:]))
+	if err != nil || weight < 1 {
+		return "", 0, fmt.Errorf("pool entry '%s': the weight must be an integer >= 1", term)
+	}
+	return strings.TrimSpace(term[:colon]), weight, nil
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitPoolSpec(t *testing.T) {
+	testCases := []struct {
+		name     string
+		spec     string
+		expected []string
+		wantErr  bool
+	}{
+		{name: "Single chain", spec: "CX", expected: []string{"CX"}},
+		{name: "Weights and spaces", spec: " CX:3 , O ", expected: []string{"CX:3", "O"}},
+		{name: "Alphabet", spec: "{CXS}:2,O", expected: []string{"{CXS}:2", "O"}},
+		{name: "Commas inside parameters", spec: "B(depth=2,prob=0.5):2,C", expected: []string{"B(depth=2,prob=0.5):2", "C"}},
+		{name: "Commas inside quotes", spec: "G(charset='a,b)'),C", expected: []string{"G(charset='a,b)')", "C"}},
+		{name: "Empty terms", spec: ",C,,X,", expected: []string{"C", "X"}},
+		{name: "Unterminated quote", spec: "G(charset='a,b),C", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			terms, err := splitPoolSpec(tc.spec)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, terms)
+		})
+	}
+}
+
+func TestParsePoolTerm(t *testing.T) {
+	testCases := []struct {
+		name    string
+		term    string
+		chain   string
+		weight  int
+		wantErr bool
+	}{
+		{name: "Default weight", term: "CX", chain: "CX", weight: 1},
+		{name: "Weight", term: "CX:5", chain: "CX", weight: 5},
+		{name: "Spaces around the weight", term: "CX : 5", chain: "CX", weight: 5},
+		{name: "Alphabet", term: "{CXS}:2", chain: "{CXS}", weight: 2},
+		{name: "Colon inside parameters", term: "F(rootdn=a:b)", chain: "F(rootdn=a:b)", weight: 1},
+		{name: "Colon inside quotes", term: "G(charset=':'):3", chain: "G(charset=':')", weight: 3},
+		{name: "Zero weight", term: "CX:0", wantErr: true},
+		{name: "Negative weight", term: "CX:-1", wantErr: true},
+		{name: "Weight that is not a number", term: "CX:a", wantErr: true},
+		{name: "Empty weight", term: "CX:", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			chain, weight, err := parsePoolTerm(tc.term)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.chain, chain)
+			assert.Equal(t, tc.weight, weight)
+		})
+	}
+}
+
+func TestNewChainPool(t *testing.T) {
+	type entry struct {
+		weight   int
+		alphabet bool
+		chain    string
+	}
+
+	testCases := []struct {
+		name     string
+		spec     string
+		expected []entry
+		wantErr  bool
+	}{
+		{name: "Chains", spec: "CX:3,O", expected: []entry{{3, false, "CX"}, {1, false, "O"}}},
+		{name: "Alphabet", spec: "{CXS}:2", expected: []entry{{2, true, "CXS"}}},
+		{name: "Parameters", spec: "C(prob=0.3),S(maxelems=2):4", expected: []entry{{1, false, "C(prob=0.3)"}, {4, false, "S(maxelems=2)"}}},
+		{name: "Alphabet with parameters", spec: "{C(prob=0.3)X}", expected: []entry{{1, true, "C(prob=0.3)X"}}},
+		{name: "Empty pool", spec: " , ", wantErr: true},
+		{name: "Empty alphabet", spec: "{}", wantErr: true},
+		{name: "Unclosed alphabet", spec: "{CX", wantErr: true},
+		{name: "Unknown middleware", spec: "C,q", wantErr: true},
+		{name: "Invalid parameter value", spec: "C(prob=2)", wantErr: true},
+		{name: "Unbalanced parentheses", spec: "C(prob=0.3", wantErr: true},
+		{name: "Stray closing parenthesis", spec: "C),X", wantErr: true},
+		{name: "Zero weight", spec: "C:0,X", wantErr: true},
+		{name: "Negative weight", spec: "C,X:-2", wantErr: true},
+		{name: "Invalid chain", spec: "XW", wantErr: true},
+		{name: "Alphabet invalid in some order", spec: "{WX}", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := New(Options{})
+			assert.NoError(t, err)
+
+			err = p.SetBaseDNPool(tc.spec)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			pool := p.chains.baseDN.Load().pool
+			var entries []entry
+			total := 0
+			for _, e := range pool.entries {
+				entries = append(entries, entry{e.weight, e.alphabet, joinChainElements(e.elements)})
+				total += e.weight
+			}
+			assert.Equal(t, tc.expected, entries)
+			assert.Equal(t, total, pool.total)
+			assert.Equal(t, tc.spec, p.BaseDNPool())
+		})
+	}
+}
+
+func TestPoolDrawnOncePerRequest(t *testing.T) {
+	p, err := New(Options{})
+	assert.NoError(t, err)
+	assert.NoError(t, p.SetBaseDNPool("{CXS}"))
+
+	for range 20 {
+		chains := p.getBaseDNChainsFor("basedn.modifydn.entry", "basedn.modifydn.newsuperior", "basedn.modifydn.newrdn")
+		assert.Same(t, chains[0], chains[1])
+		assert.Same(t, chains[0], chains[2])
+	}
+}
@@ -0,0 +1,1223 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Macmod/ldapx/berenc"
+	"github.com/Macmod/ldapx/decrypt"
+	"github.com/Macmod/ldapx/parser"
+	"github.com/Macmod/ldapx/rootdse"
+	"github.com/fatih/color"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"h12.io/socks"
+)
+
+var green = color.New(color.FgGreen)
+var red = color.New(color.FgRed)
+var yellow = color.New(color.FgYellow)
+var blue = color.New(color.FgBlue)
+
+// cyan/magenta distinguish which leg of the proxy a message belongs to:
+// cyan for forward/target-bound traffic (C->T), magenta for reverse/
+// client-bound traffic (C<-T) - both mid-brightness, legible on light and
+// dark terminal backgrounds alike, and distinct from the semantic
+// red/yellow/green above (error/warning/changed) so direction and outcome
+// are never visually conflated.
+var cyan = color.New(color.FgCyan)
+var magenta = color.New(color.FgMagenta)
+
+// ErrClosed is returned by Serve once the Proxy has been closed.
+var ErrClosed = errors.New("proxy: closed")
+
+// ConnInfo identifies the client connection a hook is called for.
+type ConnInfo struct {
+	// ID numbers client connections in the order they are accepted
+	ID uint64
+	// ClientAddr is the address of the client
+	ClientAddr net.Addr
+	// Identity is the identity the connection is bound as, if known (see
+	// decrypt.BindSession.Identity)
+	Identity string
+}
+
+// Hook is called with each message the proxy relays, once the middlewares
+// were applied to it. It returns the message to relay in its place, or nil
+// to drop it.
+type Hook func(conn ConnInfo, packet *ber.Packet) *ber.Packet
+
+// Options configure a Proxy.
+type Options struct {
+	// Settings are the initial settings, which can be changed later with
+	// UpdateSettings.
+	Settings
+
+	// Chains of middlewares, given by their letters (see the *MidFlags
+	// maps). They can be changed later with the Set*Chain methods.
+	FilterChain      string
+	BaseDNChain      string
+	AttrListChain    string
+	AttrEntriesChain string
+	ControlsChain    string
+	BindNameChain    string
+
+	// Pools of chains, one of which is drawn for each request (see
+	// SetFilterPool). A pool replaces the chain of its family, so the two
+	// cannot both be given. They can be changed later with the Set*Pool
+	// methods.
+	FilterPool      string
+	BaseDNPool      string
+	AttrListPool    string
+	AttrEntriesPool string
+	ControlsPool    string
+	BindNamePool    string
+
+	// OperationChains override BaseDNChain and AttrEntriesChain for single
+	// operations, keyed by the names in OperationChainNames. They can be
+	// changed later with SetOperationChain.
+	OperationChains map[string]string
+
+	// MiddlewareOptions override middlewares.DefaultOptions. They can be
+	// changed later with SetOption.
+	MiddlewareOptions map[string]string
+
+	// Decrypt holds the credentials to decrypt and inspect binds with,
+	// and the bind rewriting settings.
+	Decrypt decrypt.Config
+
+	// Translate, if set, makes the proxy answer client binds itself and
+	// bind upstream as the account it names.
+	Translate *decrypt.TranslateConfig
+
+	// UpstreamTLS is the TLS configuration of LDAPS connections to the
+	// target. Defaults to one that skips certificate verification.
+	UpstreamTLS *tls.Config
+
+	// UpstreamClientKey, if set, is paired with the certificate the client
+	// presents to a TLS listener to authenticate the target connection
+	// with it (Pass-the-Cert).
+	UpstreamClientKey crypto.PrivateKey
+
+	// UpstreamExternal binds every target connection with SASL EXTERNAL,
+	// as the certificate in UpstreamTLS.
+	UpstreamExternal bool
+
+	// KeyLogWriter, if set, receives the secrets of the target connections
+	// in the NSS key log format.
+	KeyLogWriter io.Writer
+
+	// OnRequest and OnResponse, if set, are called with each request
+	// forwarded to the target and each response relayed back from it,
+	// including the responses served from the cache.
+	OnRequest  Hook
+	OnResponse Hook
+
+	// Logger receives the log lines of the proxy: connections, binds and
+	// the requests and responses relayed. Output receives the details of
+	// the requests the middlewares process and the packet dumps. Both
+	// default to discarding everything.
+	Logger *log.Logger
+	Output io.Writer
+}
+
+// Proxy relays LDAP connections to a target server, applying its
+// middlewares to the requests on the way.
+type Proxy struct {
+	settings settingsStore
+	options  optionStore
+
+	mids        atomic.Pointer[middlewareSet]
+	chains      chains
+	berEncoding atomic.Pointer[berenc.Options]
+	shaping     atomic.Pointer[trafficShaping]
+	limiter     rateLimiter
+
+	decryptCfg        decrypt.Config
+	translate         *decrypt.TranslateConfig
+	upstreamTLS       *tls.Config
+	upstreamClientKey crypto.PrivateKey
+	upstreamExternal  bool
+	keyLog            io.Writer
+
+	onRequest  Hook
+	onResponse Hook
+
+	logger *log.Logger
+	out    io.Writer
+
+	stats       *statsCounter
+	cache       *responseCache
+	connCounter atomic.Uint64
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// New creates a Proxy, validating its options and chains.
+func New(opts Options) (*Proxy, error) {
+	p := &Proxy{
+		decryptCfg:        opts.Decrypt,
+		translate:         opts.Translate,
+		upstreamTLS:       opts.UpstreamTLS,
+		upstreamClientKey: opts.UpstreamClientKey,
+		upstreamExternal:  opts.UpstreamExternal,
+		keyLog:            opts.KeyLogWriter,
+		onRequest:         opts.OnRequest,
+		onResponse:        opts.OnResponse,
+		logger:            opts.Logger,
+		out:               opts.Output,
+		stats:             newStatsCounter(),
+		cache:             newResponseCache(),
+		listeners:         make(map[net.Listener]struct{}),
+		conns:             make(map[net.Conn]struct{}),
+	}
+
+	if p.out == nil {
+		p.out = io.Discard
+	}
+	if p.logger == nil {
+		p.logger = log.New(io.Discard, "", 0)
+	}
+	if p.upstreamTLS == nil {
+		p.upstreamTLS = &tls.Config{InsecureSkipVerify: true, KeyLogWriter: p.keyLog}
+	}
+	if p.upstreamExternal && len(p.upstreamTLS.Certificates) == 0 {
+		return nil, errors.New("UpstreamExternal requires a client certificate in UpstreamTLS")
+	}
+	if p.upstreamExternal && p.translate != nil {
+		return nil, errors.New("UpstreamExternal and Translate are mutually exclusive")
+	}
+
+	for key, value := range opts.MiddlewareOptions {
+		if err := ValidateOptionValue(key, value); err != nil {
+			return nil, err
+		}
+	}
+	p.options.m = make(map[string]string, len(opts.MiddlewareOptions))
+	for key, value := range opts.MiddlewareOptions {
+		p.options.m[key] = value
+	}
+	p.setupMiddlewares()
+
+	if err := p.UpdateSettings(func(s *Settings) { *s = opts.Settings }); err != nil {
+		return nil, err
+	}
+
+	// Every chain is validated, so that all of their errors are reported
+	var errs []error
+	for _, c := range []struct {
+		name    string
+		set     func(string) error
+		spec    string
+		setPool func(string) error
+		pool    string
+	}{
+		{"filter", p.SetFilterChain, opts.FilterChain, p.SetFilterPool, opts.FilterPool},
+		{"basedn", p.SetBaseDNChain, opts.BaseDNChain, p.SetBaseDNPool, opts.BaseDNPool},
+		{"attrlist", p.SetAttrListChain, opts.AttrListChain, p.SetAttrListPool, opts.AttrListPool},
+		{"attrentries", p.SetAttrEntriesChain, opts.AttrEntriesChain, p.SetAttrEntriesPool, opts.AttrEntriesPool},
+		{"controls", p.SetControlsChain, opts.ControlsChain, p.SetControlsPool, opts.ControlsPool},
+		{"bindname", p.SetBindNameChain, opts.BindNameChain, p.SetBindNamePool, opts.BindNamePool},
+	} {
+		var err error
+		switch {
+		case c.pool != "" && c.spec != "":
+			err = errors.New("a chain and a pool cannot both be given")
+		case c.pool != "":
+			err = c.setPool(c.pool)
+		default:
+			err = c.set(c.spec)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(opts.OperationChains)) {
+		if err := p.SetOperationChain(name, opts.OperationChains[name]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return p, nil
+}
+
+// DecryptionConfig returns the decryption settings the proxy was created
+// with.
+func (p *Proxy) DecryptionConfig() decrypt.Config {
+	return p.decryptCfg
+}
+
+// TranslateConfig returns the account the proxy binds upstream as, or nil
+// when authentication translation is off.
+func (p *Proxy) TranslateConfig() *decrypt.TranslateConfig {
+	return p.translate
+}
+
+// Serve accepts connections on l and relays each to the target, until ctx
+// is done or the Proxy is closed. It closes l before returning, along with
+// the connections accepted on it when ctx is done.
+func (p *Proxy) Serve(ctx context.Context, l net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	p.listeners[l] = struct{}{}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.listeners, l)
+		p.mu.Unlock()
+		l.Close()
+	}()
+
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if p.isClosed() {
+				return ErrClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		if !p.trackConn(conn) {
+			conn.Close()
+			return ErrClosed
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.untrackConn(conn)
+
+			stopConn := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stopConn()
+
+			p.handleLDAPConnection(conn)
+		}()
+	}
+}
+
+// Close stops every Serve call and closes the connections being relayed,
+// waiting for them to wind down.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	for l := range p.listeners {
+		l.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Proxy) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *Proxy) trackConn(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrackConn(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+}
+
+// Dial connects to an LDAP server the way a Proxy connects to its target:
+// through the SOCKS proxy socksServer if set, and over TLS with tlsCfg if
+// ldaps is set.
+func Dial(addr, socksServer string, ldaps bool, tlsCfg *tls.Config) (net.Conn, error) {
+	return dial(addr, socksServer, ldaps, tlsCfg, nil)
+}
+
+// connect dials the target with the current settings, applying the
+// NetSegment traffic shaping.
+func (p *Proxy) connect(addr string, tlsCfg *tls.Config) (net.Conn, error) {
+	settings := p.Settings()
+	return dial(addr, settings.SOCKS, settings.LDAPS, tlsCfg, func(conn net.Conn) net.Conn {
+		return segmentingConn{conn, p}
+	})
+}
+
+func dial(addr, socksServer string, useLdaps bool, tlsCfg *tls.Config, wrap func(net.Conn) net.Conn) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	if socksServer != "" {
+		dialSocksProxy := socks.Dial(socksServer)
+
+		// First establish connection through SOCKS proxy
+		conn, err = dialSocksProxy("tcp", addr)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Segmentation (NetSegment) operates on the raw connection, below TLS
+	if wrap != nil {
+		conn = wrap(conn)
+	}
+
+	if useLdaps {
+		if socksServer == "" && tlsCfg.ServerName == "" {
+			// Same SNI tls.Dial would have sent
+			if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) == nil {
+				tlsCfg = tlsCfg.Clone()
+				tlsCfg.ServerName = host
+			}
+		}
+
+		tlsConn := tls.Client(conn, tlsCfg)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return conn, nil
+}
+
+// dirTag returns the "[C->T] "/"[C<-T] " prefix for a message concerning
+// the forward (fromClient=true, client-to-target) or reverse
+// (fromClient=false, target-to-client) leg of the proxy.
+func dirTag(fromClient bool) string {
+	if fromClient {
+		return "[C->T] "
+	}
+	return "[C<-T] "
+}
+
+// dirPrintf logs one line about wrapping/unwrapping or other per-message
+// activity, colored and prefixed by direction (cyan "[C->T]" for the
+// forward leg, magenta "[C<-T]" for the reverse leg) - the same convention
+// used for the [C->T]/[C<-T] summary and [DEBUG] Packet Dump lines. Gated
+// on that direction's own verbosity level being at least 1 (0 stays fully
+// silent), matching how the summary lines are gated - for informational/
+// debug-tier messages only; see dirErrorf for failures.
+func (p *Proxy) dirPrintf(fromClient bool, format string, args ...interface{}) {
+	settings := p.Settings()
+	c, verb := magenta, settings.VerbRev
+	if fromClient {
+		c, verb = cyan, settings.VerbFwd
+	}
+	if verb == 0 {
+		return
+	}
+	msg := c.Sprintf(dirTag(fromClient)+format, args...)
+	p.logger.Print(strings.TrimRight(msg, "\n\r"))
+}
+
+// dirErrorf logs one error line, prefixed by direction like dirPrintf but
+// colored red (this codebase's convention for errors) rather than the
+// direction's cyan/magenta - errors shouldn't be visually softened into an
+// informational color. Always printed regardless of verbosity: a real
+// failure (a dropped connection, an unreadable message) shouldn't be
+// silently hidden by a verbosity setting the way routine info/debug output
+// can be - notably, --vr/-R defaults to 0, so gating reverse-leg errors the
+// same way as dirPrintf would silence them by default.
+func (p *Proxy) dirErrorf(fromClient bool, format string, args ...interface{}) {
+	msg := red.Sprintf(dirTag(fromClient)+format, args...)
+	p.logger.Print(strings.TrimRight(msg, "\n\r"))
+}
+
+// readLDAPMessage reads the next unit of traffic from reader, transparently
+// unwrapping it first if (and only if) it turns out to actually be wrapped -
+// the leading byte is peeked (never consumed blindly) to decide which
+// framing applies, so a stream that turns out to be plain LDAP BER is read
+// with zero risk of misconsuming bytes on a wrong guess. bs may be nil (no
+// decryption ever possible on this connection) or not yet negotiated, in
+// which case only the plaintext path is ever taken.
+//
+// Returns a slice, not a single packet: a SASL-sealed buffer can contain
+// more than one LDAPMessage (Windows AD DCs routinely pack a
+// SearchResultEntry with its terminating SearchResultDone into one sealed
+// buffer), so all messages in the buffer are parsed and returned together.
+func (p *Proxy) readLDAPMessage(reader *bufio.Reader, bs *decrypt.BindSession, fromClient bool) ([]*ber.Packet, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	// A plain top-level LDAPMessage is always a universal, constructed
+	// SEQUENCE - tag byte 0x30. Wrapped traffic (a 4-byte big-endian length
+	// prefix per RFC 4752 §3.5, whether followed by an NTLM signature/seal
+	// blob or a GSS wrap token) essentially never coincidentally starts
+	// with that exact byte
+	if first[0] == 0x30 {
+		packet, err := ber.ReadPacket(reader)
+		if err != nil {
+			return nil, err
+		}
+		p.logFramingOnce(bs, false, fromClient)
+		return []*ber.Packet{packet}, nil
+	}
+
+	if bs == nil {
+		return nil, fmt.Errorf("unexpected non-BER leading byte %#x and no active decryption session to unwrap with", first[0])
+	}
+
+	negotiated, layer, mech := bs.State()
+
+	if !negotiated {
+		if mech != decrypt.MechNone {
+			return nil, fmt.Errorf("received wrapped traffic under %s but no decryption key was ever established (missing or incorrect --decrypt-* flags)", mech)
+		}
+		return nil, fmt.Errorf("unexpected non-BER leading byte %#x on a connection with no negotiated decryption session", first[0])
+	}
+
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, lenBuf); err != nil {
+		return nil, fmt.Errorf("read wrapped message length: %w", err)
+	}
+	wrappedLen := binary.BigEndian.Uint32(lenBuf)
+	if wrappedLen > 64<<20 {
+		// Sanity cap: a garbage length here (corrupt stream, mid-connection
+		// desync) would otherwise make io.ReadFull below block indefinitely
+		// waiting for bytes that will never arrive - bail out fast instead.
+		// 64MB gives generous headroom over real AD traffic (e.g. a full
+		// schema search response, observed well over 1MB in practice) while
+		// AD's own default MaxReceiveBuffer policy tops out around 10MB.
+		return nil, fmt.Errorf("wrapped message length %d looks implausible (>64MB)", wrappedLen)
+	}
+	wrapped := make([]byte, wrappedLen)
+	if _, err := io.ReadFull(reader, wrapped); err != nil {
+		return nil, fmt.Errorf("read wrapped message body: %w", err)
+	}
+
+	var plain []byte
+	if fromClient {
+		plain, err = bs.UnwrapFromClient(wrapped)
+	} else {
+		plain, err = bs.UnwrapFromTarget(wrapped)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unwrap: %w", err)
+	}
+
+	p.logFramingOnce(bs, true, fromClient)
+	if layer == decrypt.LayerNone {
+		p.dirPrintf(fromClient, "[-] Warning: negotiation indicated %s (%s) but a post-bind PDU required unwrapping - decryption logic may have misread the handshake", mech, layer)
+	}
+
+	r := bytes.NewReader(plain)
+	var packets []*ber.Packet
+	for r.Len() > 0 {
+		packet, err := ber.ReadPacket(r)
+		if err != nil {
+			return nil, fmt.Errorf("parse LDAPMessage #%d from unwrapped buffer (%d bytes total, %d unparsed): %w", len(packets)+1, len(plain), r.Len(), err)
+		}
+		packets = append(packets, packet)
+	}
+	if len(packets) == 0 {
+		return nil, fmt.Errorf("unwrapped buffer (%d bytes) contained no LDAP messages", len(plain))
+	}
+	if len(packets) > 1 {
+		p.dirPrintf(fromClient, "[+] Unwrapped buffer contained %d LDAP messages - will be re-sealed and forwarded as one bundle", len(packets))
+	}
+	return packets, nil
+}
+
+// logFramingOnce announces, once per connection, whether post-bind traffic
+// turned out to be wrapped or plaintext - skipped once the layer is already
+// known (NTLM/Sicily reads it straight from the AUTHENTICATE_MESSAGE), since
+// only GSSAPI/SPNEGO's LayerUnknown case makes this line new information. A
+// mismatch between what was negotiated and what's actually observed is
+// reported separately, via the unconditional "[-] Warning: negotiation
+// indicated..." line in readLDAPMessage.
+//
+// bs.ShouldLogFraming's one-shot flag is shared across the forward and
+// reverse goroutines, which both call this concurrently - checking this
+// direction's own verbosity before consuming that flag prevents a
+// zero-verbosity direction from winning the race and silently burning the
+// connection's only shot at the line.
+func (p *Proxy) logFramingOnce(bs *decrypt.BindSession, wasWrapped bool, fromClient bool) {
+	if bs == nil {
+		return
+	}
+	settings := p.Settings()
+	verb := settings.VerbRev
+	if fromClient {
+		verb = settings.VerbFwd
+	}
+	if verb == 0 || !bs.ShouldLogFraming() {
+		return
+	}
+	if _, layer, _ := bs.State(); layer != decrypt.LayerUnknown {
+		return
+	}
+	if wasWrapped {
+		p.dirPrintf(fromClient, "[+] Post-bind traffic: unwrapping active")
+	} else {
+		p.dirPrintf(fromClient, "[+] Post-bind traffic: plaintext (no wrapping detected)")
+	}
+}
+
+// encodeLDAPMessage serializes a message for the wire. Messages headed to the
+// target get the BER encoding variations enabled through the BER* options;
+// messages headed back to the client are always encoded canonically.
+func (p *Proxy) encodeLDAPMessage(packet *ber.Packet, toClient bool) []byte {
+	if toClient {
+		return packet.Bytes()
+	}
+	return berenc.EncodeMessage(packet, p.BEREncoding())
+}
+
+// writeLDAPMessages writes a batch of packets back out as a unit, wrapping
+// them together into a single sealed frame if they arrived wrapped
+// (wasWrapped, threaded through from the matching readLDAPMessage call) -
+// mirroring the original sender's own bundling (one seal/sequence-number
+// advance per bundle) instead of re-sealing each message as its own
+// separate frame. A batch that arrived plaintext is written out as the
+// individual messages it already was - readLDAPMessage's plaintext path
+// never bundles, so this is always a single-element batch in that case.
+//
+// When --split-wrapped is active and a multi-message wrapped buffer was
+// read, each message is sealed and written as its own independent frame
+// rather than being bundled together - useful when a receiving peer
+// expects exactly one LDAPMessage per sealed frame. The policy is:
+// "in" splits client->target (toClient=false), "out" splits target->client
+// (toClient=true), "both" splits both directions.
+func (p *Proxy) writeLDAPMessages(w *bufio.Writer, bs *decrypt.BindSession, packets []*ber.Packet, wasWrapped, toClient bool) ([]byte, error) {
+	if !wasWrapped {
+		var out []byte
+		for _, packet := range packets {
+			b := p.encodeLDAPMessage(packet, toClient)
+			if _, err := w.Write(b); err != nil {
+				return out, err
+			}
+			out = append(out, b...)
+		}
+		return out, nil
+	}
+
+	// Check --split-wrapped policy: should we write each packet as its own
+	// individual sealed frame instead of bundling them together?
+	split := p.Settings().SplitWrapped
+	doSplit := split == "both" || (split == "in" && !toClient) || (split == "out" && toClient)
+
+	if doSplit && len(packets) > 1 {
+		var sentBytes []byte
+		for _, packet := range packets {
+			plain := p.encodeLDAPMessage(packet, toClient)
+			var wrapped []byte
+			var err error
+			if toClient {
+				wrapped, err = bs.WrapToClient(plain)
+			} else {
+				wrapped, err = bs.WrapToTarget(plain)
+			}
+			if err != nil {
+				return sentBytes, fmt.Errorf("split-wrap: %w", err)
+			}
+			lenBuf := make([]byte, 4)
+			binary.BigEndian.PutUint32(lenBuf, uint32(len(wrapped)))
+			frame := append(lenBuf, wrapped...)
+			if _, err := w.Write(frame); err != nil {
+				return sentBytes, err
+			}
+			sentBytes = append(sentBytes, plain...)
+		}
+		p.dirPrintf(!toClient, "[+] Split %d bundled messages into individual seal frames", len(packets))
+		return sentBytes, nil
+	}
+
+	var plain []byte
+	for _, packet := range packets {
+		plain = append(plain, p.encodeLDAPMessage(packet, toClient)...)
+	}
+
+	var wrapped []byte
+	var err error
+	if toClient {
+		wrapped, err = bs.WrapToClient(plain)
+	} else {
+		wrapped, err = bs.WrapToTarget(plain)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("wrap: %w", err)
+	}
+
+	lenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBuf, uint32(len(wrapped)))
+	full := append(lenBuf, wrapped...)
+	_, err = w.Write(full)
+	return plain, err
+}
+
+// handleLDAPConnection relays one client connection to the target until
+// either side hangs up.
+func (p *Proxy) handleLDAPConnection(conn net.Conn) {
+	defer conn.Close()
+
+	targetAddr := p.Settings().Target
+
+	// Build upstream TLS config:
+	// - If the client connected over TLS and presented a certificate AND
+	//   --key was provided, pair the peer cert with the loaded private key
+	//   to authenticate as a TLS client to the upstream server.
+	// - Otherwise fall back to the proxy's UpstreamTLS (insecure, with the
+	//   --upstream-cert certificate if one was given).
+	upstreamCfg := p.upstreamTLS
+	if tlsConn, ok := conn.(*tls.Conn); ok && p.upstreamClientKey != nil {
+		// The TLS handshake is *lazy* in Go's tls.Listener - Accept()
+		// returns the *tls.Conn before the handshake completes, and
+		// ConnectionState() only has PeerCertificates after the handshake.
+		if err := tlsConn.Handshake(); err != nil {
+			p.logger.Printf("[-] TLS handshake with client failed: %v", err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			clientCert := tls.Certificate{
+				Certificate: [][]byte{state.PeerCertificates[0].Raw},
+				PrivateKey:  p.upstreamClientKey,
+				Leaf:        state.PeerCertificates[0],
+			}
+			upstreamCfg = &tls.Config{
+				Certificates:       []tls.Certificate{clientCert},
+				InsecureSkipVerify: true,
+				KeyLogWriter:       p.keyLog,
+			}
+		} else {
+			fmt.Fprintln(p.out)
+			p.logger.Print(yellow.Sprintf("[!] Certificate key was provided but the client did not present a certificate: upstream client cert auth will not work"))
+		}
+	}
+
+	p.waitBeforeConnect()
+
+	// Connect to target conn - local variable for this connection only
+	localTargetConn, err := p.connect(targetAddr, upstreamCfg)
+	if err != nil {
+		p.logger.Printf("Failed to connect to target LDAP server: %v", err)
+		return
+	}
+	defer localTargetConn.Close()
+
+	// The certificate the target presented over TLS (--ldaps). Channel
+	// bindings sent upstream cover this, not ldapx's listener.
+	var targetCert *x509.Certificate
+	if tlsConn, ok := localTargetConn.(*tls.Conn); ok {
+		if state := tlsConn.ConnectionState(); len(state.PeerCertificates) > 0 {
+			targetCert = state.PeerCertificates[0]
+		}
+	}
+
+	targetConnReader := bufio.NewReader(localTargetConn)
+	targetConnWriter := bufio.NewWriter(localTargetConn)
+
+	bs := decrypt.NewBindSession()
+	connID := p.connCounter.Add(1)
+	bs.SetConnID(fmt.Sprintf("%d (%s)", connID, conn.RemoteAddr()))
+	if _, ok := localTargetConn.(*tls.Conn); ok && len(upstreamCfg.Certificates) > 0 {
+		bs.SetClientCertificate(upstreamCfg.Certificates[0].Leaf)
+	}
+	decryptCfg := p.decryptCfg
+
+	// With --translate-auth or --upstream-external the target connection
+	// is bound by ldapx itself before anything is relayed, and boundAs names
+	// the principal it's bound as. A translated bind's security layer then
+	// only applies upstream: requests are wrapped on their way to the
+	// target and responses are always returned to the client in plaintext.
+	translate := p.translate
+	boundAs := ""
+	upstreamWrapped := false
+	if translate != nil {
+		if err := p.translateBind(bs, translate, targetAddr, targetCert, targetConnReader, targetConnWriter); err != nil {
+			p.logger.Print(red.Sprintf("[-] Translated bind as '%s' failed: %v", translate.Account(), err))
+			return
+		}
+		_, layer, mech := bs.State()
+		upstreamWrapped = layer != decrypt.LayerNone
+		boundAs = translate.Account()
+		p.logger.Print(green.Sprintf("[+] Bound upstream as '%s' (%s, %s)", boundAs, mech, layer))
+	} else if p.upstreamExternal {
+		subject := upstreamCfg.Certificates[0].Leaf.Subject.String()
+		if err := p.externalBind(targetConnReader, targetConnWriter); err != nil {
+			p.logger.Print(red.Sprintf("[-] SASL EXTERNAL bind as '%s' failed: %v", subject, err))
+			return
+		}
+		boundAs = subject
+		p.logger.Print(green.Sprintf("[+] Bound upstream as '%s' (EXTERNAL)", boundAs))
+	}
+
+	// clientBs follows the binds the client sends when ldapx answers them
+	// itself
+	clientBs := decrypt.NewBindSession()
+	clientBs.SetConnID(fmt.Sprintf("%d (%s)", connID, conn.RemoteAddr()))
+
+	done := make(chan struct{}) // Channel to signal when either goroutine is done
+	// closeDone lets either direction's goroutine signal shutdown - both can
+	// hit a fatal error independently (client vs target read/unwrap
+	// failures), and closing an already-closed channel panics, so the
+	// actual close is guarded by closeDoneOnce rather than only ever
+	// happening via one hardcoded goroutine's defer.
+	var closeDoneOnce sync.Once
+	closeDone := func() { closeDoneOnce.Do(func() { close(done) }) }
+
+	connReader := bufio.NewReader(conn)
+	connWriter := bufio.NewWriter(conn)
+
+	// spoofApplied is set by the reverse goroutine, read by the forward
+	// goroutine on the client's first BindRequest - hence the atomic.
+	// bindMechCheckDone is only ever touched by the forward goroutine.
+	var spoofApplied atomic.Bool
+	bindMechCheckDone := false
+
+	// Shared by both goroutines: the forward one registers split searches
+	// and cacheable searches, the reverse one merges and records their
+	// results.
+	splitter := newSearchSplitter(p.logger)
+	recorder := newCacheRecorder(p)
+
+	// Hooks see the identity the connection is bound as at call time
+	connInfo := func() ConnInfo {
+		return ConnInfo{ID: connID, ClientAddr: conn.RemoteAddr(), Identity: bs.Identity()}
+	}
+
+	// Both return ok=false on any write/flush failure so their caller's loop
+	// can terminate the connection (via its own defer closeDone()) instead
+	// of silently swallowing the error and looping back around to read the
+	// next message as if nothing happened - a broken write means the peer
+	// on that leg is no longer receiving anything, so continuing to forward
+	// more traffic into it can only produce more of the same silent drops.
+	// The reverse goroutine writes to the target too, for the WhoAmI that
+	// follows a SASL EXTERNAL bind.
+	var targetWriteMu sync.Mutex
+
+	sendPacketsForward := func(packets []*ber.Packet, wasWrapped bool) bool {
+		p.waitBeforeRequests(len(packets))
+
+		targetWriteMu.Lock()
+		defer targetWriteMu.Unlock()
+
+		b, err := p.writeLDAPMessages(targetConnWriter, bs, packets, wasWrapped, false)
+		if err != nil {
+			p.dirErrorf(true, "[-] Error forwarding LDAP request: %v", err)
+			return false
+		}
+		p.stats.sent(true, len(packets), len(b))
+
+		if err := targetConnWriter.Flush(); err != nil {
+			p.dirErrorf(true, "[-] Error flushing LDAP request: %v", err)
+			return false
+		}
+		return true
+	}
+
+	// Cached results are written to the client by the forward goroutine
+	var clientWriteMu sync.Mutex
+
+	sendPacketsReverse := func(packets []*ber.Packet, wasWrapped bool) bool {
+		clientWriteMu.Lock()
+		defer clientWriteMu.Unlock()
+
+		b, err := p.writeLDAPMessages(connWriter, bs, packets, wasWrapped, true)
+		if err != nil {
+			p.dirErrorf(false, "[-] Error sending response back to client: %v", err)
+			return false
+		}
+		p.stats.sent(false, len(packets), len(b))
+
+		if err := connWriter.Flush(); err != nil {
+			p.dirErrorf(false, "[-] Error flushing response back to client: %v", err)
+			return false
+		}
+		return true
+	}
+
+	go func() {
+		// Signals the response goroutine (and handleLDAPConnection's own
+		// final <-done wait) to exit whenever this goroutine does, on any
+		// path - including a read/unwrap error, not just a clean loop exit.
+		defer closeDone()
+
+		var searchRequestMap = make(map[string]*ber.Packet)
+
+		for {
+			result, wrapErr := p.readLDAPMessageSafe(connReader, bs, true)
+			if wrapErr != nil {
+				p.dirErrorf(true, "[-] Error reading LDAP request: %v", wrapErr)
+				return
+			}
+			wasWrapped := result.wrapped
+			var processedPackets []*ber.Packet
+
+			for _, packet2 := range result.pkts {
+				if len(packet2.Children) < 2 {
+					p.dirErrorf(true, "[-] Malformed LDAP request (missing protocolOp) - dropping connection")
+					return
+				}
+
+				fmt.Fprintln(p.out, "\n"+strings.Repeat("─", 55))
+
+				settings := p.Settings()
+				verbFwd := settings.VerbFwd
+
+				if verbFwd > 1 {
+					p.logger.Print(cyan.Sprintf("[C->T] [DEBUG] Packet Dump"))
+					ber.WritePacket(p.out, packet2)
+				}
+
+				application := uint8(packet2.Children[1].Tag)
+				p.stats.received(true, application, len(packet2.Bytes()))
+
+				reqMessageID, _ := packet2.Children[0].Value.(int64)
+				applicationText, ok := parser.ApplicationMap[application]
+				if !ok {
+					applicationText = fmt.Sprintf("Unknown Application '%d'", application)
+				}
+
+				if verbFwd > 0 {
+					p.logger.Print(cyan.Sprintf("[C->T] [%d - %s]", reqMessageID, applicationText))
+				}
+
+				intercepts := settings.Intercept
+
+				switch application {
+				case parser.ApplicationBindRequest:
+					if boundAs != "" {
+						// The client's bind is still inspected, so that its
+						// credentials are captured, but on a session of its
+						// own: bs holds ldapx's upstream bind
+						response := translatedBindResponse(reqMessageID)
+						decrypt.InspectBindRequest(clientBs, packet2, decryptCfg)
+						decrypt.InspectBindResponse(clientBs, response, decryptCfg)
+
+						p.logger.Print(green.Sprintf("[+] Bind (%d) answered by ldapx - the upstream connection is bound as '%s'", reqMessageID, boundAs))
+						if !sendPacketsReverse([]*ber.Packet{response}, false) {
+							return
+						}
+						continue
+					}
+
+					packet2 = decrypt.RewriteBindSName(packet2, decryptCfg)
+					packet2 = decrypt.RewriteBindChannelBindings(bs, packet2, decryptCfg, targetCert)
+					packet2 = decrypt.DowngradeBindRequest(bs, packet2, decryptCfg)
+					decrypt.InspectBindRequest(bs, packet2, decryptCfg)
+
+					// After inspection, which matches the mechanism by its
+					// exact name
+					if p.hasBindNameChain() {
+						p.logger.Print(cyan.Sprintf("[+] Bind Request Intercepted (%d)", reqMessageID))
+						packet2 = p.ProcessBindRequest(packet2)
+					}
+					if !bindMechCheckDone {
+						bindMechCheckDone = true
+						if settings.SpoofMechsSet && !spoofApplied.Load() {
+							p.logger.Print(yellow.Sprintf("[-] Warning: client sent a bind without checking rootDSE for supportedSASLMechanisms (--spoof-mechs had no effect)"))
+						}
+					}
+				case parser.ApplicationSearchRequest:
+					if settings.Cache {
+						identity := bs.Identity()
+						if key, description, ok := searchCacheKey(packet2, identity); ok {
+							if cached := p.cache.Get(key, reqMessageID); cached != nil {
+								p.logger.Print(green.Sprintf("[+] Search (%d) served from cache (%d messages)", reqMessageID, len(cached)))
+								var replies []*ber.Packet
+								for _, reply := range cached {
+									if reply = p.runHook(p.onResponse, connInfo, reply); reply != nil {
+										replies = append(replies, reply)
+									}
+								}
+								if len(replies) > 0 && !sendPacketsReverse(replies, wasWrapped) {
+									return
+								}
+								continue
+							}
+							recorder.Track(reqMessageID, key, description, identity)
+						}
+					}
+
+					if intercepts.Search {
+						p.logger.Print(cyan.Sprintf("[+] Search Request Intercepted (%d)", reqMessageID))
+
+						// Each sub-search goes through the middlewares on its own
+						if subPackets := splitter.Split(packet2, settings.SplitSearch, p.optInt("SplitSearchAttrsPerSearch")); subPackets != nil {
+							for _, subPacket := range subPackets {
+								subPacket = p.ProcessSearchRequest(subPacket, searchRequestMap)
+								subPacket = p.ProcessRequestControls(subPacket)
+
+								if verbFwd > 1 {
+									p.logger.Print(cyan.Sprintf("[C->T] [DEBUG] Packet Dump"))
+									ber.WritePacket(p.out, subPacket)
+								}
+
+								if subPacket = p.runHook(p.onRequest, connInfo, subPacket); subPacket != nil {
+									processedPackets = append(processedPackets, subPacket)
+								}
+							}
+							continue
+						}
+
+						packet2 = p.ProcessSearchRequest(packet2, searchRequestMap)
+					}
+				case parser.ApplicationModifyRequest:
+					if intercepts.Modify {
+						p.logger.Print(cyan.Sprintf("[+] Modify Request Intercepted (%d)", reqMessageID))
+						packet2 = p.ProcessModifyRequest(packet2)
+					}
+				case parser.ApplicationAddRequest:
+					if intercepts.Add {
+						p.logger.Print(cyan.Sprintf("[+] Add Request Intercepted (%d)", reqMessageID))
+						packet2 = p.ProcessAddRequest(packet2)
+					}
+				case parser.ApplicationDelRequest:
+					if intercepts.Delete {
+						p.logger.Print(cyan.Sprintf("[+] Delete Request Intercepted (%d)", reqMessageID))
+						packet2 = p.ProcessDeleteRequest(packet2)
+					}
+				case parser.ApplicationModifyDNRequest:
+					if intercepts.ModifyDN {
+						p.logger.Print(cyan.Sprintf("[+] ModifyDN Request Intercepted (%d)", reqMessageID))
+						packet2 = p.ProcessModifyDNRequest(packet2)
+					}
+				case parser.ApplicationAbandonRequest:
+					// Abandoning a split search abandons its sub-searches,
+					// which the server knows under their own messageIDs
+					abandonID, err := ber.ParseInt64(packet2.Children[1].Data.Bytes())
+					if err != nil {
+						break
+					}
+					if abandons := splitter.Abandon(abandonID); abandons != nil {
+						for _, abandon := range abandons {
+							if abandon = p.runHook(p.onRequest, connInfo, abandon); abandon != nil {
+								processedPackets = append(processedPackets, abandon)
+							}
+						}
+						continue
+					}
+				}
+
+				if controlsApplications[application] {
+					packet2 = p.ProcessRequestControls(packet2)
+				}
+
+				if verbFwd > 1 {
+					p.logger.Print(cyan.Sprintf("[C->T] [DEBUG] Packet Dump"))
+					ber.WritePacket(p.out, packet2)
+				}
+
+				if packet2 = p.runHook(p.onRequest, connInfo, packet2); packet2 != nil {
+					processedPackets = append(processedPackets, packet2)
+				}
+			}
+
+			// Searches served from the cache can leave nothing to send
+			if len(processedPackets) > 0 && !sendPacketsForward(processedPackets, wasWrapped || upstreamWrapped) {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		// Mirrors the request goroutine's own defer: a read/unwrap error on
+		// this side must unblock handleLDAPConnection's final <-done wait
+		// too, not just this loop - otherwise the request goroutine stays
+		// blocked forever on its own read (the client has nothing more to
+		// send once its request went unanswered), and neither connection
+		// ever gets closed.
+		defer closeDone()
+
+		// messageIDs of the WhoAmI requests ldapx sent itself, whose
+		// responses are consumed here
+		pendingWhoAmI := make(map[int64]bool)
+
+		for {
+			select {
+			case <-done:
+				return // Exit if the request goroutine is done
+			default:
+				result, wrapErr := p.readLDAPMessageSafe(targetConnReader, bs, false)
+				if wrapErr != nil {
+					p.dirErrorf(false, "[-] Error reading LDAP response: %v", wrapErr)
+					return
+				}
+				wasWrapped := result.wrapped
+				var processedPackets []*ber.Packet
+
+				for _, responsePacket := range result.pkts {
+					if len(responsePacket.Children) < 2 {
+						p.dirErrorf(false, "[-] Malformed LDAP response (missing protocolOp) - dropping connection")
+						return
+					}
+
+					application := uint8(responsePacket.Children[1].Tag)
+					p.stats.received(false, application, len(responsePacket.Bytes()))
+
+					respMessageID, _ := responsePacket.Children[0].Value.(int64)
+					applicationText, ok := parser.ApplicationMap[application]
+					if !ok {
+						applicationText = fmt.Sprintf("Unknown Application '%d'", application)
+					}
+
+					if application == parser.ApplicationExtendedResponse && pendingWhoAmI[respMessageID] {
+						delete(pendingWhoAmI, respMessageID)
+						p.observeWhoAmI(bs, responsePacket)
+						continue
+					}
+
+					switch application {
+					case parser.ApplicationBindResponse:
+						responsePacket = decrypt.DowngradeBindResponse(bs, responsePacket, decryptCfg)
+						decrypt.InspectBindResponse(bs, responsePacket, decryptCfg)
+					case parser.ApplicationSearchResultEntry:
+						settings := p.Settings()
+						var applied bool
+						responsePacket, applied = rootdse.ProcessSearchResultEntry(responsePacket, settings.SpoofMechsSet, settings.SpoofMechs)
+						if applied {
+							spoofApplied.Store(true)
+						}
+						if p.attrListChainHasRange() {
+							responsePacket, _ = StripAddedRangeOptions(responsePacket)
+						}
+					}
+
+					if p.Settings().Cache && p.cache.Invalidate(responsePacket) {
+						p.logger.Print(green.Sprintf("[+] Cache cleared by a successful write [%d - %s]", respMessageID, applicationText))
+					}
+
+					if merged, handled := splitter.Collect(responsePacket); handled {
+						for _, mergedPacket := range merged {
+							recorder.Record(mergedPacket)
+							if mergedPacket = p.runHook(p.onResponse, connInfo, mergedPacket); mergedPacket != nil {
+								processedPackets = append(processedPackets, mergedPacket)
+							}
+						}
+						continue
+					}
+
+					verbRev := p.Settings().VerbRev
+
+					if verbRev > 0 {
+						p.logger.Print(magenta.Sprintf("[C<-T] [%d - %s] (%d bytes)", respMessageID, applicationText, len(responsePacket.Bytes())))
+
+						if verbRev > 1 {
+							p.logger.Print(magenta.Sprintf("[C<-T] [DEBUG] Packet Dump"))
+							ber.WritePacket(p.out, responsePacket)
+						}
+					}
+
+					// Cached as received, since replies from the cache go
+					// through the hook too
+					recorder.Record(responsePacket)
+					if responsePacket = p.runHook(p.onResponse, connInfo, responsePacket); responsePacket != nil {
+						processedPackets = append(processedPackets, responsePacket)
+					}
+				}
+
+				// Held back responses to sub-searches can leave nothing to send
+				if len(processedPackets) > 0 && !sendPacketsReverse(processedPackets, wasWrapped && boundAs == "") {
+					return
+				}
+
+				// Install derived keys now that the concluding BindResponse
+				// has been forwarded.
+				bs.FinishPendingHandshake()
+
+				if bs.TakeExternalWhoAmI() {
+					id := splitter.ownID()
+					pendingWhoAmI[id] = true
+					if !sendPacketsForward([]*ber.Packet{whoAmIRequest(id)}, false) {
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	<-done
+}
+
+// runHook passes packet through hook, if set.
+func (p *Proxy) runHook(hook Hook, info func() ConnInfo, packet *ber.Packet) *ber.Packet {
+	if hook == nil {
+		return packet
+	}
+	return hook(info(), packet)
+}
+
+// readResult bundles the parsed packet(s) from one read with whether they
+// arrived wrapped, so the caller can write each back out the same way.
+// Usually one packet; a wrapped read can yield several if the sealed buffer
+// contained more than one concatenated LDAPMessage.
+type readResult struct {
+	pkts    []*ber.Packet
+	wrapped bool
+}
+
+// readLDAPMessageSafe wraps readLDAPMessage with the same
+// recover()-protected pattern parser/packet.go's pretty-printer already
+// uses - a SicilyBindResponse's different shape (no matchedDN) can make
+// generic packet-shape assumptions elsewhere panic, so this converts a
+// panic from unexpectedly-shaped input into a plain error instead of
+// taking down the connection's goroutine uncontrolled.
+func (p *Proxy) readLDAPMessageSafe(reader *bufio.Reader, bs *decrypt.BindSession, fromClient bool) (result readResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while reading/parsing message: %v", r)
+		}
+	}()
+
+	first, peekErr := reader.Peek(1)
+	wasWrapped := peekErr == nil && first[0] != 0x30
+
+	pkts, readErr := p.readLDAPMessage(reader, bs, fromClient)
+	if readErr != nil {
+		return readResult{}, readErr
+	}
+	return readResult{pkts: pkts, wrapped: wasWrapped}, nil
+}
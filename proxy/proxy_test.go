@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ldapxlog "github.com/Macmod/ldapx/log"
+	filtermid "github.com/Macmod/ldapx/middlewares/filter"
+	"github.com/Macmod/ldapx/parser"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTarget is an LDAP server that answers every search with an empty
+// successful result, keeping the filters it was sent.
+type fakeTarget struct {
+	net.Listener
+
+	mu      sync.Mutex
+	filters []string
+}
+
+func newFakeTarget(t *testing.T) *fakeTarget {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	target := &fakeTarget{Listener: l}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go target.serve(conn)
+		}
+	}()
+	return target
+}
+
+func (target *fakeTarget) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 || packet.Children[1].Tag != parser.ApplicationSearchRequest {
+			continue
+		}
+
+		query := "?"
+		if filter, err := parser.PacketToFilter(packet.Children[1].Children[6]); err == nil {
+			query, _ = parser.FilterToQuery(filter)
+		}
+		target.mu.Lock()
+		target.filters = append(target.filters, query)
+		target.mu.Unlock()
+
+		messageID, _ := packet.Children[0].Value.(int64)
+		if _, err := conn.Write(envelope(messageID, searchResultDone(0)).Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (target *fakeTarget) Filters() []string {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	return append([]string(nil), target.filters...)
+}
+
+// startProxy serves p on a local listener, returning its address and the
+// channel Serve's result arrives on.
+func startProxy(t *testing.T, ctx context.Context, p *Proxy) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(ctx, l) }()
+	return l.Addr().String(), served
+}
+
+// search sends a search through the proxy at addr, returning the response,
+// or nil if none arrives.
+func search(t *testing.T, addr string, messageID int64, query string) *ber.Packet {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(testSearchRequest(t, messageID, query, []string{"cn"}, 0).Bytes())
+	assert.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	response, err := ber.ReadPacket(conn)
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func obfuscated(t *testing.T, query string, middleware filtermid.FilterMiddleware) string {
+	t.Helper()
+	filter, err := parser.QueryToFilter(query)
+	assert.NoError(t, err)
+	result, err := parser.FilterToQuery(middleware(filter))
+	assert.NoError(t, err)
+	return result
+}
+
+func TestProxyInstances(t *testing.T) {
+	ldapxlog.InitLog("")
+	target := newFakeTarget(t)
+	const query = "(&(objectClass=user)(cn=alice))"
+
+	type calls struct {
+		sync.Mutex
+		requests, responses int
+	}
+	newProxy := func(chain string, seen *calls) *Proxy {
+		p, err := New(Options{
+			Settings: Settings{
+				Target:    target.Addr().String(),
+				Intercept: InterceptFlags{Search: true},
+			},
+			FilterChain: chain,
+			OnRequest: func(conn ConnInfo, packet *ber.Packet) *ber.Packet {
+				seen.Lock()
+				defer seen.Unlock()
+				seen.requests++
+				return packet
+			},
+			OnResponse: func(conn ConnInfo, packet *ber.Packet) *ber.Packet {
+				seen.Lock()
+				defer seen.Unlock()
+				seen.responses++
+				return packet
+			},
+		})
+		assert.NoError(t, err)
+		t.Cleanup(func() { p.Close() })
+		return p
+	}
+
+	var seenA, seenB calls
+	pA, pB := newProxy("M", &seenA), newProxy("E", &seenB)
+	addrA, _ := startProxy(t, context.Background(), pA)
+	addrB, _ := startProxy(t, context.Background(), pB)
+
+	response := search(t, addrA, 1, query)
+	if assert.NotNil(t, response) {
+		assert.Equal(t, int64(1), response.Children[0].Value)
+		assert.Equal(t, int64(0), resultCode(response))
+	}
+	assert.NotNil(t, search(t, addrB, 2, query))
+	assert.NotNil(t, search(t, addrB, 3, query))
+
+	// Each proxy applies its own chain
+	assert.Equal(t, []string{
+		obfuscated(t, query, filtermid.DeMorganBoolFilterObf()),
+		obfuscated(t, query, filtermid.EqualityByExclusionFilterObf()),
+		obfuscated(t, query, filtermid.EqualityByExclusionFilterObf()),
+	}, target.Filters())
+
+	// and calls its own hooks
+	assert.Equal(t, 1, seenA.requests)
+	assert.Equal(t, 1, seenA.responses)
+	assert.Equal(t, 2, seenB.requests)
+	assert.Equal(t, 2, seenB.responses)
+
+	// and counts its own traffic
+	statsA, statsB := pA.Stats(), pB.Stats()
+	assert.Equal(t, uint64(1), statsA.Forward.PacketsReceived)
+	assert.Equal(t, uint64(1), statsA.Reverse.PacketsReceived)
+	assert.Equal(t, uint64(2), statsB.Forward.PacketsReceived)
+	assert.Equal(t, uint64(2), statsB.Reverse.PacketsReceived)
+	assert.Equal(t, uint64(2), statsB.Forward.CountsByType[parser.ApplicationSearchRequest])
+}
+
+func TestProxyHooksDrop(t *testing.T) {
+	ldapxlog.InitLog("")
+	target := newFakeTarget(t)
+
+	testCases := []struct {
+		name               string
+		dropRequest        bool
+		dropResponse       bool
+		expectedAtTarget   int
+		expectedToResponse bool
+	}{
+		{name: "Request dropped", dropRequest: true, expectedAtTarget: 0},
+		{name: "Response dropped", dropResponse: true, expectedAtTarget: 1},
+		{name: "Nothing dropped", expectedAtTarget: 1, expectedToResponse: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := len(target.Filters())
+			drop := func(dropped bool) Hook {
+				return func(conn ConnInfo, packet *ber.Packet) *ber.Packet {
+					if dropped {
+						return nil
+					}
+					return packet
+				}
+			}
+			p, err := New(Options{
+				Settings:   Settings{Target: target.Addr().String()},
+				OnRequest:  drop(tc.dropRequest),
+				OnResponse: drop(tc.dropResponse),
+			})
+			assert.NoError(t, err)
+			defer p.Close()
+			addr, _ := startProxy(t, context.Background(), p)
+
+			response := search(t, addr, 1, "(cn=alice)")
+			assert.Equal(t, tc.expectedToResponse, response != nil)
+			assert.Len(t, target.Filters(), before+tc.expectedAtTarget)
+		})
+	}
+}
+
+func TestProxyServeStops(t *testing.T) {
+	target := newFakeTarget(t)
+	newProxy := func() *Proxy {
+		p, err := New(Options{Settings: Settings{Target: target.Addr().String()}})
+		assert.NoError(t, err)
+		return p
+	}
+	waitServe := func(served <-chan error) error {
+		select {
+		case err := <-served:
+			return err
+		case <-time.After(2 * time.Second):
+			return errors.New("Serve didn't return")
+		}
+	}
+
+	t.Run("Close", func(t *testing.T) {
+		p := newProxy()
+		_, served := startProxy(t, context.Background(), p)
+		// Let Serve register its listener
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, p.Close())
+		assert.ErrorIs(t, waitServe(served), ErrClosed)
+
+		// A closed Proxy doesn't serve again
+		_, served = startProxy(t, context.Background(), p)
+		assert.ErrorIs(t, waitServe(served), ErrClosed)
+	})
+
+	t.Run("Context canceled", func(t *testing.T) {
+		p := newProxy()
+		defer p.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		_, served := startProxy(t, ctx, p)
+		cancel()
+		assert.ErrorIs(t, waitServe(served), context.Canceled)
+	})
+}
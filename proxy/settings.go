@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Macmod/ldapx/middlewares"
+)
+
+// InterceptFlags bundles all interception settings
+type InterceptFlags struct {
+	Search   bool
+	Modify   bool
+	Add      bool
+	Delete   bool
+	ModifyDN bool
+}
+
+// Settings are the proxy settings that can be changed while it runs, each
+// taking effect from the next connection or message on.
+type Settings struct {
+	// Target is the address of the target LDAP server (host:port)
+	Target string
+	// LDAPS connects to the target over TLS
+	LDAPS bool
+	// SOCKS is the address of a SOCKS proxy to reach the target through
+	SOCKS string
+
+	// VerbFwd and VerbRev are the verbosity levels of forward (requests)
+	// and reverse (responses) traffic - 0 (silent), 1 (summary), or 2
+	// (summary + packet dumps)
+	VerbFwd uint
+	VerbRev uint
+
+	// Intercept selects the operations the middlewares are applied to
+	Intercept InterceptFlags
+
+	// SpoofMechs replaces the rootDSE's supportedSASLMechanisms when
+	// SpoofMechsSet is true - an empty list removes the attribute.
+	SpoofMechs    []string
+	SpoofMechsSet bool
+
+	// SplitWrapped is "in", "out", "both", or "" (default = bundled)
+	SplitWrapped string
+	// SplitSearch is "or", "attrs", "both", or "" (default = no splitting)
+	SplitSearch string
+
+	// Tracking applies the tracking algorithm for paged search cookie
+	// management
+	Tracking bool
+
+	// Cache serves repeated identical searches from the response cache
+	Cache bool
+}
+
+// settingsStore holds the live Settings of a Proxy.
+type settingsStore struct {
+	sync.RWMutex
+	s Settings
+}
+
+func (st *settingsStore) get() Settings {
+	st.RLock()
+	defer st.RUnlock()
+	s := st.s
+	s.SpoofMechs = append([]string(nil), st.s.SpoofMechs...)
+	return s
+}
+
+// Settings returns a copy of the current settings.
+func (p *Proxy) Settings() Settings {
+	return p.settings.get()
+}
+
+// UpdateSettings changes the settings through fn, which is called with the
+// settings lock held. It fails, leaving the settings untouched, if the
+// result is invalid.
+func (p *Proxy) UpdateSettings(fn func(s *Settings)) error {
+	p.settings.Lock()
+	defer p.settings.Unlock()
+
+	s := p.settings.s
+	s.SpoofMechs = append([]string(nil), p.settings.s.SpoofMechs...)
+	fn(&s)
+
+	s.SplitWrapped = strings.ToLower(s.SplitWrapped)
+	s.SplitSearch = strings.ToLower(s.SplitSearch)
+	if err := validateSettings(s); err != nil {
+		return err
+	}
+	p.settings.s = s
+	return nil
+}
+
+func validateSettings(s Settings) error {
+	switch s.SplitWrapped {
+	case "in", "out", "both", "":
+	default:
+		return fmt.Errorf("invalid split-wrapped value: '%s' (use in, out, both, or empty string to disable)", s.SplitWrapped)
+	}
+	if err := validateSplitSearchMode(s.SplitSearch); err != nil {
+		return err
+	}
+	return nil
+}
+
+// optionStore holds the middleware options of a Proxy, falling back to
+// middlewares.DefaultOptions for the ones not set.
+type optionStore struct {
+	sync.RWMutex
+	m map[string]string
+}
+
+func (o *optionStore) get(key string) (string, bool) {
+	o.RLock()
+	defer o.RUnlock()
+	value, ok := o.m[key]
+	return value, ok
+}
+
+// Option returns the value of a middleware option, and whether it was set
+// rather than left at its default.
+func (p *Proxy) Option(key string) (string, bool) {
+	if value, ok := p.options.get(key); ok {
+		return value, true
+	}
+	return middlewares.DefaultOptions[key], false
+}
+
+// SetOption sets a middleware option, rebuilding the middlewares that use
+// it.
+func (p *Proxy) SetOption(key, value string) error {
+	if err := ValidateOptionValue(key, value); err != nil {
+		return err
+	}
+
+	p.options.Lock()
+	if p.options.m == nil {
+		p.options.m = make(map[string]string)
+	}
+	p.options.m[key] = value
+	p.options.Unlock()
+
+	p.setupMiddlewares()
+	return nil
+}
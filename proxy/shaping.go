@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Traffic shaping for the upstream (proxy-to-target) leg. Everything here is
+// driven by the Net* middleware options, re-read on every use so that
+// `set option` in the shell takes effect on live connections.
+
+type trafficShaping struct {
+	Segment         bool
+	SegmentMinBytes int
+	SegmentMaxBytes int
+	SegmentMaxDelay time.Duration
+
+	RequestDelay  time.Duration
+	RequestJitter time.Duration
+
+	ConnDelay  time.Duration
+	ConnJitter time.Duration
+
+	RateLimit float64 // requests per second across all connections, 0 = unlimited
+}
+
+func (p *Proxy) setupTrafficShaping() {
+	p.shaping.Store(&trafficShaping{
+		Segment:         p.optBool("NetSegment"),
+		SegmentMinBytes: p.optInt("NetSegmentMinBytes"),
+		SegmentMaxBytes: p.optInt("NetSegmentMaxBytes"),
+		SegmentMaxDelay: p.optMillis("NetSegmentMaxDelayMs"),
+		RequestDelay:    p.optMillis("NetRequestDelayMs"),
+		RequestJitter:   p.optMillis("NetRequestJitterMs"),
+		ConnDelay:       p.optMillis("NetConnDelayMs"),
+		ConnJitter:      p.optMillis("NetConnJitterMs"),
+		RateLimit:       p.optFloat("NetRateLimit"),
+	})
+}
+
+func (p *Proxy) getTrafficShaping() trafficShaping {
+	if s := p.shaping.Load(); s != nil {
+		return *s
+	}
+	return trafficShaping{}
+}
+
+// TrafficShapingSummary names the enabled traffic shaping settings, or
+// returns "" when shaping is off.
+func (p *Proxy) TrafficShapingSummary() string {
+	return p.getTrafficShaping().Summary()
+}
+
+func (p *Proxy) optMillis(key string) time.Duration {
+	return time.Duration(p.optInt(key)) * time.Millisecond
+}
+
+// Summary describes the enabled shaping settings for the startup banner, or
+// returns "" when shaping is off.
+func (s trafficShaping) Summary() string {
+	var parts []string
+	if s.Segment {
+		parts = append(parts, "Segment")
+	}
+	if s.RequestDelay > 0 || s.RequestJitter > 0 {
+		parts = append(parts, "RequestDelay")
+	}
+	if s.ConnDelay > 0 || s.ConnJitter > 0 {
+		parts = append(parts, "ConnDelay")
+	}
+	if s.RateLimit > 0 {
+		parts = append(parts, "RateLimit")
+	}
+	return strings.Join(parts, ",")
+}
+
+// sleepJitter sleeps for base plus a random extra of up to jitter.
+func sleepJitter(base, jitter time.Duration) {
+	d := base
+	if jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// waitBeforeConnect applies NetConnDelayMs/NetConnJitterMs before dialing
+// the target for a new client connection.
+func (p *Proxy) waitBeforeConnect() {
+	s := p.getTrafficShaping()
+	sleepJitter(s.ConnDelay, s.ConnJitter)
+}
+
+// waitBeforeRequests applies NetRequestDelayMs/NetRequestJitterMs and the
+// NetRateLimit shared by all of the proxy's connections before a batch of n
+// requests is forwarded.
+func (p *Proxy) waitBeforeRequests(n int) {
+	s := p.getTrafficShaping()
+	sleepJitter(s.RequestDelay, s.RequestJitter)
+	p.limiter.wait(n, s.RateLimit)
+}
+
+// rateLimiter spaces requests evenly at a fixed rate. Each caller reserves
+// the next free slots under the lock and then sleeps outside of it, so
+// connections queue up in order without holding each other up while
+// sleeping.
+type rateLimiter struct {
+	sync.Mutex
+	next time.Time
+}
+
+func (r *rateLimiter) wait(n int, rate float64) {
+	if rate <= 0 || n <= 0 {
+		return
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+
+	r.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	slot := r.next.Add(time.Duration(n-1) * interval)
+	r.next = slot.Add(interval)
+	r.Unlock()
+
+	time.Sleep(time.Until(slot))
+}
+
+// segmentingConn splits every write into random-sized chunks of
+// NetSegmentMinBytes-NetSegmentMaxBytes, written separately with up to
+// NetSegmentMaxDelayMs between them. Go enables TCP_NODELAY by default, so
+// each chunk leaves as its own segment. It sits below TLS when --ldaps is
+// used, so the TLS records themselves get split across segments.
+type segmentingConn struct {
+	net.Conn
+	p *Proxy
+}
+
+func (c segmentingConn) Write(b []byte) (int, error) {
+	s := c.p.getTrafficShaping()
+	if !s.Segment || s.SegmentMaxBytes <= 0 {
+		return c.Conn.Write(b)
+	}
+
+	minSize, maxSize := s.SegmentMinBytes, s.SegmentMaxBytes
+	if minSize <= 0 || minSize > maxSize {
+		minSize = maxSize
+	}
+
+	written := 0
+	for written < len(b) {
+		size := minSize + rand.Intn(maxSize-minSize+1)
+		if size > len(b)-written {
+			size = len(b) - written
+		}
+
+		n, err := c.Conn.Write(b[written : written+size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		if written < len(b) && s.SegmentMaxDelay > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(s.SegmentMaxDelay) + 1)))
+		}
+	}
+	return written, nil
+}
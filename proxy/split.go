@@ -0,0 +1,394 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/Macmod/ldapx/parser"
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+/*
+	Search Splitting
+
+	With --split-search, a search request is sent upstream as several
+	independent sub-searches, each with its own messageID:
+
+	- "or" sends one sub-search per element of a top-level OR filter
+	- "attrs" sends the same filter once per chunk of SplitSearchAttrsPerSearch
+	  attributes
+	- "both" does both, sending every combination
+
+	The responses of the sub-searches are held back until all of them are
+	done, then returned to the client as a single result set under the
+	original messageID: entries are deduplicated by DN (keeping the first
+	occurrence of each attribute when the attribute list was split),
+	references are deduplicated, and one SearchResultDone is returned - the
+	first unsuccessful one, if any sub-search failed. The sizeLimit of the
+	request applies to the merged entries, which are cut down to it with a
+	sizeLimitExceeded result, and abandoning the request abandons all of its
+	sub-searches.
+
+	Searches are only split while Search requests are intercepted.
+*/
+
+// resultSetControls are controls tied to the whole result set or to state
+// kept by the server across requests. A search carrying any of them is
+// never split nor cached.
+var resultSetControls = map[string]string{
+	parser.ControlTypePaging:                "Paging",
+	parser.ControlTypeServerSideSorting:     "Server Side Sorting",
+	"2.16.840.1.113730.3.4.9":               "VLV",
+	parser.ControlTypeDirSync:               "DirSync",
+	parser.ControlTypeSyncRequest:           "Sync Request",
+	parser.ControlTypeMicrosoftNotification: "Notification",
+}
+
+// pendingSearch collects the responses to the sub-searches of one split
+// search.
+type pendingSearch struct {
+	messageID int64
+	remaining int
+	sizeLimit int64
+
+	entryOrder []string
+	entries    map[string]*mergedEntry
+	refs       []*ber.Packet
+	refsSeen   map[string]bool
+	done       *ber.Packet
+}
+
+type mergedEntry struct {
+	objectName *ber.Packet
+	attrOrder  []string
+	attrs      map[string]*ber.Packet
+	controls   *ber.Packet
+}
+
+// searchSplitter tracks the split searches of a single client connection.
+// Sub-search messageIDs are allocated downwards from the top of the
+// messageID range, away from the small increasing IDs clients use; other
+// requests ldapx sends on the connection itself draw from the same range
+// (see ownID).
+type searchSplitter struct {
+	sync.Mutex
+	nextID  int64
+	pending map[int64]*pendingSearch
+
+	// abandoned holds the sub-searches abandoned by the client, whose
+	// responses the server may still have sent
+	abandoned map[int64]bool
+
+	logger *log.Logger
+}
+
+func newSearchSplitter(logger *log.Logger) *searchSplitter {
+	return &searchSplitter{
+		logger:    logger,
+		nextID:    math.MaxInt32,
+		pending:   make(map[int64]*pendingSearch),
+		abandoned: make(map[int64]bool),
+	}
+}
+
+// Split returns the sub-search messages for a SearchRequest message, or nil
+// if the request should be forwarded as is. In the "attrs" and "both" modes
+// each sub-search asks for at most attrsPerSearch attributes.
+func (s *searchSplitter) Split(packet *ber.Packet, mode string, attrsPerSearch int) []*ber.Packet {
+	if mode == "" || len(packet.Children) < 2 || len(packet.Children[1].Children) < 8 {
+		return nil
+	}
+
+	if len(packet.Children) > 2 {
+		for _, control := range parser.PacketToControls(packet.Children[2]) {
+			if name, blocking := resultSetControls[control.OID]; blocking {
+				s.logger.Print(yellow.Sprintf("[!] Search carries the %s control - not splitting", name))
+				return nil
+			}
+		}
+	}
+
+	request := packet.Children[1]
+	filters := []*ber.Packet{request.Children[6]}
+	if mode == "or" || mode == "both" {
+		if filter, err := parser.PacketToFilter(request.Children[6]); err == nil {
+			if or, ok := filter.(*parser.FilterOr); ok && len(or.Filters) > 1 {
+				filters = nil
+				for _, f := range or.Filters {
+					filters = append(filters, parser.FilterToPacket(f))
+				}
+			}
+		}
+	}
+
+	attrLists := [][]string{BerChildrenToList(request.Children[7])}
+	if mode == "attrs" || mode == "both" {
+		attrLists = chunkAttributes(attrLists[0], attrsPerSearch)
+	}
+
+	if len(filters)*len(attrLists) < 2 {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	messageID, _ := packet.Children[0].Value.(int64)
+	sizeLimit, _ := request.Children[3].Value.(int64)
+	search := &pendingSearch{
+		messageID: messageID,
+		sizeLimit: sizeLimit,
+		entries:   make(map[string]*mergedEntry),
+		refsSeen:  make(map[string]bool),
+	}
+
+	var subPackets []*ber.Packet
+	for _, filter := range filters {
+		for _, attrs := range attrLists {
+			subRequest := ber.Encode(request.ClassType, request.TagType, request.Tag, nil, request.Description)
+			for i, child := range request.Children {
+				switch i {
+				case 6:
+					subRequest.AppendChild(filter)
+				case 7:
+					subRequest.AppendChild(EncodeAttributeList(attrs))
+				default:
+					subRequest.AppendChild(child)
+				}
+			}
+
+			subID := s.nextOwnID()
+			s.pending[subID] = search
+			search.remaining++
+
+			subPackets = append(subPackets, envelope(subID, subRequest, packet.Children[2:]...))
+		}
+	}
+
+	s.logger.Print(cyan.Sprintf("[+] Split Search (%d) into %d sub-searches", messageID, len(subPackets)))
+
+	return subPackets
+}
+
+// Abandon returns the AbandonRequest messages for the sub-searches of the
+// split search with the given messageID that are still running, or nil if
+// that search wasn't split. Their responses are dropped from then on.
+func (s *searchSplitter) Abandon(messageID int64) []*ber.Packet {
+	s.Lock()
+	defer s.Unlock()
+
+	var requests []*ber.Packet
+	for subID, search := range s.pending {
+		if search.messageID != messageID {
+			continue
+		}
+		delete(s.pending, subID)
+		s.abandoned[subID] = true
+
+		op := ber.NewInteger(ber.ClassApplication, ber.TypePrimitive, parser.ApplicationAbandonRequest, subID, "Abandon Request")
+		requests = append(requests, envelope(s.nextOwnID(), op))
+	}
+
+	if len(requests) > 0 {
+		s.logger.Print(cyan.Sprintf("[+] Abandoned the %d running sub-searches of Search (%d)", len(requests), messageID))
+	}
+	return requests
+}
+
+// ownID allocates a messageID for a request ldapx sends on the connection
+// on its own.
+func (s *searchSplitter) ownID() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.nextOwnID()
+}
+
+// nextOwnID is ownID for callers already holding s.
+func (s *searchSplitter) nextOwnID() int64 {
+	id := s.nextID
+	s.nextID--
+	return id
+}
+
+// chunkAttributes splits attrs into chunks of at most size attributes.
+func chunkAttributes(attrs []string, size int) [][]string {
+	if size <= 0 || len(attrs) <= size {
+		return [][]string{attrs}
+	}
+
+	var chunks [][]string
+	for start := 0; start < len(attrs); start += size {
+		end := start + size
+		if end > len(attrs) {
+			end = len(attrs)
+		}
+		chunks = append(chunks, attrs[start:end])
+	}
+	return chunks
+}
+
+// Collect takes a response message. If it answers a sub-search it is held
+// back and handled is true; once the last sub-search of a split search is
+// done, the merged result set is returned in merged.
+func (s *searchSplitter) Collect(packet *ber.Packet) (merged []*ber.Packet, handled bool) {
+	messageID, _ := packet.Children[0].Value.(int64)
+
+	s.Lock()
+	defer s.Unlock()
+
+	search, ok := s.pending[messageID]
+	if !ok {
+		if !s.abandoned[messageID] {
+			return nil, false
+		}
+		if packet.Children[1].Tag == parser.ApplicationSearchResultDone {
+			delete(s.abandoned, messageID)
+		}
+		return nil, true
+	}
+
+	op := packet.Children[1]
+	switch op.Tag {
+	case parser.ApplicationSearchResultEntry:
+		search.addEntry(packet)
+	case parser.ApplicationSearchResultReference:
+		if key := string(op.Bytes()); !search.refsSeen[key] {
+			search.refsSeen[key] = true
+			search.refs = append(search.refs, envelope(search.messageID, op, packet.Children[2:]...))
+		}
+	case parser.ApplicationSearchResultDone:
+		delete(s.pending, messageID)
+		search.remaining--
+		if search.done == nil || (resultCode(search.done) == 0 && resultCode(packet) != 0) {
+			search.done = packet
+		}
+		if search.remaining == 0 {
+			return search.merge(s.logger), true
+		}
+	default:
+		// Anything else (e.g. an IntermediateResponse) has no place in the
+		// merged result set
+	}
+
+	return nil, true
+}
+
+func (p *pendingSearch) addEntry(packet *ber.Packet) {
+	op := packet.Children[1]
+	if len(op.Children) < 2 {
+		return
+	}
+
+	dn := op.Children[0].Data.String()
+	key := strings.ToLower(dn)
+	entry, ok := p.entries[key]
+	if !ok {
+		entry = &mergedEntry{
+			objectName: op.Children[0],
+			attrs:      make(map[string]*ber.Packet),
+		}
+		if len(packet.Children) > 2 {
+			entry.controls = packet.Children[2]
+		}
+		p.entries[key] = entry
+		p.entryOrder = append(p.entryOrder, key)
+	}
+
+	for _, attr := range op.Children[1].Children {
+		if len(attr.Children) == 0 {
+			continue
+		}
+		name := strings.ToLower(attr.Children[0].Data.String())
+		if _, exists := entry.attrs[name]; !exists {
+			entry.attrs[name] = attr
+			entry.attrOrder = append(entry.attrOrder, name)
+		}
+	}
+}
+
+// merge builds the messages returned to the client for a completed split
+// search, all under the original messageID.
+func (p *pendingSearch) merge(logger *log.Logger) []*ber.Packet {
+	var result []*ber.Packet
+
+	entryOrder := p.entryOrder
+	done := p.done.Children[1]
+	if p.sizeLimit > 0 && int64(len(entryOrder)) > p.sizeLimit {
+		entryOrder = entryOrder[:p.sizeLimit]
+		if resultCode(p.done) == 0 {
+			done = searchResultDone(parser.LDAPResultSizeLimitExceeded)
+		}
+	}
+
+	for _, key := range entryOrder {
+		entry := p.entries[key]
+
+		attributes := ber.NewSequence("Attributes")
+		for _, name := range entry.attrOrder {
+			attributes.AppendChild(entry.attrs[name])
+		}
+
+		op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		op.AppendChild(entry.objectName)
+		op.AppendChild(attributes)
+
+		if entry.controls != nil {
+			result = append(result, envelope(p.messageID, op, entry.controls))
+		} else {
+			result = append(result, envelope(p.messageID, op))
+		}
+	}
+
+	result = append(result, p.refs...)
+	result = append(result, envelope(p.messageID, done, p.done.Children[2:]...))
+
+	logger.Print(cyan.Sprintf("[+] Merged sub-searches of Search (%d): %d entries, %d references", p.messageID, len(entryOrder), len(p.refs)))
+
+	return result
+}
+
+// envelope wraps a protocolOp (and optional controls) into an LDAPMessage.
+func envelope(messageID int64, op *ber.Packet, controls ...*ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(op)
+	for _, control := range controls {
+		packet.AppendChild(control)
+	}
+	return packet
+}
+
+// searchResultDone builds a SearchResultDone with the given resultCode.
+func searchResultDone(code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationSearchResultDone, nil, "Search Result Done")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return op
+}
+
+// resultCode returns the resultCode of an LDAPResult message, or -1 if it
+// can't be read.
+func resultCode(packet *ber.Packet) int64 {
+	op := packet.Children[1]
+	if len(op.Children) == 0 {
+		return -1
+	}
+	code, ok := op.Children[0].Value.(int64)
+	if !ok {
+		return -1
+	}
+	return code
+}
+
+// validateSplitSearchMode validates a --split-search mode.
+func validateSplitSearchMode(mode string) error {
+	switch mode {
+	case "", "or", "attrs", "both":
+		return nil
+	}
+	return fmt.Errorf("invalid split-search mode '%s' (use or, attrs, both, or empty string to disable)", mode)
+}
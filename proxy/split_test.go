@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"testing"
+
+	"github.com/Macmod/ldapx/parser"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/assert"
+)
+
+// discardLogger is the logger of the proxy parts under test.
+var discardLogger = log.New(io.Discard, "", 0)
+
+func testSearchRequest(t *testing.T, messageID int64, query string, attrs []string, sizeLimit int64) *ber.Packet {
+	filter, err := parser.QueryToFilter(query)
+	assert.NoError(t, err)
+
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationSearchRequest, nil, "Search Request")
+	request.AppendChild(EncodeBaseDN("DC=draco,DC=local"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(2), "Scope"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "Deref Aliases"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, sizeLimit, "Size Limit"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "Time Limit"))
+	request.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	request.AppendChild(parser.FilterToPacket(filter))
+	request.AppendChild(EncodeAttributeList(attrs))
+
+	return ber.DecodePacket(envelope(messageID, request).Bytes())
+}
+
+func testSearchEntry(messageID int64, dn string, attrs ...string) *ber.Packet {
+	attributes := ber.NewSequence("Attributes")
+	for _, name := range attrs {
+		attr := ber.NewSequence("Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name+"-value", "Value"))
+		attr.AppendChild(values)
+		attributes.AppendChild(attr)
+	}
+
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "Object Name"))
+	op.AppendChild(attributes)
+	return ber.DecodePacket(envelope(messageID, op).Bytes())
+}
+
+func testSearchDone(messageID int64, code int64) *ber.Packet {
+	return ber.DecodePacket(envelope(messageID, searchResultDone(code)).Bytes())
+}
+
+func subSearchIDs(packets []*ber.Packet) []int64 {
+	ids := make([]int64, len(packets))
+	for i, packet := range packets {
+		ids[i], _ = packet.Children[0].Value.(int64)
+	}
+	return ids
+}
+
+func entrySummary(packet *ber.Packet) (string, []string) {
+	op := packet.Children[1]
+	var attrs []string
+	for _, attr := range op.Children[1].Children {
+		attrs = append(attrs, attr.Children[0].Data.String())
+	}
+	return op.Children[0].Data.String(), attrs
+}
+
+func TestSearchSplitterSplit(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mode     string
+		query    string
+		attrs    []string
+		expected int
+	}{
+		{name: "Disabled", mode: "", query: "(|(cn=a)(sn=b))", attrs: []string{"cn"}, expected: 0},
+		{name: "OR filter", mode: "or", query: "(|(cn=a)(sn=b)(uid=c))", attrs: []string{"cn"}, expected: 3},
+		{name: "Not an OR filter", mode: "or", query: "(&(cn=a)(sn=b))", attrs: []string{"cn"}, expected: 0},
+		{name: "Attributes", mode: "attrs", query: "(cn=a)", attrs: []string{"cn", "sn", "uid"}, expected: 3},
+		{name: "Single attribute", mode: "attrs", query: "(cn=a)", attrs: []string{"cn"}, expected: 0},
+		{name: "Both", mode: "both", query: "(|(cn=a)(sn=b))", attrs: []string{"cn", "sn"}, expected: 4},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			splitter := newSearchSplitter(discardLogger)
+			subPackets := splitter.Split(testSearchRequest(t, 1, tc.query, tc.attrs, 0), tc.mode, 1)
+			assert.Len(t, subPackets, tc.expected)
+			for _, id := range subSearchIDs(subPackets) {
+				assert.NotEqual(t, int64(1), id)
+			}
+		})
+	}
+}
+
+func TestSearchSplitterMerge(t *testing.T) {
+	splitter := newSearchSplitter(discardLogger)
+	ids := subSearchIDs(splitter.Split(testSearchRequest(t, 7, "(cn=a)", []string{"cn", "sn"}, 0), "attrs", 1))
+	assert.Len(t, ids, 2)
+
+	// Responses to other messages are not held back
+	_, handled := splitter.Collect(testSearchEntry(7, "CN=a"))
+	assert.False(t, handled)
+
+	for _, packet := range []*ber.Packet{
+		testSearchEntry(ids[0], "CN=a,DC=draco,DC=local", "cn"),
+		testSearchEntry(ids[1], "cn=A,dc=draco,dc=local", "sn", "cn"),
+		testSearchEntry(ids[1], "CN=b,DC=draco,DC=local", "sn"),
+		testSearchDone(ids[0], parser.LDAPResultSuccess),
+	} {
+		merged, handled := splitter.Collect(packet)
+		assert.True(t, handled)
+		assert.Nil(t, merged)
+	}
+
+	merged, handled := splitter.Collect(testSearchDone(ids[1], parser.LDAPResultSuccess))
+	assert.True(t, handled)
+	assert.Len(t, merged, 3)
+	for _, packet := range merged {
+		assert.Equal(t, int64(7), packet.Children[0].Value)
+	}
+
+	dn, attrs := entrySummary(merged[0])
+	assert.Equal(t, "CN=a,DC=draco,DC=local", dn)
+	assert.Equal(t, []string{"cn", "sn"}, attrs)
+	dn, attrs = entrySummary(merged[1])
+	assert.Equal(t, "CN=b,DC=draco,DC=local", dn)
+	assert.Equal(t, []string{"sn"}, attrs)
+	assert.Equal(t, int64(parser.LDAPResultSuccess), resultCode(merged[2]))
+}
+
+func TestSearchSplitterMergeResult(t *testing.T) {
+	testCases := []struct {
+		name      string
+		sizeLimit int64
+		codes     []int64
+		entries   int
+		expected  int64
+	}{
+		{name: "Success", codes: []int64{0, 0}, entries: 3, expected: parser.LDAPResultSuccess},
+		{name: "First failure wins", codes: []int64{0, 32, 50}, entries: 4, expected: 32},
+		{name: "Size limit on the merged entries", sizeLimit: 2, codes: []int64{0, 0}, entries: 2, expected: parser.LDAPResultSizeLimitExceeded},
+		{name: "Size limit not reached", sizeLimit: 5, codes: []int64{0, 0}, entries: 3, expected: parser.LDAPResultSuccess},
+		{name: "Size limit with a failure", sizeLimit: 1, codes: []int64{0, 32}, entries: 1, expected: 32},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			splitter := newSearchSplitter(discardLogger)
+			query := "(|(cn=a)(cn=b)(cn=c))"
+			if len(tc.codes) == 2 {
+				query = "(|(cn=a)(cn=b))"
+			}
+			ids := subSearchIDs(splitter.Split(testSearchRequest(t, 3, query, []string{"cn"}, tc.sizeLimit), "or", 0))
+			assert.Len(t, ids, len(tc.codes))
+
+			// Each sub-search finds two entries, one of them shared
+			var merged []*ber.Packet
+			for i, id := range ids {
+				splitter.Collect(testSearchEntry(id, "CN=shared", "cn"))
+				splitter.Collect(testSearchEntry(id, "CN="+string(rune('a'+i)), "cn"))
+				merged, _ = splitter.Collect(testSearchDone(id, tc.codes[i]))
+			}
+
+			assert.Len(t, merged, tc.entries+1)
+			assert.Equal(t, tc.expected, resultCode(merged[len(merged)-1]))
+		})
+	}
+}
+
+func TestSearchSplitterAbandon(t *testing.T) {
+	splitter := newSearchSplitter(discardLogger)
+	ids := subSearchIDs(splitter.Split(testSearchRequest(t, 5, "(|(cn=a)(sn=b))", []string{"cn"}, 0), "or", 0))
+	assert.Len(t, ids, 2)
+
+	// The first sub-search is done before the client abandons the search
+	splitter.Collect(testSearchDone(ids[0], parser.LDAPResultSuccess))
+
+	assert.Nil(t, splitter.Abandon(4))
+	abandons := splitter.Abandon(5)
+	assert.Len(t, abandons, 1)
+	op := abandons[0].Children[1]
+	assert.Equal(t, ber.ClassApplication, op.ClassType)
+	assert.Equal(t, ber.Tag(parser.ApplicationAbandonRequest), op.Tag)
+	abandonedID, err := ber.ParseInt64(ber.DecodePacket(abandons[0].Bytes()).Children[1].Data.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, ids[1], abandonedID)
+	assert.NotContains(t, ids, abandons[0].Children[0].Value)
+
+	// Whatever the server still sends for it is dropped
+	merged, handled := splitter.Collect(testSearchEntry(ids[1], "CN=a", "cn"))
+	assert.True(t, handled)
+	assert.Nil(t, merged)
+	merged, handled = splitter.Collect(testSearchDone(ids[1], parser.LDAPResultSuccess))
+	assert.True(t, handled)
+	assert.Nil(t, merged)
+	_, handled = splitter.Collect(testSearchDone(ids[1], parser.LDAPResultSuccess))
+	assert.False(t, handled)
+
+	assert.Nil(t, splitter.Abandon(5))
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import "sync"
+
+// DirectionStats counts the traffic of one leg of the proxy.
+type DirectionStats struct {
+	PacketsReceived uint64
+	PacketsSent     uint64
+	BytesReceived   uint64
+	BytesSent       uint64
+	CountsByType    map[int]uint64
+}
+
+// Stats counts the traffic a Proxy has relayed, Forward for client requests
+// and Reverse for target responses.
+type Stats struct {
+	Forward DirectionStats
+	Reverse DirectionStats
+}
+
+type statsCounter struct {
+	sync.Mutex
+	Stats
+}
+
+func newStatsCounter() *statsCounter {
+	c := &statsCounter{}
+	c.reset()
+	return c
+}
+
+// reset zeroes the counters. Caller holds the lock, or has c to itself.
+func (c *statsCounter) reset() {
+	c.Forward = DirectionStats{CountsByType: make(map[int]uint64)}
+	c.Reverse = DirectionStats{CountsByType: make(map[int]uint64)}
+}
+
+func (c *statsCounter) received(fromClient bool, application uint8, size int) {
+	c.Lock()
+	defer c.Unlock()
+	d := &c.Reverse
+	if fromClient {
+		d = &c.Forward
+	}
+	d.PacketsReceived++
+	d.BytesReceived += uint64(size)
+	d.CountsByType[int(application)]++
+}
+
+func (c *statsCounter) sent(fromClient bool, packets, size int) {
+	c.Lock()
+	defer c.Unlock()
+	d := &c.Reverse
+	if fromClient {
+		d = &c.Forward
+	}
+	d.PacketsSent += uint64(packets)
+	d.BytesSent += uint64(size)
+}
+
+func (d DirectionStats) clone() DirectionStats {
+	counts := make(map[int]uint64, len(d.CountsByType))
+	for k, v := range d.CountsByType {
+		counts[k] = v
+	}
+	d.CountsByType = counts
+	return d
+}
+
+// Stats returns a copy of the traffic counters.
+func (p *Proxy) Stats() Stats {
+	p.stats.Lock()
+	defer p.stats.Unlock()
+	return Stats{Forward: p.stats.Forward.clone(), Reverse: p.stats.Reverse.clone()}
+}
+
+// ResetStats zeroes the traffic counters.
+func (p *Proxy) ResetStats() {
+	p.stats.Lock()
+	defer p.stats.Unlock()
+	p.stats.reset()
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"net"
+
+	"github.com/Macmod/ldapx/decrypt"
+	"github.com/Macmod/ldapx/parser"
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// translateBind performs the --translate-auth bind on a fresh target
+// connection, before anything from the client is relayed over it.
+func (p *Proxy) translateBind(bs *decrypt.BindSession, tc *decrypt.TranslateConfig, targetAddr string, targetCert *x509.Certificate, r *bufio.Reader, w *bufio.Writer) error {
+	host, _, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		host = targetAddr
+	}
+	return bs.BindUpstream(tc, host, targetCert, p.bindExchange(r, w))
+}
+
+// externalBind performs the --upstream-external SASL EXTERNAL bind, which
+// makes the server authenticate the connection as the subject of the TLS
+// client certificate.
+func (p *Proxy) externalBind(r *bufio.Reader, w *bufio.Writer) error {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationBindRequest, nil, "Bind Request")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(3), "Version"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Name"))
+	sasl := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "SASL")
+	sasl.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "EXTERNAL", "Mechanism"))
+	op.AppendChild(sasl)
+
+	response, err := p.bindExchange(r, w)(op)
+	if err != nil {
+		return err
+	}
+	if len(response.Children) < 3 {
+		return fmt.Errorf("malformed BindResponse")
+	}
+	if code, _ := response.Children[0].Value.(int64); code != 0 {
+		diag, _ := response.Children[2].Value.(string)
+		return fmt.Errorf("SASL EXTERNAL bind failed with result code %d: %s", code, diag)
+	}
+	return nil
+}
+
+// whoAmIRequest is the WhoAmI extended operation (RFC 4532) ldapx sends
+// after a client's SASL EXTERNAL bind, to learn the account the target
+// mapped the certificate to.
+func whoAmIRequest(messageID int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationExtendedRequest, nil, "Extended Request")
+	op.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, parser.ControlTypeWhoAmI, "Request Name"))
+	return envelope(messageID, op)
+}
+
+// observeWhoAmI records the target's answer to a whoAmIRequest.
+func (p *Proxy) observeWhoAmI(bs *decrypt.BindSession, packet *ber.Packet) {
+	op := packet.Children[1]
+	if len(op.Children) < 3 {
+		p.logger.Print(red.Sprintf("[-] Malformed WhoAmI response after the SASL/EXTERNAL bind"))
+		return
+	}
+	if code, _ := op.Children[0].Value.(int64); code != 0 {
+		diag, _ := op.Children[2].Value.(string)
+		p.logger.Print(red.Sprintf("[-] WhoAmI after the SASL/EXTERNAL bind failed with result code %d: %s", code, diag))
+		return
+	}
+
+	authzID := ""
+	for _, child := range op.Children[3:] {
+		// responseValue [11]
+		if child.ClassType == ber.ClassContext && child.Tag == 11 {
+			authzID = child.Data.String()
+		}
+	}
+	bs.SetExternalMapped(authzID)
+
+	if authzID == "" {
+		p.logger.Print(yellow.Sprintf("[!] The target maps the SASL/EXTERNAL bind to the anonymous identity"))
+		return
+	}
+	p.logger.Print(green.Sprintf("[+] The target maps the SASL/EXTERNAL bind to '%s'", authzID))
+}
+
+// bindExchange sends bind operations ldapx originates itself over a target
+// connection and returns the matching BindResponse operations.
+func (p *Proxy) bindExchange(r *bufio.Reader, w *bufio.Writer) decrypt.BindExchange {
+	var messageID int64
+	return func(op *ber.Packet) (*ber.Packet, error) {
+		messageID++
+		if _, err := w.Write(p.encodeLDAPMessage(envelope(messageID, op), false)); err != nil {
+			return nil, err
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+
+		packets, err := p.readLDAPMessage(r, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		response := packets[0]
+		if len(response.Children) < 2 {
+			return nil, fmt.Errorf("malformed response to the bind")
+		}
+		if id, _ := response.Children[0].Value.(int64); id != messageID {
+			return nil, fmt.Errorf("expected a response to message %d, got %d", messageID, id)
+		}
+		if response.Children[1].Tag != parser.ApplicationBindResponse {
+			return nil, fmt.Errorf("expected a BindResponse, got application %d", response.Children[1].Tag)
+		}
+		return response.Children[1], nil
+	}
+}
+
+// translatedBindResponse is ldapx's own successful answer to a client's bind
+// when ldapx has bound the upstream connection itself.
+func translatedBindResponse(messageID int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, parser.ApplicationBindResponse, nil, "Bind Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return envelope(messageID, op)
+}
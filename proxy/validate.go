@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Macmod/ldapx/middlewares"
+	filtermid "github.com/Macmod/ldapx/middlewares/filter"
+)
+
+// validateChainRunes parses chain (see ParseChain) and checks that every
+// element is a registered middleware code in flags, taking only the
+// parameters params lists for it, with values their options accept. It
+// returns an error listing any unrecognized codes so callers can surface
+// typos instead of silently dropping them, and otherwise the elements with
+// the options they override. The reserved parameters are accepted by every
+// middleware, and left to the caller.
+func validateChainRunes(chain string, flags map[rune]string, params map[rune]map[string]string, reserved ...string) ([]ChainElement, error) {
+	elements, err := ParseChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	var unknown []rune
+	for _, e := range elements {
+		if _, exists := flags[e.Code]; !exists {
+			unknown = append(unknown, e.Code)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Slice(unknown, func(i, j int) bool {
+			return unknown[i] < unknown[j]
+		})
+
+		var parts []string
+		for _, c := range unknown {
+			parts = append(parts, fmt.Sprintf("%q", string(c)))
+		}
+
+		return nil, fmt.Errorf("unrecognized middleware code(s): %s", strings.Join(parts, ", "))
+	}
+
+	for i, e := range elements {
+		if len(e.Params) == 0 {
+			continue
+		}
+
+		accepted := params[e.Code]
+		elements[i].options = make(map[string]string, len(e.Params))
+		for name, value := range e.Params {
+			if slices.Contains(reserved, name) {
+				continue
+			}
+			option, ok := accepted[name]
+			if !ok {
+				names := append(slices.Sorted(maps.Keys(accepted)), reserved...)
+				if len(names) == 0 {
+					return nil, fmt.Errorf("middleware %q (%s) takes no parameters", string(e.Code), flags[e.Code])
+				}
+				return nil, fmt.Errorf("middleware %q (%s) has no parameter '%s' (use %s)", string(e.Code), flags[e.Code], name, strings.Join(names, ", "))
+			}
+			if err := ValidateOptionValue(option, value); err != nil {
+				return nil, fmt.Errorf("middleware %q (%s): %w", string(e.Code), flags[e.Code], err)
+			}
+			elements[i].options[option] = value
+		}
+	}
+
+	return elements, nil
+}
+
+// exclusiveBaseDNMids are the BaseDN middlewares that replace the BaseDN with
+// an alternative DN form carrying no DN of its own (MS-ADTS 3.1.1.3.1.2.4).
+// Nothing before them survives the replacement, and nothing after them has a DN
+// left to work on, so they are only allowed as the entire chain.
+var exclusiveBaseDNMids = map[rune]string{
+	'U': "GUIDFormat",
+	'I': "SIDFormat",
+}
+
+// wkGUIDPredecessors are the BaseDN middlewares that may precede WKGUIDFormat.
+// A predecessor must leave the leading RDN of the BaseDN matchable by
+// WKGUIDFormat's case-insensitive comparison against its container table;
+// anything else silently turns WKGUIDFormat into a no-op, and should be placed
+// after it instead, where it applies to the object_DN of the resulting form.
+var wkGUIDPredecessors = map[rune]bool{
+	'C': true,
+}
+
+// requiredBaseDNOptions maps a BaseDN middleware to the option it cannot
+// operate without.
+var requiredBaseDNOptions = map[rune]string{
+	'U': "BDNGuid",
+	'I': "BDNSid",
+}
+
+// validateBaseDNChain checks the BaseDN chain for unknown codes, for exclusive
+// middlewares sharing the chain with others, for middlewares that would keep
+// WKGUIDFormat from matching, and for middlewares whose required options are
+// unset.
+func (p *Proxy) validateBaseDNChain(chain string) ([]ChainElement, error) {
+	elements, err := validateChainRunes(chain, BaseDNMidFlags, BaseDNChainParams)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, e := range elements {
+		c := e.Code
+		if name, isExclusive := exclusiveBaseDNMids[c]; isExclusive && len(elements) > 1 {
+			return nil, fmt.Errorf("middleware %q (%s) must be the only one in the basedn chain", string(c), name)
+		}
+
+		if c == 'W' && i > 0 {
+			for _, prevElement := range elements[:i] {
+				prev := prevElement.Code
+				if prev == c {
+					return nil, fmt.Errorf("middleware %q (%s) cannot appear more than once in the basedn chain", string(c), BaseDNMidFlags[c])
+				}
+
+				if !wkGUIDPredecessors[prev] {
+					return nil, fmt.Errorf(
+						"middleware %q (%s) cannot be preceded by %q (%s) in the basedn chain - place it after %q instead",
+						string(c), BaseDNMidFlags[c], string(prev), BaseDNMidFlags[prev], string(c),
+					)
+				}
+			}
+		}
+
+		if option, required := requiredBaseDNOptions[c]; required && p.midOpts(e.options).str(option) == "" {
+			return nil, fmt.Errorf("middleware %q (%s) requires the %s option to be set", string(c), BaseDNMidFlags[c], option)
+		}
+	}
+
+	return elements, nil
+}
+
+// FilterScopeParam is the parameter that restricts any Filter middleware of
+// a chain to some attributes (see filtermid.ParseAttrScope), e.g.
+// "X(scope='memberOf,@sid')".
+const FilterScopeParam = "scope"
+
+// validateFilterChain checks the filter chain for unknown codes, for
+// invalid attribute scopes and for middlewares whose required options are
+// unset.
+func (p *Proxy) validateFilterChain(chain string) ([]ChainElement, error) {
+	elements, err := validateChainRunes(chain, FilterMidFlags, FilterChainParams, FilterScopeParam)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, e := range elements {
+		if spec, scoped := e.Params[FilterScopeParam]; scoped {
+			if elements[i].scope, err = filtermid.ParseAttrScope(spec); err != nil {
+				return nil, fmt.Errorf("middleware %q (%s): %w", string(e.Code), FilterMidFlags[e.Code], err)
+			}
+		}
+		if e.Code == 'F' && p.midOpts(e.options).str("FiltObjCategoryRootDN") == "" {
+			return nil, fmt.Errorf("middleware \"F\" (ObjectCategoryForm) requires the FiltObjCategoryRootDN option to be set")
+		}
+	}
+
+	return elements, nil
+}
+
+// validateControlsChain checks the controls chain for unknown codes and for
+// middlewares whose required options are unset.
+func (p *Proxy) validateControlsChain(chain string) ([]ChainElement, error) {
+	elements, err := validateChainRunes(chain, ControlsMidFlags, ControlsChainParams)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range elements {
+		if e.Code == 'S' && len(p.midOpts(e.options).list("CtrlStripOIDs")) == 0 {
+			return nil, fmt.Errorf("middleware \"S\" (Strip) requires the CtrlStripOIDs option to be set")
+		}
+	}
+
+	return elements, nil
+}
+
+// validateBindNameChain checks the BindName chain for unknown codes and for
+// middlewares whose required options are unset.
+func (p *Proxy) validateBindNameChain(chain string) ([]ChainElement, error) {
+	elements, err := validateChainRunes(chain, BindNameMidFlags, BindNameChainParams)
+	if err != nil {
+		return nil, err
+	}
+
+	required := map[rune]string{'D': "BindDN", 'I': "BindSid", 'G': "BindGuid"}
+	for _, e := range elements {
+		if option, ok := required[e.Code]; ok && p.midOpts(e.options).str(option) == "" {
+			return nil, fmt.Errorf("middleware \"%c\" (%s) requires the %s option to be set", e.Code, BindNameMidFlags[e.Code], option)
+		}
+	}
+
+	return elements, nil
+}
+
+// positiveIntCountOptions maps an integer option to the smallest value that
+// still lets its middleware do something useful; a value below the minimum is
+// rejected when the option is set, since it would only make the middleware a
+// no-op or produce empty output (the middlewares themselves also treat such a
+// value as a no-op rather than crashing). The OID *MaxSpaces/*MaxZeros options
+// are intentionally absent: they treat 0 as "convert to OID form without this
+// decoration", a legitimate choice. FiltBitwiseDecompositionMaxBits needs at
+// least 2, since it splits out up to maxBits-1 individual bits and so does
+// nothing at 1.
+var positiveIntCountOptions = map[string]int{
+	"BDNSpacingMaxElems":              1,
+	"FiltSpacingMaxSpaces":            1,
+	"FiltTimestampGarbageMaxChars":    1,
+	"FiltGarbageMaxElems":             1,
+	"FiltGarbageMaxSize":              1,
+	"FiltANRSubstringMaxElems":        1,
+	"FiltPrependZerosMaxElems":        1,
+	"FiltAddBoolMaxDepth":             1,
+	"FiltDblNegBoolMaxDepth":          1,
+	"FiltBitwiseDecompositionMaxBits": 2,
+	"AttrsGarbageExistingMaxElems":    1,
+	"AttrsGarbageNonExistingMaxElems": 1,
+	"AttrsGarbageNonExistingMaxSize":  1,
+	"CtrlNoiseMaxElems":               1,
+	"CtrlOIDMaxZeros":                 1,
+	"BERPaddedLengthMaxBytes":         1,
+	"BERIntPaddingMaxBytes":           1,
+	"NetSegmentMinBytes":              1,
+	"NetSegmentMaxBytes":              1,
+	"SplitSearchAttrsPerSearch":       1,
+	"CacheTTL":                        1,
+	"CacheMaxSearches":                1,
+	"CacheMaxEntries":                 1,
+}
+
+// fractionalOptions are the numeric options other than probabilities that
+// take fractions, whose integer defaults would otherwise make them look like
+// integer options.
+var fractionalOptions = map[string]bool{
+	"NetRateLimit": true,
+}
+
+// ValidateOptionValue rejects a user-supplied option value of the wrong type
+// for its option, since the middlewares would silently fall back to the
+// default. The type is told from the option: a *Prob option is a probability
+// in [0,1], an option defaulting to true or false is a boolean, and an
+// option with an integer default is a non-negative integer - or at least the
+// minimum in positiveIntCountOptions - unless it is in fractionalOptions.
+// Charsets, modes, DNs and other strings are not checked.
+func ValidateOptionValue(key, value string) error {
+	def, known := middlewares.DefaultOptions[key]
+	if !known {
+		return nil
+	}
+
+	switch {
+	case strings.HasSuffix(key, "Prob"):
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("option %q must be a probability between 0 and 1, got %q", key, value)
+		}
+	case def == "true" || def == "false":
+		if v := strings.ToLower(value); v != "true" && v != "false" {
+			return fmt.Errorf("option %q must be true or false, got %q", key, value)
+		}
+	case fractionalOptions[key]:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 {
+			return fmt.Errorf("option %q must be a number >= 0, got %q", key, value)
+		}
+	default:
+		if _, err := strconv.Atoi(def); err != nil {
+			return nil
+		}
+		min := positiveIntCountOptions[key]
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("option %q must be an integer >= %d, got %q", key, min, value)
+		}
+		if n < min {
+			return fmt.Errorf("option %q must be an integer >= %d, got %d", key, min, n)
+		}
+	}
+
+	return nil
+}
@@ -9,7 +9,7 @@ import (
 )
 
 // spoofColor marks feedback about --spoof-mechs actually taking effect on
-// the wire - green, matching internal/app's own "changed" convention (this
+// the wire - green, matching the proxy package's own "changed" convention (this
 // package can't reach that unexported var directly, so it defines its own
 // instance of the same semantic color, same as decrypt package's
 // decryptColor).